@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/russellromney/coffer/internal/agefile"
+)
+
+// decryptAge decrypts an age file with the identities in identityFiles.
+// Files encrypted with a passphrase prompt for it instead, unless the file
+// itself came from stdin and there's no terminal to prompt on.
+func decryptAge(data []byte, identityFiles []string, fromStdin bool) ([]byte, error) {
+	identities, err := agefile.LoadIdentities(identityFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var passphrase agefile.PassphraseFunc
+	if !fromStdin || term.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase = func() (string, error) {
+			return readPassphrase("Enter passphrase: ", false)
+		}
+	}
+
+	plaintext, err := agefile.Decrypt(data, identities, passphrase)
+	switch {
+	case errors.Is(err, agefile.ErrPassphraseRequired):
+		return nil, fmt.Errorf("%w, which is read from stdin without a terminal: import the file from a path instead of -", err)
+	case errors.Is(err, agefile.ErrIdentityRequired):
+		return nil, fmt.Errorf("file is age-encrypted: pass --identity with an age identity file")
+	}
+	return plaintext, err
+}
+
+// readPassphrase prompts for a passphrase on the terminal, or reads the first
+// line of stdin when it isn't one (for scripts)
+func readPassphrase(prompt string, confirm bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("passphrase cannot be empty")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		if string(again) != string(passphrase) {
+			return "", fmt.Errorf("passphrases do not match")
+		}
+	}
+	return string(passphrase), nil
+}
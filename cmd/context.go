@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/russellromney/coffer/internal/config"
+	"github.com/russellromney/coffer/internal/secrets"
+)
+
+// Set by the persistent --vault, --project and --env flags
+var (
+	globalVault   string
+	globalProject string
+	globalEnv     string
+)
+
+// loadConfig returns the config of the vault selected by --vault,
+// COFFER_VAULT or 'coffer vault use'
+func loadConfig() (*config.Config, error) {
+	if globalVault != "" {
+		return config.NewForVault(globalVault)
+	}
+	return config.New()
+}
+
+var (
+	projectFileOnce sync.Once
+	projectFile     *config.ProjectFile
+	projectFileErr  error
+)
+
+// loadProjectFile returns the .coffer.yaml governing the working directory,
+// or nil if there isn't one
+func loadProjectFile() (*config.ProjectFile, error) {
+	projectFileOnce.Do(func() {
+		wd, err := os.Getwd()
+		if err != nil {
+			projectFileErr = fmt.Errorf("failed to get working directory: %w", err)
+			return
+		}
+		projectFile, projectFileErr = config.FindProjectFile(wd)
+	})
+	return projectFile, projectFileErr
+}
+
+// projectOverride returns the project selected by --project, COFFER_PROJECT
+// or .coffer.yaml, and where it came from. An empty name means the global
+// active project applies.
+func projectOverride() (name, source string, err error) {
+	if globalProject != "" {
+		return globalProject, "--project", nil
+	}
+	if name := os.Getenv(config.ProjectEnvVar); name != "" {
+		return name, config.ProjectEnvVar, nil
+	}
+	pf, err := loadProjectFile()
+	if err != nil {
+		return "", "", err
+	}
+	if pf != nil && pf.Project != "" {
+		return pf.Project, pf.Path, nil
+	}
+	return "", "", nil
+}
+
+// defaultEnv returns the selected environment: --env, then COFFER_ENV, then
+// the env in .coffer.yaml. It is empty if none of them set one.
+func defaultEnv() (string, error) {
+	if globalEnv != "" {
+		return globalEnv, nil
+	}
+	if name := os.Getenv(config.EnvEnvVar); name != "" {
+		return name, nil
+	}
+	pf, err := loadProjectFile()
+	if err != nil {
+		return "", err
+	}
+	if pf != nil {
+		return pf.Env, nil
+	}
+	return "", nil
+}
+
+// resolveEnvName returns the selected environment, or an error if there
+// isn't one
+func resolveEnvName() (string, error) {
+	name, err := defaultEnv()
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", fmt.Errorf("no environment: use --env, set %s, or add env to %s", config.EnvEnvVar, config.ProjectFileName)
+	}
+	return name, nil
+}
+
+// keyAllowed reports whether the .coffer.yaml key filter lets commands in
+// this directory read key
+func keyAllowed() (func(key string) bool, error) {
+	pf, err := loadProjectFile()
+	if err != nil {
+		return nil, err
+	}
+	if pf == nil || pf.Keys.IsZero() {
+		return func(string) bool { return true }, nil
+	}
+	return pf.Keys.Match, nil
+}
+
+// checkKeyAllowed fails for a key the .coffer.yaml key filter excludes
+func checkKeyAllowed(key string) error {
+	allowed, err := keyAllowed()
+	if err != nil {
+		return err
+	}
+	if !allowed(key) {
+		return fmt.Errorf("secret '%s' is excluded by the keys filter in %s", key, projectFile.Path)
+	}
+	return nil
+}
+
+// filterSecrets drops keys excluded by the .coffer.yaml key filter
+func filterSecrets(values map[string]secrets.Value) (map[string]secrets.Value, error) {
+	allowed, err := keyAllowed()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make(map[string]secrets.Value, len(values))
+	for key, value := range values {
+		if allowed(key) {
+			filtered[key] = value
+		}
+	}
+	return filtered, nil
+}
@@ -22,19 +22,19 @@ Examples:
 	RunE: runDelete,
 }
 
-var (
-	deleteEnv   string
-	deleteForce bool
-)
+var deleteForce bool
 
 func init() {
 	rootCmd.AddCommand(deleteCmd)
-	deleteCmd.Flags().StringVarP(&deleteEnv, "env", "e", "", "Environment name (required)")
 	deleteCmd.Flags().BoolVarP(&deleteForce, "force", "f", false, "Skip confirmation")
-	deleteCmd.MarkFlagRequired("env")
 }
 
 func runDelete(cmd *cobra.Command, args []string) error {
+	envName, err := resolveEnvName()
+	if err != nil {
+		return err
+	}
+
 	v, s, err := getUnlockedVault()
 	if err != nil {
 		return err
@@ -47,9 +47,9 @@ func runDelete(cmd *cobra.Command, args []string) error {
 	}
 
 	// Get environment
-	env, err := s.GetEnvironmentByName(project.ID, deleteEnv)
+	env, err := s.GetEnvironmentByName(project.ID, envName)
 	if err == store.ErrNotFound {
-		return fmt.Errorf("environment '%s' not found in project '%s'", deleteEnv, project.Name)
+		return fmt.Errorf("environment '%s' not found in project '%s'", envName, project.Name)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to get environment: %w", err)
@@ -60,14 +60,14 @@ func runDelete(cmd *cobra.Command, args []string) error {
 	// Check if secret exists
 	_, err = s.GetSecret(env.ID, key)
 	if err == store.ErrNotFound {
-		return fmt.Errorf("secret '%s' not found in %s/%s", key, project.Name, deleteEnv)
+		return fmt.Errorf("secret '%s' not found in %s/%s", key, project.Name, envName)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to get secret: %w", err)
 	}
 
 	if !deleteForce {
-		fmt.Printf("Are you sure you want to delete '%s' from %s/%s? [y/N] ", key, project.Name, deleteEnv)
+		fmt.Printf("Are you sure you want to delete '%s' from %s/%s? [y/N] ", key, project.Name, envName)
 		var response string
 		fmt.Scanln(&response)
 		if response != "y" && response != "Y" {
@@ -80,6 +80,6 @@ func runDelete(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to delete secret: %w", err)
 	}
 
-	fmt.Printf("Deleted %s from %s/%s\n", key, project.Name, deleteEnv)
+	fmt.Printf("Deleted %s from %s/%s\n", key, project.Name, envName)
 	return nil
 }
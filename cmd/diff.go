@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/russellromney/coffer/internal/secrets"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <env> <env>",
+	Short: "Compare the secrets in two environments",
+	Long: `Compare the secrets visible in two environments, including inherited ones:
+keys only in the first (-), keys only in the second (+) and keys whose
+values differ (~). Each value shows where it came from, so a key inherited
+from a parent is easy to tell apart from one set directly.
+
+Each side is [project/]env[@point]. Without a project, the active project
+is used. A point is a snapshot (v3), an RFC3339 timestamp or a duration ago
+(2h, 3d), and compares the environment as it was then.
+
+Values are hidden by default. Use --mask to show the first and last
+characters of long values, or --show-values to show them in full.
+
+Examples:
+  coffer diff dev prod
+  coffer diff prod@v3 prod
+  coffer diff myapp/prod other/prod --mask
+  coffer diff staging prod --show-values --resolve
+  coffer diff staging prod --exit-code`,
+	Args: cobra.ExactArgs(2),
+	RunE: runDiff,
+}
+
+var (
+	diffShowValues bool
+	diffMask       bool
+	diffResolve    bool
+	diffAll        bool
+	diffExitCode   bool
+)
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().BoolVar(&diffShowValues, "show-values", false, "Show differing values in full (use with caution)")
+	diffCmd.Flags().BoolVar(&diffMask, "mask", false, "Show differing values masked")
+	diffCmd.Flags().BoolVar(&diffResolve, "resolve", false, "Compare values with ${VAR} references resolved")
+	diffCmd.Flags().BoolVar(&diffAll, "all", false, "Also list keys that are identical")
+	diffCmd.Flags().BoolVar(&diffExitCode, "exit-code", false, "Exit with status 1 if the environments differ")
+}
+
+// diffSide is one side of a comparison: an environment, optionally at a
+// point in time
+type diffSide struct {
+	label  string
+	values map[string]secrets.Value
+}
+
+// loadDiffSide loads the secrets for a [project/]env[@point] reference
+func loadDiffSide(s store.Store, svc *secrets.Service, ref string) (*diffSide, error) {
+	envRef, point, hasPoint := strings.Cut(ref, "@")
+	project, env, err := resolveEnvRef(s, envRef)
+	if err != nil {
+		return nil, err
+	}
+
+	side := &diffSide{label: project.Name + "/" + env.Name}
+	opts := secrets.Options{Resolve: diffResolve}
+	if hasPoint {
+		at, label, err := resolvePointInTime(svc, project, env.Name, point)
+		if err != nil {
+			return nil, err
+		}
+		opts.At = at
+		side.label += "@" + label
+	}
+
+	side.values, err = svc.Load(project, env.Name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return side, nil
+}
+
+func runDiff(cmd *cobra.Command, args []string) error {
+	if diffShowValues && diffMask {
+		return fmt.Errorf("--show-values and --mask cannot be used together")
+	}
+
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	svc := newSecrets(v, s)
+	from, err := loadDiffSide(s, svc, args[0])
+	if err != nil {
+		return err
+	}
+	to, err := loadDiffSide(s, svc, args[1])
+	if err != nil {
+		return err
+	}
+	if from.label == to.label {
+		from.label, to.label = args[0], args[1]
+	}
+
+	diffs := secrets.Compare(from.values, to.values)
+	counts := make(map[string]int)
+	for _, d := range diffs {
+		counts[d.Kind]++
+	}
+
+	if len(diffs) == counts[secrets.ChangeUnchanged] {
+		fmt.Printf("%s and %s are identical (%d keys)\n", from.label, to.label, len(diffs))
+		return nil
+	}
+
+	fmt.Printf("Comparing %s with %s:\n", from.label, to.label)
+	for _, d := range diffs {
+		switch d.Kind {
+		case secrets.ChangeRemoved:
+			fmt.Printf("  - %s  only in %s %s\n", d.Key, from.label, provenance(d.From))
+			printDiffValue(from.label, d.From)
+		case secrets.ChangeCreated:
+			fmt.Printf("  + %s  only in %s %s\n", d.Key, to.label, provenance(d.To))
+			printDiffValue(to.label, d.To)
+		case secrets.ChangeUpdated:
+			fmt.Printf("  ~ %s  %s %s, %s %s\n", d.Key, from.label, provenance(d.From), to.label, provenance(d.To))
+			printDiffValue(from.label, d.From)
+			printDiffValue(to.label, d.To)
+		case secrets.ChangeUnchanged:
+			if diffAll {
+				fmt.Printf("    %s  %s, %s\n", d.Key, provenance(d.From), provenance(d.To))
+			}
+		}
+	}
+	fmt.Printf("%d different, %d only in %s, %d only in %s, %d identical\n",
+		counts[secrets.ChangeUpdated],
+		counts[secrets.ChangeRemoved], from.label,
+		counts[secrets.ChangeCreated], to.label,
+		counts[secrets.ChangeUnchanged])
+
+	if diffExitCode {
+		v.Close()
+		os.Exit(1)
+	}
+	return nil
+}
+
+// provenance describes where a loaded value came from
+func provenance(value *secrets.Value) string {
+	if value.IsInherited {
+		return fmt.Sprintf("[inherited from %s]", value.SourceEnvName)
+	}
+	return fmt.Sprintf("[set in %s]", value.SourceEnvName)
+}
+
+// printDiffValue prints a value under its key when --show-values or --mask
+// is set
+func printDiffValue(label string, value *secrets.Value) {
+	switch {
+	case diffShowValues:
+		fmt.Printf("      %s: %s\n", label, value.Value)
+	case diffMask:
+		fmt.Printf("      %s: %s\n", label, maskValue(value.Value))
+	}
+}
+
+// maskValue hides a value, keeping the first and last two characters of
+// values long enough that this reveals little
+func maskValue(value string) string {
+	runes := []rune(value)
+	if len(runes) < 12 {
+		return "****"
+	}
+	return string(runes[:2]) + "****" + string(runes[len(runes)-2:])
+}
@@ -53,7 +53,8 @@ var envDeleteCmd = &cobra.Command{
 	Long: `Delete an environment and all its secrets.
 
 This action is irreversible. Use --force to skip confirmation.
-Cannot delete an environment that has child environments.
+Cannot delete an environment that other environments inherit from, as
+their parent or as one of their layers.
 
 Example:
   coffer env delete staging
@@ -77,7 +78,43 @@ Example:
 	RunE: runEnvBranch,
 }
 
-var envForce bool
+var envRenameCmd = &cobra.Command{
+	Use:   "rename <name> <new-name>",
+	Short: "Rename an environment",
+	Long: `Rename an environment. Its secrets, history, snapshots, child
+environments, member grants and tokens are kept.
+
+Update any .coffer.yaml files or COFFER_ENV settings that use the old name.
+
+Example:
+  coffer env rename stage staging`,
+	Args: cobra.ExactArgs(2),
+	RunE: runEnvRename,
+}
+
+var envCloneCmd = &cobra.Command{
+	Use:   "clone <name> <new-name>",
+	Short: "Copy an environment",
+	Long: `Copy an environment's secrets into a new environment with the same parent.
+
+The copy gets its own encryption key. By default its history starts with
+the current values; --with-history copies every earlier version too, so
+the copy can be read with --at. Snapshots aren't copied.
+
+Members holding the environment, and tokens covering the whole project, are
+given the copy's key; tokens scoped to the environment aren't.
+
+Example:
+  coffer env clone dev dev2
+  coffer env clone prod prod-eu --with-history`,
+	Args: cobra.ExactArgs(2),
+	RunE: runEnvClone,
+}
+
+var (
+	envForce       bool
+	envWithHistory bool
+)
 
 func init() {
 	rootCmd.AddCommand(envCmd)
@@ -85,11 +122,31 @@ func init() {
 	envCmd.AddCommand(envListCmd)
 	envCmd.AddCommand(envDeleteCmd)
 	envCmd.AddCommand(envBranchCmd)
+	envCmd.AddCommand(envRenameCmd)
+	envCmd.AddCommand(envCloneCmd)
 
 	envDeleteCmd.Flags().BoolVarP(&envForce, "force", "f", false, "Skip confirmation")
+	envCloneCmd.Flags().BoolVar(&envWithHistory, "with-history", false, "Copy every earlier version of each secret")
 }
 
+// getActiveProject returns the project commands operate on: COFFER_PROJECT,
+// then .coffer.yaml, then the global active project
 func getActiveProject(s store.Store) (*models.Project, error) {
+	name, source, err := projectOverride()
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		project, err := s.GetProjectByName(name)
+		if err == store.ErrNotFound {
+			return nil, fmt.Errorf("project '%s' (from %s) not found", name, source)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get project: %w", err)
+		}
+		return project, nil
+	}
+
 	activeID, err := s.GetConfig(models.ConfigActiveProject)
 	if err == store.ErrNotFound {
 		return nil, fmt.Errorf("no active project: use 'coffer project use <name>' first")
@@ -109,6 +166,38 @@ func getActiveProject(s store.Store) (*models.Project, error) {
 	return project, nil
 }
 
+// resolveEnvRef looks up an environment given as "project/env", or as "env"
+// in the active project
+func resolveEnvRef(s store.Store, ref string) (*models.Project, *models.Environment, error) {
+	var project *models.Project
+	var err error
+	envName := ref
+	if projectName, name, ok := strings.Cut(ref, "/"); ok {
+		envName = name
+		project, err = s.GetProjectByName(projectName)
+		if err == store.ErrNotFound {
+			return nil, nil, fmt.Errorf("project '%s' not found", projectName)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get project: %w", err)
+		}
+	} else {
+		project, err = getActiveProject(s)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	env, err := s.GetEnvironmentByName(project.ID, envName)
+	if err == store.ErrNotFound {
+		return nil, nil, fmt.Errorf("environment '%s' not found in project '%s'", envName, project.Name)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get environment: %w", err)
+	}
+	return project, env, nil
+}
+
 func runEnvCreate(cmd *cobra.Command, args []string) error {
 	v, s, err := getUnlockedVault()
 	if err != nil {
@@ -183,12 +272,25 @@ func runEnvList(cmd *cobra.Command, args []string) error {
 			}
 		}
 
+		var sources []string
 		if e.ParentID != nil {
-			parentName := envMap[*e.ParentID]
+			sources = append(sources, fmt.Sprintf("inherits from '%s'", envMap[*e.ParentID]))
+		}
+		layers, _ := s.GetEnvironmentLayers(e.ID)
+		if len(layers) > 0 {
+			layerNames := make([]string, len(layers))
+			for i, l := range layers {
+				layerNames[i] = l.Name
+			}
+			sources = append(sources, "layers "+strings.Join(layerNames, ", "))
+		}
+
+		if len(sources) > 0 {
+			via := strings.Join(sources, ", ")
 			if inheritedCount > 0 {
-				fmt.Printf("  %s (%d local, %d inherited) -> inherits from '%s'\n", e.Name, localCount, inheritedCount, parentName)
+				fmt.Printf("  %s (%d local, %d inherited) -> %s\n", e.Name, localCount, inheritedCount, via)
 			} else {
-				fmt.Printf("  %s (%d secrets) -> inherits from '%s'\n", e.Name, localCount, parentName)
+				fmt.Printf("  %s (%d secrets) -> %s\n", e.Name, localCount, via)
 			}
 		} else {
 			fmt.Printf("  %s (%d secrets)\n", e.Name, len(mergedSecrets))
@@ -220,7 +322,7 @@ func runEnvDelete(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to get environment: %w", err)
 	}
 
-	// Check for child environments
+	// Check for environments that inherit from it, as parent or layer
 	children, err := s.GetEnvironmentChildren(env.ID)
 	if err != nil {
 		return fmt.Errorf("failed to check for child environments: %w", err)
@@ -230,7 +332,7 @@ func runEnvDelete(cmd *cobra.Command, args []string) error {
 		for i, c := range children {
 			childNames[i] = c.Name
 		}
-		return fmt.Errorf("cannot delete '%s': has child environments (%s). Delete children first", name, strings.Join(childNames, ", "))
+		return fmt.Errorf("cannot delete '%s': environments inherit from it (%s). Delete or detach them first", name, strings.Join(childNames, ", "))
 	}
 
 	if !envForce {
@@ -298,3 +400,74 @@ func runEnvBranch(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Created environment '%s' inheriting from '%s' (%d secrets inherited)\n", newName, parentName, len(parentSecrets))
 	return nil
 }
+
+func runEnvRename(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	project, err := getActiveProject(s)
+	if err != nil {
+		return err
+	}
+
+	name, newName := args[0], args[1]
+
+	env, err := s.GetEnvironmentByName(project.ID, name)
+	if err == store.ErrNotFound {
+		return fmt.Errorf("environment '%s' not found in project '%s'", name, project.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get environment: %w", err)
+	}
+
+	_, err = s.GetEnvironmentByName(project.ID, newName)
+	if err == nil {
+		return fmt.Errorf("environment '%s' already exists in project '%s'", newName, project.Name)
+	}
+	if err != store.ErrNotFound {
+		return err
+	}
+
+	if err := s.RenameEnvironment(env.ID, newName); err != nil {
+		return fmt.Errorf("failed to rename environment: %w", err)
+	}
+
+	fmt.Printf("Renamed environment '%s' to '%s' in project '%s'\n", name, newName, project.Name)
+	return nil
+}
+
+func runEnvClone(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	project, err := getActiveProject(s)
+	if err != nil {
+		return err
+	}
+
+	name, newName := args[0], args[1]
+
+	_, err = s.GetEnvironmentByName(project.ID, newName)
+	if err == nil {
+		return fmt.Errorf("environment '%s' already exists in project '%s'", newName, project.Name)
+	}
+	if err != store.ErrNotFound {
+		return err
+	}
+
+	env, regrant, err := newSecrets(v, s).CloneEnvironment(project, name, newName, envWithHistory)
+	if err != nil {
+		return err
+	}
+
+	secrets, _ := s.ListSecrets(env.ID)
+	fmt.Printf("Cloned environment '%s' to '%s' (%d secrets)\n", name, newName, len(secrets))
+	printRegrant(regrant)
+	return nil
+}
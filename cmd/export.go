@@ -1,15 +1,21 @@
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"sort"
+	"io"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 
-	"github.com/russellromney/coffer/internal/crypto"
-	"github.com/russellromney/coffer/internal/resolver"
-	"github.com/russellromney/coffer/internal/store"
+	"github.com/russellromney/coffer/internal/agefile"
+	"github.com/russellromney/coffer/internal/dotenv"
+	"github.com/russellromney/coffer/internal/format"
+	"github.com/russellromney/coffer/internal/manifest"
+	"github.com/russellromney/coffer/internal/secrets"
 )
 
 var exportCmd = &cobra.Command{
@@ -20,145 +26,243 @@ var exportCmd = &cobra.Command{
 By default, exports in .env format. Use --format json for JSON output.
 Use --resolve to expand ${VAR} references.
 
+--format yaml, toml and json-nested write nested objects for config-file
+based frameworks: keys are split on --separator, so DB__HOST and DB__PORT
+become DB.HOST and DB.PORT.
+
+--format k8s-secret writes a v1/Secret manifest with base64 data, named
+<project>-<env> unless --name is given. With --seal-cert (the controller
+certificate from 'kubeseal --fetch-cert'), it writes a SealedSecret
+instead, which only the sealed-secrets controller can decrypt.
+
+--format bash, fish, powershell and nushell emit quoted variable
+assignments for eval, safe for any value including quotes, backslashes
+and newlines.
+
+Use --encrypt-to to encrypt the output to one or more age recipients, or
+--passphrase to encrypt it with a passphrase, so plaintext never touches
+disk. 'coffer import' decrypts age files transparently.
+
+Use --format sops, sops-json or sops-dotenv to write a SOPS file encrypted
+to the --encrypt-to age recipients, readable by 'sops -d'. --sops-file
+reuses an existing SOPS file's recipients and key order, so re-exporting
+produces a minimal diff.
+
+Inside a directory with a .coffer.yaml, --env defaults to its env and only
+keys passing its keys filter are exported.
+
+Use --at to export the environment as it was at an RFC3339 timestamp or a
+duration ago, reconstructed from secret history.
+
 Examples:
   coffer export --env prod > .env.prod
   coffer export --env dev --format json > secrets.json
-  coffer export --env prod --resolve`,
+  coffer export --env prod --resolve
+  coffer export --env dev --format yaml > config.yaml
+  coffer export --env dev --format toml --separator _ > config.toml
+  coffer export --env prod --format k8s-secret --name myapp-secrets --namespace prod
+  coffer export --env prod --format k8s-secret --namespace prod --seal-cert cert.pem
+  eval "$(coffer export --env dev --format bash)"
+  coffer export --env dev --format fish | source
+  coffer export --env dev --format powershell | Invoke-Expression
+  coffer export --env dev --encrypt-to age1... --armor > dev.env.age
+  coffer export --env dev --passphrase > dev.env.age
+  coffer export --env prod --format sops --encrypt-to age1... > secrets.enc.yaml
+  coffer export --env prod --format sops --sops-file secrets.enc.yaml > new.enc.yaml`,
 	RunE: runExport,
 }
 
 var (
-	exportEnv     string
-	exportFormat  string
-	exportResolve bool
+	exportFormat      string
+	exportResolve     bool
+	exportAt          string
+	exportEncryptTo   []string
+	exportPassphrase  bool
+	exportArmor       bool
+	exportSOPSFile    string
+	exportSeparator   string
+	exportName        string
+	exportNamespace   string
+	exportLabels      []string
+	exportAnnotations []string
+	exportSealCert    string
+	exportSealScope   string
 )
 
 func init() {
 	rootCmd.AddCommand(exportCmd)
-	exportCmd.Flags().StringVarP(&exportEnv, "env", "e", "", "Environment name (required)")
-	exportCmd.Flags().StringVarP(&exportFormat, "format", "f", "env", "Output format: env, json")
+	exportCmd.Flags().StringVarP(&exportFormat, "format", "f", "env", "Output format: env, json, json-nested, yaml, toml, bash, fish, powershell, nushell, k8s-secret, sops, sops-json, sops-dotenv")
+	exportCmd.Flags().StringVar(&exportSeparator, "separator", format.DefaultSeparator, "Separator for nesting keys in yaml, toml and json-nested")
 	exportCmd.Flags().BoolVar(&exportResolve, "resolve", false, "Resolve ${VAR} references")
-	exportCmd.MarkFlagRequired("env")
+	exportCmd.Flags().StringVar(&exportAt, "at", "", "Export secrets as of an RFC3339 timestamp or duration ago (e.g. 2h)")
+	exportCmd.Flags().StringArrayVar(&exportEncryptTo, "encrypt-to", nil, "Encrypt output to an age recipient (repeatable)")
+	exportCmd.Flags().BoolVar(&exportPassphrase, "passphrase", false, "Encrypt output with an age passphrase")
+	exportCmd.Flags().BoolVarP(&exportArmor, "armor", "a", false, "PEM-encode encrypted output")
+	exportCmd.Flags().StringVar(&exportName, "name", "", "Kubernetes Secret name (default <project>-<env>)")
+	exportCmd.Flags().StringVar(&exportNamespace, "namespace", "", "Kubernetes namespace")
+	exportCmd.Flags().StringArrayVar(&exportLabels, "label", nil, "Kubernetes label key=value (repeatable)")
+	exportCmd.Flags().StringArrayVar(&exportAnnotations, "annotation", nil, "Kubernetes annotation key=value (repeatable)")
+	exportCmd.Flags().StringVar(&exportSealCert, "seal-cert", "", "Write a SealedSecret encrypted to this sealed-secrets certificate")
+	exportCmd.Flags().StringVar(&exportSealScope, "seal-scope", manifest.ScopeStrict, "SealedSecret scope: strict, namespace-wide, cluster-wide")
+	exportCmd.Flags().StringVar(&exportSOPSFile, "sops-file", "", "Existing SOPS file whose recipients and key order to reuse")
 }
 
 func runExport(cmd *cobra.Command, args []string) error {
-	v, s, err := getUnlockedVault()
-	if err != nil {
-		return err
+	sopsFormat, isSOPS := sopsFormats[exportFormat]
+	if exportSOPSFile != "" && !isSOPS {
+		return fmt.Errorf("--sops-file requires a sops format")
+	}
+	if isSOPS && exportPassphrase {
+		return fmt.Errorf("SOPS files are encrypted to age recipients: use --encrypt-to instead of --passphrase")
+	}
+	if exportPassphrase && len(exportEncryptTo) > 0 {
+		return fmt.Errorf("--passphrase can't be combined with --encrypt-to")
 	}
-	defer v.Close()
 
-	project, err := getActiveProject(s)
-	if err != nil {
-		return err
+	// SOPS output is encrypted per value; --encrypt-to only names its recipients
+	encrypt := !isSOPS && (len(exportEncryptTo) > 0 || exportPassphrase)
+	if encrypt && !exportArmor && term.IsTerminal(int(os.Stdout.Fd())) {
+		return fmt.Errorf("refusing to write encrypted binary output to a terminal: redirect it or use --armor")
 	}
 
-	// Get environment
-	env, err := s.GetEnvironmentByName(project.ID, exportEnv)
-	if err == store.ErrNotFound {
-		return fmt.Errorf("environment '%s' not found in project '%s'", exportEnv, project.Name)
+	envName, err := resolveEnvName()
+	if err != nil {
+		return err
 	}
+	at, err := parseAtFlag(exportAt)
 	if err != nil {
-		return fmt.Errorf("failed to get environment: %w", err)
+		return err
 	}
 
-	// Get encryption key
-	encKey, err := v.GetKey()
+	v, s, err := getUnlockedVault()
 	if err != nil {
-		return fmt.Errorf("failed to get encryption key: %w", err)
+		return err
 	}
+	defer v.Close()
 
-	// Load and decrypt all secrets (with inheritance)
-	secrets, err := s.ListSecretsWithInheritance(env.ID)
+	project, err := getActiveProject(s)
 	if err != nil {
-		return fmt.Errorf("failed to list secrets: %w", err)
+		return err
 	}
 
-	decryptedSecrets := make(map[string]string)
-	for _, secret := range secrets {
-		value, err := crypto.Decrypt(encKey, secret.EncryptedValue, secret.Nonce, []byte(secret.Key))
-		if err != nil {
-			return fmt.Errorf("failed to decrypt secret '%s': %w", secret.Key, err)
-		}
-		decryptedSecrets[secret.Key] = string(value)
+	// Load and decrypt all secrets (with inheritance), resolving references if requested
+	values, err := newSecrets(v, s).Load(project, envName, secrets.Options{Resolve: exportResolve, At: secrets.AtTime(at)})
+	if err != nil {
+		return err
 	}
-
-	// Resolve references if requested
-	outputSecrets := decryptedSecrets
-	if exportResolve {
-		outputSecrets, err = resolver.Resolve(decryptedSecrets)
-		if err != nil {
-			return fmt.Errorf("failed to resolve references: %w", err)
-		}
+	values, err = filterSecrets(values)
+	if err != nil {
+		return err
 	}
+	outputSecrets := secrets.ToMap(values)
 
-	// Output in requested format
+	// Render in requested format
+	var out bytes.Buffer
 	switch exportFormat {
 	case "env":
-		outputEnvFormat(outputSecrets)
+		outputEnvFormat(&out, outputSecrets)
 	case "json":
-		if err := outputJSONFormat(outputSecrets); err != nil {
+		if err := outputJSONFormat(&out, outputSecrets); err != nil {
 			return fmt.Errorf("failed to output JSON: %w", err)
 		}
+	case "json-nested":
+		err = outputNestedJSONFormat(&out, outputSecrets, exportSeparator)
+	case "yaml":
+		err = outputYAMLFormat(&out, outputSecrets, exportSeparator)
+	case "toml":
+		err = outputTOMLFormat(&out, outputSecrets, exportSeparator)
+	case "k8s-secret":
+		err = outputK8sFormat(&out, outputSecrets, project.Name, envName)
+	case "bash", "fish", "powershell", "nushell":
+		err = format.WriteShell(&out, outputSecrets, exportFormat)
+	case "sops", "sops-json", "sops-dotenv":
+		data, err := encryptSOPS(outputSecrets, sopsFormat, exportEncryptTo, exportSOPSFile)
+		if err != nil {
+			return err
+		}
+		out.Write(data)
 	default:
-		return fmt.Errorf("unknown format: %s (use 'env' or 'json')", exportFormat)
+		return fmt.Errorf("unknown format: %s (use 'env', 'json', 'json-nested', 'yaml', 'toml', 'bash', 'fish', 'powershell', 'nushell', 'k8s-secret', 'sops', 'sops-json' or 'sops-dotenv')", exportFormat)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to output %s: %w", exportFormat, err)
 	}
 
-	return nil
-}
+	if !encrypt {
+		_, err = os.Stdout.Write(out.Bytes())
+		return err
+	}
 
-func outputEnvFormat(secrets map[string]string) {
-	// Sort keys for consistent output
-	keys := make([]string, 0, len(secrets))
-	for k := range secrets {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	for _, key := range keys {
-		value := secrets[key]
-		// Quote values that contain special characters
-		if needsQuoting(value) {
-			fmt.Printf("%s=\"%s\"\n", key, escapeValue(value))
-		} else {
-			fmt.Printf("%s=%s\n", key, value)
+	var passphrase string
+	if exportPassphrase {
+		passphrase, err = readPassphrase("Enter passphrase: ", true)
+		if err != nil {
+			return err
 		}
 	}
+	return agefile.Encrypt(os.Stdout, out.Bytes(), exportEncryptTo, passphrase, exportArmor)
 }
 
-func outputJSONFormat(secrets map[string]string) error {
+func outputEnvFormat(w io.Writer, secrets map[string]string) {
+	w.Write(dotenv.Marshal(secrets))
+}
+
+func outputJSONFormat(w io.Writer, secrets map[string]string) error {
 	data, err := json.MarshalIndent(secrets, "", "  ")
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(data))
+	fmt.Fprintln(w, string(data))
 	return nil
 }
 
-func needsQuoting(value string) bool {
-	for _, c := range value {
-		if c == ' ' || c == '"' || c == '\'' || c == '\n' || c == '\t' || c == '$' || c == '`' {
-			return true
-		}
+// outputK8sFormat writes a Secret manifest, or a SealedSecret with --seal-cert
+func outputK8sFormat(w io.Writer, secrets map[string]string, projectName, envName string) error {
+	labels, err := parseKeyValues("label", exportLabels)
+	if err != nil {
+		return err
+	}
+	annotations, err := parseKeyValues("annotation", exportAnnotations)
+	if err != nil {
+		return err
+	}
+
+	meta := manifest.Metadata{
+		Name:        exportName,
+		Namespace:   exportNamespace,
+		Labels:      labels,
+		Annotations: annotations,
+	}
+	if meta.Name == "" {
+		meta.Name = strings.ToLower(strings.ReplaceAll(projectName+"-"+envName, "_", "-"))
 	}
-	return false
+
+	if exportSealCert == "" {
+		return manifest.WriteSecret(w, secrets, meta)
+	}
+	data, err := os.ReadFile(exportSealCert)
+	if err != nil {
+		return fmt.Errorf("failed to read sealing certificate: %w", err)
+	}
+	pubKey, err := manifest.ParseSealingKey(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", exportSealCert, err)
+	}
+	return manifest.WriteSealedSecret(w, secrets, meta, pubKey, exportSealScope)
 }
 
-func escapeValue(value string) string {
-	result := ""
-	for _, c := range value {
-		switch c {
-		case '"':
-			result += "\\\""
-		case '\\':
-			result += "\\\\"
-		case '\n':
-			result += "\\n"
-		case '\t':
-			result += "\\t"
-		default:
-			result += string(c)
+// parseKeyValues parses repeated key=value flags
+func parseKeyValues(flag string, pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	result := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --%s %q: expected key=value", flag, pair)
 		}
+		result[key] = value
 	}
-	return result
+	return result, nil
 }
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/russellromney/coffer/internal/format"
+)
+
+func outputYAMLFormat(w io.Writer, secrets map[string]string, sep string) error {
+	nested, err := format.Nest(secrets, sep)
+	if err != nil {
+		return err
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(nested); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func outputTOMLFormat(w io.Writer, secrets map[string]string, sep string) error {
+	nested, err := format.Nest(secrets, sep)
+	if err != nil {
+		return err
+	}
+	return toml.NewEncoder(w).Encode(nested)
+}
+
+func outputNestedJSONFormat(w io.Writer, secrets map[string]string, sep string) error {
+	nested, err := format.Nest(secrets, sep)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(nested, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(data))
+	return nil
+}
+
+func parseYAML(data []byte, sep string) (map[string]string, error) {
+	var parsed map[string]any
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	return format.Flatten(parsed, sep)
+}
+
+func parseTOML(data []byte, sep string) (map[string]string, error) {
+	var parsed map[string]any
+	if err := toml.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	return format.Flatten(parsed, sep)
+}
+
+// parseJSON reads flat or nested JSON objects; numbers keep their exact text
+func parseJSON(data []byte, sep string) (map[string]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var parsed map[string]any
+	if err := dec.Decode(&parsed); err != nil {
+		return nil, err
+	}
+	return format.Flatten(parsed, sep)
+}
@@ -5,8 +5,7 @@ import (
 
 	"github.com/spf13/cobra"
 
-	"github.com/russellromney/coffer/internal/crypto"
-	"github.com/russellromney/coffer/internal/store"
+	"github.com/russellromney/coffer/internal/secrets"
 )
 
 var getCmd = &cobra.Command{
@@ -16,65 +15,59 @@ var getCmd = &cobra.Command{
 
 The decrypted value is printed to stdout.
 
+Use --at to read the value as it was at an RFC3339 timestamp or a
+duration ago, reconstructed from secret history.
+
+Keys excluded by the keys filter of a .coffer.yaml can't be read in its
+directory.
+
 Examples:
   coffer get DATABASE_URL --env prod
-  coffer get API_KEY --env dev`,
+  coffer get API_KEY --env dev
+  coffer get API_KEY --env prod --at 2h`,
 	Args: cobra.ExactArgs(1),
 	RunE: runGet,
 }
 
-var getEnv string
+var getAt string
 
 func init() {
 	rootCmd.AddCommand(getCmd)
-	getCmd.Flags().StringVarP(&getEnv, "env", "e", "", "Environment name (required)")
-	getCmd.MarkFlagRequired("env")
+	getCmd.Flags().StringVar(&getAt, "at", "", "Read the value as of an RFC3339 timestamp or duration ago (e.g. 2h)")
 }
 
 func runGet(cmd *cobra.Command, args []string) error {
-	v, s, err := getUnlockedVault()
+	envName, err := resolveEnvName()
 	if err != nil {
 		return err
 	}
-	defer v.Close()
-
-	project, err := getActiveProject(s)
+	at, err := parseAtFlag(getAt)
 	if err != nil {
 		return err
 	}
 
-	// Get environment
-	env, err := s.GetEnvironmentByName(project.ID, getEnv)
-	if err == store.ErrNotFound {
-		return fmt.Errorf("environment '%s' not found in project '%s'", getEnv, project.Name)
-	}
+	v, s, err := getUnlockedVault()
 	if err != nil {
-		return fmt.Errorf("failed to get environment: %w", err)
+		return err
 	}
+	defer v.Close()
 
-	key := args[0]
-
-	// Get secret with inheritance
-	mergedSecret, err := s.GetSecretWithInheritance(env.ID, key)
-	if err == store.ErrNotFound {
-		return fmt.Errorf("secret '%s' not found in %s/%s", key, project.Name, getEnv)
-	}
+	project, err := getActiveProject(s)
 	if err != nil {
-		return fmt.Errorf("failed to get secret: %w", err)
+		return err
 	}
 
-	// Get encryption key
-	encKey, err := v.GetKey()
-	if err != nil {
-		return fmt.Errorf("failed to get encryption key: %w", err)
+	key := args[0]
+	if err := checkKeyAllowed(key); err != nil {
+		return err
 	}
 
-	// Decrypt value
-	value, err := crypto.Decrypt(encKey, mergedSecret.EncryptedValue, mergedSecret.Nonce, []byte(key))
+	// Get and decrypt secret with inheritance
+	secret, err := newSecrets(v, s).Get(project, envName, key, secrets.Options{At: secrets.AtTime(at)})
 	if err != nil {
-		return fmt.Errorf("failed to decrypt secret: %w", err)
+		return err
 	}
 
-	fmt.Println(string(value))
+	fmt.Println(secret.Value)
 	return nil
 }
@@ -5,9 +5,6 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
-
-	"github.com/russellromney/coffer/internal/crypto"
-	"github.com/russellromney/coffer/internal/store"
 )
 
 var historyCmd = &cobra.Command{
@@ -17,6 +14,8 @@ var historyCmd = &cobra.Command{
 
 Displays when each version was created and what action was taken.
 Use --show-values to reveal the actual values (use with caution).
+Keys excluded by the keys filter of a .coffer.yaml can't be read in its
+directory.
 
 Examples:
   coffer history DATABASE_URL --env prod
@@ -26,63 +25,50 @@ Examples:
 }
 
 var (
-	historyEnv        string
 	historyLimit      int
 	historyShowValues bool
 )
 
 func init() {
 	rootCmd.AddCommand(historyCmd)
-	historyCmd.Flags().StringVarP(&historyEnv, "env", "e", "", "Environment name (required)")
 	historyCmd.Flags().IntVarP(&historyLimit, "limit", "l", 10, "Number of versions to show")
 	historyCmd.Flags().BoolVar(&historyShowValues, "show-values", false, "Show decrypted values")
-	historyCmd.MarkFlagRequired("env")
 }
 
 func runHistory(cmd *cobra.Command, args []string) error {
-	v, s, err := getUnlockedVault()
+	envName, err := resolveEnvName()
 	if err != nil {
 		return err
 	}
-	defer v.Close()
 
-	project, err := getActiveProject(s)
+	v, s, err := getUnlockedVault()
 	if err != nil {
 		return err
 	}
+	defer v.Close()
 
-	// Get environment
-	env, err := s.GetEnvironmentByName(project.ID, historyEnv)
-	if err == store.ErrNotFound {
-		return fmt.Errorf("environment '%s' not found in project '%s'", historyEnv, project.Name)
-	}
+	project, err := getActiveProject(s)
 	if err != nil {
-		return fmt.Errorf("failed to get environment: %w", err)
+		return err
 	}
 
 	key := args[0]
+	if err := checkKeyAllowed(key); err != nil {
+		return err
+	}
 
-	// Get history
-	history, err := s.GetSecretHistory(env.ID, key, historyLimit)
+	// Get history, decrypting values only if requested
+	history, err := newSecrets(v, s).History(project, envName, key, historyLimit, historyShowValues)
 	if err != nil {
-		return fmt.Errorf("failed to get history: %w", err)
+		return err
 	}
 
 	if len(history) == 0 {
-		fmt.Printf("No history found for '%s' in %s/%s\n", key, project.Name, historyEnv)
+		fmt.Printf("No history found for '%s' in %s/%s\n", key, project.Name, envName)
 		return nil
 	}
 
-	// Get encryption key if showing values
-	var encKey []byte
-	if historyShowValues {
-		encKey, err = v.GetKey()
-		if err != nil {
-			return fmt.Errorf("failed to get encryption key: %w", err)
-		}
-	}
-
-	fmt.Printf("History for '%s' in %s/%s:\n\n", key, project.Name, historyEnv)
+	fmt.Printf("History for '%s' in %s/%s:\n\n", key, project.Name, envName)
 
 	for _, h := range history {
 		actionIcon := "?"
@@ -99,12 +85,11 @@ func runHistory(cmd *cobra.Command, args []string) error {
 		fmt.Printf("  [%s] v%d  %s  %s\n", actionIcon, h.Version, timestamp, h.ChangeType)
 
 		if historyShowValues && h.ChangeType != "delete" {
-			value, err := crypto.Decrypt(encKey, h.EncryptedValue, h.Nonce, []byte(key))
-			if err != nil {
+			if h.DecryptErr != nil {
 				fmt.Printf("       Value: [decryption error]\n")
 			} else {
 				// Truncate long values
-				valStr := string(value)
+				valStr := h.Value
 				if len(valStr) > 60 {
 					valStr = valStr[:60] + "..."
 				}
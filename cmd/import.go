@@ -1,46 +1,108 @@
 package cmd
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/cobra"
 
-	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/agefile"
+	"github.com/russellromney/coffer/internal/dotenv"
+	"github.com/russellromney/coffer/internal/format"
+	"github.com/russellromney/coffer/internal/manifest"
+	"github.com/russellromney/coffer/internal/secrets"
+	"github.com/russellromney/coffer/internal/sops"
 	"github.com/russellromney/coffer/internal/store"
 )
 
 var importCmd = &cobra.Command{
 	Use:   "import <file>",
 	Short: "Import secrets from a file",
-	Long: `Import secrets from a .env or JSON file.
+	Long: `Import secrets from a .env, JSON, YAML or TOML file.
 
-The file format is auto-detected based on content, or you can
-specify it with --format.
+The file format is auto-detected based on extension and content, or you
+can specify it with --format. Pass - to read the file from stdin. Nested objects in JSON, YAML and TOML are
+flattened by joining keys with --separator (DB.HOST becomes DB__HOST).
+
+Docker Compose files (environment: blocks), Kubernetes Secret manifests
+(base64 data and stringData) and ConfigMaps are recognized from YAML
+files, or selected with --format compose, k8s-secret or configmap.
+Manifest keys become variable names: db-password imports as DB_PASSWORD.
+Helm values files import as plain YAML. A manifest imports atomically.
+
+.env files follow the format godotenv and python-dotenv accept: export
+prefixes, single- and double-quoted (multi-line) values, escapes, inline
+comments, and $VAR/${VAR} expansion from keys defined earlier in the
+file. References to other keys are kept as written; use --no-expand to
+keep all of them.
+
+age-encrypted files (from 'coffer export --encrypt-to' or the age CLI)
+are decrypted transparently with --identity, or by prompting for the
+passphrase if they were encrypted with one. Without a terminal the
+passphrase is read from the first line of stdin, so a passphrase-encrypted
+file can't also be piped in with -.
+
+SOPS files (YAML, JSON or dotenv, encrypted with age keys) are detected
+and decrypted too. Without --identity, the age key is found the way sops
+finds it: SOPS_AGE_KEY_FILE, SOPS_AGE_KEY, or ~/.config/sops/age/keys.txt.
+Nested keys are flattened with __ (DB: {HOST: x} becomes DB__HOST).
+
+Use --dry-run to preview which keys would be created, updated, left
+unchanged or removed. --strategy decides what happens to existing keys
+whose values differ: overwrite (default), skip, or fail without importing
+anything. --prune deletes keys defined in the environment (not inherited)
+that the file doesn't contain. All changes are applied in one transaction.
 
 Examples:
   coffer import .env --env dev
-  coffer import secrets.json --env prod --format json`,
+  coffer import .env.example --env dev --dry-run --prune
+  coffer import .env --env prod --strategy skip
+  coffer import secrets.json --env prod --format json
+  kubectl get secret api -o yaml | coffer import - --env prod --format k8s-secret
+  coffer import config.yaml --env dev
+  coffer import config.toml --env dev --separator _
+  coffer import docker-compose.yml --env dev --service api
+  coffer import secret.yaml --env prod --format k8s-secret
+  coffer import dev.env.age --env dev --identity ~/.config/age/key.txt
+  coffer import secrets.enc.yaml --env prod`,
 	Args: cobra.ExactArgs(1),
 	RunE: runImport,
 }
 
 var (
-	importEnv    string
-	importFormat string
+	importFormat     string
+	importIdentities []string
+	importSeparator  string
+	importNoExpand   bool
+	importDryRun     bool
+	importStrategy   string
+	importPrune      bool
+	importService    string
 )
 
 func init() {
 	rootCmd.AddCommand(importCmd)
-	importCmd.Flags().StringVarP(&importEnv, "env", "e", "", "Environment name (required)")
-	importCmd.Flags().StringVarP(&importFormat, "format", "f", "", "File format: env, json (auto-detected if not specified)")
-	importCmd.MarkFlagRequired("env")
+	importCmd.Flags().StringVarP(&importFormat, "format", "f", "", "File format: env, json, yaml, toml, compose, k8s-secret, configmap (auto-detected if not specified)")
+	importCmd.Flags().StringVar(&importService, "service", "", "Compose service to read (default: all services)")
+	importCmd.Flags().BoolVar(&importDryRun, "dry-run", false, "Show what would change without importing")
+	importCmd.Flags().StringVar(&importStrategy, "strategy", "overwrite", "Existing keys with different values: skip, overwrite, fail")
+	importCmd.Flags().BoolVar(&importPrune, "prune", false, "Delete keys in the environment that aren't in the file")
+	importCmd.Flags().BoolVar(&importNoExpand, "no-expand", false, "Keep $VAR references in .env files literal")
+	importCmd.Flags().StringVar(&importSeparator, "separator", format.DefaultSeparator, "Separator for flattening nested keys")
+	importCmd.Flags().StringArrayVarP(&importIdentities, "identity", "i", nil, "age identity file for encrypted files (repeatable)")
 }
 
 func runImport(cmd *cobra.Command, args []string) error {
+	envName, err := resolveEnvName()
+	if err != nil {
+		return err
+	}
+
 	v, s, err := getUnlockedVault()
 	if err != nil {
 		return err
@@ -52,143 +114,174 @@ func runImport(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	// Get environment
-	env, err := s.GetEnvironmentByName(project.ID, importEnv)
-	if err == store.ErrNotFound {
-		return fmt.Errorf("environment '%s' not found in project '%s'", importEnv, project.Name)
-	}
-	if err != nil {
-		return fmt.Errorf("failed to get environment: %w", err)
+	// Check the environment before decrypting anything
+	svc := newSecrets(v, s)
+	if _, err := svc.Environment(project, envName); err != nil {
+		return err
 	}
 
 	// Read file
 	filename := args[0]
-	data, err := os.ReadFile(filename)
+	var data []byte
+	if filename == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(filename)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to read file: %w", err)
 	}
 
-	// Detect format
-	format := importFormat
-	if format == "" {
-		if strings.HasSuffix(filename, ".json") {
-			format = "json"
-		} else if isJSON(data) {
-			format = "json"
-		} else {
-			format = "env"
+	// SOPS files carry their own format and decrypt straight to secrets
+	var parsed map[string]string
+	if _, ok := sops.DetectFormat(data); ok {
+		parsed, err = decryptSOPS(data, importIdentities)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt SOPS file: %w", err)
 		}
+	} else if parsed, err = parseFile(filename, data); err != nil {
+		return err
 	}
 
-	// Parse secrets
-	var secrets map[string]string
-	switch format {
-	case "json":
-		secrets, err = parseJSON(data)
-	case "env":
-		secrets, err = parseEnv(data)
-	default:
-		return fmt.Errorf("unknown format: %s (use 'env' or 'json')", format)
-	}
-	if err != nil {
-		return fmt.Errorf("failed to parse file: %w", err)
-	}
-
-	if len(secrets) == 0 {
+	if len(parsed) == 0 {
 		fmt.Println("No secrets found in file")
 		return nil
 	}
 
-	// Get encryption key
-	encKey, err := v.GetKey()
-	if err != nil {
-		return fmt.Errorf("failed to get encryption key: %w", err)
-	}
-
-	// Import secrets
-	created := 0
-	updated := 0
-
-	for key, value := range secrets {
-		// Validate key
-		if !isValidKeyName(key) {
+	// Drop keys that can't be environment variables
+	values := make(map[string]string, len(parsed))
+	for key, value := range parsed {
+		if !secrets.IsValidKeyName(key) {
 			fmt.Printf("Skipping invalid key: %s\n", key)
 			continue
 		}
+		values[key] = value
+	}
 
-		// Encrypt value
-		encryptedValue, nonce, err := crypto.Encrypt(encKey, []byte(value), []byte(key))
-		if err != nil {
-			return fmt.Errorf("failed to encrypt %s: %w", key, err)
-		}
+	strategy, err := secrets.ParseStrategy(importStrategy)
+	if err != nil {
+		return err
+	}
 
-		// Check if exists
-		_, err = s.GetSecret(env.ID, key)
-		if err == store.ErrNotFound {
-			_, err = s.CreateSecret(env.ID, key, encryptedValue, nonce)
-			if err != nil {
-				return fmt.Errorf("failed to create %s: %w", key, err)
-			}
-			created++
-		} else if err != nil {
-			return fmt.Errorf("failed to check %s: %w", key, err)
-		} else {
-			_, err = s.UpdateSecret(env.ID, key, encryptedValue, nonce)
-			if err != nil {
-				return fmt.Errorf("failed to update %s: %w", key, err)
-			}
-			updated++
-		}
+	plan, err := svc.PlanImport(project, envName, values, secrets.ImportOptions{Strategy: strategy, Prune: importPrune})
+	var conflict *secrets.ErrImportConflict
+	if errors.As(err, &conflict) && importDryRun {
+		printImportPlan(plan)
+	}
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Imported to %s/%s: %d created, %d updated\n", project.Name, importEnv, created, updated)
+	if importDryRun {
+		printImportPlan(plan)
+		fmt.Println("Dry run: no changes made")
+		return nil
+	}
+
+	err = svc.ApplyImport(plan)
+	if errors.Is(err, store.ErrSecretsChanged) {
+		return fmt.Errorf("%s/%s changed during the import: run it again", project.Name, envName)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported to %s/%s: %s\n", project.Name, envName, summarizeImportPlan(plan))
 	return nil
 }
 
-func isJSON(data []byte) bool {
-	var js json.RawMessage
-	return json.Unmarshal(data, &js) == nil
+// printImportPlan shows what an import changes, one key per line
+func printImportPlan(plan *secrets.ImportPlan) {
+	width := 0
+	for _, c := range plan.Changes {
+		width = max(width, len(c.Key))
+	}
+	for _, c := range plan.Changes {
+		fmt.Printf("  %-*s  %s\n", width, c.Key, c.Kind)
+	}
+	fmt.Println(summarizeImportPlan(plan))
 }
 
-func parseJSON(data []byte) (map[string]string, error) {
-	var result map[string]string
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, err
+func summarizeImportPlan(plan *secrets.ImportPlan) string {
+	parts := []string{
+		fmt.Sprintf("%d created", plan.Count(secrets.ChangeCreated)),
+		fmt.Sprintf("%d updated", plan.Count(secrets.ChangeUpdated)),
+		fmt.Sprintf("%d unchanged", plan.Count(secrets.ChangeUnchanged)),
+	}
+	if n := plan.Count(secrets.ChangeSkipped); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d skipped", n))
 	}
-	return result, nil
+	if n := plan.Count(secrets.ChangeRemoved); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d removed", n))
+	}
+	return strings.Join(parts, ", ")
 }
 
-func parseEnv(data []byte) (map[string]string, error) {
-	result := make(map[string]string)
-	scanner := bufio.NewScanner(strings.NewReader(string(data)))
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		// Parse KEY=value
-		idx := strings.Index(line, "=")
-		if idx == -1 {
-			continue
+// parseFile decrypts an age file if needed and parses it by format
+func parseFile(filename string, data []byte) (map[string]string, error) {
+	// Decrypt age files
+	var err error
+	if agefile.IsEncrypted(data) {
+		data, err = decryptAge(data, importIdentities, filename == "-")
+		if err != nil {
+			return nil, err
 		}
+		filename = strings.TrimSuffix(filename, ".age")
+	}
 
-		key := strings.TrimSpace(line[:idx])
-		value := strings.TrimSpace(line[idx+1:])
+	// Detect format
+	format := importFormat
+	if format == "" {
+		format = detectFormat(filename, data)
+	}
 
-		// Remove quotes if present
-		if len(value) >= 2 {
-			if (value[0] == '"' && value[len(value)-1] == '"') ||
-				(value[0] == '\'' && value[len(value)-1] == '\'') {
-				value = value[1 : len(value)-1]
-			}
-		}
+	// Parse secrets
+	var parsed map[string]string
+	switch format {
+	case "json", "json-nested":
+		parsed, err = parseJSON(data, importSeparator)
+	case "yaml", "yml", "helm":
+		parsed, err = parseYAML(data, importSeparator)
+	case "compose":
+		parsed, err = manifest.ParseCompose(data, importService)
+	case "k8s-secret":
+		parsed, err = manifest.ParseSecret(data)
+	case "configmap":
+		parsed, err = manifest.ParseConfigMap(data)
+	case "toml":
+		parsed, err = parseTOML(data, importSeparator)
+	case "env":
+		var entries []dotenv.Entry
+		entries, err = dotenv.Parse(data, dotenv.Options{Literal: importNoExpand})
+		parsed = dotenv.ToMap(entries)
+	default:
+		return nil, fmt.Errorf("unknown format: %s (use 'env', 'json', 'yaml', 'toml', 'compose', 'k8s-secret' or 'configmap')", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file: %w", err)
+	}
+	return parsed, nil
+}
 
-		result[key] = value
+// detectFormat guesses a file's format from its extension, then its content
+func detectFormat(filename string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return manifest.DetectFormat(data)
+	case ".toml":
+		return "toml"
+	case ".env":
+		return "env"
 	}
+	if isJSON(data) {
+		return "json"
+	}
+	return "env"
+}
 
-	return result, scanner.Err()
+func isJSON(data []byte) bool {
+	var js json.RawMessage
+	return json.Unmarshal(data, &js) == nil
 }
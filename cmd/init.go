@@ -7,7 +7,6 @@ import (
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
 
-	"github.com/russellromney/coffer/internal/config"
 	"github.com/russellromney/coffer/internal/vault"
 )
 
@@ -16,12 +15,14 @@ var initCmd = &cobra.Command{
 	Short: "Initialize a new vault",
 	Long: `Initialize a new coffer vault with a master password.
 
-The vault will be created in ~/.coffer/ by default. This command will
-prompt you to enter and confirm your master password.
+The vault will be created in ~/.coffer/ by default ($COFFER_HOME if set).
+With --vault, a named vault is created instead (see 'coffer vault').
+This command will prompt you to enter and confirm your master password.
 
 Example:
   coffer init
-  coffer init --password mypassword  # Non-interactive`,
+  coffer init --password mypassword  # Non-interactive
+  coffer --vault team init`,
 	RunE: runInit,
 }
 
@@ -33,7 +34,7 @@ func init() {
 }
 
 func runInit(cmd *cobra.Command, args []string) error {
-	cfg, err := config.New()
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
@@ -46,39 +47,9 @@ func runInit(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("vault already initialized at %s", cfg.DataDir)
 	}
 
-	var password string
-
-	if initPassword != "" {
-		// Non-interactive mode
-		if len(initPassword) < 8 {
-			return fmt.Errorf("password must be at least 8 characters")
-		}
-		password = initPassword
-	} else {
-		// Interactive mode - prompt for password
-		fmt.Print("Enter master password: ")
-		password1, err := term.ReadPassword(int(os.Stdin.Fd()))
-		fmt.Println()
-		if err != nil {
-			return fmt.Errorf("failed to read password: %w", err)
-		}
-
-		if len(password1) < 8 {
-			return fmt.Errorf("password must be at least 8 characters")
-		}
-
-		// Confirm password
-		fmt.Print("Confirm master password: ")
-		password2, err := term.ReadPassword(int(os.Stdin.Fd()))
-		fmt.Println()
-		if err != nil {
-			return fmt.Errorf("failed to read password: %w", err)
-		}
-
-		if string(password1) != string(password2) {
-			return fmt.Errorf("passwords do not match")
-		}
-		password = string(password1)
+	password, err := readNewPassword(initPassword)
+	if err != nil {
+		return err
 	}
 
 	// Initialize vault
@@ -90,3 +61,40 @@ func runInit(cmd *cobra.Command, args []string) error {
 	fmt.Println("Your vault is now unlocked. Use 'coffer lock' to lock it.")
 	return nil
 }
+
+// readNewPassword returns the --password value, or prompts for a new master
+// password twice
+func readNewPassword(flag string) (string, error) {
+	if flag != "" {
+		// Non-interactive mode
+		if len(flag) < 8 {
+			return "", fmt.Errorf("password must be at least 8 characters")
+		}
+		return flag, nil
+	}
+
+	// Interactive mode - prompt for password
+	fmt.Print("Enter master password: ")
+	password1, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+
+	if len(password1) < 8 {
+		return "", fmt.Errorf("password must be at least 8 characters")
+	}
+
+	// Confirm password
+	fmt.Print("Confirm master password: ")
+	password2, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+
+	if string(password1) != string(password2) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return string(password1), nil
+}
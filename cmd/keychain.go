@@ -7,7 +7,6 @@ import (
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
 
-	"github.com/russellromney/coffer/internal/config"
 	"github.com/russellromney/coffer/internal/vault"
 )
 
@@ -67,7 +66,7 @@ func init() {
 }
 
 func runKeychainStatus(cmd *cobra.Command, args []string) error {
-	cfg, err := config.New()
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
@@ -105,7 +104,7 @@ func runKeychainStatus(cmd *cobra.Command, args []string) error {
 }
 
 func runKeychainEnable(cmd *cobra.Command, args []string) error {
-	cfg, err := config.New()
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
@@ -152,7 +151,7 @@ func runKeychainEnable(cmd *cobra.Command, args []string) error {
 }
 
 func runKeychainDisable(cmd *cobra.Command, args []string) error {
-	cfg, err := config.New()
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
@@ -2,11 +2,11 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/spf13/cobra"
 
-	"github.com/russellromney/coffer/internal/crypto"
-	"github.com/russellromney/coffer/internal/store"
+	"github.com/russellromney/coffer/internal/secrets"
 )
 
 var listCmd = &cobra.Command{
@@ -15,26 +15,40 @@ var listCmd = &cobra.Command{
 	Long: `List all secrets in an environment.
 
 By default, only key names are shown. Use --show-values to reveal values.
+Inherited keys show which environment they come from, and keys whose value
+hides one from a lower-precedence parent or layer list what they shadow.
+Use --at to list the environment as it was at an RFC3339 timestamp or a
+duration ago, reconstructed from secret history. Keys excluded by the
+keys filter of a .coffer.yaml are not listed in its directory.
 
 Examples:
   coffer list --env prod
-  coffer list --env dev --show-values`,
+  coffer list --env dev --show-values
+  coffer list --env prod --at 2026-01-02T15:04:05Z`,
 	RunE: runList,
 }
 
 var (
-	listEnv        string
 	listShowValues bool
+	listAt         string
 )
 
 func init() {
 	rootCmd.AddCommand(listCmd)
-	listCmd.Flags().StringVarP(&listEnv, "env", "e", "", "Environment name (required)")
 	listCmd.Flags().BoolVar(&listShowValues, "show-values", false, "Show secret values (use with caution)")
-	listCmd.MarkFlagRequired("env")
+	listCmd.Flags().StringVar(&listAt, "at", "", "List secrets as of an RFC3339 timestamp or duration ago (e.g. 2h)")
 }
 
 func runList(cmd *cobra.Command, args []string) error {
+	envName, err := resolveEnvName()
+	if err != nil {
+		return err
+	}
+	at, err := parseAtFlag(listAt)
+	if err != nil {
+		return err
+	}
+
 	v, s, err := getUnlockedVault()
 	if err != nil {
 		return err
@@ -46,51 +60,67 @@ func runList(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	// Get environment
-	env, err := s.GetEnvironmentByName(project.ID, listEnv)
-	if err == store.ErrNotFound {
-		return fmt.Errorf("environment '%s' not found in project '%s'", listEnv, project.Name)
-	}
-	if err != nil {
-		return fmt.Errorf("failed to get environment: %w", err)
+	// Past states are reconstructed from history, which means decrypting;
+	// current keys can be listed without decrypting anything
+	var values []secrets.Value
+	svc := newSecrets(v, s)
+	if at.IsZero() {
+		values, err = svc.List(project, envName, listShowValues)
+		if err != nil {
+			return err
+		}
+	} else {
+		loaded, err := svc.Load(project, envName, secrets.Options{At: secrets.AtTime(at)})
+		if err != nil {
+			return err
+		}
+		for _, key := range secrets.SortedKeys(loaded) {
+			values = append(values, loaded[key])
+		}
 	}
 
-	// List secrets with inheritance
-	secrets, err := s.ListSecretsWithInheritance(env.ID)
+	allowed, err := keyAllowed()
 	if err != nil {
-		return fmt.Errorf("failed to list secrets: %w", err)
+		return err
+	}
+	filtered := values[:0]
+	for _, secret := range values {
+		if allowed(secret.Key) {
+			filtered = append(filtered, secret)
+		}
 	}
+	values = filtered
 
-	if len(secrets) == 0 {
-		fmt.Printf("No secrets in %s/%s\n", project.Name, listEnv)
+	if len(values) == 0 {
+		fmt.Printf("No secrets in %s/%s\n", project.Name, envName)
 		return nil
 	}
 
-	// Get encryption key if showing values
-	var encKey []byte
-	if listShowValues {
-		encKey, err = v.GetKey()
-		if err != nil {
-			return fmt.Errorf("failed to get encryption key: %w", err)
-		}
+	if at.IsZero() {
+		fmt.Printf("Secrets in %s/%s:\n", project.Name, envName)
+	} else {
+		fmt.Printf("Secrets in %s/%s at %s:\n", project.Name, envName, at.Local().Format("2006-01-02 15:04:05"))
 	}
-
-	fmt.Printf("Secrets in %s/%s:\n", project.Name, listEnv)
-	for _, secret := range secrets {
-		inheritedMarker := ""
+	for _, secret := range values {
+		var notes []string
 		if secret.IsInherited {
-			inheritedMarker = fmt.Sprintf(" [inherited from %s]", secret.SourceEnvName)
+			notes = append(notes, "inherited from "+secret.SourceEnvName)
+		}
+		if len(secret.Shadows) > 0 {
+			notes = append(notes, "shadows "+strings.Join(secret.Shadows, ", "))
+		}
+		marker := ""
+		if len(notes) > 0 {
+			marker = " [" + strings.Join(notes, ", ") + "]"
 		}
 
-		if listShowValues {
-			value, err := crypto.Decrypt(encKey, secret.EncryptedValue, secret.Nonce, []byte(secret.Key))
-			if err != nil {
-				fmt.Printf("  %s = [decryption error]%s\n", secret.Key, inheritedMarker)
-			} else {
-				fmt.Printf("  %s = %s%s\n", secret.Key, string(value), inheritedMarker)
-			}
-		} else {
-			fmt.Printf("  %s%s\n", secret.Key, inheritedMarker)
+		switch {
+		case !listShowValues:
+			fmt.Printf("  %s%s\n", secret.Key, marker)
+		case secret.DecryptErr != nil:
+			fmt.Printf("  %s = [decryption error]%s\n", secret.Key, marker)
+		default:
+			fmt.Printf("  %s = %s%s\n", secret.Key, secret.Value, marker)
 		}
 	}
 
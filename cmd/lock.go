@@ -5,7 +5,6 @@ import (
 
 	"github.com/spf13/cobra"
 
-	"github.com/russellromney/coffer/internal/config"
 	"github.com/russellromney/coffer/internal/vault"
 )
 
@@ -27,7 +26,7 @@ func init() {
 }
 
 func runLock(cmd *cobra.Command, args []string) error {
-	cfg, err := config.New()
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
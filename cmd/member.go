@@ -0,0 +1,380 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/secrets"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+var memberCmd = &cobra.Command{
+	Use:   "member",
+	Short: "Manage vault members",
+	Long: `Manage the people who can access environments in this vault.
+
+Each member has their own X25519 keypair. Granting a member an environment
+seals its encryption key to their public key, so they can unlock with their
+identity file instead of the master password. Removing a member rekeys every
+environment they had access to.
+
+Examples:
+  coffer member keygen                          # Run by the new member
+  coffer member add alice --public-key coffer-pub-... --grant myapp/prod
+  coffer member list
+  coffer member remove alice`,
+}
+
+var memberKeygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a member identity",
+	Long: `Generate an X25519 keypair and write the private key to an identity file
+(default ~/.coffer/identity). Share the printed public key with the vault
+owner so they can add you with 'coffer member add'.
+
+Example:
+  coffer member keygen
+  coffer member keygen --output ./alice.identity`,
+	RunE: runMemberKeygen,
+}
+
+var memberAddCmd = &cobra.Command{
+	Use:   "add <name>",
+	Short: "Add a member",
+	Long: `Register a member's public key and optionally grant environments.
+
+Environments are given as project/env, or just env for the active project.
+Granting an environment also grants the environments it inherits from.
+
+Example:
+  coffer member add alice --public-key coffer-pub-... --grant myapp/prod
+  coffer member add bob --public-key coffer-pub-... --grant dev --grant staging`,
+	Args: cobra.ExactArgs(1),
+	RunE: runMemberAdd,
+}
+
+var memberGrantCmd = &cobra.Command{
+	Use:   "grant <name> <env>...",
+	Short: "Grant a member access to environments",
+	Long: `Seal environment keys to a member so they can read and write them.
+
+Example:
+  coffer member grant alice myapp/prod
+  coffer member grant bob dev staging`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: runMemberGrant,
+}
+
+var memberRevokeCmd = &cobra.Command{
+	Use:   "revoke <name> <env>...",
+	Short: "Revoke a member's access to environments",
+	Long: `Revoke a member's access to environments. Each environment is rekeyed,
+so a key the member kept can't read values written afterwards. Service
+tokens holding the key are given the new one, and are listed.
+
+Only the named environments are rekeyed. The member keeps the keys of
+the environments they inherit from, which granting also gave them;
+these are listed so you can revoke them too if no other grant needs
+them.
+
+The old key still reads copies of the vault taken before the rekey.
+Sessions unlocked before it, including other members', hold the old
+key and need to unlock again.
+
+Example:
+  coffer member revoke alice myapp/prod`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: runMemberRevoke,
+}
+
+var memberRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a member",
+	Long: `Remove a member and rekey every environment they had access to.
+
+Use --force to skip confirmation.
+
+Example:
+  coffer member remove alice
+  coffer member remove alice --force`,
+	Args: cobra.ExactArgs(1),
+	RunE: runMemberRemove,
+}
+
+var memberListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List members",
+	Long: `List members and the environments they can access.
+
+Example:
+  coffer member list`,
+	RunE: runMemberList,
+}
+
+var (
+	memberOutput    string
+	memberForce     bool
+	memberPublicKey string
+	memberGrants    []string
+)
+
+func init() {
+	rootCmd.AddCommand(memberCmd)
+	memberCmd.AddCommand(memberKeygenCmd)
+	memberCmd.AddCommand(memberAddCmd)
+	memberCmd.AddCommand(memberGrantCmd)
+	memberCmd.AddCommand(memberRevokeCmd)
+	memberCmd.AddCommand(memberRemoveCmd)
+	memberCmd.AddCommand(memberListCmd)
+
+	memberKeygenCmd.Flags().StringVarP(&memberOutput, "output", "o", "", "Identity file to write (default ~/.coffer/identity)")
+	memberKeygenCmd.Flags().BoolVarP(&memberForce, "force", "f", false, "Overwrite an existing identity file")
+	memberAddCmd.Flags().StringVar(&memberPublicKey, "public-key", "", "Member's public key from 'coffer member keygen' (required)")
+	memberAddCmd.Flags().StringArrayVar(&memberGrants, "grant", nil, "Environment to grant (repeatable)")
+	memberAddCmd.MarkFlagRequired("public-key")
+	memberRemoveCmd.Flags().BoolVarP(&memberForce, "force", "f", false, "Skip confirmation")
+}
+
+func runMemberKeygen(cmd *cobra.Command, args []string) error {
+	path := memberOutput
+	if path == "" {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		if err := cfg.EnsureDataDir(); err != nil {
+			return err
+		}
+		path = cfg.IdentityPath
+	}
+
+	if _, err := os.Stat(path); err == nil && !memberForce {
+		return fmt.Errorf("identity file %s already exists (use --force to overwrite)", path)
+	}
+
+	privateKey, publicKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	identity, err := crypto.FormatIdentity(privateKey)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(identity), 0600); err != nil {
+		return fmt.Errorf("failed to write identity file: %w", err)
+	}
+
+	fmt.Printf("Wrote identity to %s\n", path)
+	fmt.Println("Share your public key with the vault owner:")
+	fmt.Println()
+	fmt.Println(crypto.EncodePublicKey(publicKey))
+	return nil
+}
+
+func runMemberAdd(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	name := args[0]
+
+	publicKey, err := crypto.ParsePublicKey(memberPublicKey)
+	if err != nil {
+		return err
+	}
+
+	// Resolve grants up front so a typo doesn't leave a half-added member
+	envs := make([]*models.Environment, 0, len(memberGrants))
+	for _, ref := range memberGrants {
+		_, env, err := resolveEnvRef(s, ref)
+		if err != nil {
+			return err
+		}
+		envs = append(envs, env)
+	}
+
+	if _, err := s.GetMemberByName(name); err == nil {
+		return fmt.Errorf("member '%s' already exists", name)
+	}
+	member, err := s.CreateMember(name, publicKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added member '%s'\n", name)
+
+	svc := newSecrets(v, s)
+	for i, env := range envs {
+		if _, err := svc.Grant(member, env.ID); err != nil {
+			return fmt.Errorf("failed to grant %s: %w", memberGrants[i], err)
+		}
+		fmt.Printf("Granted %s\n", memberGrants[i])
+	}
+	return nil
+}
+
+func runMemberGrant(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	member, err := getMember(s, args[0])
+	if err != nil {
+		return err
+	}
+
+	svc := newSecrets(v, s)
+	for _, ref := range args[1:] {
+		_, env, err := resolveEnvRef(s, ref)
+		if err != nil {
+			return err
+		}
+		if _, err := svc.Grant(member, env.ID); err != nil {
+			return fmt.Errorf("failed to grant %s: %w", ref, err)
+		}
+		fmt.Printf("Granted %s to '%s'\n", ref, member.Name)
+	}
+	return nil
+}
+
+func runMemberRevoke(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	member, err := getMember(s, args[0])
+	if err != nil {
+		return err
+	}
+
+	svc := newSecrets(v, s)
+	for _, ref := range args[1:] {
+		_, env, err := resolveEnvRef(s, ref)
+		if err != nil {
+			return err
+		}
+		revocation, err := svc.Revoke(member, env.ID)
+		if err != nil {
+			return fmt.Errorf("failed to revoke %s: %w", ref, err)
+		}
+		fmt.Printf("Revoked %s from '%s' (environment rekeyed)\n", ref, member.Name)
+		printRotation(&revocation.Rotation)
+		for _, kept := range revocation.Retained {
+			name := describeEnv(s, kept.ID)
+			fmt.Printf("  '%s' still holds the key for %s, which %s inherits from.\n", member.Name, name, ref)
+			fmt.Printf("  Revoke it too with: coffer member revoke %s %s\n", member.Name, name)
+		}
+	}
+	fmt.Println("Sessions unlocked before the rekey keep the old key until they unlock again.")
+	return nil
+}
+
+// printRotation reports the service tokens a rekey changed
+func printRotation(rotation *secrets.Rotation) {
+	if len(rotation.Resealed) > 0 {
+		fmt.Printf("  New key sealed to tokens: %s\n", strings.Join(rotation.Resealed, ", "))
+	}
+}
+
+func runMemberRemove(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	member, err := getMember(s, args[0])
+	if err != nil {
+		return err
+	}
+
+	if !memberForce {
+		fmt.Printf("Are you sure you want to remove member '%s' and rekey their environments? [y/N] ", member.Name)
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Cancelled")
+			return nil
+		}
+	}
+
+	// Rekey first: if it fails the member is still listed and removal can be retried
+	rotation, err := newSecrets(v, s).RevokeAll(member)
+	if err != nil {
+		return fmt.Errorf("failed to rekey environments: %w", err)
+	}
+	if err := s.DeleteMember(member.ID); err != nil {
+		return fmt.Errorf("failed to remove member: %w", err)
+	}
+
+	fmt.Printf("Removed member '%s'\n", member.Name)
+	printRotation(rotation)
+	fmt.Println("Sessions unlocked before the rekey keep the old key until they unlock again.")
+	return nil
+}
+
+func runMemberList(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	members, err := s.ListMembers()
+	if err != nil {
+		return fmt.Errorf("failed to list members: %w", err)
+	}
+
+	if len(members) == 0 {
+		fmt.Println("No members. Add one with 'coffer member add <name>'")
+		return nil
+	}
+
+	fmt.Println("Members:")
+	for _, m := range members {
+		fmt.Printf("  %s %s\n", m.Name, crypto.EncodePublicKey(m.PublicKey))
+
+		grants, err := s.ListMemberKeys(m.ID)
+		if err != nil {
+			return fmt.Errorf("failed to list grants: %w", err)
+		}
+		for _, g := range grants {
+			fmt.Printf("    %s\n", describeEnv(s, g.EnvironmentID))
+		}
+	}
+	return nil
+}
+
+func getMember(s store.Store, name string) (*models.Member, error) {
+	member, err := s.GetMemberByName(name)
+	if err == store.ErrNotFound {
+		return nil, fmt.Errorf("member '%s' not found", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get member: %w", err)
+	}
+	return member, nil
+}
+
+// describeEnv renders an environment ID as project/env for display
+func describeEnv(s store.Store, envID string) string {
+	env, err := s.GetEnvironment(envID)
+	if err != nil {
+		return envID
+	}
+	project, err := s.GetProject(env.ProjectID)
+	if err != nil {
+		return env.Name
+	}
+	return project.Name + "/" + env.Name
+}
@@ -2,11 +2,12 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
 
-	"github.com/russellromney/coffer/internal/config"
 	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/secrets"
 	"github.com/russellromney/coffer/internal/store"
 	"github.com/russellromney/coffer/internal/vault"
 )
@@ -76,9 +77,46 @@ Example:
 	RunE: runProjectDelete,
 }
 
+var projectRenameCmd = &cobra.Command{
+	Use:   "rename <name> <new-name>",
+	Short: "Rename a project",
+	Long: `Rename a project. Its environments, secrets and tokens are kept, and it
+stays active if it was.
+
+Update any .coffer.yaml files or COFFER_PROJECT settings that use the old
+name.
+
+Example:
+  coffer project rename myapp myapp-legacy`,
+	Args: cobra.ExactArgs(2),
+	RunE: runProjectRename,
+}
+
+var projectCloneCmd = &cobra.Command{
+	Use:   "clone <name> <new-name>",
+	Short: "Copy a project",
+	Long: `Copy a project with all its environments and secrets, e.g. to use one
+project as a template for another. Parent links between environments are
+kept, and each copied environment gets its own encryption key.
+
+By default the copies' history starts with the current values;
+--with-history copies every earlier version too. Snapshots aren't copied.
+
+Members keep access to the copies of the environments they hold. Only
+tokens without a project scope cover the new project. Environments that
+inherit from another project must be reparented or detached first.
+
+Example:
+  coffer project clone myapp myapp-v2
+  coffer project clone myapp myapp-v2 --with-history`,
+	Args: cobra.ExactArgs(2),
+	RunE: runProjectClone,
+}
+
 var (
 	projectDescription string
 	projectForce       bool
+	projectWithHistory bool
 )
 
 func init() {
@@ -87,13 +125,16 @@ func init() {
 	projectCmd.AddCommand(projectListCmd)
 	projectCmd.AddCommand(projectUseCmd)
 	projectCmd.AddCommand(projectDeleteCmd)
+	projectCmd.AddCommand(projectRenameCmd)
+	projectCmd.AddCommand(projectCloneCmd)
 
 	projectCreateCmd.Flags().StringVarP(&projectDescription, "description", "d", "", "Project description")
 	projectDeleteCmd.Flags().BoolVarP(&projectForce, "force", "f", false, "Skip confirmation")
+	projectCloneCmd.Flags().BoolVar(&projectWithHistory, "with-history", false, "Copy every earlier version of each secret")
 }
 
 func getUnlockedVault() (*vault.Vault, store.Store, error) {
-	cfg, err := config.New()
+	cfg, err := loadConfig()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -105,6 +146,20 @@ func getUnlockedVault() (*vault.Vault, store.Store, error) {
 		return nil, nil, fmt.Errorf("vault not initialized: run 'coffer init' first")
 	}
 
+	// A service token unlocks in-memory and limits the store to its scope
+	if token := os.Getenv(TokenEnvVar); token != "" {
+		if err := v.UnlockWithToken(token); err != nil {
+			v.Close()
+			return nil, nil, fmt.Errorf("failed to unlock with %s: %w", TokenEnvVar, err)
+		}
+		s, err := v.GetStore()
+		if err != nil {
+			v.Close()
+			return nil, nil, err
+		}
+		return v, store.NewScopedStore(s, v.Token()), nil
+	}
+
 	if !v.IsUnlocked() {
 		v.Close()
 		return nil, nil, fmt.Errorf("vault is locked: run 'coffer unlock' first")
@@ -253,3 +308,79 @@ func runProjectDelete(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Deleted project '%s'\n", name)
 	return nil
 }
+
+func runProjectRename(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	name, newName := args[0], args[1]
+
+	project, err := s.GetProjectByName(name)
+	if err == store.ErrNotFound {
+		return fmt.Errorf("project '%s' not found", name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get project: %w", err)
+	}
+
+	_, err = s.GetProjectByName(newName)
+	if err == nil {
+		return fmt.Errorf("project '%s' already exists", newName)
+	}
+	if err != store.ErrNotFound {
+		return err
+	}
+
+	if err := s.RenameProject(project.ID, newName); err != nil {
+		return fmt.Errorf("failed to rename project: %w", err)
+	}
+
+	fmt.Printf("Renamed project '%s' to '%s'\n", name, newName)
+	return nil
+}
+
+func runProjectClone(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	name, newName := args[0], args[1]
+
+	project, err := s.GetProjectByName(name)
+	if err == store.ErrNotFound {
+		return fmt.Errorf("project '%s' not found", name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get project: %w", err)
+	}
+
+	_, err = s.GetProjectByName(newName)
+	if err == nil {
+		return fmt.Errorf("project '%s' already exists", newName)
+	}
+	if err != store.ErrNotFound {
+		return err
+	}
+
+	clone, regrant, err := newSecrets(v, s).CloneProject(project, newName, projectWithHistory)
+	if err != nil {
+		return err
+	}
+
+	envs, _ := s.ListEnvironments(clone.ID)
+	fmt.Printf("Cloned project '%s' to '%s' (%d environments)\n", name, newName, len(envs))
+	printRegrant(regrant)
+	fmt.Printf("Use 'coffer project use %s' to switch to it\n", newName)
+	return nil
+}
+
+// newSecrets returns a secrets service using whichever keys the vault was
+// unlocked with
+func newSecrets(v *vault.Vault, s store.Store) *secrets.Service {
+	return secrets.New(s, v.GetKey).WithEnvironmentKeys(v.EnvironmentKeys())
+}
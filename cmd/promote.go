@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/russellromney/coffer/internal/secrets"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+var promoteCmd = &cobra.Command{
+	Use:   "promote --from <env> --to <env> [KEYS...|--all]",
+	Short: "Copy secrets from one environment to another",
+	Long: `Copy secrets from one environment to another in the same project, e.g.
+from staging to prod once a change has been tested.
+
+Name the keys to promote, or use --all for every key defined directly in
+the source (add --include-inherited for the keys it inherits too). Values
+are re-encrypted with the target's key and each change is recorded in the
+target's history. Keys the target has that aren't promoted are left alone.
+
+The changes are shown before anything is written, with where each value
+comes from, and you're asked to confirm. If the target changes before you
+confirm, nothing is written. --require-independent refuses to promote into
+an environment that inherits from the source, where a copy would only
+shadow values it already sees.
+
+Examples:
+  coffer promote --from staging --to prod API_URL FEATURE_FLAGS
+  coffer promote --from staging --to prod --all --dry-run
+  coffer promote --from staging --to prod --all --require-independent --force`,
+	RunE: runPromote,
+}
+
+var (
+	promoteFrom               string
+	promoteTo                 string
+	promoteAll                bool
+	promoteIncludeInherited   bool
+	promoteRequireIndependent bool
+	promoteDryRun             bool
+	promoteForce              bool
+)
+
+func init() {
+	rootCmd.AddCommand(promoteCmd)
+	promoteCmd.Flags().StringVar(&promoteFrom, "from", "", "Environment to copy from (required)")
+	promoteCmd.Flags().StringVar(&promoteTo, "to", "", "Environment to copy to (required)")
+	promoteCmd.Flags().BoolVar(&promoteAll, "all", false, "Promote every key defined in the source")
+	promoteCmd.Flags().BoolVar(&promoteIncludeInherited, "include-inherited", false, "With --all, also promote keys the source inherits")
+	promoteCmd.Flags().BoolVar(&promoteRequireIndependent, "require-independent", false, "Fail if the target inherits from the source")
+	promoteCmd.Flags().BoolVar(&promoteDryRun, "dry-run", false, "Show what would change without writing anything")
+	promoteCmd.Flags().BoolVarP(&promoteForce, "force", "f", false, "Skip confirmation")
+	promoteCmd.MarkFlagRequired("from")
+	promoteCmd.MarkFlagRequired("to")
+}
+
+func runPromote(cmd *cobra.Command, args []string) error {
+	if promoteAll == (len(args) > 0) {
+		return fmt.Errorf("name the keys to promote, or use --all")
+	}
+	if promoteIncludeInherited && !promoteAll {
+		return fmt.Errorf("--include-inherited requires --all")
+	}
+
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	project, err := getActiveProject(s)
+	if err != nil {
+		return err
+	}
+
+	svc := newSecrets(v, s)
+	plan, err := svc.PlanPromote(project, promoteFrom, promoteTo, secrets.PromoteOptions{
+		Keys:               args,
+		IncludeInherited:   promoteIncludeInherited,
+		RequireIndependent: promoteRequireIndependent,
+	})
+	if err != nil {
+		return err
+	}
+
+	from := project.Name + "/" + promoteFrom
+	to := project.Name + "/" + promoteTo
+	if len(plan.Changes) == plan.Count(secrets.ChangeUnchanged) {
+		fmt.Printf("%s already matches %s for %d key(s)\n", to, from, len(plan.Changes))
+		return nil
+	}
+
+	// Load both sides to show where each value comes from
+	source, err := svc.Load(project, promoteFrom, secrets.Options{})
+	if err != nil {
+		return err
+	}
+	target, err := svc.Load(project, promoteTo, secrets.Options{})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Promoting from %s to %s:\n", from, to)
+	for _, c := range plan.Changes {
+		src := source[c.Key]
+		switch c.Kind {
+		case secrets.ChangeCreated:
+			line := fmt.Sprintf("  + %s  %s", c.Key, provenance(&src))
+			if current, ok := target[c.Key]; ok {
+				line += fmt.Sprintf(", overrides value inherited from %s", current.SourceEnvName)
+			}
+			fmt.Println(line)
+		case secrets.ChangeUpdated:
+			fmt.Printf("  ~ %s  %s\n", c.Key, provenance(&src))
+		}
+	}
+	fmt.Println(summarizeImportPlan(plan))
+	if promoteDryRun {
+		fmt.Println("Dry run: no changes made")
+		return nil
+	}
+
+	if !promoteForce {
+		fmt.Printf("Are you sure you want to promote to %s? [y/N] ", to)
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Cancelled")
+			return nil
+		}
+	}
+
+	err = svc.ApplyImport(plan)
+	if errors.Is(err, store.ErrSecretsChanged) {
+		return fmt.Errorf("%s changed while the promotion was being confirmed: run it again to see the current changes", to)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Promoted from %s to %s: %s\n", from, to, summarizeImportPlan(plan))
+	return nil
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/russellromney/coffer/internal/render"
+	"github.com/russellromney/coffer/internal/secrets"
+)
+
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Render a template with secrets",
+	Long: `Render a Go text/template file with an environment's secrets.
+
+Secrets are resolved (${VAR} references expanded) and available as
+{{ .DATABASE_URL }}. Missing keys render as empty strings; use required
+to fail instead. Inside a directory with a .coffer.yaml, only keys passing
+its keys filter are available. Helper functions:
+
+  b64enc    base64-encode a value           {{ .CERT | b64enc }}
+  b64dec    base64-decode a value           {{ .CERT_B64 | b64dec }}
+  quote     double-quote and escape         {{ .PASSWORD | quote }}
+  squote    single-quote for sh/bash        {{ .USER | squote }}
+  required  fail if a value is empty        {{ required "set DB_URL" .DB_URL }}
+  default   fallback for empty values       {{ .PORT | default "8080" }}
+  env       look up a key by name           {{ env "API_KEY" }}
+
+Output files are written with 0600 permissions. Rendering over an
+existing file that other users can read is refused.
+
+Examples:
+  coffer render --env prod -i config.tmpl -o config.yaml
+  coffer render --env dev -i nginx.conf.tmpl > nginx.conf`,
+	RunE: runRender,
+}
+
+var (
+	renderInput  string
+	renderOutput string
+)
+
+func init() {
+	rootCmd.AddCommand(renderCmd)
+	renderCmd.Flags().StringVarP(&renderInput, "input", "i", "", "Template file, or - for stdin (required)")
+	renderCmd.Flags().StringVarP(&renderOutput, "output", "o", "", "Output file (default stdout)")
+	renderCmd.MarkFlagRequired("input")
+}
+
+func runRender(cmd *cobra.Command, args []string) error {
+	envName, err := resolveEnvName()
+	if err != nil {
+		return err
+	}
+
+	var src []byte
+	if renderInput == "-" {
+		src, err = io.ReadAll(os.Stdin)
+	} else {
+		src, err = os.ReadFile(renderInput)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read template: %w", err)
+	}
+
+	// Check before decrypting anything
+	if renderOutput != "" {
+		if err := checkOutputPermissions(renderOutput); err != nil {
+			return err
+		}
+	}
+
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	project, err := getActiveProject(s)
+	if err != nil {
+		return err
+	}
+
+	values, err := newSecrets(v, s).Load(project, envName, secrets.Options{Resolve: true})
+	if err != nil {
+		return err
+	}
+	values, err = filterSecrets(values)
+	if err != nil {
+		return err
+	}
+
+	out, err := render.Execute(filepath.Base(renderInput), string(src), secrets.ToMap(values))
+	if err != nil {
+		return err
+	}
+
+	if renderOutput == "" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	if err := writePrivateFile(renderOutput, out); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Rendered %s/%s to %s\n", project.Name, envName, renderOutput)
+	return nil
+}
+
+// checkOutputPermissions refuses to overwrite a file other users can access
+func checkOutputPermissions(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check output file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("refusing to write secrets to %s: not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("refusing to write secrets to %s: permissions %04o allow access by other users (chmod 600 %s)", path, perm, path)
+	}
+	return nil
+}
+
+// writePrivateFile atomically writes data to path with 0600 permissions
+func writePrivateFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// CreateTemp already uses 0600; be explicit in case of an unusual umask
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set output permissions: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/russellromney/coffer/internal/secrets"
+)
+
+var envReparentCmd = &cobra.Command{
+	Use:   "reparent <env> <new-parent|--none>",
+	Short: "Change the environment an environment inherits from",
+	Long: `Make an environment inherit from a different parent, or from none with
+--none. Secrets set in the environment are kept; inherited ones now come
+from the new parent. Child environments move along with it.
+
+The keys whose visible values change are shown before anything is
+written. An environment can't inherit from itself or from one of its own
+descendants.
+
+Examples:
+  coffer env reparent dev_personal staging
+  coffer env reparent dev_personal --none --dry-run`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: runEnvReparent,
+}
+
+var envLayersCmd = &cobra.Command{
+	Use:   "layers <env> [layer...|--none]",
+	Short: "Compose an environment from ordered layers",
+	Long: `Show or set the layers an environment is composed from.
+
+Layers are listed lowest precedence first: each layer's values, including
+what it inherits, override its parent's and earlier layers', and values set
+in the environment itself override them all. This lets shared config such
+as a region's be mixed in without duplicating whole chains. The parent, if
+any, is kept and has lower precedence than every layer.
+
+With no layers, the current ones are shown. --none removes them all. The
+keys whose visible values change are shown before anything is written.
+
+Examples:
+  coffer env layers prod-eu base prod eu-overrides
+  coffer env layers prod-eu
+  coffer env layers prod-eu --none --dry-run`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runEnvLayers,
+}
+
+var envDetachCmd = &cobra.Command{
+	Use:   "detach <env>",
+	Short: "Stop an environment inheriting from its parent and layers",
+	Long: `Remove an environment's parent link and layers.
+
+With --materialize, the values it inherits are first copied into it, in
+the same transaction, so it keeps seeing exactly what it sees now and
+later changes to its old parent and layers no longer reach it. Without it, inherited
+keys disappear from the environment.
+
+Examples:
+  coffer env detach dev_personal --materialize
+  coffer env detach dev_personal --dry-run`,
+	Args: cobra.ExactArgs(1),
+	RunE: runEnvDetach,
+}
+
+var (
+	reparentNone      bool
+	reparentDryRun    bool
+	reparentForce     bool
+	layersNone        bool
+	layersDryRun      bool
+	layersForce       bool
+	detachMaterialize bool
+	detachDryRun      bool
+	detachForce       bool
+)
+
+func init() {
+	envCmd.AddCommand(envReparentCmd)
+	envCmd.AddCommand(envLayersCmd)
+	envCmd.AddCommand(envDetachCmd)
+
+	envReparentCmd.Flags().BoolVar(&reparentNone, "none", false, "Remove the parent instead")
+	envReparentCmd.Flags().BoolVar(&reparentDryRun, "dry-run", false, "Show what would change without writing anything")
+	envReparentCmd.Flags().BoolVarP(&reparentForce, "force", "f", false, "Skip confirmation")
+	envLayersCmd.Flags().BoolVar(&layersNone, "none", false, "Remove every layer")
+	envLayersCmd.Flags().BoolVar(&layersDryRun, "dry-run", false, "Show what would change without writing anything")
+	envLayersCmd.Flags().BoolVarP(&layersForce, "force", "f", false, "Skip confirmation")
+	envDetachCmd.Flags().BoolVar(&detachMaterialize, "materialize", false, "Copy inherited values into the environment first")
+	envDetachCmd.Flags().BoolVar(&detachDryRun, "dry-run", false, "Show what would change without writing anything")
+	envDetachCmd.Flags().BoolVarP(&detachForce, "force", "f", false, "Skip confirmation")
+}
+
+func runEnvReparent(cmd *cobra.Command, args []string) error {
+	if reparentNone == (len(args) == 2) {
+		return fmt.Errorf("name the new parent, or use --none")
+	}
+	parentName := ""
+	if len(args) == 2 {
+		parentName = args[1]
+	}
+
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	project, err := getActiveProject(s)
+	if err != nil {
+		return err
+	}
+
+	envName := args[0]
+	svc := newSecrets(v, s)
+	diffs, err := svc.PlanReparent(project, envName, parentName)
+	if err != nil {
+		return err
+	}
+
+	target := fmt.Sprintf("inherit from '%s'", parentName)
+	if parentName == "" {
+		target = "have no parent"
+	}
+	fmt.Printf("Making '%s' %s:\n", envName, target)
+	printVisibleChanges(diffs)
+	if reparentDryRun {
+		fmt.Println("Dry run: no changes made")
+		return nil
+	}
+
+	if !reparentForce {
+		fmt.Printf("Are you sure you want to make '%s' %s? [y/N] ", envName, target)
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Cancelled")
+			return nil
+		}
+	}
+
+	regrant, err := svc.Reparent(project, envName, parentName)
+	if err != nil {
+		return err
+	}
+	if parentName == "" {
+		fmt.Printf("'%s' no longer has a parent\n", envName)
+	} else {
+		fmt.Printf("'%s' now inherits from '%s'\n", envName, parentName)
+	}
+	printRegrant(regrant)
+	return nil
+}
+
+func runEnvLayers(cmd *cobra.Command, args []string) error {
+	if layersNone && len(args) > 1 {
+		return fmt.Errorf("name the layers, or use --none")
+	}
+
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	project, err := getActiveProject(s)
+	if err != nil {
+		return err
+	}
+
+	envName, layerNames := args[0], args[1:]
+	svc := newSecrets(v, s)
+	if len(layerNames) == 0 && !layersNone {
+		layers, err := svc.Layers(project, envName)
+		if err != nil {
+			return err
+		}
+		if len(layers) == 0 {
+			fmt.Printf("'%s' has no layers\n", envName)
+			return nil
+		}
+		fmt.Printf("Layers of '%s', lowest precedence first:\n", envName)
+		for _, l := range layers {
+			fmt.Printf("  %s\n", l.Name)
+		}
+		return nil
+	}
+
+	diffs, err := svc.PlanLayers(project, envName, layerNames)
+	if err != nil {
+		return err
+	}
+
+	target := "layers " + strings.Join(layerNames, ", ")
+	if layersNone {
+		target = "no layers"
+	}
+	fmt.Printf("Giving '%s' %s:\n", envName, target)
+	printVisibleChanges(diffs)
+	if layersDryRun {
+		fmt.Println("Dry run: no changes made")
+		return nil
+	}
+
+	if !layersForce {
+		fmt.Printf("Are you sure you want to give '%s' %s? [y/N] ", envName, target)
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Cancelled")
+			return nil
+		}
+	}
+
+	regrant, err := svc.SetLayers(project, envName, layerNames)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("'%s' now has %s\n", envName, target)
+	printRegrant(regrant)
+	return nil
+}
+
+// printRegrant reports who was given the keys of an environment's new sources
+func printRegrant(regrant *secrets.Regrant) {
+	if len(regrant.Members) > 0 {
+		fmt.Printf("  Granted the new keys to members: %s\n", strings.Join(regrant.Members, ", "))
+		fmt.Println("  They need to unlock again to read the new values")
+	}
+	if len(regrant.Tokens) > 0 {
+		fmt.Printf("  Granted the new keys to tokens: %s\n", strings.Join(regrant.Tokens, ", "))
+	}
+}
+
+func runEnvDetach(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	project, err := getActiveProject(s)
+	if err != nil {
+		return err
+	}
+
+	envName := args[0]
+	svc := newSecrets(v, s)
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return err
+	}
+	layers, err := svc.Layers(project, envName)
+	if err != nil {
+		return err
+	}
+	if env.ParentID == nil && len(layers) == 0 {
+		return fmt.Errorf("environment '%s' doesn't inherit from anything", envName)
+	}
+	values, err := svc.Load(project, envName, secrets.Options{})
+	if err != nil {
+		return err
+	}
+
+	var inherited []string
+	for _, key := range secrets.SortedKeys(values) {
+		if values[key].IsInherited {
+			inherited = append(inherited, key)
+		}
+	}
+
+	if detachMaterialize {
+		fmt.Printf("Detaching '%s', copying %d inherited secret(s) into it:\n", envName, len(inherited))
+		for _, key := range inherited {
+			v := values[key]
+			fmt.Printf("  + %s  %s\n", key, provenance(&v))
+		}
+	} else {
+		fmt.Printf("Detaching '%s', removing %d inherited secret(s) from it:\n", envName, len(inherited))
+		for _, key := range inherited {
+			v := values[key]
+			fmt.Printf("  - %s  %s\n", key, provenance(&v))
+		}
+	}
+	if detachDryRun {
+		fmt.Println("Dry run: no changes made")
+		return nil
+	}
+
+	if !detachForce {
+		fmt.Printf("Are you sure you want to detach '%s'? [y/N] ", envName)
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Cancelled")
+			return nil
+		}
+	}
+
+	copied, err := svc.Detach(project, envName, detachMaterialize)
+	if err != nil {
+		return err
+	}
+	if detachMaterialize {
+		fmt.Printf("Detached '%s' and copied %d inherited secret(s) into it\n", envName, len(copied))
+	} else {
+		fmt.Printf("Detached '%s'\n", envName)
+	}
+	return nil
+}
+
+// printVisibleChanges lists keys an environment would gain (+), lose (-) or
+// see a different value for (~), with where each value comes from
+func printVisibleChanges(diffs []secrets.ValueDiff) {
+	changed := 0
+	for _, d := range diffs {
+		switch d.Kind {
+		case secrets.ChangeCreated:
+			fmt.Printf("  + %s  %s\n", d.Key, provenance(d.To))
+		case secrets.ChangeRemoved:
+			fmt.Printf("  - %s  %s\n", d.Key, provenance(d.From))
+		case secrets.ChangeUpdated:
+			fmt.Printf("  ~ %s  %s, now %s\n", d.Key, provenance(d.From), provenance(d.To))
+		default:
+			continue
+		}
+		changed++
+	}
+	if changed == 0 {
+		fmt.Println("  (no visible secrets change)")
+	}
+}
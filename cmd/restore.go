@@ -23,20 +23,20 @@ Examples:
 	RunE: runRestore,
 }
 
-var (
-	restoreEnv     string
-	restoreVersion int
-)
+var restoreVersion int
 
 func init() {
 	rootCmd.AddCommand(restoreCmd)
-	restoreCmd.Flags().StringVarP(&restoreEnv, "env", "e", "", "Environment name (required)")
 	restoreCmd.Flags().IntVarP(&restoreVersion, "version", "v", 0, "Version to restore (required)")
-	restoreCmd.MarkFlagRequired("env")
 	restoreCmd.MarkFlagRequired("version")
 }
 
 func runRestore(cmd *cobra.Command, args []string) error {
+	envName, err := resolveEnvName()
+	if err != nil {
+		return err
+	}
+
 	v, s, err := getUnlockedVault()
 	if err != nil {
 		return err
@@ -49,9 +49,9 @@ func runRestore(cmd *cobra.Command, args []string) error {
 	}
 
 	// Get environment
-	env, err := s.GetEnvironmentByName(project.ID, restoreEnv)
+	env, err := s.GetEnvironmentByName(project.ID, envName)
 	if err == store.ErrNotFound {
-		return fmt.Errorf("environment '%s' not found in project '%s'", restoreEnv, project.Name)
+		return fmt.Errorf("environment '%s' not found in project '%s'", envName, project.Name)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to get environment: %w", err)
@@ -62,7 +62,7 @@ func runRestore(cmd *cobra.Command, args []string) error {
 	// Get the version to restore
 	historyEntry, err := s.GetSecretVersion(env.ID, key, restoreVersion)
 	if err == store.ErrNotFound {
-		return fmt.Errorf("version %d not found for '%s' in %s/%s", restoreVersion, key, project.Name, restoreEnv)
+		return fmt.Errorf("version %d not found for '%s' in %s/%s", restoreVersion, key, project.Name, envName)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to get version: %w", err)
@@ -91,7 +91,7 @@ func runRestore(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	fmt.Printf("Restored '%s' to version %d in %s/%s\n", key, restoreVersion, project.Name, restoreEnv)
+	fmt.Printf("Restored '%s' to version %d in %s/%s\n", key, restoreVersion, project.Name, envName)
 	return nil
 }
 
@@ -33,5 +33,7 @@ func Execute() {
 }
 
 func init() {
-	// Global flags can be added here
+	rootCmd.PersistentFlags().StringVar(&globalVault, "vault", "", "Vault to use (overrides COFFER_VAULT and 'vault use')")
+	rootCmd.PersistentFlags().StringVar(&globalProject, "project", "", "Project to use (overrides COFFER_PROJECT, .coffer.yaml and 'project use')")
+	rootCmd.PersistentFlags().StringVarP(&globalEnv, "env", "e", "", "Environment to use (overrides COFFER_ENV and .coffer.yaml)")
 }
@@ -9,9 +9,8 @@ import (
 
 	"github.com/spf13/cobra"
 
-	"github.com/russellromney/coffer/internal/crypto"
-	"github.com/russellromney/coffer/internal/resolver"
-	"github.com/russellromney/coffer/internal/store"
+	"github.com/russellromney/coffer/internal/mount"
+	"github.com/russellromney/coffer/internal/secrets"
 )
 
 var runCmd = &cobra.Command{
@@ -23,6 +22,15 @@ injected as environment variables.
 The command and its arguments should come after "--".
 Secret references (${VAR}) are resolved before injection.
 
+Inside a directory with a .coffer.yaml, --env defaults to its env, only
+keys passing its keys filter are injected or mounted, and its files are
+written (mode 0600) before the command starts and removed when it exits.
+File paths must stay inside the .coffer.yaml's directory, and must not
+exist yet: existing files are never overwritten.
+
+Use --at to run with the secrets as they were at an RFC3339 timestamp or a
+duration ago, e.g. to reproduce yesterday's deploy.
+
 Examples:
   coffer run --env prod -- npm start
   coffer run --env dev -- ./my-app --port 8080
@@ -31,12 +39,11 @@ Examples:
 	DisableFlagParsing: false,
 }
 
-var runEnv string
+var runAt string
 
 func init() {
 	rootCmd.AddCommand(runCmd)
-	runCmd.Flags().StringVarP(&runEnv, "env", "e", "", "Environment name (required)")
-	runCmd.MarkFlagRequired("env")
+	runCmd.Flags().StringVar(&runAt, "at", "", "Use secrets as of an RFC3339 timestamp or duration ago (e.g. 2h)")
 }
 
 func runRun(cmd *cobra.Command, args []string) error {
@@ -46,59 +53,52 @@ func runRun(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("no command specified: use 'coffer run --env <env> -- <command>'")
 	}
 
-	v, s, err := getUnlockedVault()
+	envName, err := resolveEnvName()
 	if err != nil {
 		return err
 	}
-	defer v.Close()
-
-	project, err := getActiveProject(s)
+	at, err := parseAtFlag(runAt)
 	if err != nil {
 		return err
 	}
 
-	// Get environment
-	env, err := s.GetEnvironmentByName(project.ID, runEnv)
-	if err == store.ErrNotFound {
-		return fmt.Errorf("environment '%s' not found in project '%s'", runEnv, project.Name)
-	}
+	v, s, err := getUnlockedVault()
 	if err != nil {
-		return fmt.Errorf("failed to get environment: %w", err)
+		return err
 	}
+	defer v.Close()
 
-	// Get encryption key
-	encKey, err := v.GetKey()
+	project, err := getActiveProject(s)
 	if err != nil {
-		return fmt.Errorf("failed to get encryption key: %w", err)
+		return err
 	}
 
-	// Load and decrypt all secrets (with inheritance)
-	secrets, err := s.ListSecretsWithInheritance(env.ID)
+	// Load, decrypt and resolve all secrets (with inheritance)
+	values, err := newSecrets(v, s).Load(project, envName, secrets.Options{Resolve: true, At: secrets.AtTime(at)})
 	if err != nil {
-		return fmt.Errorf("failed to list secrets: %w", err)
-	}
-
-	decryptedSecrets := make(map[string]string)
-	for _, secret := range secrets {
-		value, err := crypto.Decrypt(encKey, secret.EncryptedValue, secret.Nonce, []byte(secret.Key))
-		if err != nil {
-			return fmt.Errorf("failed to decrypt secret '%s': %w", secret.Key, err)
-		}
-		decryptedSecrets[secret.Key] = string(value)
+		return err
 	}
-
-	// Resolve references
-	resolvedSecrets, err := resolver.Resolve(decryptedSecrets)
+	injected, err := filterSecrets(values)
 	if err != nil {
-		return fmt.Errorf("failed to resolve secret references: %w", err)
+		return err
 	}
 
 	// Build environment
 	environ := os.Environ()
-	for key, value := range resolvedSecrets {
+	for key, value := range secrets.ToMap(injected) {
 		environ = append(environ, fmt.Sprintf("%s=%s", key, value))
 	}
 
+	pf, err := loadProjectFile()
+	if err != nil {
+		return err
+	}
+	mounts, err := mount.Write(pf, secrets.ToMap(injected))
+	if err != nil {
+		return err
+	}
+	defer mounts.Remove()
+
 	// Execute command
 	execCmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
 	execCmd.Env = environ
@@ -132,6 +132,7 @@ func runRun(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		// If the command exited with an error, propagate the exit code
 		if exitErr, ok := err.(*exec.ExitError); ok {
+			mounts.Remove()
 			os.Exit(exitErr.ExitCode())
 		}
 		return fmt.Errorf("command failed: %w", err)
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/russellromney/coffer/internal/server"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve a local HTTP/JSON API",
+	Long: `Serve a REST API over a unix socket or loopback TCP address, so
+tools written in other languages can read and write secrets without
+parsing CLI output.
+
+Requests authenticate with an API token from 'coffer token create'
+sent as "Authorization: Bearer <token>". The vault must be unlocked
+when the server starts; the key is held in memory until it exits.
+
+Endpoints:
+  GET    /v1/projects
+  GET    /v1/projects/{project}/environments
+  GET    /v1/projects/{project}/environments/{env}/secrets[?resolve=true]
+  GET    /v1/projects/{project}/environments/{env}/secrets/{key}[?resolve=true]
+  PUT    /v1/projects/{project}/environments/{env}/secrets/{key}   {"value": "..."}
+  DELETE /v1/projects/{project}/environments/{env}/secrets/{key}
+  GET    /v1/projects/{project}/environments/{env}/secrets/{key}/history[?limit=10&values=true]
+  GET    /v1/audit[?limit=50]
+
+Examples:
+  coffer serve                                  # unix socket in ~/.coffer
+  coffer serve --listen unix:///run/coffer.sock
+  coffer serve --listen 127.0.0.1:7410`,
+	RunE: runServe,
+}
+
+var serveListen string
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().StringVarP(&serveListen, "listen", "l", "", "Listen address: unix:///path or loopback host:port (default unix socket in the data directory)")
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	key, err := v.GetKey()
+	if err != nil {
+		return fmt.Errorf("failed to get encryption key: %w", err)
+	}
+
+	listen := serveListen
+	if listen == "" {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		listen = "unix://" + filepath.Join(cfg.DataDir, "coffer.sock")
+	}
+
+	l, err := server.Listen(listen)
+	if err != nil {
+		return err
+	}
+
+	httpServer := &http.Server{
+		Handler:           server.New(s, key).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Shut down cleanly on interrupt
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(ctx)
+	}()
+
+	fmt.Printf("Serving coffer API on %s\n", listen)
+	if err := httpServer.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("server failed: %w", err)
+	}
+	return nil
+}
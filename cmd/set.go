@@ -9,8 +9,7 @@ import (
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
 
-	"github.com/russellromney/coffer/internal/crypto"
-	"github.com/russellromney/coffer/internal/store"
+	"github.com/russellromney/coffer/internal/secrets"
 )
 
 var setCmd = &cobra.Command{
@@ -29,44 +28,35 @@ Examples:
 	RunE: runSet,
 }
 
-var (
-	setEnv   string
-	setStdin bool
-)
+var setStdin bool
 
 func init() {
 	rootCmd.AddCommand(setCmd)
-	setCmd.Flags().StringVarP(&setEnv, "env", "e", "", "Environment name (required)")
 	setCmd.Flags().BoolVar(&setStdin, "stdin", false, "Read value from stdin")
-	setCmd.MarkFlagRequired("env")
 }
 
 func runSet(cmd *cobra.Command, args []string) error {
-	v, s, err := getUnlockedVault()
+	envName, err := resolveEnvName()
 	if err != nil {
 		return err
 	}
-	defer v.Close()
 
-	project, err := getActiveProject(s)
+	v, s, err := getUnlockedVault()
 	if err != nil {
 		return err
 	}
+	defer v.Close()
 
-	// Get environment
-	env, err := s.GetEnvironmentByName(project.ID, setEnv)
-	if err == store.ErrNotFound {
-		return fmt.Errorf("environment '%s' not found in project '%s'", setEnv, project.Name)
-	}
+	project, err := getActiveProject(s)
 	if err != nil {
-		return fmt.Errorf("failed to get environment: %w", err)
+		return err
 	}
 
 	key := args[0]
 
 	// Validate key name
-	if !isValidKeyName(key) {
-		return fmt.Errorf("invalid key name: must contain only uppercase letters, numbers, and underscores")
+	if !secrets.IsValidKeyName(key) {
+		return secrets.ErrInvalidKeyName
 	}
 
 	// Get value
@@ -92,56 +82,16 @@ func runSet(cmd *cobra.Command, args []string) error {
 		value = string(valueBytes)
 	}
 
-	// Get encryption key
-	encKey, err := v.GetKey()
-	if err != nil {
-		return fmt.Errorf("failed to get encryption key: %w", err)
-	}
-
-	// Encrypt value with key name as AAD
-	encryptedValue, nonce, err := crypto.Encrypt(encKey, []byte(value), []byte(key))
+	// Encrypt and store
+	created, err := newSecrets(v, s).Set(project, envName, key, value)
 	if err != nil {
-		return fmt.Errorf("failed to encrypt value: %w", err)
+		return err
 	}
-
-	// Check if secret exists
-	_, err = s.GetSecret(env.ID, key)
-	if err == store.ErrNotFound {
-		// Create new secret
-		_, err = s.CreateSecret(env.ID, key, encryptedValue, nonce)
-		if err != nil {
-			return fmt.Errorf("failed to create secret: %w", err)
-		}
-		fmt.Printf("Created %s in %s/%s\n", key, project.Name, setEnv)
-	} else if err != nil {
-		return fmt.Errorf("failed to check secret: %w", err)
+	if created {
+		fmt.Printf("Created %s in %s/%s\n", key, project.Name, envName)
 	} else {
-		// Update existing secret
-		_, err = s.UpdateSecret(env.ID, key, encryptedValue, nonce)
-		if err != nil {
-			return fmt.Errorf("failed to update secret: %w", err)
-		}
-		fmt.Printf("Updated %s in %s/%s\n", key, project.Name, setEnv)
+		fmt.Printf("Updated %s in %s/%s\n", key, project.Name, envName)
 	}
 
 	return nil
 }
-
-func isValidKeyName(key string) bool {
-	if len(key) == 0 {
-		return false
-	}
-	for i, c := range key {
-		if c >= 'A' && c <= 'Z' {
-			continue
-		}
-		if c >= '0' && c <= '9' && i > 0 {
-			continue
-		}
-		if c == '_' {
-			continue
-		}
-		return false
-	}
-	return true
-}
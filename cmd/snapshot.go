@@ -0,0 +1,304 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/secrets"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+var envSnapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage environment snapshots",
+	Long: `Record named points in an environment's history to diff against or roll
+back to.
+
+Snapshots are numbered v1, v2, ... per environment. They don't copy
+secrets: contents are reconstructed from secret history, so they survive
+key rotation and take no space.
+
+Examples:
+  coffer env snapshot create prod --message "before migration"
+  coffer env snapshot list prod
+  coffer env snapshot diff prod v1
+  coffer env snapshot diff prod v1 v2`,
+}
+
+var envSnapshotCreateCmd = &cobra.Command{
+	Use:   "create <env>",
+	Short: "Snapshot an environment",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runEnvSnapshotCreate,
+}
+
+var envSnapshotListCmd = &cobra.Command{
+	Use:   "list <env>",
+	Short: "List an environment's snapshots",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runEnvSnapshotList,
+}
+
+var envSnapshotDiffCmd = &cobra.Command{
+	Use:   "diff <env> <from> [to]",
+	Short: "Show keys changed between two points in time",
+	Long: `Show the keys defined in an environment that changed between two points
+in time. Each point is a snapshot (v3), an RFC3339 timestamp, or a
+duration ago (2h, 3d). Without <to>, compares against the current state.
+
+Examples:
+  coffer env snapshot diff prod v1
+  coffer env snapshot diff prod v1 v2
+  coffer env snapshot diff prod 24h`,
+	Args: cobra.RangeArgs(2, 3),
+	RunE: runEnvSnapshotDiff,
+}
+
+var envRollbackCmd = &cobra.Command{
+	Use:   "rollback <env> --to <snapshot|timestamp>",
+	Short: "Restore an environment to an earlier state",
+	Long: `Restore every secret defined in an environment to its state at a snapshot
+(v3), an RFC3339 timestamp, or a duration ago (2h, 3d).
+
+Changed keys are reverted, deleted keys re-created and keys added since
+then removed, in a single transaction. Each change is recorded in secret
+history, and a snapshot of the state before the rollback is taken, so a
+rollback can itself be rolled back. Inherited secrets are not touched.
+
+Examples:
+  coffer env rollback prod --to v3
+  coffer env rollback prod --to 2026-01-02T15:04:05Z --dry-run
+  coffer env rollback prod --to 2h --force`,
+	Args: cobra.ExactArgs(1),
+	RunE: runEnvRollback,
+}
+
+var (
+	snapshotMessage string
+	rollbackTo      string
+	rollbackDryRun  bool
+	rollbackForce   bool
+)
+
+func init() {
+	envCmd.AddCommand(envSnapshotCmd)
+	envCmd.AddCommand(envRollbackCmd)
+	envSnapshotCmd.AddCommand(envSnapshotCreateCmd)
+	envSnapshotCmd.AddCommand(envSnapshotListCmd)
+	envSnapshotCmd.AddCommand(envSnapshotDiffCmd)
+
+	envSnapshotCreateCmd.Flags().StringVarP(&snapshotMessage, "message", "m", "", "Describe the snapshot")
+	envRollbackCmd.Flags().StringVar(&rollbackTo, "to", "", "Snapshot (v3), RFC3339 timestamp or duration ago (2h) (required)")
+	envRollbackCmd.Flags().BoolVar(&rollbackDryRun, "dry-run", false, "Show what would change without writing anything")
+	envRollbackCmd.Flags().BoolVarP(&rollbackForce, "force", "f", false, "Skip confirmation")
+	envRollbackCmd.MarkFlagRequired("to")
+}
+
+// parsePointInTime parses an RFC3339 timestamp or a duration ago ("2h", "3d")
+func parsePointInTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := parseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: use an RFC3339 timestamp or a duration like 2h or 3d", s)
+	}
+	return time.Now().Add(-d), nil
+}
+
+// parseAtFlag parses an --at flag; empty means the current state (the zero
+// time)
+func parseAtFlag(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return parsePointInTime(s)
+}
+
+// resolvePointInTime resolves a snapshot (v3), timestamp or duration to a
+// point in history and a label describing it
+func resolvePointInTime(svc *secrets.Service, project *models.Project, envName, ref string) (secrets.Point, string, error) {
+	if version, ok := secrets.ParseSnapshotVersion(ref); ok {
+		snap, err := svc.Snapshot(project, envName, version)
+		if err != nil {
+			return secrets.Point{}, "", err
+		}
+		return secrets.AtSnapshot(snap), fmt.Sprintf("v%d", snap.Version), nil
+	}
+	t, err := parsePointInTime(ref)
+	if err != nil {
+		return secrets.Point{}, "", err
+	}
+	return secrets.AtTime(t), t.Local().Format("2006-01-02 15:04:05"), nil
+}
+
+func runEnvSnapshotCreate(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	project, env, err := resolveEnvRef(s, args[0])
+	if err != nil {
+		return err
+	}
+
+	snap, err := newSecrets(v, s).CreateSnapshot(project, env.Name, snapshotMessage)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created snapshot v%d of %s/%s\n", snap.Version, project.Name, env.Name)
+	return nil
+}
+
+func runEnvSnapshotList(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	project, env, err := resolveEnvRef(s, args[0])
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := newSecrets(v, s).Snapshots(project, env.Name)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		fmt.Printf("No snapshots of %s/%s. Create one with 'coffer env snapshot create %s'\n", project.Name, env.Name, args[0])
+		return nil
+	}
+
+	fmt.Printf("Snapshots of %s/%s:\n", project.Name, env.Name)
+	for _, snap := range snapshots {
+		line := fmt.Sprintf("  v%-3d %s", snap.Version, snap.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+		if snap.Message != "" {
+			line += "  " + snap.Message
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func runEnvSnapshotDiff(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	project, env, err := resolveEnvRef(s, args[0])
+	if err != nil {
+		return err
+	}
+	svc := newSecrets(v, s)
+
+	fromPoint, fromLabel, err := resolvePointInTime(svc, project, env.Name, args[1])
+	if err != nil {
+		return err
+	}
+	toPoint, toLabel := secrets.AtTime(time.Now()), "current"
+	if len(args) == 3 {
+		toPoint, toLabel, err = resolvePointInTime(svc, project, env.Name, args[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	from, err := svc.ValuesAt(project, env.Name, fromPoint)
+	if err != nil {
+		return err
+	}
+	to, err := svc.ValuesAt(project, env.Name, toPoint)
+	if err != nil {
+		return err
+	}
+
+	changes := secrets.Diff(from, to)
+	if len(changes) == 0 {
+		fmt.Printf("No changes in %s/%s from %s to %s\n", project.Name, env.Name, fromLabel, toLabel)
+		return nil
+	}
+	fmt.Printf("Changes in %s/%s from %s to %s:\n", project.Name, env.Name, fromLabel, toLabel)
+	printChanges(changes)
+	return nil
+}
+
+func runEnvRollback(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	project, env, err := resolveEnvRef(s, args[0])
+	if err != nil {
+		return err
+	}
+	svc := newSecrets(v, s)
+
+	at, label, err := resolvePointInTime(svc, project, env.Name, rollbackTo)
+	if err != nil {
+		return err
+	}
+	plan, err := svc.PlanRollback(project, env.Name, at)
+	if err != nil {
+		return err
+	}
+
+	if len(plan.Changes) == plan.Count(secrets.ChangeUnchanged) {
+		fmt.Printf("%s/%s already matches %s\n", project.Name, env.Name, label)
+		return nil
+	}
+
+	fmt.Printf("Rolling back %s/%s to %s:\n", project.Name, env.Name, label)
+	printChanges(plan.Changes)
+	if rollbackDryRun {
+		fmt.Println("Dry run: no changes made")
+		return nil
+	}
+
+	if !rollbackForce {
+		fmt.Printf("Are you sure you want to roll back %s/%s? [y/N] ", project.Name, env.Name)
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Cancelled")
+			return nil
+		}
+	}
+
+	snap, err := svc.ApplyRollback(plan, "before rollback to "+label)
+	if errors.Is(err, store.ErrSecretsChanged) {
+		return fmt.Errorf("%s/%s changed while the rollback was being confirmed: run it again to see the current changes", project.Name, env.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rolled back %s/%s to %s: %s (previous state saved as v%d)\n", project.Name, env.Name, label, summarizeImportPlan(plan), snap.Version)
+	return nil
+}
+
+// printChanges lists created (+), updated (~) and removed (-) keys, skipping
+// unchanged ones
+func printChanges(changes []secrets.ImportChange) {
+	for _, c := range changes {
+		switch c.Kind {
+		case secrets.ChangeCreated:
+			fmt.Printf("  + %s\n", c.Key)
+		case secrets.ChangeUpdated:
+			fmt.Printf("  ~ %s\n", c.Key)
+		case secrets.ChangeRemoved:
+			fmt.Printf("  - %s\n", c.Key)
+		}
+	}
+}
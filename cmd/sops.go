@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+
+	"github.com/russellromney/coffer/internal/agefile"
+	"github.com/russellromney/coffer/internal/sops"
+)
+
+// sopsFormats maps export formats to SOPS file formats
+var sopsFormats = map[string]sops.Format{
+	"sops":        sops.FormatYAML,
+	"sops-json":   sops.FormatJSON,
+	"sops-dotenv": sops.FormatDotenv,
+}
+
+// sopsIdentities loads age identities for SOPS files. Without --identity it
+// falls back to the locations sops itself uses: SOPS_AGE_KEY_FILE,
+// SOPS_AGE_KEY, then the user config directory's sops/age/keys.txt.
+func sopsIdentities(identityFiles []string) ([]age.Identity, error) {
+	if len(identityFiles) > 0 {
+		return agefile.LoadIdentities(identityFiles)
+	}
+
+	if path := os.Getenv("SOPS_AGE_KEY_FILE"); path != "" {
+		return agefile.LoadIdentities([]string{path})
+	}
+	if key := os.Getenv("SOPS_AGE_KEY"); key != "" {
+		ids, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SOPS_AGE_KEY: %w", err)
+		}
+		return ids, nil
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		path := filepath.Join(dir, "sops", "age", "keys.txt")
+		if _, err := os.Stat(path); err == nil {
+			return agefile.LoadIdentities([]string{path})
+		}
+	}
+
+	return nil, fmt.Errorf("file is SOPS-encrypted: pass --identity or set SOPS_AGE_KEY_FILE")
+}
+
+// decryptSOPS decrypts a SOPS file into secrets
+func decryptSOPS(data []byte, identityFiles []string) (map[string]string, error) {
+	identities, err := sopsIdentities(identityFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, _, err := sops.Decrypt(data, identities)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(entries))
+	for _, e := range entries {
+		result[e.Key] = e.Value
+	}
+	return result, nil
+}
+
+// encryptSOPS renders secrets as a SOPS file. With a template file, its
+// recipients and settings are reused and its key order is kept; new keys are
+// appended in sorted order.
+func encryptSOPS(values map[string]string, format sops.Format, recipients []string, templatePath string) ([]byte, error) {
+	suffix := sops.DefaultUnencryptedSuffix
+	var order []string
+
+	if templatePath != "" {
+		data, err := os.ReadFile(templatePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SOPS file: %w", err)
+		}
+		meta, err := sops.ReadMetadata(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", templatePath, err)
+		}
+		recipients = appendUnique(meta.Recipients, recipients...)
+		suffix = meta.UnencryptedSuffix
+		order = meta.Keys
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("SOPS export needs age recipients: use --encrypt-to or --sops-file")
+	}
+
+	entries := make([]sops.Entry, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, key := range order {
+		if value, ok := values[key]; ok && !seen[key] {
+			entries = append(entries, sops.Entry{Key: key, Value: value})
+			seen[key] = true
+		}
+	}
+
+	rest := make([]string, 0, len(values))
+	for key := range values {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	for _, key := range rest {
+		entries = append(entries, sops.Entry{Key: key, Value: values[key]})
+	}
+
+	return sops.Encrypt(entries, format, recipients, suffix)
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			if existing == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
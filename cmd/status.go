@@ -5,7 +5,6 @@ import (
 
 	"github.com/spf13/cobra"
 
-	"github.com/russellromney/coffer/internal/config"
 	"github.com/russellromney/coffer/internal/models"
 	"github.com/russellromney/coffer/internal/vault"
 )
@@ -26,7 +25,7 @@ func init() {
 }
 
 func runStatus(cmd *cobra.Command, args []string) error {
-	cfg, err := config.New()
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
@@ -34,6 +33,9 @@ func runStatus(cmd *cobra.Command, args []string) error {
 	v := vault.New(cfg)
 	defer v.Close()
 
+	if cfg.Name != "" {
+		fmt.Printf("Vault: %s\n", cfg.Name)
+	}
 	fmt.Printf("Vault location: %s\n", cfg.DataDir)
 
 	if !v.IsInitialized() {
@@ -58,7 +60,11 @@ func runStatus(cmd *cobra.Command, args []string) error {
 	}
 
 	if v.IsUnlocked() {
-		fmt.Println("Lock state: Unlocked")
+		if member := v.MemberName(); member != "" {
+			fmt.Printf("Lock state: Unlocked (member %s)\n", member)
+		} else {
+			fmt.Println("Lock state: Unlocked")
+		}
 	} else {
 		fmt.Println("Lock state: Locked")
 		return nil
@@ -70,8 +76,13 @@ func runStatus(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	activeProjectID, err := store.GetConfig(models.ConfigActiveProject)
-	if err == nil && activeProjectID != "" {
+	name, source, err := projectOverride()
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		fmt.Printf("Active project: %s (from %s)\n", name, source)
+	} else if activeProjectID, err := store.GetConfig(models.ConfigActiveProject); err == nil && activeProjectID != "" {
 		project, err := store.GetProject(activeProjectID)
 		if err == nil {
 			fmt.Printf("Active project: %s\n", project.Name)
@@ -80,5 +91,9 @@ func runStatus(cmd *cobra.Command, args []string) error {
 		fmt.Println("Active project: None (use 'coffer project use <name>')")
 	}
 
+	if env, err := defaultEnv(); err == nil && env != "" {
+		fmt.Printf("Default environment: %s\n", env)
+	}
+
 	return nil
 }
@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+// TokenEnvVar holds a service token used to unlock the vault without a session
+const TokenEnvVar = "COFFER_TOKEN"
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage service and API tokens",
+	Long: `Manage tokens for CI, machines and 'coffer serve'.
+
+Tokens can be scoped to a project, an environment within it, and
+read-only access, and can expire. Set COFFER_TOKEN to use a token
+instead of a session: the vault is unlocked for that process only,
+and commands are limited to the token's scope.
+
+Only a hash of each token is stored in the vault. Each token has its
+own keypair, and only the data keys of the environments in its scope
+are sealed to it; a token never carries the vault key. The token is
+shown once when it is created.
+
+Examples:
+  coffer token create dashboard
+  coffer token create ci --project myapp --env ci --read-only --ttl 30d
+  COFFER_TOKEN=coffer_... coffer run -- ./deploy.sh
+  coffer token list
+  coffer token revoke ci`,
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create [name]",
+	Short: "Create an API token",
+	Long: `Create a new token and print it.
+
+Without --project the token can access every project. With --env
+it is further limited to a single environment of that project.
+Use --ttl to make the token expire (e.g. 12h, 30d).
+
+Example:
+  coffer token create dashboard
+  coffer token create ci --project myapp --env ci --read-only --ttl 30d`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runTokenCreate,
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List API tokens",
+	Long: `List all API tokens and their scopes.
+
+Example:
+  coffer token list`,
+	RunE: runTokenList,
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke <name>",
+	Short: "Revoke an API token",
+	Long: `Revoke an API token so it can no longer be used.
+
+Example:
+  coffer token revoke ci`,
+	Args: cobra.ExactArgs(1),
+	RunE: runTokenRevoke,
+}
+
+var (
+	tokenProject  string
+	tokenEnv      string
+	tokenReadOnly bool
+	tokenTTL      string
+)
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+	tokenCmd.AddCommand(tokenCreateCmd)
+	tokenCmd.AddCommand(tokenListCmd)
+	tokenCmd.AddCommand(tokenRevokeCmd)
+
+	tokenCreateCmd.Flags().StringVar(&tokenProject, "project", "", "Limit the token to a project")
+	tokenCreateCmd.Flags().StringVarP(&tokenEnv, "env", "e", "", "Limit the token to an environment (requires --project)")
+	tokenCreateCmd.Flags().BoolVar(&tokenReadOnly, "read-only", false, "Only allow reading secrets")
+	tokenCreateCmd.Flags().StringVar(&tokenTTL, "ttl", "", "Expire the token after this long (e.g. 12h, 30d)")
+}
+
+func runTokenCreate(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	name := "token-" + uuid.New().String()[:8]
+	if len(args) == 1 {
+		name = args[0]
+	}
+
+	token := &models.APIToken{Name: name, ReadOnly: tokenReadOnly}
+
+	if tokenEnv != "" && tokenProject == "" {
+		return fmt.Errorf("--env requires --project")
+	}
+	if tokenProject != "" {
+		project, err := s.GetProjectByName(tokenProject)
+		if err == store.ErrNotFound {
+			return fmt.Errorf("project '%s' not found", tokenProject)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get project: %w", err)
+		}
+		token.ProjectID = project.ID
+
+		if tokenEnv != "" {
+			env, err := s.GetEnvironmentByName(project.ID, tokenEnv)
+			if err == store.ErrNotFound {
+				return fmt.Errorf("environment '%s' not found in project '%s'", tokenEnv, project.Name)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to get environment: %w", err)
+			}
+			token.EnvironmentID = env.ID
+		}
+	}
+
+	if tokenTTL != "" {
+		ttl, err := parseDuration(tokenTTL)
+		if err != nil {
+			return fmt.Errorf("invalid --ttl: %w", err)
+		}
+		expiresAt := time.Now().Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+
+	// The token only gets the data keys of the environments in its scope
+	envKeys, err := newSecrets(v, s).TokenKeys(token)
+	if err != nil {
+		return err
+	}
+
+	raw, err := v.CreateToken(token, envKeys)
+	if err != nil {
+		return fmt.Errorf("failed to create token: %w", err)
+	}
+
+	fmt.Printf("Created token '%s' (%s)\n", name, describeTokenScope(s, token))
+	fmt.Println("Store it now - it won't be shown again:")
+	fmt.Println()
+	fmt.Println(raw)
+	return nil
+}
+
+func runTokenList(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	tokens, err := s.ListAPITokens()
+	if err != nil {
+		return fmt.Errorf("failed to list tokens: %w", err)
+	}
+
+	if len(tokens) == 0 {
+		fmt.Println("No tokens. Create one with 'coffer token create <name>'")
+		return nil
+	}
+
+	fmt.Println("Tokens:")
+	for _, t := range tokens {
+		lastUsed := "never used"
+		if t.LastUsedAt != nil {
+			lastUsed = "last used " + t.LastUsedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("  %s (%s) - %s\n", t.Name, describeTokenScope(s, &t), lastUsed)
+	}
+	return nil
+}
+
+func runTokenRevoke(cmd *cobra.Command, args []string) error {
+	v, s, err := getUnlockedVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	name := args[0]
+
+	tokens, err := s.ListAPITokens()
+	if err != nil {
+		return fmt.Errorf("failed to list tokens: %w", err)
+	}
+	for _, t := range tokens {
+		if t.Name == name || t.ID == name {
+			if err := s.DeleteAPIToken(t.ID); err != nil {
+				return fmt.Errorf("failed to revoke token: %w", err)
+			}
+			fmt.Printf("Revoked token '%s'\n", t.Name)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("token '%s' not found", name)
+}
+
+// describeTokenScope renders a token's scope for display, e.g. "myapp/ci, read-only"
+func describeTokenScope(s store.Store, t *models.APIToken) string {
+	scope := "all projects"
+	if t.ProjectID != "" {
+		scope = t.ProjectID
+		if p, err := s.GetProject(t.ProjectID); err == nil {
+			scope = p.Name
+		}
+		if t.EnvironmentID != "" {
+			envName := t.EnvironmentID
+			if e, err := s.GetEnvironment(t.EnvironmentID); err == nil {
+				envName = e.Name
+			}
+			scope += "/" + envName
+		}
+	}
+
+	if t.ReadOnly {
+		scope += ", read-only"
+	} else {
+		scope += ", read-write"
+	}
+	if t.ExpiresAt != nil {
+		scope += ", expires " + t.ExpiresAt.Format(time.RFC3339)
+	}
+	return scope
+}
+
+// parseDuration parses a Go duration, also accepting a whole number of days ("30d")
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -7,7 +7,7 @@ import (
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
 
-	"github.com/russellromney/coffer/internal/config"
+	"github.com/russellromney/coffer/internal/crypto"
 	"github.com/russellromney/coffer/internal/vault"
 )
 
@@ -19,29 +19,35 @@ var unlockCmd = &cobra.Command{
 If keychain is enabled, the vault will be unlocked automatically
 without prompting for a password. Use --password to force password entry.
 
+Members unlock with their identity file instead (see 'coffer member').
+A member session can only read the environments granted to them.
+
 This creates a session that allows you to access secrets without
 re-entering your password. The session expires after 8 hours.
 
 Examples:
   coffer unlock                       # Uses keychain if enabled, otherwise prompts
   coffer unlock --prompt              # Always prompt for password
-  coffer unlock --password secret123  # Non-interactive`,
+  coffer unlock --password secret123  # Non-interactive
+  coffer unlock --identity ~/.coffer/identity`,
 	RunE: runUnlock,
 }
 
 var (
 	unlockPrompt         bool
 	unlockPasswordValue  string
+	unlockIdentity       string
 )
 
 func init() {
 	rootCmd.AddCommand(unlockCmd)
 	unlockCmd.Flags().BoolVar(&unlockPrompt, "prompt", false, "Force password prompt (ignore keychain)")
 	unlockCmd.Flags().StringVarP(&unlockPasswordValue, "password", "p", "", "Master password (non-interactive mode)")
+	unlockCmd.Flags().StringVarP(&unlockIdentity, "identity", "i", "", "Unlock as a member with this identity file")
 }
 
 func runUnlock(cmd *cobra.Command, args []string) error {
-	cfg, err := config.New()
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
@@ -60,6 +66,24 @@ func runUnlock(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	// Members unlock with their private key
+	if unlockIdentity != "" {
+		data, err := os.ReadFile(unlockIdentity)
+		if err != nil {
+			return fmt.Errorf("failed to read identity file: %w", err)
+		}
+		privateKey, err := crypto.ParseIdentity(data)
+		if err != nil {
+			return err
+		}
+		member, err := v.UnlockWithIdentity(privateKey)
+		if err != nil {
+			return fmt.Errorf("failed to unlock vault: %w", err)
+		}
+		fmt.Printf("Vault unlocked as member '%s'\n", member.Name)
+		return nil
+	}
+
 	// If password provided via flag, use it directly
 	if unlockPasswordValue != "" {
 		if err := v.Unlock(unlockPasswordValue); err != nil {
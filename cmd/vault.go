@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/russellromney/coffer/internal/config"
+	"github.com/russellromney/coffer/internal/vault"
+)
+
+var vaultCmd = &cobra.Command{
+	Use:   "vault",
+	Short: "Manage vaults",
+	Long: `Manage multiple vaults, e.g. a personal vault and a team vault.
+
+The default vault lives in ~/.coffer (or $COFFER_HOME). Named vaults live in
+~/.coffer/vaults/<name>, each with its own master password, session and
+keychain entry, so unlocking one doesn't unlock the others.
+
+The vault a command uses is chosen by --vault, then $COFFER_VAULT, then
+'coffer vault use'.
+
+Examples:
+  coffer vault create team
+  coffer vault use team
+  coffer --vault personal list --env dev`,
+}
+
+var vaultCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create a named vault",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runVaultCreate,
+}
+
+var vaultListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List vaults",
+	RunE:  runVaultList,
+}
+
+var vaultUseCmd = &cobra.Command{
+	Use:   "use <name>",
+	Short: "Set the current vault",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runVaultUse,
+}
+
+var (
+	vaultPassword string
+	vaultUse      bool
+)
+
+func init() {
+	rootCmd.AddCommand(vaultCmd)
+	vaultCmd.AddCommand(vaultCreateCmd)
+	vaultCmd.AddCommand(vaultListCmd)
+	vaultCmd.AddCommand(vaultUseCmd)
+
+	vaultCreateCmd.Flags().StringVarP(&vaultPassword, "password", "p", "", "Master password (non-interactive mode)")
+	vaultCreateCmd.Flags().BoolVar(&vaultUse, "use", false, "Make the new vault current")
+}
+
+// currentVaultName returns the name of the vault commands use
+func currentVaultName() (string, error) {
+	if globalVault != "" {
+		return globalVault, nil
+	}
+	return config.CurrentVault()
+}
+
+func runVaultCreate(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	cfg, err := config.NewForVault(name)
+	if err != nil {
+		return err
+	}
+
+	v := vault.New(cfg)
+	defer v.Close()
+
+	if v.IsInitialized() {
+		return fmt.Errorf("vault '%s' already exists at %s", name, cfg.DataDir)
+	}
+
+	password, err := readNewPassword(vaultPassword)
+	if err != nil {
+		return err
+	}
+	if err := v.Initialize(password); err != nil {
+		return fmt.Errorf("failed to initialize vault: %w", err)
+	}
+	fmt.Printf("Created vault '%s' at %s\n", name, cfg.DataDir)
+
+	if vaultUse {
+		if err := config.SetCurrentVault(name); err != nil {
+			return err
+		}
+		fmt.Printf("Now using vault '%s'\n", name)
+	}
+	return nil
+}
+
+func runVaultList(cmd *cobra.Command, args []string) error {
+	names, err := config.ListVaults()
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		fmt.Println("No vaults. Create one with 'coffer init' or 'coffer vault create <name>'.")
+		return nil
+	}
+
+	current, err := currentVaultName()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Vaults:")
+	for _, name := range names {
+		cfg, err := config.NewForVault(name)
+		if err != nil {
+			return err
+		}
+		marker := "  "
+		if name == current {
+			marker = "* "
+		}
+		v := vault.New(cfg)
+		state := "locked"
+		if v.IsUnlocked() {
+			state = "unlocked"
+		}
+		v.Close()
+		fmt.Printf("%s%s (%s) %s\n", marker, name, state, cfg.DataDir)
+	}
+	return nil
+}
+
+func runVaultUse(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	cfg, err := config.NewForVault(name)
+	if err != nil {
+		return err
+	}
+	if !cfg.Exists() {
+		return fmt.Errorf("vault '%s' not found: create it with 'coffer vault create %s'", name, name)
+	}
+
+	if err := config.SetCurrentVault(name); err != nil {
+		return err
+	}
+	fmt.Printf("Now using vault '%s'\n", name)
+	if env := os.Getenv(config.VaultEnvVar); env != "" && env != name {
+		fmt.Printf("Note: %s=%s overrides this in the current shell\n", config.VaultEnvVar, env)
+	}
+	return nil
+}
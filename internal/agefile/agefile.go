@@ -0,0 +1,163 @@
+// Package agefile encrypts and decrypts whole files with age, to recipients
+// or a passphrase, in the binary or ASCII-armored encoding.
+package agefile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// header starts every binary age file
+const header = "age-encryption.org/v1\n"
+
+var (
+	// ErrPassphraseRequired is returned when a file was encrypted with a
+	// passphrase and no way to get one was given
+	ErrPassphraseRequired = errors.New("file is encrypted with a passphrase")
+	// ErrIdentityRequired is returned when a file was encrypted to
+	// recipients and no identities were given
+	ErrIdentityRequired = errors.New("file is age-encrypted and no identity was given")
+	// ErrIncorrectPassphrase is returned when the passphrase doesn't decrypt the file
+	ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+	// ErrNoIdentityMatch is returned when none of the identities decrypt the file
+	ErrNoIdentityMatch = errors.New("none of the identities can decrypt this file")
+)
+
+// PassphraseFunc returns the passphrase for a file encrypted with one. It's
+// only called for such files.
+type PassphraseFunc func() (string, error)
+
+// IsEncrypted reports whether data is an age file, binary or armored
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(header)) || isArmored(data)
+}
+
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header))
+}
+
+// Encrypt writes data to w encrypted to the given age recipients, or to a
+// passphrase if one is given. age doesn't allow mixing the two.
+func Encrypt(w io.Writer, data []byte, recipients []string, passphrase string, armored bool) error {
+	var rcpts []age.Recipient
+	if passphrase != "" {
+		if len(recipients) > 0 {
+			return fmt.Errorf("a passphrase can't be combined with recipients")
+		}
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return err
+		}
+		rcpts = append(rcpts, r)
+	}
+	for _, s := range recipients {
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return fmt.Errorf("invalid recipient %q: %w", s, err)
+		}
+		rcpts = append(rcpts, r)
+	}
+	if len(rcpts) == 0 {
+		return fmt.Errorf("no recipients or passphrase to encrypt to")
+	}
+
+	out := w
+	var aw io.WriteCloser
+	if armored {
+		aw = armor.NewWriter(w)
+		out = aw
+	}
+
+	ew, err := age.Encrypt(out, rcpts...)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt: %w", err)
+	}
+	if _, err := ew.Write(data); err != nil {
+		return fmt.Errorf("failed to encrypt: %w", err)
+	}
+	if err := ew.Close(); err != nil {
+		return fmt.Errorf("failed to encrypt: %w", err)
+	}
+	if aw != nil {
+		return aw.Close()
+	}
+	return nil
+}
+
+// Decrypt decrypts an age file, binary or armored. Files encrypted with a
+// passphrase get it from passphrase, which may be nil if there's no way to
+// ask for one; other files are decrypted with identities.
+func Decrypt(data []byte, identities []age.Identity, passphrase PassphraseFunc) ([]byte, error) {
+	if isArmored(data) {
+		unarmored, err := io.ReadAll(armor.NewReader(bytes.NewReader(bytes.TrimSpace(data))))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read armored age file: %w", err)
+		}
+		data = unarmored
+	}
+
+	scrypt := isScryptEncrypted(data)
+	if scrypt {
+		if passphrase == nil {
+			return nil, ErrPassphraseRequired
+		}
+		p, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		id, err := age.NewScryptIdentity(p)
+		if err != nil {
+			return nil, err
+		}
+		identities = []age.Identity{id}
+	} else if len(identities) == 0 {
+		return nil, ErrIdentityRequired
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(data), identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			if scrypt {
+				return nil, ErrIncorrectPassphrase
+			}
+			return nil, ErrNoIdentityMatch
+		}
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+// isScryptEncrypted reports whether a binary age file was encrypted with a passphrase
+func isScryptEncrypted(data []byte) bool {
+	header, _, _ := bytes.Cut(data, []byte("\n---"))
+	return bytes.Contains(header, []byte("\n-> scrypt "))
+}
+
+// LoadIdentities reads age identities from identity files
+func LoadIdentities(paths []string) ([]age.Identity, error) {
+	var identities []age.Identity
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open identity file: %w", err)
+		}
+		ids, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse identity file %s: %w", path, err)
+		}
+		identities = append(identities, ids...)
+	}
+	return identities, nil
+}
@@ -0,0 +1,175 @@
+package agefile
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func newIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity() error = %v", err)
+	}
+	return id
+}
+
+func passphrase(p string) PassphraseFunc {
+	return func() (string, error) { return p, nil }
+}
+
+func TestRoundTrip(t *testing.T) {
+	id := newIdentity(t)
+	plaintext := []byte("API_KEY=sk-123\nDEBUG=true\n")
+
+	tests := []struct {
+		name       string
+		recipients []string
+		passphrase string
+		armored    bool
+		identities []age.Identity
+		decryptFn  PassphraseFunc
+	}{
+		{name: "recipient", recipients: []string{id.Recipient().String()}, identities: []age.Identity{id}},
+		{name: "recipient armored", recipients: []string{id.Recipient().String()}, armored: true, identities: []age.Identity{id}},
+		{name: "passphrase", passphrase: "correct horse", decryptFn: passphrase("correct horse")},
+		{name: "passphrase armored", passphrase: "correct horse", armored: true, decryptFn: passphrase("correct horse")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Encrypt(&buf, plaintext, tt.recipients, tt.passphrase, tt.armored); err != nil {
+				t.Fatalf("Encrypt() error = %v", err)
+			}
+			data := buf.Bytes()
+			if bytes.Contains(data, []byte("sk-123")) {
+				t.Error("Encrypt() output contains plaintext")
+			}
+			if got := strings.HasPrefix(string(data), "-----BEGIN AGE ENCRYPTED FILE-----"); got != tt.armored {
+				t.Errorf("armored = %v, want %v", got, tt.armored)
+			}
+			if !IsEncrypted(data) {
+				t.Error("IsEncrypted() = false")
+			}
+
+			got, err := Decrypt(data, tt.identities, tt.decryptFn)
+			if err != nil {
+				t.Fatalf("Decrypt() error = %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Errorf("Decrypt() = %q, want %q", got, plaintext)
+			}
+		})
+	}
+}
+
+func TestIsEncrypted(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"binary", "age-encryption.org/v1\n-> X25519 abc\n", true},
+		{"armored with leading space", "\n  -----BEGIN AGE ENCRYPTED FILE-----\nYWdl\n", true},
+		{"dotenv", "KEY=value\n", false},
+		{"json", `{"KEY": "value"}`, false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsEncrypted([]byte(tt.data)); got != tt.want {
+				t.Errorf("IsEncrypted(%q) = %v, want %v", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	id := newIdentity(t)
+	var toRecipient, toPassphrase bytes.Buffer
+	if err := Encrypt(&toRecipient, []byte("x"), []string{id.Recipient().String()}, "", false); err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	if err := Encrypt(&toPassphrase, []byte("x"), nil, "secret", true); err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	called := false
+	prompt := func() (string, error) {
+		called = true
+		return "unused", nil
+	}
+	if _, err := Decrypt(toRecipient.Bytes(), []age.Identity{newIdentity(t)}, prompt); !errors.Is(err, ErrNoIdentityMatch) {
+		t.Errorf("Decrypt() with the wrong identity error = %v, want ErrNoIdentityMatch", err)
+	}
+	if called {
+		t.Error("Decrypt() asked for a passphrase for a file encrypted to recipients")
+	}
+	if _, err := Decrypt(toRecipient.Bytes(), nil, nil); !errors.Is(err, ErrIdentityRequired) {
+		t.Errorf("Decrypt() without identities error = %v, want ErrIdentityRequired", err)
+	}
+
+	if _, err := Decrypt(toPassphrase.Bytes(), nil, passphrase("wrong")); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Errorf("Decrypt() with the wrong passphrase error = %v, want ErrIncorrectPassphrase", err)
+	}
+	// Without a way to ask, e.g. when the file itself was read from stdin
+	if _, err := Decrypt(toPassphrase.Bytes(), []age.Identity{id}, nil); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("Decrypt() without a passphrase error = %v, want ErrPassphraseRequired", err)
+	}
+	failed := errors.New("no terminal")
+	if _, err := Decrypt(toPassphrase.Bytes(), nil, func() (string, error) { return "", failed }); !errors.Is(err, failed) {
+		t.Errorf("Decrypt() error = %v, want the passphrase error", err)
+	}
+
+	if _, err := Decrypt([]byte("-----BEGIN AGE ENCRYPTED FILE-----\n!!!\n"), []age.Identity{id}, nil); err == nil {
+		t.Error("Decrypt() of corrupt armor expected error")
+	}
+}
+
+func TestEncryptErrors(t *testing.T) {
+	id := newIdentity(t)
+	var buf bytes.Buffer
+	if err := Encrypt(&buf, []byte("x"), []string{id.Recipient().String()}, "secret", false); err == nil {
+		t.Error("Encrypt() with a passphrase and recipients expected error")
+	}
+	if err := Encrypt(&buf, []byte("x"), []string{"age1invalid"}, "", false); err == nil {
+		t.Error("Encrypt() with an invalid recipient expected error")
+	}
+	if err := Encrypt(&buf, []byte("x"), nil, "", false); err == nil {
+		t.Error("Encrypt() with nothing to encrypt to expected error")
+	}
+}
+
+func TestLoadIdentities(t *testing.T) {
+	id := newIdentity(t)
+	path := filepath.Join(t.TempDir(), "key.txt")
+	if err := os.WriteFile(path, []byte("# created: now\n"+id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := LoadIdentities([]string{path})
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("LoadIdentities() = %v, %v, want one identity", ids, err)
+	}
+	var buf bytes.Buffer
+	Encrypt(&buf, []byte("x"), []string{id.Recipient().String()}, "", false)
+	if got, err := Decrypt(buf.Bytes(), ids, nil); err != nil || string(got) != "x" {
+		t.Errorf("Decrypt() with loaded identities = %q, %v", got, err)
+	}
+
+	if _, err := LoadIdentities([]string{filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("LoadIdentities() of a missing file expected error")
+	}
+	bad := filepath.Join(t.TempDir(), "bad.txt")
+	os.WriteFile(bad, []byte("not a key\n"), 0600)
+	if _, err := LoadIdentities([]string{bad}); err == nil {
+		t.Error("LoadIdentities() of an invalid file expected error")
+	}
+}
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 )
 
 const (
@@ -15,20 +19,48 @@ const (
 	SessionFileName = "session"
 	// ConfigFileName stores user preferences
 	ConfigFileName = "config"
+	// IdentityFileName stores the member private key
+	IdentityFileName = "identity"
+	// CurrentVaultFileName stores the name of the vault 'coffer vault use' selected
+	CurrentVaultFileName = "current-vault"
+	// VaultsDirName holds named vaults inside the coffer home
+	VaultsDirName = "vaults"
+	// DefaultVaultName is the vault stored directly in the coffer home
+	DefaultVaultName = "default"
+	// DefaultKeychainAccount is the keychain account of the default vault
+	DefaultKeychainAccount = "master-key"
 )
 
+// Environment variables that select where vaults live and which one is used
+const (
+	HomeEnvVar  = "COFFER_HOME"
+	VaultEnvVar = "COFFER_VAULT"
+)
+
+var vaultNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
 // Config holds the configuration for coffer
 type Config struct {
+	// Name is the vault's name, or empty for a custom data directory
+	Name string
 	// DataDir is the directory where coffer stores its data
 	DataDir string
 	// DBPath is the full path to the SQLite database
 	DBPath string
 	// SessionPath is the full path to the session file
 	SessionPath string
+	// IdentityPath is the default location of the member identity file
+	IdentityPath string
+	// KeychainAccount is the OS keychain account holding this vault's key
+	KeychainAccount string
 }
 
-// DefaultDataDir returns the default data directory (~/.coffer)
+// DefaultDataDir returns the coffer home: $COFFER_HOME, or ~/.coffer. The
+// default vault lives here and named vaults live under vaults/.
 func DefaultDataDir() (string, error) {
+	if home := os.Getenv(HomeEnvVar); home != "" {
+		return filepath.Abs(home)
+	}
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", fmt.Errorf("failed to get home directory: %w", err)
@@ -36,22 +68,129 @@ func DefaultDataDir() (string, error) {
 	return filepath.Join(home, DefaultDirName), nil
 }
 
-// New creates a new Config with the default data directory
+// New creates a new Config for the current vault (see CurrentVault)
 func New() (*Config, error) {
-	dataDir, err := DefaultDataDir()
+	name, err := CurrentVault()
+	if err != nil {
+		return nil, err
+	}
+	return NewForVault(name)
+}
+
+// NewForVault creates a new Config for a named vault
+func NewForVault(name string) (*Config, error) {
+	if !IsValidVaultName(name) {
+		return nil, fmt.Errorf("invalid vault name: %q", name)
+	}
+	home, err := DefaultDataDir()
 	if err != nil {
 		return nil, err
 	}
-	return NewWithDataDir(dataDir), nil
+
+	dataDir := home
+	if name != DefaultVaultName {
+		dataDir = filepath.Join(home, VaultsDirName, name)
+	}
+	cfg := NewWithDataDir(dataDir)
+	cfg.Name = name
+	return cfg, nil
 }
 
 // NewWithDataDir creates a new Config with a custom data directory
 func NewWithDataDir(dataDir string) *Config {
 	return &Config{
-		DataDir:     dataDir,
-		DBPath:      filepath.Join(dataDir, DBFileName),
-		SessionPath: filepath.Join(dataDir, SessionFileName),
+		DataDir:         dataDir,
+		DBPath:          filepath.Join(dataDir, DBFileName),
+		SessionPath:     filepath.Join(dataDir, SessionFileName),
+		IdentityPath:    filepath.Join(dataDir, IdentityFileName),
+		KeychainAccount: keychainAccount(dataDir),
+	}
+}
+
+// keychainAccount keeps the original account name for ~/.coffer so existing
+// keychain entries still work, and keys every other vault by its directory
+func keychainAccount(dataDir string) string {
+	if abs, err := filepath.Abs(dataDir); err == nil {
+		dataDir = abs
+	}
+	if home, err := os.UserHomeDir(); err == nil && dataDir == filepath.Join(home, DefaultDirName) {
+		return DefaultKeychainAccount
+	}
+	return DefaultKeychainAccount + ":" + dataDir
+}
+
+// IsValidVaultName reports whether name can be used as a vault name
+func IsValidVaultName(name string) bool {
+	return vaultNamePattern.MatchString(name)
+}
+
+// CurrentVault returns the vault to use: $COFFER_VAULT, then the vault
+// selected with SetCurrentVault, then the default vault
+func CurrentVault() (string, error) {
+	if name := os.Getenv(VaultEnvVar); name != "" {
+		return name, nil
+	}
+	home, err := DefaultDataDir()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(home, CurrentVaultFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return DefaultVaultName, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read current vault: %w", err)
+	}
+	if name := strings.TrimSpace(string(data)); name != "" {
+		return name, nil
+	}
+	return DefaultVaultName, nil
+}
+
+// SetCurrentVault selects the vault used when neither --vault nor
+// $COFFER_VAULT is set
+func SetCurrentVault(name string) error {
+	if !IsValidVaultName(name) {
+		return fmt.Errorf("invalid vault name: %q", name)
+	}
+	home, err := DefaultDataDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(home, 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(home, CurrentVaultFileName), []byte(name+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to save current vault: %w", err)
+	}
+	return nil
+}
+
+// ListVaults returns the names of initialized vaults, sorted, with the
+// default vault first
+func ListVaults() ([]string, error) {
+	home, err := DefaultDataDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if NewWithDataDir(home).Exists() {
+		names = append(names, DefaultVaultName)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(home, VaultsDirName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list vaults: %w", err)
+	}
+	var named []string
+	for _, e := range entries {
+		if e.IsDir() && IsValidVaultName(e.Name()) && NewWithDataDir(filepath.Join(home, VaultsDirName, e.Name())).Exists() {
+			named = append(named, e.Name())
+		}
 	}
+	sort.Strings(named)
+	return append(names, named...), nil
 }
 
 // EnsureDataDir creates the data directory if it doesn't exist
@@ -186,3 +186,94 @@ func TestSession(t *testing.T) {
 		t.Fatalf("DeleteSession() second call error = %v", err)
 	}
 }
+
+func TestNewForVault(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv(HomeEnvVar, home)
+
+	cfg, err := NewForVault(DefaultVaultName)
+	if err != nil {
+		t.Fatalf("NewForVault() error = %v", err)
+	}
+	if cfg.DataDir != home {
+		t.Errorf("default DataDir = %s, want %s", cfg.DataDir, home)
+	}
+
+	team, err := NewForVault("team")
+	if err != nil {
+		t.Fatalf("NewForVault() error = %v", err)
+	}
+	if want := filepath.Join(home, VaultsDirName, "team"); team.DataDir != want {
+		t.Errorf("team DataDir = %s, want %s", team.DataDir, want)
+	}
+	if team.KeychainAccount == cfg.KeychainAccount {
+		t.Errorf("vaults share keychain account %s", team.KeychainAccount)
+	}
+
+	for _, name := range []string{"", "../x", "a/b", ".hidden"} {
+		if _, err := NewForVault(name); err == nil {
+			t.Errorf("NewForVault(%q) expected error", name)
+		}
+	}
+}
+
+func TestDefaultKeychainAccount(t *testing.T) {
+	home, _ := os.UserHomeDir()
+	cfg := NewWithDataDir(filepath.Join(home, DefaultDirName))
+	if cfg.KeychainAccount != DefaultKeychainAccount {
+		t.Errorf("KeychainAccount = %s, want %s", cfg.KeychainAccount, DefaultKeychainAccount)
+	}
+}
+
+func TestCurrentVault(t *testing.T) {
+	t.Setenv(HomeEnvVar, t.TempDir())
+	t.Setenv(VaultEnvVar, "")
+
+	name, err := CurrentVault()
+	if err != nil || name != DefaultVaultName {
+		t.Fatalf("CurrentVault() = %q, %v; want %q", name, err, DefaultVaultName)
+	}
+
+	if err := SetCurrentVault("team"); err != nil {
+		t.Fatalf("SetCurrentVault() error = %v", err)
+	}
+	if name, _ := CurrentVault(); name != "team" {
+		t.Errorf("CurrentVault() = %q, want team", name)
+	}
+
+	t.Setenv(VaultEnvVar, "other")
+	if name, _ := CurrentVault(); name != "other" {
+		t.Errorf("CurrentVault() with %s = %q, want other", VaultEnvVar, name)
+	}
+}
+
+func TestListVaults(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv(HomeEnvVar, home)
+
+	for _, name := range []string{DefaultVaultName, "zeta", "alpha"} {
+		cfg, _ := NewForVault(name)
+		if err := cfg.EnsureDataDir(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(cfg.DBPath, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not initialized, so not listed
+	os.MkdirAll(filepath.Join(home, VaultsDirName, "empty"), 0700)
+
+	names, err := ListVaults()
+	if err != nil {
+		t.Fatalf("ListVaults() error = %v", err)
+	}
+	want := []string{DefaultVaultName, "alpha", "zeta"}
+	if len(names) != len(want) {
+		t.Fatalf("ListVaults() = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("ListVaults()[%d] = %s, want %s", i, names[i], want[i])
+		}
+	}
+}
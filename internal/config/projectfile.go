@@ -0,0 +1,189 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ProjectFileName is the per-directory file that binds a directory tree to a
+// project and default environment
+const ProjectFileName = ".coffer.yaml"
+
+// Environment variables that override the project file and global config
+const (
+	ProjectEnvVar = "COFFER_PROJECT"
+	EnvEnvVar     = "COFFER_ENV"
+)
+
+// ProjectFile is a parsed .coffer.yaml:
+//
+//	project: myapp
+//	env: dev
+//	keys:
+//	  include: ["DB_*", "API_KEY"]
+//	  exclude: ["*_ADMIN_*"]
+//	files:
+//	  - path: certs/tls.crt
+//	    key: TLS_CERT
+//	  - path: config/app.yaml
+//	    template: config/app.yaml.tmpl
+type ProjectFile struct {
+	// Path is the file's location; relative mount paths resolve against its
+	// directory
+	Path    string      `yaml:"-"`
+	Project string      `yaml:"project"`
+	Env     string      `yaml:"env"`
+	Keys    KeyFilter   `yaml:"keys"`
+	Files   []FileMount `yaml:"files"`
+}
+
+// KeyFilter limits which secrets commands in the directory can read, using
+// path.Match patterns. An empty include list matches every key; exclude wins
+// over include.
+type KeyFilter struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// FileMount writes a secret, or a template rendered with secrets, to a file
+// while a command runs
+type FileMount struct {
+	Path     string `yaml:"path"`
+	Key      string `yaml:"key"`
+	Template string `yaml:"template"`
+}
+
+// FindProjectFile walks up from dir looking for a .coffer.yaml. It returns
+// nil without error when there isn't one.
+func FindProjectFile(dir string) (*ProjectFile, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve directory: %w", err)
+	}
+	for {
+		p := filepath.Join(dir, ProjectFileName)
+		if _, err := os.Stat(p); err == nil {
+			return LoadProjectFile(p)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to check %s: %w", p, err)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// LoadProjectFile reads and validates a project file
+func LoadProjectFile(p string) (*ProjectFile, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", p, err)
+	}
+
+	var pf ProjectFile
+	if err := yaml.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", p, err)
+	}
+	pf.Path = p
+
+	for _, pattern := range append(append([]string{}, pf.Keys.Include...), pf.Keys.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid key pattern %q", p, pattern)
+		}
+	}
+	for i, f := range pf.Files {
+		if f.Path == "" {
+			return nil, fmt.Errorf("%s: files[%d] has no path", p, i)
+		}
+		if (f.Key == "") == (f.Template == "") {
+			return nil, fmt.Errorf("%s: files[%d] needs exactly one of key or template", p, i)
+		}
+	}
+	return &pf, nil
+}
+
+// Dir returns the directory containing the project file
+func (pf *ProjectFile) Dir() string {
+	return filepath.Dir(pf.Path)
+}
+
+// Resolve returns a path from the project file relative to its directory
+func (pf *ProjectFile) Resolve(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(pf.Dir(), p)
+}
+
+// MountPath resolves a files[].path against the project file's directory,
+// following symlinks, and rejects paths that end up outside that directory,
+// so a .coffer.yaml in a cloned repository can't write secrets elsewhere
+func (pf *ProjectFile) MountPath(p string) (string, error) {
+	root, err := filepath.EvalSymlinks(pf.Dir())
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", pf.Dir(), err)
+	}
+	resolved, err := evalExistingSymlinks(filepath.Clean(pf.Resolve(p)))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", p, err)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: files path %q is outside %s", pf.Path, p, pf.Dir())
+	}
+	return resolved, nil
+}
+
+// evalExistingSymlinks resolves symlinks in the longest prefix of p that
+// exists, keeping the rest as written
+func evalExistingSymlinks(p string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
+
+// Match reports whether a key passes the filter
+func (f KeyFilter) Match(key string) bool {
+	for _, pattern := range f.Exclude {
+		if ok, _ := path.Match(pattern, key); ok {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IsZero reports whether the filter allows every key
+func (f KeyFilter) IsZero() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindProjectFile(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "a", "b", "c")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pf, err := FindProjectFile(nested)
+	if err != nil {
+		t.Fatalf("FindProjectFile() error = %v", err)
+	}
+	if pf != nil {
+		t.Fatalf("FindProjectFile() = %+v, want nil", pf)
+	}
+
+	content := `project: myapp
+env: dev
+keys:
+  include: ["DB_*"]
+files:
+  - path: certs/tls.crt
+    key: TLS_CERT
+`
+	path := filepath.Join(root, "a", ProjectFileName)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pf, err = FindProjectFile(nested)
+	if err != nil {
+		t.Fatalf("FindProjectFile() error = %v", err)
+	}
+	if pf == nil || pf.Path != path {
+		t.Fatalf("FindProjectFile() = %+v, want %s", pf, path)
+	}
+	if pf.Project != "myapp" || pf.Env != "dev" {
+		t.Errorf("project/env = %s/%s, want myapp/dev", pf.Project, pf.Env)
+	}
+	if got := pf.Resolve(pf.Files[0].Path); got != filepath.Join(root, "a", "certs", "tls.crt") {
+		t.Errorf("Resolve() = %s", got)
+	}
+}
+
+func TestLoadProjectFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"invalid yaml", "project: [unclosed"},
+		{"bad pattern", "keys:\n  include: ['[']"},
+		{"mount without path", "files:\n  - key: A"},
+		{"mount with key and template", "files:\n  - path: x\n    key: A\n    template: t"},
+		{"mount with neither", "files:\n  - path: x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ProjectFileName)
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadProjectFile(path); err == nil {
+				t.Error("LoadProjectFile() expected error")
+			}
+		})
+	}
+}
+
+func TestKeyFilterMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter KeyFilter
+		key    string
+		want   bool
+	}{
+		{"empty filter", KeyFilter{}, "ANY", true},
+		{"include match", KeyFilter{Include: []string{"DB_*"}}, "DB_URL", true},
+		{"include miss", KeyFilter{Include: []string{"DB_*"}}, "API_KEY", false},
+		{"exclude", KeyFilter{Exclude: []string{"*_ADMIN"}}, "DB_ADMIN", false},
+		{"exclude wins", KeyFilter{Include: []string{"DB_*"}, Exclude: []string{"DB_ADMIN"}}, "DB_ADMIN", false},
+		{"exact include", KeyFilter{Include: []string{"API_KEY"}}, "API_KEY", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(tt.key); got != tt.want {
+				t.Errorf("Match(%s) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMountPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	dir := filepath.Join(root, "project")
+	if err := os.MkdirAll(filepath.Join(dir, "certs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "certs"), filepath.Join(dir, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	pf := &ProjectFile{Path: filepath.Join(dir, ProjectFileName)}
+	realDir, _ := filepath.EvalSymlinks(dir)
+
+	tests := []struct {
+		path string
+		want string // empty when the path must be rejected
+	}{
+		{"certs/tls.crt", filepath.Join(realDir, "certs", "tls.crt")},
+		{"new/dir/file", filepath.Join(realDir, "new", "dir", "file")},
+		{"certs/../app.env", filepath.Join(realDir, "app.env")},
+		{"linked/tls.crt", filepath.Join(realDir, "certs", "tls.crt")},
+		{filepath.Join(dir, "abs.env"), filepath.Join(realDir, "abs.env")},
+		{"../outside.env", ""},
+		{"certs/../../outside.env", ""},
+		{filepath.Join(outside, "abs.env"), ""},
+		{"escape/stolen.env", ""},
+		{"escape/new/stolen.env", ""},
+		{".", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := pf.MountPath(tt.path)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("MountPath() = %s, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MountPath() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("MountPath() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
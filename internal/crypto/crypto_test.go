@@ -2,6 +2,7 @@ package crypto
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -302,6 +303,78 @@ func TestDeriveKeyUsableForEncryption(t *testing.T) {
 }
 
 // Benchmark tests
+func TestGenerateToken(t *testing.T) {
+	token1, err := GenerateToken()
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	token2, _ := GenerateToken()
+
+	if !strings.HasPrefix(token1, TokenPrefix) {
+		t.Errorf("GenerateToken() = %s, want prefix %s", token1, TokenPrefix)
+	}
+	if token1 == token2 {
+		t.Error("GenerateToken() should generate unique tokens")
+	}
+
+	if !bytes.Equal(HashToken(token1), HashToken(token1+"\n")) {
+		t.Error("HashToken() should ignore surrounding whitespace")
+	}
+	if bytes.Equal(HashToken(token1), HashToken(token2)) {
+		t.Error("HashToken() should differ for different tokens")
+	}
+}
+
+func TestSealTo(t *testing.T) {
+	priv, pub, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	if derived, _ := PublicKeyFor(priv); !bytes.Equal(derived, pub) {
+		t.Error("PublicKeyFor() should match the generated public key")
+	}
+
+	sealed, err := SealTo(pub, []byte("env key"), []byte("env-1"))
+	if err != nil {
+		t.Fatalf("SealTo() error = %v", err)
+	}
+	opened, err := OpenSealed(priv, sealed, []byte("env-1"))
+	if err != nil {
+		t.Fatalf("OpenSealed() error = %v", err)
+	}
+	if string(opened) != "env key" {
+		t.Errorf("OpenSealed() = %q, want env key", opened)
+	}
+
+	if _, err := OpenSealed(priv, sealed, []byte("env-2")); err == nil {
+		t.Error("OpenSealed() should fail with different AAD")
+	}
+	other, _, _ := GenerateKeyPair()
+	if _, err := OpenSealed(other, sealed, []byte("env-1")); err == nil {
+		t.Error("OpenSealed() should fail with another private key")
+	}
+}
+
+func TestEncodeKeys(t *testing.T) {
+	priv, pub, _ := GenerateKeyPair()
+
+	gotPub, err := ParsePublicKey(EncodePublicKey(pub))
+	if err != nil || !bytes.Equal(gotPub, pub) {
+		t.Errorf("ParsePublicKey() round trip failed: %v", err)
+	}
+	gotPriv, err := ParsePrivateKey(EncodePrivateKey(priv) + "\n")
+	if err != nil || !bytes.Equal(gotPriv, priv) {
+		t.Errorf("ParsePrivateKey() round trip failed: %v", err)
+	}
+
+	if _, err := ParsePublicKey(EncodePrivateKey(priv)); err != ErrInvalidPublicKey {
+		t.Errorf("ParsePublicKey(private key) error = %v, want ErrInvalidPublicKey", err)
+	}
+	if _, err := ParsePublicKey("coffer-pub-short"); err != ErrInvalidPublicKey {
+		t.Errorf("ParsePublicKey(short) error = %v, want ErrInvalidPublicKey", err)
+	}
+}
+
 func BenchmarkEncrypt(b *testing.B) {
 	key, _ := GenerateKey()
 	plaintext := []byte("benchmark secret value")
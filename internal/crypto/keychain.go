@@ -7,12 +7,9 @@ import (
 	"github.com/zalando/go-keyring"
 )
 
-const (
-	// KeychainService is the service name used in the OS keychain
-	KeychainService = "coffer"
-	// KeychainAccount is the account name for the master key
-	KeychainAccount = "master-key"
-)
+// KeychainService is the service name used in the OS keychain. Each vault
+// stores its key under its own account (see config.Config.KeychainAccount).
+const KeychainService = "coffer"
 
 // KeychainAvailable checks if the OS keychain is available
 func KeychainAvailable() bool {
@@ -24,7 +21,7 @@ func KeychainAvailable() bool {
 }
 
 // StoreKeyInKeychain stores the derived encryption key in the OS keychain
-func StoreKeyInKeychain(key []byte) error {
+func StoreKeyInKeychain(account string, key []byte) error {
 	if len(key) != KeyLength {
 		return ErrInvalidKeyLength
 	}
@@ -32,7 +29,7 @@ func StoreKeyInKeychain(key []byte) error {
 	// Encode key as base64 for storage
 	encoded := base64.StdEncoding.EncodeToString(key)
 
-	err := keyring.Set(KeychainService, KeychainAccount, encoded)
+	err := keyring.Set(KeychainService, account, encoded)
 	if err != nil {
 		return fmt.Errorf("failed to store key in keychain: %w", err)
 	}
@@ -41,8 +38,8 @@ func StoreKeyInKeychain(key []byte) error {
 }
 
 // GetKeyFromKeychain retrieves the encryption key from the OS keychain
-func GetKeyFromKeychain() ([]byte, error) {
-	encoded, err := keyring.Get(KeychainService, KeychainAccount)
+func GetKeyFromKeychain(account string) ([]byte, error) {
+	encoded, err := keyring.Get(KeychainService, account)
 	if err == keyring.ErrNotFound {
 		return nil, fmt.Errorf("no key found in keychain")
 	}
@@ -63,8 +60,8 @@ func GetKeyFromKeychain() ([]byte, error) {
 }
 
 // DeleteKeyFromKeychain removes the encryption key from the OS keychain
-func DeleteKeyFromKeychain() error {
-	err := keyring.Delete(KeychainService, KeychainAccount)
+func DeleteKeyFromKeychain(account string) error {
+	err := keyring.Delete(KeychainService, account)
 	if err == keyring.ErrNotFound {
 		return nil // Already deleted, not an error
 	}
@@ -75,7 +72,7 @@ func DeleteKeyFromKeychain() error {
 }
 
 // HasKeyInKeychain checks if a key exists in the keychain
-func HasKeyInKeychain() bool {
-	_, err := keyring.Get(KeychainService, KeychainAccount)
+func HasKeyInKeychain(account string) bool {
+	_, err := keyring.Get(KeychainService, account)
 	return err == nil
 }
@@ -0,0 +1,165 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// PublicKeyPrefix identifies encoded member public keys
+	PublicKeyPrefix = "coffer-pub-"
+	// PrivateKeyPrefix identifies encoded member private keys
+	PrivateKeyPrefix = "COFFER-SECRET-KEY-"
+)
+
+var (
+	// ErrInvalidPublicKey is returned when a public key can't be parsed
+	ErrInvalidPublicKey = errors.New("invalid public key")
+	// ErrInvalidPrivateKey is returned when a private key can't be parsed
+	ErrInvalidPrivateKey = errors.New("invalid private key")
+)
+
+// sealKeyContext domain-separates keys derived for sealed boxes
+const sealKeyContext = "coffer-seal-v1:"
+
+// GenerateKeyPair generates an X25519 keypair for a vault member
+func GenerateKeyPair() (privateKey, publicKey []byte, err error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate keypair: %w", err)
+	}
+	return priv.Bytes(), priv.PublicKey().Bytes(), nil
+}
+
+// PublicKeyFor returns the public key belonging to an X25519 private key
+func PublicKeyFor(privateKey []byte) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, ErrInvalidPrivateKey
+	}
+	return priv.PublicKey().Bytes(), nil
+}
+
+// SealTo encrypts plaintext so only the holder of the private key matching
+// publicKey can decrypt it. A fresh ephemeral keypair is used per call; the
+// result is the ephemeral public key, the nonce and the ciphertext.
+func SealTo(publicKey, plaintext, aad []byte) ([]byte, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	ciphertext, nonce, err := Encrypt(sealKey(shared, ephemeralPub, publicKey), plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, len(ephemeralPub)+len(nonce)+len(ciphertext))
+	sealed = append(sealed, ephemeralPub...)
+	sealed = append(sealed, nonce...)
+	return append(sealed, ciphertext...), nil
+}
+
+// OpenSealed decrypts a box produced by SealTo with the recipient's private key
+func OpenSealed(privateKey, sealed, aad []byte) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, ErrInvalidPrivateKey
+	}
+	if len(sealed) < KeyLength+NonceLength {
+		return nil, ErrDecryptionFailed
+	}
+
+	ephemeralPub := sealed[:KeyLength]
+	nonce := sealed[KeyLength : KeyLength+NonceLength]
+	ciphertext := sealed[KeyLength+NonceLength:]
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralPub)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	shared, err := priv.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return Decrypt(sealKey(shared, ephemeralPub, priv.PublicKey().Bytes()), ciphertext, nonce, aad)
+}
+
+// sealKey derives the symmetric key for a sealed box, bound to both public keys
+func sealKey(shared, ephemeralPub, recipientPub []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(sealKeyContext))
+	h.Write(shared)
+	h.Write(ephemeralPub)
+	h.Write(recipientPub)
+	return h.Sum(nil)
+}
+
+// EncodePublicKey formats a public key for display and sharing
+func EncodePublicKey(publicKey []byte) string {
+	return PublicKeyPrefix + base64.RawURLEncoding.EncodeToString(publicKey)
+}
+
+// ParsePublicKey parses a public key produced by EncodePublicKey
+func ParsePublicKey(s string) ([]byte, error) {
+	return parseKey(s, PublicKeyPrefix, ErrInvalidPublicKey)
+}
+
+// EncodePrivateKey formats a private key for an identity file
+func EncodePrivateKey(privateKey []byte) string {
+	return PrivateKeyPrefix + base64.RawURLEncoding.EncodeToString(privateKey)
+}
+
+// ParsePrivateKey parses a private key produced by EncodePrivateKey
+func ParsePrivateKey(s string) ([]byte, error) {
+	return parseKey(s, PrivateKeyPrefix, ErrInvalidPrivateKey)
+}
+
+// FormatIdentity renders an identity file holding a member's private key
+func FormatIdentity(privateKey []byte) (string, error) {
+	publicKey, err := PublicKeyFor(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("# coffer identity\n# public key: %s\n%s\n", EncodePublicKey(publicKey), EncodePrivateKey(privateKey)), nil
+}
+
+// ParseIdentity reads the private key from an identity file, skipping comments
+func ParseIdentity(data []byte) ([]byte, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return ParsePrivateKey(line)
+	}
+	return nil, ErrInvalidPrivateKey
+}
+
+func parseKey(s, prefix string, invalid error) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, invalid
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil || len(key) != KeyLength {
+		return nil, invalid
+	}
+	return key, nil
+}
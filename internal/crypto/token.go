@@ -0,0 +1,42 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	// TokenPrefix identifies coffer API tokens
+	TokenPrefix = "coffer_"
+	// TokenLength is the number of random bytes in a token
+	TokenLength = 32
+)
+
+// GenerateToken generates a random API token.
+// Tokens are high-entropy, so a plain SHA-256 hash is enough to store them.
+func GenerateToken() (string, error) {
+	b := make([]byte, TokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return TokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tokenKeyContext separates the token wrapping key from the token lookup hash
+const tokenKeyContext = "coffer-token-key-v1:"
+
+// HashToken returns the SHA-256 hash of a token for storage and lookup
+func HashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return sum[:]
+}
+
+// DeriveTokenKey derives the key used to wrap a data key for a token.
+// It is domain-separated from HashToken, so the stored hash can't unwrap anything.
+func DeriveTokenKey(token string) []byte {
+	sum := sha256.Sum256([]byte(tokenKeyContext + strings.TrimSpace(token)))
+	return sum[:]
+}
@@ -0,0 +1,390 @@
+// Package dotenv parses and writes .env files following the de-facto format
+// shared by godotenv and python-dotenv.
+//
+// Supported syntax:
+//
+//	# comment
+//	KEY=value               # inline comment (needs whitespace before #)
+//	export KEY=value
+//	KEY='literal $value'    # no escapes or expansion
+//	KEY="line1\nline2"      # escapes: \n \r \t \\ \" \' \$
+//	KEY="multi
+//	line"
+//	URL=http://${HOST}:$PORT
+//	NAME=${USER:-nobody}
+//
+// Variables in unquoted and double-quoted values expand to keys defined
+// earlier in the file. References to keys the file doesn't define are left
+// as written, so coffer ${VAR} references survive an import.
+package dotenv
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Entry is a parsed key/value pair
+type Entry struct {
+	Key   string
+	Value string
+	// Line is the 1-based line the entry starts on
+	Line int
+}
+
+// Options controls parsing
+type Options struct {
+	// Literal disables variable expansion
+	Literal bool
+}
+
+// ParseError reports a syntax error and the line it occurred on
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Parse parses a .env file, returning entries in file order. A key set more
+// than once appears once, with its last value, at its first position.
+func Parse(data []byte, opts Options) ([]Entry, error) {
+	p := &parser{
+		src:   strings.ReplaceAll(string(data), "\r\n", "\n"),
+		line:  1,
+		opts:  opts,
+		index: make(map[string]int),
+	}
+	p.src = strings.TrimPrefix(p.src, "\ufeff")
+
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return p.entries, nil
+		}
+		if err := p.parseLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ToMap converts entries to a map
+func ToMap(entries []Entry) map[string]string {
+	result := make(map[string]string, len(entries))
+	for _, e := range entries {
+		result[e.Key] = e.Value
+	}
+	return result
+}
+
+type parser struct {
+	src     string
+	pos     int
+	line    int
+	opts    Options
+	entries []Entry
+	index   map[string]int
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) peek() byte {
+	return p.src[p.pos]
+}
+
+func (p *parser) next() byte {
+	c := p.src[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+func (p *parser) errorf(line int, format string, args ...any) error {
+	return &ParseError{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// skipBlank skips whitespace, blank lines and comment lines
+func (p *parser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\n':
+			p.next()
+		case '#':
+			p.skipToEOL()
+		default:
+			return
+		}
+	}
+}
+
+// skipSpaces skips spaces and tabs on the current line
+func (p *parser) skipSpaces() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.next()
+	}
+}
+
+func (p *parser) skipToEOL() {
+	for !p.eof() && p.peek() != '\n' {
+		p.next()
+	}
+}
+
+func (p *parser) parseLine() error {
+	line := p.line
+
+	key := p.readKey()
+	if key == "export" && !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.skipSpaces()
+		key = p.readKey()
+	}
+	if key == "" {
+		end := strings.IndexByte(p.src[p.pos:], '\n')
+		if end < 0 {
+			end = len(p.src) - p.pos
+		}
+		return p.errorf(line, "invalid key: %q", p.src[p.pos:p.pos+end])
+	}
+
+	p.skipSpaces()
+	if p.eof() || p.peek() != '=' {
+		return p.errorf(line, "expected '=' after %s", key)
+	}
+	p.next()
+	p.skipSpaces()
+
+	value, err := p.readValue(line)
+	if err != nil {
+		return err
+	}
+
+	if i, ok := p.index[key]; ok {
+		p.entries[i].Value = value
+	} else {
+		p.index[key] = len(p.entries)
+		p.entries = append(p.entries, Entry{Key: key, Value: value, Line: line})
+	}
+	return nil
+}
+
+// readKey reads a key: a letter or underscore followed by letters, digits,
+// underscores, dots or dashes
+func (p *parser) readKey() string {
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if c == '_' || isLetter(c) || (p.pos > start && (isDigit(c) || c == '.' || c == '-')) {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *parser) readValue(line int) (string, error) {
+	if p.eof() || p.peek() == '\n' {
+		return "", nil
+	}
+
+	var value string
+	switch quote := p.peek(); quote {
+	case '\'', '"':
+		p.next()
+		raw, err := p.readQuoted(quote, line)
+		if err != nil {
+			return "", err
+		}
+		value = raw
+		if quote == '"' {
+			value, err = p.expand(raw, line, true)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		// Only a comment may follow the closing quote
+		p.skipSpaces()
+		if !p.eof() && p.peek() != '\n' && p.peek() != '#' {
+			return "", p.errorf(p.line, "unexpected characters after closing quote")
+		}
+		p.skipToEOL()
+	default:
+		start := p.pos
+		for !p.eof() && p.peek() != '\n' {
+			if p.peek() == '#' && p.pos > start && (p.src[p.pos-1] == ' ' || p.src[p.pos-1] == '\t') {
+				break
+			}
+			p.next()
+		}
+		raw := strings.TrimRight(p.src[start:p.pos], " \t")
+		p.skipToEOL()
+
+		var err error
+		value, err = p.expand(raw, line, false)
+		if err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
+
+// readQuoted reads up to the closing quote, which may be lines later.
+// Backslash-escaped quotes don't close a double-quoted value.
+func (p *parser) readQuoted(quote byte, line int) (string, error) {
+	start := p.pos
+	for !p.eof() {
+		c := p.next()
+		if c == '\\' && quote == '"' && !p.eof() {
+			p.next()
+			continue
+		}
+		if c == quote {
+			return p.src[start : p.pos-1], nil
+		}
+	}
+	return "", p.errorf(line, "unterminated %c-quoted value", quote)
+}
+
+// expand substitutes $VAR, ${VAR} and ${VAR:-default} with earlier values
+// and turns \$ into a literal dollar. Double-quoted values also decode the
+// escapes \n \r \t \\ \" and \'; unknown escapes are kept as written.
+func (p *parser) expand(s string, line int, escapes bool) (string, error) {
+	if !strings.ContainsAny(s, `$\`) {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch c := s[i+1]; {
+			case c == '$':
+				b.WriteByte('$')
+			case escapes && c == 'n':
+				b.WriteByte('\n')
+			case escapes && c == 'r':
+				b.WriteByte('\r')
+			case escapes && c == 't':
+				b.WriteByte('\t')
+			case escapes && (c == '\\' || c == '"' || c == '\''):
+				b.WriteByte(c)
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			}
+			i++
+			continue
+		}
+		if s[i] != '$' || p.opts.Literal {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		// ${VAR} or ${VAR:-default}
+		if i+1 < len(s) && s[i+1] == '{' {
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", p.errorf(line, "unterminated ${ in value")
+			}
+			ref := s[i : i+end+1]
+			name, def, hasDefault := strings.Cut(s[i+2:i+end], ":-")
+			if value, ok := p.lookup(name); ok {
+				b.WriteString(value)
+			} else if hasDefault {
+				b.WriteString(def)
+			} else {
+				b.WriteString(ref)
+			}
+			i += end
+			continue
+		}
+
+		// $VAR
+		j := i + 1
+		for j < len(s) && (s[j] == '_' || isLetter(s[j]) || (j > i+1 && isDigit(s[j]))) {
+			j++
+		}
+		if value, ok := p.lookup(s[i+1 : j]); ok && j > i+1 {
+			b.WriteString(value)
+		} else {
+			b.WriteString(s[i:j])
+		}
+		i = j - 1
+	}
+	return b.String(), nil
+}
+
+func (p *parser) lookup(name string) (string, bool) {
+	i, ok := p.index[name]
+	if !ok {
+		return "", false
+	}
+	return p.entries[i].Value, true
+}
+
+// Quote formats a value so Parse reads it back unchanged: bare when safe,
+// single-quoted when the value has no single quotes or newlines, and
+// double-quoted with escapes otherwise.
+func Quote(value string) string {
+	if !strings.ContainsAny(value, " \t\r\n\"'`$#\\") {
+		return value
+	}
+	if !strings.ContainsAny(value, "'\r\n") {
+		return "'" + value + "'"
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range value {
+		switch c {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '$':
+			b.WriteString(`\$`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Marshal renders secrets as a .env file with keys in sorted order
+func Marshal(secrets map[string]string) []byte {
+	keys := make([]string, 0, len(secrets))
+	for k := range secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(Quote(secrets[key]))
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,147 @@
+package dotenv
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]string
+	}{
+		{"simple", "KEY=value", map[string]string{"KEY": "value"}},
+		{"empty", "KEY=", map[string]string{"KEY": ""}},
+		{"spaces around equals", "KEY = value  ", map[string]string{"KEY": "value"}},
+		{"export prefix", "export KEY=value", map[string]string{"KEY": "value"}},
+		{"key named export", "export=value", map[string]string{"export": "value"}},
+		{"comments and blanks", "# comment\n\n  # indented\nKEY=value\n", map[string]string{"KEY": "value"}},
+		{"inline comment", "KEY=value # comment", map[string]string{"KEY": "value"}},
+		{"hash without space", "KEY=a#b", map[string]string{"KEY": "a#b"}},
+		{"single quoted", `KEY='a "b" $C \n'`, map[string]string{"KEY": `a "b" $C \n`}},
+		{"double quoted", `KEY="a # b"  # comment`, map[string]string{"KEY": "a # b"}},
+		{"escapes", `KEY="tab\tnl\nquote\"bs\\dollar\$"`, map[string]string{"KEY": "tab\tnl\nquote\"bs\\dollar$"}},
+		{"unknown escape", `KEY="a\qb"`, map[string]string{"KEY": `a\qb`}},
+		{"multiline double quoted", "KEY=\"line1\nline2\"\nNEXT=x", map[string]string{"KEY": "line1\nline2", "NEXT": "x"}},
+		{"multiline single quoted", "KEY='line1\nline2'", map[string]string{"KEY": "line1\nline2"}},
+		{"crlf", "A=1\r\nB=2\r\n", map[string]string{"A": "1", "B": "2"}},
+		{"dotted key", "app.name=x", map[string]string{"app.name": "x"}},
+		{"last value wins", "A=1\nA=2", map[string]string{"A": "2"}},
+		{"expansion", "HOST=db\nPORT=5432\nURL=postgres://${HOST}:$PORT/x", map[string]string{"HOST": "db", "PORT": "5432", "URL": "postgres://db:5432/x"}},
+		{"expansion in double quotes", "A=x\nB=\"${A}y\"", map[string]string{"A": "x", "B": "xy"}},
+		{"no expansion in single quotes", "A=x\nB='${A}'", map[string]string{"A": "x", "B": "${A}"}},
+		{"escaped dollar", "A=x\nB=\\$A", map[string]string{"A": "x", "B": "$A"}},
+		{"escaped backslash before variable", "A=x\nB=\"\\\\$A\"", map[string]string{"A": "x", "B": `\x`}},
+		{"default", "B=${A:-fallback}", map[string]string{"B": "fallback"}},
+		{"undefined reference kept", "B=${DB_HOST}/$OTHER", map[string]string{"B": "${DB_HOST}/$OTHER"}},
+		{"lone dollar", "B=cost $5 $", map[string]string{"B": "cost $5 $"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := Parse([]byte(tt.input), Options{})
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			got := ToMap(entries)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Parse() = %q, want %q", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("Parse()[%s] = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseLiteral(t *testing.T) {
+	entries, err := Parse([]byte("A=x\nB=${A}\nC=\\$A"), Options{Literal: true})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	got := ToMap(entries)
+	if got["B"] != "${A}" {
+		t.Errorf("B = %q, want ${A}", got["B"])
+	}
+	if got["C"] != "$A" {
+		t.Errorf("C = %q, want $A", got["C"])
+	}
+}
+
+func TestParseOrderAndLines(t *testing.T) {
+	entries, err := Parse([]byte("# header\nB=1\nA=\"multi\nline\"\nC=3\n"), Options{})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	want := []Entry{{"B", "1", 2}, {"A", "multi\nline", 3}, {"C", "3", 5}}
+	if len(entries) != len(want) {
+		t.Fatalf("Parse() = %+v, want %+v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		line  int
+	}{
+		{"missing equals", "A=1\nNOT_AN_ASSIGNMENT\n", 2},
+		{"invalid key", "A=1\n\n1KEY=x", 3},
+		{"unterminated double quote", "A=1\nB=\"abc\nC=2", 2},
+		{"unterminated single quote", "A='abc", 1},
+		{"trailing characters", "A=1\nB=\"x\"y", 2},
+		{"unterminated brace", "A=${B", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.input), Options{})
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("Parse() error = %v, want ParseError", err)
+			}
+			if perr.Line != tt.line {
+				t.Errorf("error line = %d, want %d (%v)", perr.Line, tt.line, err)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	secrets := map[string]string{
+		"PLAIN":     "value",
+		"EMPTY":     "",
+		"SPACES":    "a b  c ",
+		"DOLLAR":    "${OTHER} $HOME",
+		"QUOTES":    `it's "quoted"`,
+		"BACKSLASH": `C:\path\to`,
+		"MULTILINE": "-----BEGIN KEY-----\nabc\n-----END KEY-----\n",
+		"MIXED":     "it's $5\n\t\\ \"#\"",
+		"HASH":      "#not-a-comment",
+		"CR":        "a\r\nb",
+		"UNICODE":   "héllo wörld ✓",
+		"PLAIN2":    "PLAIN",
+	}
+
+	entries, err := Parse(Marshal(secrets), Options{})
+	if err != nil {
+		t.Fatalf("Parse(Marshal()) error = %v\n%s", err, Marshal(secrets))
+	}
+	got := ToMap(entries)
+	if len(got) != len(secrets) {
+		t.Fatalf("round trip returned %d keys, want %d", len(got), len(secrets))
+	}
+	for k, v := range secrets {
+		if got[k] != v {
+			t.Errorf("round trip %s = %q, want %q", k, got[k], v)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Package format converts secrets between flat keys and the nested objects
+// of JSON, YAML and TOML files, and quotes them for shell export.
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSeparator splits keys into nested objects: DB__HOST becomes DB.HOST
+const DefaultSeparator = "__"
+
+// Nest turns flat keys into nested objects by splitting on sep. A key that
+// is both a value and a parent (DB and DB__HOST) can't be represented.
+func Nest(secrets map[string]string, sep string) (map[string]any, error) {
+	keys := make([]string, 0, len(secrets))
+	for k := range secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	root := make(map[string]any)
+	for _, key := range keys {
+		parts := []string{key}
+		if sep != "" {
+			parts = strings.Split(key, sep)
+		}
+		for _, p := range parts {
+			if p == "" {
+				return nil, fmt.Errorf("can't nest %s: empty path segment (change --separator)", key)
+			}
+		}
+
+		node := root
+		for i, p := range parts[:len(parts)-1] {
+			switch child := node[p].(type) {
+			case map[string]any:
+				node = child
+			case nil:
+				next := make(map[string]any)
+				node[p] = next
+				node = next
+			default:
+				return nil, fmt.Errorf("can't nest %s: %s is also a value", key, strings.Join(parts[:i+1], sep))
+			}
+		}
+
+		last := parts[len(parts)-1]
+		if _, ok := node[last]; ok {
+			return nil, fmt.Errorf("can't nest %s: it is also a parent of other keys", key)
+		}
+		node[last] = secrets[key]
+	}
+	return root, nil
+}
+
+// Flatten is the inverse of Nest: nested objects become keys joined with
+// sep, and scalar values are converted to strings
+func Flatten(data map[string]any, sep string) (map[string]string, error) {
+	result := make(map[string]string)
+	if err := flattenInto(result, data, "", sep); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func flattenInto(result map[string]string, data map[string]any, prefix, sep string) error {
+	for k, v := range data {
+		key := k
+		if prefix != "" {
+			if sep == "" {
+				return fmt.Errorf("%s: nested keys need a separator", prefix)
+			}
+			key = prefix + sep + k
+		}
+
+		if nested, ok := v.(map[string]any); ok {
+			if err := flattenInto(result, nested, key, sep); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, err := scalarString(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if _, ok := result[key]; ok {
+			return fmt.Errorf("%s: duplicate key after flattening", key)
+		}
+		result[key] = value
+	}
+	return nil
+}
+
+// scalarString renders a decoded YAML, TOML or JSON scalar as a secret value
+func scalarString(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case []any:
+		return "", fmt.Errorf("lists aren't supported")
+	default:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+}
@@ -0,0 +1,124 @@
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNest(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		sep     string
+		want    string
+		wantErr string
+	}{
+		{"flat", map[string]string{"A": "1", "B": "2"}, "__", `{"A":"1","B":"2"}`, ""},
+		{"nested", map[string]string{"DB__HOST": "h", "DB__PORT": "5432", "NAME": "x"}, "__", `{"DB":{"HOST":"h","PORT":"5432"},"NAME":"x"}`, ""},
+		{"deep", map[string]string{"A__B__C": "v"}, "__", `{"A":{"B":{"C":"v"}}}`, ""},
+		{"no separator", map[string]string{"A__B": "v"}, "", `{"A__B":"v"}`, ""},
+		{"custom separator", map[string]string{"A.B": "v"}, ".", `{"A":{"B":"v"}}`, ""},
+		{"value and parent", map[string]string{"A": "1", "A__B": "2"}, "__", "", "can't nest A__B: A is also a value"},
+		{"parent and value", map[string]string{"A__B": "1", "A__B__C": "2"}, "__", "", "can't nest A__B__C: A__B is also a value"},
+		{"empty segment", map[string]string{"A____B": "v"}, "__", "", "empty path segment"},
+		{"leading separator", map[string]string{"__A": "v"}, "__", "", "empty path segment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Nest(tt.secrets, tt.sep)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Nest() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Nest() error = %v", err)
+			}
+			data, _ := json.Marshal(got)
+			if string(data) != tt.want {
+				t.Errorf("Nest() = %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]any
+		sep     string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "scalars",
+			data: map[string]any{"S": "x", "I": 42, "I64": int64(-7), "U": uint64(9), "F": 1.5, "B": true, "N": nil, "J": json.Number("1.50")},
+			sep:  "__",
+			want: map[string]string{"S": "x", "I": "42", "I64": "-7", "U": "9", "F": "1.5", "B": "true", "N": "", "J": "1.50"},
+		},
+		{
+			name: "time",
+			data: map[string]any{"T": time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+			want: map[string]string{"T": "2024-01-02T03:04:05Z"},
+		},
+		{
+			name: "nested",
+			data: map[string]any{"DB": map[string]any{"HOST": "h", "OPTS": map[string]any{"SSL": false}}},
+			sep:  "__",
+			want: map[string]string{"DB__HOST": "h", "DB__OPTS__SSL": "false"},
+		},
+		{
+			name:    "nested without separator",
+			data:    map[string]any{"DB": map[string]any{"HOST": "h"}},
+			wantErr: "DB: nested keys need a separator",
+		},
+		{
+			name:    "duplicate after flattening",
+			data:    map[string]any{"A__B": "1", "A": map[string]any{"B": "2"}},
+			sep:     "__",
+			wantErr: "A__B: duplicate key after flattening",
+		},
+		{
+			name:    "list",
+			data:    map[string]any{"HOSTS": []any{"a", "b"}},
+			sep:     "__",
+			wantErr: "HOSTS: lists aren't supported",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Flatten(tt.data, tt.sep)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Flatten() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Flatten() error = %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Flatten() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNestFlattenRoundTrip(t *testing.T) {
+	secrets := map[string]string{"DB__HOST": "h", "DB__PORT": "5432", "API_KEY": "k", "EMPTY": ""}
+	nested, err := Nest(secrets, DefaultSeparator)
+	if err != nil {
+		t.Fatalf("Nest() error = %v", err)
+	}
+	got, err := Flatten(nested, DefaultSeparator)
+	if err != nil {
+		t.Fatalf("Flatten() error = %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(secrets) {
+		t.Errorf("round trip = %v, want %v", got, secrets)
+	}
+}
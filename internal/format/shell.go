@@ -0,0 +1,78 @@
+package format
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// shells are the export formats that emit shell code for eval
+var shells = map[string]func(key, value string) string{
+	"bash": func(key, value string) string {
+		return fmt.Sprintf("export %s=%s", key, QuotePOSIX(value))
+	},
+	"fish": func(key, value string) string {
+		return fmt.Sprintf("set -gx %s %s", key, QuoteFish(value))
+	},
+	"powershell": func(key, value string) string {
+		return fmt.Sprintf("$env:%s = %s", key, QuotePowerShell(value))
+	},
+	"nushell": func(key, value string) string {
+		return fmt.Sprintf("$env.%s = %s", key, QuoteNushell(value))
+	},
+}
+
+// WriteShell writes one statement per secret, sorted by key, that sets it
+// as an environment variable in shell: bash, fish, powershell or nushell
+func WriteShell(w io.Writer, secrets map[string]string, shell string) error {
+	line, ok := shells[shell]
+	if !ok {
+		return fmt.Errorf("unknown shell: %s", shell)
+	}
+
+	keys := make([]string, 0, len(secrets))
+	for k := range secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if _, err := fmt.Fprintln(w, line(key, secrets[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QuotePOSIX single-quotes a value for sh/bash/zsh. Nothing is special inside
+// single quotes, so an embedded quote closes the string, adds an escaped
+// quote and reopens it.
+func QuotePOSIX(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// QuoteFish single-quotes a value for fish, where only \ and ' are escapes
+func QuoteFish(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(value, "'", `\'`) + "'"
+}
+
+// QuotePowerShell single-quotes a value for PowerShell, where a quote is
+// escaped by doubling it. PowerShell also treats typographic quotes as quotes.
+func QuotePowerShell(value string) string {
+	for _, q := range []string{"'", "‘", "’", "‚", "‛"} {
+		value = strings.ReplaceAll(value, q, q+q)
+	}
+	return "'" + value + "'"
+}
+
+// QuoteNushell writes a nushell raw string, r#'...'#, with enough #s that
+// the value can't terminate it early
+func QuoteNushell(value string) string {
+	hashes := "#"
+	for strings.Contains(value, "'"+hashes) {
+		hashes += "#"
+	}
+	return "r" + hashes + "'" + value + "'" + hashes
+}
@@ -0,0 +1,132 @@
+package format
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// shellValues are the values every quoting function must survive
+var shellValues = []struct {
+	name  string
+	value string
+}{
+	{"empty", ""},
+	{"plain", "value"},
+	{"spaces", "a b  c"},
+	{"single quote", "it's"},
+	{"double quote", `say "hi"`},
+	{"backslash", `C:\path\`},
+	{"backslash before quote", `\'`},
+	{"newline", "line1\nline2\n"},
+	{"dollar", "$HOME ${USER} $(id)"},
+	{"backtick", "`id`"},
+	{"hash", "a #b"},
+	{"typographic quotes", "‘curly’"},
+	{"raw string terminator", "'#"},
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		quote func(string) string
+		value string
+		want  string
+	}{
+		{QuotePOSIX, "", `''`},
+		{QuotePOSIX, "it's", `'it'\''s'`},
+		{QuotePOSIX, `a\b $X "y" ` + "`z`", `'a\b $X "y" ` + "`z`'"},
+		{QuotePOSIX, "a\nb", "'a\nb'"},
+		{QuoteFish, "", `''`},
+		{QuoteFish, "it's", `'it\'s'`},
+		{QuoteFish, `C:\dir\`, `'C:\\dir\\'`},
+		{QuoteFish, `$X "y" ` + "`z`", `'$X "y" ` + "`z`'"},
+		{QuotePowerShell, "", `''`},
+		{QuotePowerShell, "it's", `'it''s'`},
+		{QuotePowerShell, "‘a’", `'‘‘a’’'`},
+		{QuotePowerShell, `$env:X \ "y" ` + "`n", `'$env:X \ "y" ` + "`n'"},
+		{QuoteNushell, "", `r#''#`},
+		{QuoteNushell, "it's", `r#'it's'#`},
+		{QuoteNushell, "'#", `r##''#'##`},
+		{QuoteNushell, "a'##b", `r###'a'##b'###`},
+	}
+	for _, tt := range tests {
+		if got := tt.quote(tt.value); got != tt.want {
+			t.Errorf("quote(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+// interpreters print a quoted value with each shell's own parser. The
+// expected strings in TestQuote pin the exact output; these check that the
+// shells read it back as the original value.
+var interpreters = []struct {
+	shell string
+	quote func(string) string
+	args  func(quoted string) []string
+}{
+	{"sh", QuotePOSIX, posixPrint},
+	{"bash", QuotePOSIX, posixPrint},
+	{"dash", QuotePOSIX, posixPrint},
+	{"zsh", QuotePOSIX, posixPrint},
+	{"fish", QuoteFish, func(q string) []string {
+		return []string{"--no-config", "-c", "printf '%s' " + q}
+	}},
+	{"pwsh", QuotePowerShell, func(q string) []string {
+		return []string{"-NoProfile", "-NonInteractive", "-Command", "[Console]::Out.Write(" + q + ")"}
+	}},
+	{"nu", QuoteNushell, func(q string) []string {
+		return []string{"--no-config-file", "-c", "print -n " + q}
+	}},
+}
+
+func posixPrint(q string) []string {
+	return []string{"-c", "printf '%s' " + q}
+}
+
+// TestQuoteInterpreters evaluates quoted values in every shell that is
+// installed. Shells that aren't are skipped, so run this where fish, pwsh
+// and nu are available to cover all of them.
+func TestQuoteInterpreters(t *testing.T) {
+	for _, sh := range interpreters {
+		t.Run(sh.shell, func(t *testing.T) {
+			path, err := exec.LookPath(sh.shell)
+			if err != nil {
+				t.Skipf("%s not installed", sh.shell)
+			}
+			for _, tt := range shellValues {
+				t.Run(tt.name, func(t *testing.T) {
+					out, err := exec.Command(path, sh.args(sh.quote(tt.value))...).Output()
+					if err != nil {
+						t.Fatalf("%s error = %v", sh.shell, err)
+					}
+					if string(out) != tt.value {
+						t.Errorf("%s printed %q, want %q", sh.shell, out, tt.value)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestWriteShell(t *testing.T) {
+	secrets := map[string]string{"B": "it's", "A": "1"}
+	tests := map[string]string{
+		"bash":       "export A='1'\nexport B='it'\\''s'\n",
+		"fish":       "set -gx A '1'\nset -gx B 'it\\'s'\n",
+		"powershell": "$env:A = '1'\n$env:B = 'it''s'\n",
+		"nushell":    "$env.A = r#'1'#\n$env.B = r#'it's'#\n",
+	}
+	for shell, want := range tests {
+		var buf bytes.Buffer
+		if err := WriteShell(&buf, secrets, shell); err != nil {
+			t.Fatalf("WriteShell(%s) error = %v", shell, err)
+		}
+		if buf.String() != want {
+			t.Errorf("WriteShell(%s) =\n%s\nwant\n%s", shell, buf.String(), want)
+		}
+	}
+	if err := WriteShell(&bytes.Buffer{}, secrets, "tcsh"); err == nil || !strings.Contains(err.Error(), "unknown shell") {
+		t.Errorf("WriteShell(tcsh) error = %v", err)
+	}
+}
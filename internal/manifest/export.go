@@ -0,0 +1,195 @@
+package manifest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Metadata is the metadata of an exported Kubernetes object
+type Metadata struct {
+	Name        string            `yaml:"name"`
+	Namespace   string            `yaml:"namespace,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// k8sSecret is an exported v1/Secret
+type k8sSecret struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   Metadata          `yaml:"metadata"`
+	Type       string            `yaml:"type"`
+	Data       map[string]string `yaml:"data"`
+}
+
+// sealedSecret is an exported bitnami.com/v1alpha1 SealedSecret
+type sealedSecret struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Kind       string   `yaml:"kind"`
+	Metadata   Metadata `yaml:"metadata"`
+	Spec       struct {
+		EncryptedData map[string]string `yaml:"encryptedData"`
+		Template      struct {
+			Metadata Metadata `yaml:"metadata"`
+			Type     string   `yaml:"type"`
+		} `yaml:"template"`
+	} `yaml:"spec"`
+}
+
+// Sealing scopes, as understood by the sealed-secrets controller
+const (
+	ScopeStrict        = "strict"
+	ScopeNamespaceWide = "namespace-wide"
+	ScopeClusterWide   = "cluster-wide"
+)
+
+// WriteSecret writes secrets as a v1/Secret manifest with base64 data
+func WriteSecret(w io.Writer, secrets map[string]string, meta Metadata) error {
+	secret := k8sSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   meta,
+		Type:       "Opaque",
+		Data:       make(map[string]string, len(secrets)),
+	}
+	for key, value := range secrets {
+		secret.Data[key] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return encode(w, secret)
+}
+
+// WriteSealedSecret writes secrets as a SealedSecret whose values are
+// encrypted to the sealed-secrets controller's public key, so only the
+// controller in the cluster can turn it back into a Secret
+func WriteSealedSecret(w io.Writer, secrets map[string]string, meta Metadata, pubKey *rsa.PublicKey, scope string) error {
+	label, annotations, err := scopeLabel(meta, scope)
+	if err != nil {
+		return err
+	}
+
+	sealed := sealedSecret{APIVersion: "bitnami.com/v1alpha1", Kind: "SealedSecret"}
+	sealed.Metadata = Metadata{Name: meta.Name, Namespace: meta.Namespace}
+	if len(annotations) > 0 {
+		sealed.Metadata.Annotations = annotations
+	}
+	sealed.Spec.Template.Metadata = meta
+	sealed.Spec.Template.Type = "Opaque"
+	sealed.Spec.EncryptedData = make(map[string]string, len(secrets))
+	for key, value := range secrets {
+		ciphertext, err := hybridEncrypt(pubKey, []byte(value), []byte(label))
+		if err != nil {
+			return fmt.Errorf("failed to seal %s: %w", key, err)
+		}
+		sealed.Spec.EncryptedData[key] = base64.StdEncoding.EncodeToString(ciphertext)
+	}
+	return encode(w, sealed)
+}
+
+// scopeLabel returns the label a scope binds sealed values to, and the
+// annotations that tell the controller which scope was used
+func scopeLabel(meta Metadata, scope string) (string, map[string]string, error) {
+	var label string
+	annotations := make(map[string]string)
+	switch scope {
+	case ScopeStrict:
+		label = meta.Namespace + "/" + meta.Name
+	case ScopeNamespaceWide:
+		label = meta.Namespace
+		annotations["sealedsecrets.bitnami.com/namespace-wide"] = "true"
+	case ScopeClusterWide:
+		annotations["sealedsecrets.bitnami.com/cluster-wide"] = "true"
+	default:
+		return "", nil, fmt.Errorf("unknown seal scope: %s (use 'strict', 'namespace-wide' or 'cluster-wide')", scope)
+	}
+	if scope != ScopeClusterWide && meta.Namespace == "" {
+		return "", nil, fmt.Errorf("--namespace is required to seal with %s scope", scope)
+	}
+	return label, annotations, nil
+}
+
+func encode(w io.Writer, v any) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// hybridEncrypt encrypts plaintext the way kubeseal does: a random AES-256
+// session key is RSA-OAEP encrypted (SHA-256, with label binding the scope)
+// and prefixed with its 2-byte length, followed by the AES-GCM ciphertext
+// under a zero nonce (safe because each session key is used once)
+func hybridEncrypt(pubKey *rsa.PublicKey, plaintext, label []byte) ([]byte, error) {
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaCiphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pubKey, sessionKey, label)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 2, 2+len(rsaCiphertext)+len(plaintext)+gcm.Overhead())
+	binary.BigEndian.PutUint16(out, uint16(len(rsaCiphertext)))
+	out = append(out, rsaCiphertext...)
+	return gcm.Seal(out, make([]byte, gcm.NonceSize()), plaintext, nil), nil
+}
+
+// ParseSealingKey reads an RSA public key from a PEM certificate (as printed
+// by 'kubeseal --fetch-cert') or a PEM public key
+func ParseSealingKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	var pub any
+	var err error
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub = cert.PublicKey
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("sealing key must be RSA")
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,213 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func newSealingKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	return key
+}
+
+// hybridDecrypt reverses hybridEncrypt the way the sealed-secrets controller
+// does. OAEP decryption fails unless label matches the one sealed with.
+func hybridDecrypt(t *testing.T, key *rsa.PrivateKey, ciphertext, label []byte) (string, error) {
+	t.Helper()
+	if len(ciphertext) < 2 {
+		t.Fatal("ciphertext too short")
+	}
+	n := int(binary.BigEndian.Uint16(ciphertext))
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), nil, key, ciphertext[2:2+n], label)
+	if err != nil {
+		return "", err
+	}
+	block, _ := aes.NewCipher(sessionKey)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, make([]byte, gcm.NonceSize()), ciphertext[2+n:], nil)
+	if err != nil {
+		t.Fatalf("gcm.Open() error = %v", err)
+	}
+	return string(plaintext), nil
+}
+
+func TestWriteSecret(t *testing.T) {
+	var buf bytes.Buffer
+	meta := Metadata{Name: "app", Namespace: "prod", Labels: map[string]string{"app": "web"}}
+	if err := WriteSecret(&buf, map[string]string{"B": "two", "A": "one"}, meta); err != nil {
+		t.Fatalf("WriteSecret() error = %v", err)
+	}
+	want := `apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: prod
+  labels:
+    app: web
+type: Opaque
+data:
+  A: b25l
+  B: dHdv
+`
+	if buf.String() != want {
+		t.Errorf("WriteSecret() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteSealedSecret(t *testing.T) {
+	key := newSealingKey(t)
+	values := map[string]string{"API_KEY": "sk-123", "EMPTY": ""}
+	meta := Metadata{Name: "app", Namespace: "prod", Annotations: map[string]string{"team": "web"}}
+
+	tests := []struct {
+		scope string
+		label string
+	}{
+		{ScopeStrict, "prod/app"},
+		{ScopeNamespaceWide, "prod"},
+		{ScopeClusterWide, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteSealedSecret(&buf, values, meta, &key.PublicKey, tt.scope); err != nil {
+				t.Fatalf("WriteSealedSecret() error = %v", err)
+			}
+			var sealed sealedSecret
+			if err := yaml.Unmarshal(buf.Bytes(), &sealed); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if len(sealed.Spec.EncryptedData) != len(values) {
+				t.Fatalf("encryptedData = %v", sealed.Spec.EncryptedData)
+			}
+			for k, want := range values {
+				ciphertext, err := base64.StdEncoding.DecodeString(sealed.Spec.EncryptedData[k])
+				if err != nil {
+					t.Fatalf("%s: invalid base64: %v", k, err)
+				}
+				got, err := hybridDecrypt(t, key, ciphertext, []byte(tt.label))
+				if err != nil {
+					t.Fatalf("%s: decrypt with label %q error = %v", k, tt.label, err)
+				}
+				if got != want {
+					t.Errorf("%s = %q, want %q", k, got, want)
+				}
+				// The label binds the value to its scope
+				if _, err := hybridDecrypt(t, key, ciphertext, []byte("other/app")); err == nil {
+					t.Errorf("%s: decrypt with another label succeeded", k)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteSealedSecretStructure(t *testing.T) {
+	key := newSealingKey(t)
+	meta := Metadata{Name: "app", Namespace: "prod", Labels: map[string]string{"app": "web"}}
+	var buf bytes.Buffer
+	if err := WriteSealedSecret(&buf, map[string]string{"API_KEY": "sk-123"}, meta, &key.PublicKey, ScopeNamespaceWide); err != nil {
+		t.Fatalf("WriteSealedSecret() error = %v", err)
+	}
+
+	// Replace the random ciphertext so the rest can be compared exactly
+	var sealed sealedSecret
+	if err := yaml.Unmarshal(buf.Bytes(), &sealed); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	for k := range sealed.Spec.EncryptedData {
+		sealed.Spec.EncryptedData[k] = "<sealed>"
+	}
+	var got bytes.Buffer
+	encode(&got, sealed)
+	want := `apiVersion: bitnami.com/v1alpha1
+kind: SealedSecret
+metadata:
+  name: app
+  namespace: prod
+  annotations:
+    sealedsecrets.bitnami.com/namespace-wide: "true"
+spec:
+  encryptedData:
+    API_KEY: <sealed>
+  template:
+    metadata:
+      name: app
+      namespace: prod
+      labels:
+        app: web
+    type: Opaque
+`
+	if got.String() != want {
+		t.Errorf("WriteSealedSecret() =\n%s\nwant\n%s", got.String(), want)
+	}
+}
+
+func TestWriteSealedSecretErrors(t *testing.T) {
+	key := newSealingKey(t)
+	tests := []struct {
+		name    string
+		meta    Metadata
+		scope   string
+		wantErr string
+	}{
+		{"unknown scope", Metadata{Name: "app", Namespace: "prod"}, "global", "unknown seal scope"},
+		{"strict without namespace", Metadata{Name: "app"}, ScopeStrict, "--namespace is required"},
+		{"namespace-wide without namespace", Metadata{Name: "app"}, ScopeNamespaceWide, "--namespace is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := WriteSealedSecret(&bytes.Buffer{}, map[string]string{"A": "b"}, tt.meta, &key.PublicKey, tt.scope)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("WriteSealedSecret() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseSealingKey(t *testing.T) {
+	key := newSealingKey(t)
+	pkix, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	tests := []struct {
+		name    string
+		input   []byte
+		wantErr string
+	}{
+		{"public key", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}), ""},
+		{"rsa public key", pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)}), ""},
+		{"not pem", []byte("hello"), "no PEM data"},
+		{"private key", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), "unsupported PEM block"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSealingKey(tt.input)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ParseSealingKey() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSealingKey() error = %v", err)
+			}
+			if !got.Equal(&key.PublicKey) {
+				t.Error("ParseSealingKey() returned a different key")
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package manifest reads secret values out of docker-compose files and
+// Kubernetes Secret and ConfigMap manifests, and writes them as Secrets or
+// as SealedSecrets for the sealed-secrets controller.
+//
+// Kubernetes keys are often file names or dotted config names (db-password,
+// app.properties), so they are normalized to environment variable names:
+// upper-cased, with '-' and '.' replaced by '_'.
+package manifest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Formats recognized by DetectFormat
+const (
+	FormatCompose   = "compose"
+	FormatSecret    = "k8s-secret"
+	FormatConfigMap = "configmap"
+	FormatYAML      = "yaml"
+)
+
+// composeFile is the part of a docker-compose.yml that holds variables
+type composeFile struct {
+	Services map[string]struct {
+		Environment yaml.Node `yaml:"environment"`
+	} `yaml:"services"`
+}
+
+// manifest is the part of a Kubernetes Secret or ConfigMap that holds values
+type manifest struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Data       map[string]string `yaml:"data"`
+	StringData map[string]string `yaml:"stringData"`
+	BinaryData map[string]string `yaml:"binaryData"`
+}
+
+// DetectFormat recognizes Kubernetes manifests and compose files among YAML
+// files, falling back to plain YAML
+func DetectFormat(data []byte) string {
+	docs, err := decodeManifests(data)
+	if err == nil {
+		for _, m := range docs {
+			switch m.Kind {
+			case "Secret":
+				return FormatSecret
+			case "ConfigMap":
+				return FormatConfigMap
+			}
+		}
+	}
+
+	var compose composeFile
+	if yaml.Unmarshal(data, &compose) == nil && len(compose.Services) > 0 {
+		return FormatCompose
+	}
+	return FormatYAML
+}
+
+// NormalizeKey turns a Kubernetes data key into an environment variable
+// name: DB_PASSWORD for db-password, APP_NAME for app.name
+func NormalizeKey(key string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+}
+
+// ParseCompose collects the environment: blocks of a compose file's
+// services. With service set, only that service is read. Variables without
+// a value (passed through from the host) are skipped.
+func ParseCompose(data []byte, service string) (map[string]string, error) {
+	var compose composeFile
+	if err := yaml.Unmarshal(data, &compose); err != nil {
+		return nil, err
+	}
+	if len(compose.Services) == 0 {
+		return nil, fmt.Errorf("no services found")
+	}
+
+	names := make([]string, 0, len(compose.Services))
+	for name := range compose.Services {
+		if service == "" || name == service {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("service '%s' not found", service)
+	}
+	sort.Strings(names)
+
+	result := make(map[string]string)
+	source := make(map[string]string)
+	for _, name := range names {
+		svc := compose.Services[name]
+		env, err := composeEnvironment(&svc.Environment)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", name, err)
+		}
+		for key, value := range env {
+			if prev, ok := result[key]; ok && prev != value {
+				return nil, fmt.Errorf("%s differs between services %s and %s (use --service)", key, source[key], name)
+			}
+			result[key] = value
+			source[key] = name
+		}
+	}
+	return result, nil
+}
+
+// composeEnvironment reads an environment: block in either map or
+// KEY=VALUE list form. Map values are taken as written, so 1.50 stays 1.50.
+func composeEnvironment(node *yaml.Node) (map[string]string, error) {
+	result := make(map[string]string)
+	switch node.Kind {
+	case 0:
+		// No environment block
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			if value.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("%s: value must be a string, number or boolean", key)
+			}
+			if value.Tag == "!!null" {
+				continue
+			}
+			result[key] = value.Value
+		}
+	case yaml.SequenceNode:
+		var env []string
+		if err := node.Decode(&env); err != nil {
+			return nil, err
+		}
+		for _, item := range env {
+			if key, value, ok := strings.Cut(item, "="); ok {
+				result[key] = value
+			}
+		}
+	default:
+		return nil, fmt.Errorf("environment must be a map or a list")
+	}
+	return result, nil
+}
+
+// ParseSecret reads the values of the Secrets in a (multi-document)
+// manifest: base64 data, overridden by plaintext stringData
+func ParseSecret(data []byte) (map[string]string, error) {
+	return parseManifests(data, "Secret", func(m *manifest) (map[string]string, error) {
+		decoded, err := decodeBase64(m.Data, "data")
+		if err != nil {
+			return nil, err
+		}
+		result, err := normalizeKeys(decoded)
+		if err != nil {
+			return nil, fmt.Errorf("data: %w", err)
+		}
+		plain, err := normalizeKeys(m.StringData)
+		if err != nil {
+			return nil, fmt.Errorf("stringData: %w", err)
+		}
+		for key, value := range plain {
+			result[key] = value
+		}
+		return result, nil
+	})
+}
+
+// ParseConfigMap reads the values of the ConfigMaps in a manifest: data and
+// base64 binaryData
+func ParseConfigMap(data []byte) (map[string]string, error) {
+	return parseManifests(data, "ConfigMap", func(m *manifest) (map[string]string, error) {
+		decoded, err := decodeBase64(m.BinaryData, "binaryData")
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]string, len(m.Data)+len(decoded))
+		for key, value := range m.Data {
+			values[key] = value
+		}
+		for key, value := range decoded {
+			if _, ok := values[key]; ok {
+				return nil, fmt.Errorf("%s is in both data and binaryData", key)
+			}
+			values[key] = value
+		}
+		return normalizeKeys(values)
+	})
+}
+
+// parseManifests merges the values of every document of the given kind.
+// A key with different values in two documents is an error, and so is
+// finding no values at all.
+func parseManifests(data []byte, kind string, read func(*manifest) (map[string]string, error)) (map[string]string, error) {
+	docs, err := decodeManifests(data)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	source := make(map[string]string)
+	found := false
+	for i := range docs {
+		m := &docs[i]
+		if m.Kind != kind {
+			continue
+		}
+		found = true
+
+		values, err := read(m)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", kind, m.Metadata.Name, err)
+		}
+		for key, value := range values {
+			if prev, ok := result[key]; ok && prev != value {
+				return nil, fmt.Errorf("%s differs between %s %s and %s", key, kind, source[key], m.Metadata.Name)
+			}
+			result[key] = value
+			source[key] = m.Metadata.Name
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no %s found in manifest", kind)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no values found in %s", kind)
+	}
+	return result, nil
+}
+
+// normalizeKeys applies NormalizeKey to every key. Two keys that normalize
+// to the same name (db-host and DB_HOST) are an error unless their values
+// match.
+func normalizeKeys(values map[string]string) (map[string]string, error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make(map[string]string, len(values))
+	source := make(map[string]string, len(values))
+	for _, key := range keys {
+		name := NormalizeKey(key)
+		if prev, ok := source[name]; ok && result[name] != values[key] {
+			return nil, fmt.Errorf("%s and %s both become %s", prev, key, name)
+		}
+		result[name] = values[key]
+		source[name] = key
+	}
+	return result, nil
+}
+
+// decodeBase64 decodes the values of a data or binaryData field
+func decodeBase64(values map[string]string, field string) (map[string]string, error) {
+	result := make(map[string]string, len(values))
+	for key, encoded := range values {
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid base64 in %s: %w", key, field, err)
+		}
+		result[key] = string(value)
+	}
+	return result, nil
+}
+
+// decodeManifests decodes every document in a YAML stream
+func decodeManifests(data []byte) ([]manifest, error) {
+	var docs []manifest
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var m manifest
+		err := dec.Decode(&m)
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, m)
+	}
+}
@@ -0,0 +1,219 @@
+package manifest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"secret", "apiVersion: v1\nkind: Secret\nmetadata:\n  name: app\n", FormatSecret},
+		{"configmap", "apiVersion: v1\nkind: ConfigMap\n", FormatConfigMap},
+		{"secret after another document", "kind: Service\n---\nkind: Secret\n", FormatSecret},
+		{"compose", "services:\n  web:\n    image: nginx\n", FormatCompose},
+		{"plain yaml", "db:\n  host: localhost\n", FormatYAML},
+		{"invalid yaml", "a: [", FormatYAML},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectFormat([]byte(tt.input)); got != tt.want {
+				t.Errorf("DetectFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	tests := map[string]string{
+		"DB_HOST":         "DB_HOST",
+		"db-password":     "DB_PASSWORD",
+		"app.properties":  "APP_PROPERTIES",
+		"Mixed.case-Name": "MIXED_CASE_NAME",
+	}
+	for key, want := range tests {
+		if got := NormalizeKey(key); got != want {
+			t.Errorf("NormalizeKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestParseCompose(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		service string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:  "map form",
+			input: "services:\n  web:\n    environment:\n      HOST: db\n      PORT: 5432\n      RATIO: 1.50\n      DEBUG: true\n      FROM_HOST:\n",
+			want:  map[string]string{"HOST": "db", "PORT": "5432", "RATIO": "1.50", "DEBUG": "true"},
+		},
+		{
+			name:  "list form",
+			input: "services:\n  web:\n    environment:\n      - HOST=db\n      - URL=a=b\n      - FROM_HOST\n",
+			want:  map[string]string{"HOST": "db", "URL": "a=b"},
+		},
+		{
+			name:  "services merged",
+			input: "services:\n  web:\n    environment:\n      HOST: db\n  worker:\n    environment:\n      - HOST=db\n      - QUEUE=jobs\n",
+			want:  map[string]string{"HOST": "db", "QUEUE": "jobs"},
+		},
+		{
+			name:    "services disagree",
+			input:   "services:\n  web:\n    environment:\n      HOST: a\n  worker:\n    environment:\n      HOST: b\n",
+			wantErr: "HOST differs between services web and worker",
+		},
+		{
+			name:    "one service",
+			input:   "services:\n  web:\n    environment:\n      HOST: a\n  worker:\n    environment:\n      HOST: b\n",
+			service: "worker",
+			want:    map[string]string{"HOST": "b"},
+		},
+		{
+			name:    "unknown service",
+			input:   "services:\n  web:\n    image: nginx\n",
+			service: "api",
+			wantErr: "service 'api' not found",
+		},
+		{
+			name:    "nested value",
+			input:   "services:\n  web:\n    environment:\n      HOST:\n        a: b\n",
+			wantErr: "HOST: value must be",
+		},
+		{
+			name:    "no services",
+			input:   "version: '3'\n",
+			wantErr: "no services found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCompose([]byte(tt.input), tt.service)
+			checkParse(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestParseSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:  "data is base64",
+			input: "kind: Secret\ndata:\n  API_KEY: c2stMTIz\n",
+			want:  map[string]string{"API_KEY": "sk-123"},
+		},
+		{
+			name:  "stringData wins over data",
+			input: "kind: Secret\ndata:\n  API_KEY: b2xk\n  OTHER: eA==\nstringData:\n  API_KEY: new\n",
+			want:  map[string]string{"API_KEY": "new", "OTHER": "x"},
+		},
+		{
+			name:  "stringData wins after normalizing",
+			input: "kind: Secret\ndata:\n  api-key: b2xk\nstringData:\n  API_KEY: new\n",
+			want:  map[string]string{"API_KEY": "new"},
+		},
+		{
+			name:  "keys normalized",
+			input: "kind: Secret\nstringData:\n  db-password: p\n  app.name: x\n",
+			want:  map[string]string{"DB_PASSWORD": "p", "APP_NAME": "x"},
+		},
+		{
+			name:    "normalized keys collide",
+			input:   "kind: Secret\nstringData:\n  db-host: a\n  DB_HOST: b\n",
+			wantErr: "DB_HOST and db-host both become DB_HOST",
+		},
+		{
+			name:  "documents merged",
+			input: "kind: Secret\nmetadata:\n  name: a\nstringData:\n  A: \"1\"\n---\nkind: ConfigMap\ndata:\n  B: \"2\"\n---\nkind: Secret\nmetadata:\n  name: b\nstringData:\n  C: \"3\"\n",
+			want:  map[string]string{"A": "1", "C": "3"},
+		},
+		{
+			name:    "documents disagree",
+			input:   "kind: Secret\nmetadata:\n  name: a\nstringData:\n  A: \"1\"\n---\nkind: Secret\nmetadata:\n  name: b\nstringData:\n  A: \"2\"\n",
+			wantErr: "A differs between Secret a and b",
+		},
+		{
+			name:    "invalid base64",
+			input:   "kind: Secret\nmetadata:\n  name: app\ndata:\n  A: \"!!\"\n",
+			wantErr: "Secret app: A: invalid base64 in data",
+		},
+		{
+			name:    "empty",
+			input:   "kind: Secret\nmetadata:\n  name: app\n",
+			wantErr: "no values found in Secret",
+		},
+		{
+			name:    "no secret",
+			input:   "kind: ConfigMap\ndata:\n  A: b\n",
+			wantErr: "no Secret found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSecret([]byte(tt.input))
+			checkParse(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestParseConfigMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:  "data and binaryData",
+			input: "kind: ConfigMap\ndata:\n  log-level: debug\nbinaryData:\n  cert.pem: Y2VydA==\n",
+			want:  map[string]string{"LOG_LEVEL": "debug", "CERT_PEM": "cert"},
+		},
+		{
+			name:    "key in both fields",
+			input:   "kind: ConfigMap\ndata:\n  A: x\nbinaryData:\n  A: eA==\n",
+			wantErr: "A is in both data and binaryData",
+		},
+		{
+			name:    "empty",
+			input:   "kind: ConfigMap\ndata: {}\n",
+			wantErr: "no values found in ConfigMap",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseConfigMap([]byte(tt.input))
+			checkParse(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func checkParse(t *testing.T, got map[string]string, err error, want map[string]string, wantErr string) {
+	t.Helper()
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("error = %v, want %q", err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("[%s] = %q, want %q", k, got[k], v)
+		}
+	}
+}
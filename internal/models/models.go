@@ -19,6 +19,60 @@ type Environment struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// InheritanceChange records what an environment inherited from after a
+// change to its parent or layers, so past states can be read with the
+// lineage they had then
+type InheritanceChange struct {
+	EnvironmentID string    `json:"environment_id"`
+	ParentID      *string   `json:"parent_id,omitempty"`
+	LayerIDs      []string  `json:"layer_ids,omitempty"` // increasing precedence
+	Seq           int64     `json:"seq"`                 // history sequence, as in SecretHistory
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// EnvironmentKey is an environment's data key, either sealed to the vault's
+// public key (Nonce empty) or, for keys created before the vault had a
+// keypair, encrypted with the vault key. Secrets in the environment are
+// encrypted with the unwrapped data key.
+type EnvironmentKey struct {
+	EnvironmentID string    `json:"environment_id"`
+	WrappedKey    []byte    `json:"-"` // Never serialize
+	Nonce         []byte    `json:"-"` // Never serialize; empty for sealed keys
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Member is a person with their own X25519 keypair. Members are granted
+// environments by sealing the environment's data key to their public key.
+type Member struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	PublicKey []byte    `json:"public_key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MemberKey is an environment's data key sealed to a member's public key
+type MemberKey struct {
+	MemberID      string    `json:"member_id"`
+	EnvironmentID string    `json:"environment_id"`
+	SealedKey     []byte    `json:"-"` // Never serialize
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// TokenKey is an environment's data key sealed to a service token's public key
+type TokenKey struct {
+	TokenID       string    `json:"token_id"`
+	EnvironmentID string    `json:"environment_id"`
+	SealedKey     []byte    `json:"-"` // Never serialize
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// KeyGrants are the copies of an environment's data key sealed to members
+// and service tokens
+type KeyGrants struct {
+	Members []MemberKey
+	Tokens  []TokenKey
+}
+
 // Secret represents an encrypted secret value
 type Secret struct {
 	ID             string    `json:"id"`
@@ -37,6 +91,37 @@ type MergedSecret struct {
 	SourceEnvID   string `json:"source_env_id"`   // Environment where secret is defined
 	SourceEnvName string `json:"source_env_name"` // Environment name for display
 	IsInherited   bool   `json:"is_inherited"`    // true if from parent, false if local
+	// Shadowed lists lower-precedence environments that also define the key,
+	// highest precedence first
+	Shadowed []ShadowedSecret `json:"shadowed,omitempty"`
+}
+
+// ShadowedSecret is a definition of a key hidden by one with higher
+// precedence
+type ShadowedSecret struct {
+	Secret
+	SourceEnvID   string `json:"source_env_id"`
+	SourceEnvName string `json:"source_env_name"`
+}
+
+// SecretChange is one write in a batch applied atomically to an environment
+type SecretChange struct {
+	Key            string
+	EncryptedValue []byte
+	Nonce          []byte
+	Delete         bool // remove the key instead of writing it
+}
+
+// EnvironmentCopy is a copy of an environment to insert: the new row, its
+// data key, and its secrets and history already encrypted under that key.
+// The caller picks the environment's ID, since the key is bound to it.
+type EnvironmentCopy struct {
+	Environment Environment
+	Layers      []string // layer IDs, in order of increasing precedence
+	Key         EnvironmentKey
+	Secrets     []Secret
+	History     []SecretHistory
+	Grants      KeyGrants // the new key sealed to members and tokens
 }
 
 // SecretHistory records changes to secrets for versioning
@@ -48,9 +133,22 @@ type SecretHistory struct {
 	Nonce          []byte    `json:"-"`
 	Version        int       `json:"version"`
 	ChangeType     string    `json:"change_type"` // "create", "update", "delete"
+	Seq            int64     `json:"seq"`         // orders all history in the vault, even within one instant
 	CreatedAt      time.Time `json:"created_at"`
 }
 
+// Snapshot is a numbered point in an environment's history. Its secrets
+// aren't copied: they are reconstructed from the history entries with a Seq
+// up to HistorySeq.
+type Snapshot struct {
+	ID            string    `json:"id"`
+	EnvironmentID string    `json:"environment_id"`
+	Version       int       `json:"version"` // 1, 2, ... per environment
+	Message       string    `json:"message,omitempty"`
+	HistorySeq    int64     `json:"history_seq"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
 // VaultMeta stores vault-level metadata for password verification
 type VaultMeta struct {
 	ID              int       `json:"id"`
@@ -58,6 +156,9 @@ type VaultMeta struct {
 	KeyCheck        []byte    `json:"-"` // Encrypted known value for verification
 	KeyCheckNonce   []byte    `json:"-"`
 	KeychainEnabled bool      `json:"keychain_enabled"`
+	PublicKey       []byte    `json:"-"` // Vault keypair that environment keys are sealed to
+	PrivateKey      []byte    `json:"-"` // Encrypted with the vault key
+	PrivateKeyNonce []byte    `json:"-"`
 	CreatedAt       time.Time `json:"created_at"`
 }
 
@@ -73,6 +174,22 @@ type AuditLog struct {
 	ErrorMessage  string    `json:"error_message,omitempty"`
 }
 
+// APIToken is a scoped credential for the HTTP API. Only a hash of the token is stored.
+type APIToken struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	TokenHash     []byte     `json:"-"`                        // Never serialize
+	WrappedKey    []byte     `json:"-"`                        // Private key encrypted with a key derived from the token
+	WrappedNonce  []byte     `json:"-"`                        // Nonce for WrappedKey
+	PublicKey     []byte     `json:"-"`                        // Environment keys are sealed to this
+	ProjectID     string     `json:"project_id,omitempty"`     // Empty for all projects
+	EnvironmentID string     `json:"environment_id,omitempty"` // Empty for all environments in the project
+	ReadOnly      bool       `json:"read_only"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"` // nil for tokens that never expire
+	LastUsedAt    *time.Time `json:"last_used_at,omitempty"`
+}
+
 // Config represents a key-value configuration setting
 type Config struct {
 	Key   string `json:"key"`
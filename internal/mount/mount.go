@@ -0,0 +1,120 @@
+// Package mount writes the files a .coffer.yaml lists (a secret, or a
+// template rendered with secrets) while a command runs, and removes them
+// when it exits.
+package mount
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/russellromney/coffer/internal/config"
+	"github.com/russellromney/coffer/internal/render"
+)
+
+// Mounts records what Write created, so Remove deletes only that
+type Mounts struct {
+	files []string
+	dirs  []string
+}
+
+// Write writes every file pf lists. Paths must stay inside pf's directory
+// after resolving symlinks, and must not exist yet: files are created with
+// O_EXCL and mode 0600, so an existing file (or symlink) is never
+// overwritten. If a file can't be written, the ones already written are
+// removed.
+func Write(pf *config.ProjectFile, values map[string]string) (*Mounts, error) {
+	m := &Mounts{}
+	if pf == nil {
+		return m, nil
+	}
+	for _, f := range pf.Files {
+		if err := m.write(pf, f, values); err != nil {
+			m.Remove()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Mounts) write(pf *config.ProjectFile, f config.FileMount, values map[string]string) error {
+	var data []byte
+	if f.Key != "" {
+		value, ok := values[f.Key]
+		if !ok {
+			return fmt.Errorf("failed to mount %s: secret '%s' not found", f.Path, f.Key)
+		}
+		data = []byte(value)
+	} else {
+		src, err := os.ReadFile(pf.Resolve(f.Template))
+		if err != nil {
+			return fmt.Errorf("failed to read template: %w", err)
+		}
+		data, err = render.Execute(filepath.Base(f.Template), string(src), values)
+		if err != nil {
+			return fmt.Errorf("failed to mount %s: %w", f.Path, err)
+		}
+	}
+
+	path, err := pf.MountPath(f.Path)
+	if err != nil {
+		return err
+	}
+	if err := m.mkdirAll(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", f.Path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("failed to mount %s: file already exists (remove it if a previous run left it behind)", f.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mount %s: %w", f.Path, err)
+	}
+	m.files = append(m.files, path)
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to mount %s: %w", f.Path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to mount %s: %w", f.Path, err)
+	}
+	return nil
+}
+
+// mkdirAll creates dir and any missing parents with mode 0700, recording
+// the ones it created
+func (m *Mounts) mkdirAll(dir string) error {
+	var missing []string
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil {
+			break
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		missing = append(missing, p)
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0700); err != nil {
+			return err
+		}
+		m.dirs = append(m.dirs, missing[i])
+	}
+	return nil
+}
+
+// Remove deletes the files Write created, then the directories it created
+// for them if they are empty. It is safe to call more than once.
+func (m *Mounts) Remove() {
+	for _, path := range m.files {
+		os.Remove(path)
+	}
+	for i := len(m.dirs) - 1; i >= 0; i-- {
+		os.Remove(m.dirs[i])
+	}
+	m.files, m.dirs = nil, nil
+}
@@ -0,0 +1,126 @@
+package mount
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/russellromney/coffer/internal/config"
+)
+
+func projectFile(t *testing.T, files ...config.FileMount) *config.ProjectFile {
+	t.Helper()
+	dir := t.TempDir()
+	return &config.ProjectFile{Path: filepath.Join(dir, config.ProjectFileName), Files: files}
+}
+
+func TestWriteAndRemove(t *testing.T) {
+	pf := projectFile(t,
+		config.FileMount{Path: "certs/tls/tls.crt", Key: "TLS_CERT"},
+		config.FileMount{Path: "app.yaml", Template: "app.yaml.tmpl"},
+	)
+	dir := pf.Dir()
+	os.WriteFile(filepath.Join(dir, "app.yaml.tmpl"), []byte("host: {{ .HOST }}\n"), 0644)
+	os.Mkdir(filepath.Join(dir, "certs"), 0755)
+	os.WriteFile(filepath.Join(dir, "certs", "keep.txt"), []byte("mine"), 0644)
+
+	mounts, err := Write(pf, map[string]string{"TLS_CERT": "cert", "HOST": "db"})
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	cert := filepath.Join(dir, "certs", "tls", "tls.crt")
+	if data, _ := os.ReadFile(cert); string(data) != "cert" {
+		t.Errorf("tls.crt = %q, want cert", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "app.yaml")); string(data) != "host: db\n" {
+		t.Errorf("app.yaml = %q", data)
+	}
+	if info, err := os.Stat(cert); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("tls.crt mode = %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+
+	// Only what Write created is removed: the new tls directory goes, the
+	// existing certs directory and its other files stay
+	mounts.Remove()
+	mounts.Remove()
+	for _, p := range []string{cert, filepath.Join(dir, "certs", "tls"), filepath.Join(dir, "app.yaml")} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after Remove()", p)
+		}
+	}
+	for _, p := range []string{filepath.Join(dir, "certs", "keep.txt"), filepath.Join(dir, "app.yaml.tmpl")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("%s was removed: %v", p, err)
+		}
+	}
+}
+
+func TestWriteExistingFile(t *testing.T) {
+	pf := projectFile(t, config.FileMount{Path: ".env", Key: "A"})
+	existing := filepath.Join(pf.Dir(), ".env")
+	os.WriteFile(existing, []byte("user data"), 0600)
+
+	_, err := Write(pf, map[string]string{"A": "secret"})
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("Write() error = %v, want already exists", err)
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "user data" {
+		t.Errorf("existing file = %q, want it untouched", data)
+	}
+}
+
+func TestWriteSymlink(t *testing.T) {
+	outside := t.TempDir()
+	target := filepath.Join(outside, "target")
+
+	// A symlink at the mount path is never followed, even to a missing file
+	pf := projectFile(t, config.FileMount{Path: "link", Key: "A"})
+	os.Symlink(target, filepath.Join(pf.Dir(), "link"))
+	if _, err := Write(pf, map[string]string{"A": "secret"}); err == nil {
+		t.Error("Write() through a symlinked file expected error")
+	}
+
+	// Nor is a symlinked directory leading outside the project
+	pf = projectFile(t, config.FileMount{Path: "dir/secret", Key: "A"})
+	os.Symlink(outside, filepath.Join(pf.Dir(), "dir"))
+	if _, err := Write(pf, map[string]string{"A": "secret"}); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("Write() through a symlinked directory error = %v, want outside", err)
+	}
+
+	entries, _ := os.ReadDir(outside)
+	if len(entries) != 0 {
+		t.Errorf("files written outside the project: %v", entries)
+	}
+}
+
+func TestWriteEscapingPath(t *testing.T) {
+	for _, p := range []string{"../escape.env", "a/../../escape.env", "/tmp/escape.env"} {
+		pf := projectFile(t, config.FileMount{Path: p, Key: "A"})
+		if _, err := Write(pf, map[string]string{"A": "secret"}); err == nil || !strings.Contains(err.Error(), "outside") {
+			t.Errorf("Write(%s) error = %v, want outside", p, err)
+		}
+	}
+}
+
+func TestWriteFailureRemovesEarlierFiles(t *testing.T) {
+	pf := projectFile(t,
+		config.FileMount{Path: "first/a.env", Key: "A"},
+		config.FileMount{Path: "b.env", Key: "MISSING"},
+	)
+	if _, err := Write(pf, map[string]string{"A": "1"}); err == nil || !strings.Contains(err.Error(), "secret 'MISSING' not found") {
+		t.Fatalf("Write() error = %v, want missing secret", err)
+	}
+	if _, err := os.Lstat(filepath.Join(pf.Dir(), "first")); !os.IsNotExist(err) {
+		t.Error("earlier mount was left behind after a failure")
+	}
+}
+
+func TestWriteNoProjectFile(t *testing.T) {
+	mounts, err := Write(nil, nil)
+	if err != nil {
+		t.Fatalf("Write(nil) error = %v", err)
+	}
+	mounts.Remove()
+}
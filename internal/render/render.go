@@ -0,0 +1,61 @@
+// Package render executes Go text/templates against an environment's
+// secrets, with helpers for encoding and quoting values.
+package render
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"text/template"
+
+	"github.com/russellromney/coffer/internal/format"
+)
+
+// Funcs returns the helper functions available to templates. env looks
+// keys up in values.
+func Funcs(values map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"b64enc": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"b64dec": func(s string) (string, error) {
+			data, err := base64.StdEncoding.DecodeString(s)
+			return string(data), err
+		},
+		"quote": strconv.Quote,
+		// squote single-quotes for POSIX shells: it's becomes 'it'\''s'
+		"squote": format.QuotePOSIX,
+		"required": func(msg, s string) (string, error) {
+			if s == "" {
+				return "", errors.New(msg)
+			}
+			return s, nil
+		},
+		"default": func(def, s string) string {
+			if s == "" {
+				return def
+			}
+			return s
+		},
+		"env": func(key string) string {
+			return values[key]
+		},
+	}
+}
+
+// Execute executes a template against secrets. Missing keys are empty so
+// default and required can handle them.
+func Execute(name, src string, values map[string]string) ([]byte, error) {
+	tmpl, err := template.New(name).Funcs(Funcs(values)).Option("missingkey=zero").Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, values); err != nil {
+		return nil, fmt.Errorf("failed to render template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
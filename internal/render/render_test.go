@@ -0,0 +1,83 @@
+package render
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestExecute(t *testing.T) {
+	values := map[string]string{
+		"HOST":     "db.internal",
+		"PASSWORD": `p"a\ss`,
+		"USER":     "o'brien",
+		"CERT":     "cert",
+		"CERT_B64": "Y2VydA==",
+		"EMPTY":    "",
+	}
+	tests := []struct {
+		name    string
+		src     string
+		want    string
+		wantErr string
+	}{
+		{"value", "host={{ .HOST }}", "host=db.internal", ""},
+		{"missing key is empty", "x={{ .MISSING }}", "x=", ""},
+		{"missing key in a condition", "{{ if .MISSING }}set{{ else }}unset{{ end }}", "unset", ""},
+		{"b64enc", "{{ .CERT | b64enc }}", "Y2VydA==", ""},
+		{"b64dec", "{{ .CERT_B64 | b64dec }}", "cert", ""},
+		{"b64dec invalid", "{{ .HOST | b64dec }}", "", "illegal base64"},
+		{"quote escapes", "{{ .PASSWORD | quote }}", `"p\"a\\ss"`, ""},
+		{"squote escapes", "{{ .USER | squote }}", `'o'\''brien'`, ""},
+		{"squote plain", "{{ .HOST | squote }}", "'db.internal'", ""},
+		{"squote empty", "{{ .EMPTY | squote }}", "''", ""},
+		{"required present", `{{ required "set HOST" .HOST }}`, "db.internal", ""},
+		{"required missing", `{{ required "set DB_URL" .DB_URL }}`, "", "set DB_URL"},
+		{"required empty", `{{ required "set EMPTY" .EMPTY }}`, "", "set EMPTY"},
+		{"default missing", `{{ .PORT | default "8080" }}`, "8080", ""},
+		{"default empty", `{{ .EMPTY | default "x" }}`, "x", ""},
+		{"default set", `{{ .HOST | default "localhost" }}`, "db.internal", ""},
+		{"env", `{{ env "HOST" }}`, "db.internal", ""},
+		{"env missing", `[{{ env "MISSING" }}]`, "[]", ""},
+		{"parse error", "{{ .HOST", "", "failed to parse template"},
+		{"unknown function", "{{ .HOST | upper }}", "", "function \"upper\" not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Execute("test.tmpl", tt.src, values)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Execute() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSquoteShell runs a rendered script so a value can't break out of its
+// quotes
+func TestSquoteShell(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	value := "it's'; echo injected; '"
+	script, err := Execute("run.sh.tmpl", "printf '%s' {{ .VALUE | squote }}", map[string]string{"VALUE": value})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	out, err := exec.Command(sh, "-c", string(script)).Output()
+	if err != nil {
+		t.Fatalf("sh error = %v", err)
+	}
+	if string(out) != value {
+		t.Errorf("sh printed %q, want %q", out, value)
+	}
+}
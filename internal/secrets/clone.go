@@ -0,0 +1,290 @@
+package secrets
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+)
+
+// CloneEnvironment copies an environment's secrets into a new environment in
+// the same project, with the same parent and layers. The copy gets its own
+// data key, which is granted to the members holding the source's key and to
+// the tokens whose scope covers the copy; the returned Regrant names them.
+// With withHistory, the full secret history is copied too, so the clone can
+// be read at earlier points in time; otherwise its history starts now.
+func (svc *Service) CloneEnvironment(project *models.Project, envName, newName string, withHistory bool) (*models.Environment, *Regrant, error) {
+	src, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	layers, err := svc.store.GetEnvironmentLayers(src.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get layers: %w", err)
+	}
+
+	dst := models.Environment{
+		ID:        uuid.New().String(),
+		ProjectID: project.ID,
+		Name:      newName,
+		ParentID:  src.ParentID,
+	}
+	regrant := &Regrant{}
+	c, err := svc.copyEnvironment(src, dst, withHistory, regrant)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.Layers = envIDs(layers)
+	if err := svc.store.CopyEnvironments([]models.EnvironmentCopy{c}); err != nil {
+		return nil, nil, fmt.Errorf("failed to clone environment: %w", err)
+	}
+	return &c.Environment, regrant, nil
+}
+
+// CloneProject copies a project with all its environments and secrets,
+// keeping parent and layer links between the copied environments. Each
+// copied environment gets its own data key, granted like CloneEnvironment
+// does except that only unscoped tokens cover the new project.
+// Environments inheriting from another project can't be copied; the error
+// names the first one found.
+func (svc *Service) CloneProject(project *models.Project, newName string, withHistory bool) (*models.Project, *Regrant, error) {
+	envs, err := svc.store.ListEnvironments(project.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list environments: %w", err)
+	}
+
+	dstProject := &models.Project{
+		ID:          uuid.New().String(),
+		Name:        newName,
+		Description: project.Description,
+	}
+
+	layers := make(map[string][]models.Environment, len(envs))
+	for _, env := range envs {
+		layers[env.ID], err = svc.store.GetEnvironmentLayers(env.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get layers: %w", err)
+		}
+	}
+	if err := svc.checkSourcesInProject(project, envs, layers); err != nil {
+		return nil, nil, err
+	}
+
+	// Copy parents and layers before the environments that use them so every
+	// link points at an environment that's already been inserted
+	regrant := &Regrant{}
+	ids := make(map[string]string, len(envs))
+	copies := make([]models.EnvironmentCopy, 0, len(envs))
+	for len(copies) < len(envs) {
+		progress := false
+		for i := range envs {
+			src := &envs[i]
+			if _, done := ids[src.ID]; done {
+				continue
+			}
+			var parentID *string
+			if src.ParentID != nil {
+				id, ok := ids[*src.ParentID]
+				if !ok {
+					continue
+				}
+				parentID = &id
+			}
+			layerIDs, ok := remapIDs(ids, envIDs(layers[src.ID]))
+			if !ok {
+				continue
+			}
+
+			dst := models.Environment{
+				ID:        uuid.New().String(),
+				ProjectID: dstProject.ID,
+				Name:      src.Name,
+				ParentID:  parentID,
+			}
+			c, err := svc.copyEnvironment(src, dst, withHistory, regrant)
+			if err != nil {
+				return nil, nil, err
+			}
+			c.Layers = layerIDs
+			ids[src.ID] = dst.ID
+			copies = append(copies, c)
+			progress = true
+		}
+		if !progress {
+			return nil, nil, fmt.Errorf("environments in '%s' inherit from outside the project", project.Name)
+		}
+	}
+
+	if err := svc.store.CopyProject(dstProject, copies); err != nil {
+		return nil, nil, fmt.Errorf("failed to clone project: %w", err)
+	}
+	return dstProject, regrant, nil
+}
+
+// checkSourcesInProject reports the first environment whose parent or a
+// layer belongs to another project, since a copy of the project couldn't
+// link to it
+func (svc *Service) checkSourcesInProject(project *models.Project, envs []models.Environment, layers map[string][]models.Environment) error {
+	inProject := make(map[string]bool, len(envs))
+	for _, env := range envs {
+		inProject[env.ID] = true
+	}
+	for _, env := range envs {
+		sources := envIDs(layers[env.ID])
+		if env.ParentID != nil {
+			sources = append([]string{*env.ParentID}, sources...)
+		}
+		for _, id := range sources {
+			if !inProject[id] {
+				return fmt.Errorf("environment '%s' inherits from '%s', outside project '%s': reparent or detach it before cloning the project",
+					env.Name, svc.describeSource(id), project.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// describeSource names an environment as project/env, or by ID if it can't
+// be read
+func (svc *Service) describeSource(envID string) string {
+	env, err := svc.store.GetEnvironment(envID)
+	if err != nil {
+		return envID
+	}
+	project, err := svc.store.GetProject(env.ProjectID)
+	if err != nil {
+		return env.Name
+	}
+	return project.Name + "/" + env.Name
+}
+
+// remapIDs maps each of ids through m, reporting false if any isn't there yet
+func remapIDs(m map[string]string, ids []string) ([]string, bool) {
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		mapped, ok := m[id]
+		if !ok {
+			return nil, false
+		}
+		out = append(out, mapped)
+	}
+	return out, true
+}
+
+// copyEnvironment re-encrypts an environment's secrets (and optionally its
+// history) under a fresh data key for dst, and seals that key to the members
+// and tokens cloneGrants picks, adding them to regrant. Only the source's
+// own key is needed, so a member or token session holding it can copy it.
+func (svc *Service) copyEnvironment(src *models.Environment, dst models.Environment, withHistory bool, regrant *Regrant) (models.EnvironmentCopy, error) {
+	oldKey, err := svc.environmentKey(src.ID)
+	if err != nil {
+		return models.EnvironmentCopy{}, err
+	}
+	newKey, err := crypto.GenerateKey()
+	if err != nil {
+		return models.EnvironmentCopy{}, fmt.Errorf("failed to generate environment key: %w", err)
+	}
+	envKey, err := svc.wrapEnvironmentKey(dst.ID, newKey)
+	if err != nil {
+		return models.EnvironmentCopy{}, err
+	}
+	grants, err := svc.cloneGrants(src, dst, newKey, regrant)
+	if err != nil {
+		return models.EnvironmentCopy{}, err
+	}
+
+	current, err := svc.store.ListSecrets(src.ID)
+	if err != nil {
+		return models.EnvironmentCopy{}, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	for i, sec := range current {
+		current[i].EncryptedValue, current[i].Nonce, err = reencrypt(oldKey, newKey, sec.EncryptedValue, sec.Nonce, sec.Key)
+		if err != nil {
+			return models.EnvironmentCopy{}, err
+		}
+	}
+
+	now := time.Now()
+	dst.CreatedAt = now
+	var history []models.SecretHistory
+	if withHistory {
+		// Keep the creation time so the clone can be read as of any point
+		// its history covers
+		dst.CreatedAt = src.CreatedAt
+		history, err = svc.store.ListEnvironmentHistory(src.ID)
+		if err != nil {
+			return models.EnvironmentCopy{}, fmt.Errorf("failed to list history: %w", err)
+		}
+		for i, h := range history {
+			history[i].EncryptedValue, history[i].Nonce, err = reencrypt(oldKey, newKey, h.EncryptedValue, h.Nonce, h.Key)
+			if err != nil {
+				return models.EnvironmentCopy{}, err
+			}
+		}
+	} else {
+		// Start a fresh history with each secret's current value
+		for i := range current {
+			current[i].Version = 1
+			current[i].CreatedAt, current[i].UpdatedAt = now, now
+			history = append(history, models.SecretHistory{
+				Key:            current[i].Key,
+				EncryptedValue: current[i].EncryptedValue,
+				Nonce:          current[i].Nonce,
+				Version:        1,
+				ChangeType:     models.ChangeTypeCreate,
+				CreatedAt:      current[i].CreatedAt,
+			})
+		}
+	}
+
+	svc.envKeys[dst.ID] = newKey
+	return models.EnvironmentCopy{
+		Environment: dst,
+		Key:         *envKey,
+		Secrets:     current,
+		History:     history,
+		Grants:      grants,
+	}, nil
+}
+
+// cloneGrants seals a copy's key to every member holding the source's key,
+// and to the tokens whose scope covers the copy: project-wide tokens if it
+// stays in the source's project, and unscoped tokens. Tokens scoped to the
+// source environment don't cover the copy.
+func (svc *Service) cloneGrants(src *models.Environment, dst models.Environment, key []byte, regrant *Regrant) (models.KeyGrants, error) {
+	var grants models.KeyGrants
+
+	members, err := svc.store.ListEnvironmentMembers(src.ID)
+	if err != nil {
+		return grants, fmt.Errorf("failed to list members: %w", err)
+	}
+	for _, m := range members {
+		sealed, err := crypto.SealTo(m.PublicKey, key, []byte(dst.ID))
+		if err != nil {
+			return grants, fmt.Errorf("failed to seal environment key to '%s': %w", m.Name, err)
+		}
+		grants.Members = append(grants.Members, models.MemberKey{MemberID: m.ID, EnvironmentID: dst.ID, SealedKey: sealed})
+		regrant.Members = appendNew(regrant.Members, []string{m.Name})
+	}
+
+	tokens, err := svc.store.ListEnvironmentTokens(src.ID)
+	if err != nil {
+		return grants, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	for _, t := range tokens {
+		if t.EnvironmentID != "" || (t.ProjectID != "" && t.ProjectID != dst.ProjectID) {
+			continue
+		}
+		sealed, err := crypto.SealTo(t.PublicKey, key, []byte(dst.ID))
+		if err != nil {
+			return grants, fmt.Errorf("failed to seal environment key to token '%s': %w", t.Name, err)
+		}
+		grants.Tokens = append(grants.Tokens, models.TokenKey{TokenID: t.ID, EnvironmentID: dst.ID, SealedKey: sealed})
+		regrant.Tokens = appendNew(regrant.Tokens, []string{t.Name})
+	}
+	return grants, nil
+}
@@ -0,0 +1,191 @@
+package secrets
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+)
+
+func TestCloneEnvironment(t *testing.T) {
+	te := setupTestEnv(t)
+	base, _ := te.store.CreateEnvironment(te.project.ID, "base")
+	dev, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "dev", base.ID)
+	shared, _ := te.store.CreateEnvironment(te.project.ID, "shared")
+	te.store.SetEnvironmentInheritance(dev.ID, &base.ID, []string{shared.ID}, nil, models.KeyGrants{})
+	te.setSecret(t, base.ID, "SHARED", "b")
+	te.setSecret(t, dev.ID, "URL", "old")
+	at := time.Now()
+	te.setSecret(t, dev.ID, "URL", "new")
+
+	svc := te.service()
+	clone, _, err := svc.CloneEnvironment(te.project, "dev", "dev2", false)
+	if err != nil {
+		t.Fatalf("CloneEnvironment() error = %v", err)
+	}
+	if clone.ParentID == nil || *clone.ParentID != base.ID {
+		t.Errorf("clone parent = %v, want %s", clone.ParentID, base.ID)
+	}
+
+	// Read through a fresh service so keys come from the store
+	values, err := te.service().Load(te.project, "dev2", Options{})
+	if err != nil {
+		t.Fatalf("Load(dev2) error = %v", err)
+	}
+	if values["URL"].Value != "new" || values["URL"].Version != 1 || values["SHARED"].SourceEnvName != "base" {
+		t.Errorf("Load(dev2) = %+v", values)
+	}
+	if layers, _ := te.store.GetEnvironmentLayers(clone.ID); len(layers) != 1 || layers[0].ID != shared.ID {
+		t.Errorf("clone layers = %+v, want [shared]", layers)
+	}
+	if _, err := te.store.GetEnvironmentKey(clone.ID); err != nil {
+		t.Errorf("clone has no key of its own: %v", err)
+	}
+	history, _ := svc.History(te.project, "dev2", "URL", 10, true)
+	if len(history) != 1 {
+		t.Errorf("History(dev2) = %+v, want a single entry", history)
+	}
+
+	// With history, the clone can be read at earlier points in time
+	if _, _, err := svc.CloneEnvironment(te.project, "dev", "dev3", true); err != nil {
+		t.Fatalf("CloneEnvironment(withHistory) error = %v", err)
+	}
+	past, err := te.service().Load(te.project, "dev3", Options{At: AtTime(at)})
+	if err != nil {
+		t.Fatalf("Load(dev3, At) error = %v", err)
+	}
+	if past["URL"].Value != "old" {
+		t.Errorf("Load(dev3, At)[URL] = %q, want old", past["URL"].Value)
+	}
+}
+
+func TestCloneProject(t *testing.T) {
+	te := setupTestEnv(t)
+	prod, _ := te.store.CreateEnvironment(te.project.ID, "prod")
+	// prod-eu is created before the layer it uses, so ordering by creation
+	// alone wouldn't be enough
+	eu, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "prod-eu", prod.ID)
+	regional, _ := te.store.CreateEnvironment(te.project.ID, "regional")
+	te.store.SetEnvironmentInheritance(eu.ID, &prod.ID, []string{regional.ID}, nil, models.KeyGrants{})
+	te.store.CreateEnvironment(te.project.ID, "dev")
+	te.setSecret(t, prod.ID, "HOST", "db")
+	te.setSecret(t, regional.ID, "CDN", "eu.cdn")
+	te.setSecret(t, eu.ID, "REGION", "eu")
+
+	svc := te.service()
+	clone, _, err := svc.CloneProject(te.project, "myapp-v2", false)
+	if err != nil {
+		t.Fatalf("CloneProject() error = %v", err)
+	}
+
+	envs, _ := te.store.ListEnvironments(clone.ID)
+	if len(envs) != 4 {
+		t.Fatalf("ListEnvironments(clone) = %+v, want 4", envs)
+	}
+	values, err := te.service().Load(clone, "prod-eu", Options{})
+	if err != nil {
+		t.Fatalf("Load(clone/prod-eu) error = %v", err)
+	}
+	if v := values["HOST"]; v.Value != "db" || !v.IsInherited || v.SourceEnvID == prod.ID {
+		t.Errorf("HOST = %+v, want inherited from the cloned prod", v)
+	}
+	if v := values["CDN"]; v.Value != "eu.cdn" || v.SourceEnvID == regional.ID {
+		t.Errorf("CDN = %+v, want inherited from the cloned regional layer", v)
+	}
+	if values["REGION"].Value != "eu" {
+		t.Errorf("REGION = %+v", values["REGION"])
+	}
+
+	// The original is untouched
+	if original, _ := svc.Load(te.project, "prod-eu", Options{}); original["HOST"].SourceEnvID != prod.ID {
+		t.Errorf("original HOST = %+v", original["HOST"])
+	}
+}
+
+func TestCloneGrants(t *testing.T) {
+	te := setupTestEnv(t)
+	base, _ := te.store.CreateEnvironment(te.project.ID, "base")
+	dev, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "dev", base.ID)
+	te.setSecret(t, base.ID, "SHARED", "b")
+	te.setSecret(t, dev.ID, "URL", "dev")
+
+	svc := te.service()
+	privateKey, publicKey, _ := crypto.GenerateKeyPair()
+	member, _ := te.store.CreateMember("alice", publicKey)
+	svc.Grant(member, dev.ID)
+
+	var tokens []*models.APIToken
+	for _, token := range []*models.APIToken{
+		{Name: "deploy", TokenHash: []byte("deploy"), ProjectID: te.project.ID},
+		{Name: "dev-only", TokenHash: []byte("dev-only"), ProjectID: te.project.ID, EnvironmentID: dev.ID},
+	} {
+		_, token.PublicKey, _ = crypto.GenerateKeyPair()
+		te.store.CreateAPIToken(token, nil)
+		tokens = append(tokens, token)
+	}
+
+	// A member session clones with only its own grants, without the vault key
+	openGrants := func() map[string][]byte {
+		grants, _ := te.store.ListMemberKeys(member.ID)
+		keys := make(map[string][]byte)
+		for _, g := range grants {
+			key, err := crypto.OpenSealed(privateKey, g.SealedKey, []byte(g.EnvironmentID))
+			if err != nil {
+				t.Fatalf("OpenSealed() error = %v", err)
+			}
+			keys[g.EnvironmentID] = key
+		}
+		return keys
+	}
+	noVaultKey := func() ([]byte, error) { return nil, errors.New("no vault key") }
+	memberSvc := New(te.store, noVaultKey).WithEnvironmentKeys(openGrants())
+	clone, regrant, err := memberSvc.CloneEnvironment(te.project, "dev", "dev2", false)
+	if err != nil {
+		t.Fatalf("member CloneEnvironment() error = %v", err)
+	}
+	if len(regrant.Members) != 1 || regrant.Members[0] != "alice" {
+		t.Errorf("regrant members = %v, want alice", regrant.Members)
+	}
+	if len(regrant.Tokens) != 1 || regrant.Tokens[0] != "deploy" {
+		t.Errorf("regrant tokens = %v, want only the project token", regrant.Tokens)
+	}
+	if keys, _ := te.store.ListTokenKeys(tokens[1].ID); len(keys) != 0 {
+		t.Errorf("environment token got %d keys for the clone", len(keys))
+	}
+
+	// The member's next session reads the clone
+	values, err := New(te.store, noVaultKey).WithEnvironmentKeys(openGrants()).Load(te.project, "dev2", Options{})
+	if err != nil {
+		t.Fatalf("member Load(dev2) error = %v", err)
+	}
+	if values["URL"].Value != "dev" || values["SHARED"].Value != "b" {
+		t.Errorf("member Load(dev2) = %+v", values)
+	}
+	if values, _ := te.service().Load(te.project, clone.Name, Options{}); values["URL"].Value != "dev" {
+		t.Errorf("owner Load(dev2) = %+v", values)
+	}
+
+	// Only unscoped tokens cover a cloned project
+	_, regrant, err = svc.CloneProject(te.project, "myapp-v2", false)
+	if err != nil {
+		t.Fatalf("CloneProject() error = %v", err)
+	}
+	if len(regrant.Members) != 1 || len(regrant.Tokens) != 0 {
+		t.Errorf("CloneProject() regrant = %+v, want alice and no tokens", regrant)
+	}
+}
+
+func TestCloneProjectOutsideSource(t *testing.T) {
+	te := setupTestEnv(t)
+	other, _ := te.store.CreateProject("shared", "")
+	common, _ := te.store.CreateEnvironment(other.ID, "common")
+	te.store.CreateEnvironmentWithParent(te.project.ID, "dev", common.ID)
+
+	_, _, err := te.service().CloneProject(te.project, "myapp-v2", false)
+	if err == nil || !strings.Contains(err.Error(), "'dev' inherits from 'shared/common'") {
+		t.Errorf("CloneProject() error = %v, want it to name dev and shared/common", err)
+	}
+}
@@ -0,0 +1,49 @@
+package secrets
+
+import "sort"
+
+// ValueDiff compares one key across two sets of loaded secrets. Kind is
+// ChangeRemoved when the key is only in From, ChangeCreated when it is only
+// in To, ChangeUpdated when the values differ and ChangeUnchanged otherwise.
+type ValueDiff struct {
+	Key  string `json:"key"`
+	Kind string `json:"kind"`
+	From *Value `json:"from,omitempty"`
+	To   *Value `json:"to,omitempty"`
+}
+
+// Compare compares every key in two sets of loaded secrets, sorted by key.
+// Values keep their provenance, so callers can show where each came from.
+func Compare(from, to map[string]Value) []ValueDiff {
+	keys := make(map[string]bool, len(from)+len(to))
+	for key := range from {
+		keys[key] = true
+	}
+	for key := range to {
+		keys[key] = true
+	}
+
+	diffs := make([]ValueDiff, 0, len(keys))
+	for key := range keys {
+		d := ValueDiff{Key: key}
+		if v, ok := from[key]; ok {
+			d.From = &v
+		}
+		if v, ok := to[key]; ok {
+			d.To = &v
+		}
+		switch {
+		case d.To == nil:
+			d.Kind = ChangeRemoved
+		case d.From == nil:
+			d.Kind = ChangeCreated
+		case d.From.Value != d.To.Value:
+			d.Kind = ChangeUpdated
+		default:
+			d.Kind = ChangeUnchanged
+		}
+		diffs = append(diffs, d)
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+	return diffs
+}
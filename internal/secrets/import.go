@@ -0,0 +1,194 @@
+package secrets
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+)
+
+// Strategy decides what an import does with keys that already exist with a
+// different value
+type Strategy string
+
+const (
+	StrategyOverwrite Strategy = "overwrite"
+	StrategySkip      Strategy = "skip"
+	StrategyFail      Strategy = "fail"
+)
+
+// ParseStrategy validates a strategy name
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case StrategyOverwrite, StrategySkip, StrategyFail:
+		return Strategy(s), nil
+	}
+	return "", fmt.Errorf("unknown strategy: %s (use 'skip', 'overwrite' or 'fail')", s)
+}
+
+// Change kinds reported by an import plan
+const (
+	ChangeCreated   = "created"
+	ChangeUpdated   = "updated"
+	ChangeUnchanged = "unchanged"
+	ChangeSkipped   = "skipped"
+	ChangeRemoved   = "removed"
+)
+
+// ImportOptions controls how imported values are merged into an environment
+type ImportOptions struct {
+	Strategy Strategy
+	// Prune removes keys defined in the environment but absent from the import
+	Prune bool
+}
+
+// ImportChange is what an import does to one key
+type ImportChange struct {
+	Key  string `json:"key"`
+	Kind string `json:"kind"`
+}
+
+// ImportPlan describes the changes an import would make, compared against
+// the environment's decrypted values. Apply it with ApplyImport.
+type ImportPlan struct {
+	Environment *models.Environment
+	Changes     []ImportChange
+	values      map[string]string
+	versions    map[string]int // version of each key the plan was compared with
+}
+
+// ErrImportConflict is returned by the fail strategy when imported keys
+// already exist with different values
+type ErrImportConflict struct {
+	Keys []string
+}
+
+func (e *ErrImportConflict) Error() string {
+	return fmt.Sprintf("%d existing key(s) would change: %s (use --strategy overwrite or skip)", len(e.Keys), strings.Join(e.Keys, ", "))
+}
+
+// Count returns how many changes are of the given kind
+func (p *ImportPlan) Count(kind string) int {
+	n := 0
+	for _, c := range p.Changes {
+		if c.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// PlanImport compares values with the secrets defined directly in an
+// environment (inherited values aren't touched) and returns the changes an
+// import would make, sorted by key
+func (svc *Service) PlanImport(project *models.Project, envName string, values map[string]string, opts ImportOptions) (*ImportPlan, error) {
+	for key := range values {
+		if !IsValidKeyName(key) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKeyName, key)
+		}
+	}
+
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := svc.store.ListSecrets(env.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	existing := make(map[string]string, len(current))
+	versions := make(map[string]int, len(current))
+	for _, s := range current {
+		versions[s.Key] = s.Version
+	}
+	if len(current) > 0 {
+		encKey, err := svc.environmentKey(env.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range current {
+			plaintext, err := crypto.Decrypt(encKey, s.EncryptedValue, s.Nonce, []byte(s.Key))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt %s: %w", s.Key, err)
+			}
+			existing[s.Key] = string(plaintext)
+		}
+	}
+
+	plan := &ImportPlan{Environment: env, values: values, versions: versions}
+	var conflicts []string
+	for key, value := range values {
+		old, ok := existing[key]
+		switch {
+		case !ok:
+			plan.Changes = append(plan.Changes, ImportChange{Key: key, Kind: ChangeCreated})
+		case old == value:
+			plan.Changes = append(plan.Changes, ImportChange{Key: key, Kind: ChangeUnchanged})
+		case opts.Strategy == StrategySkip:
+			plan.Changes = append(plan.Changes, ImportChange{Key: key, Kind: ChangeSkipped})
+		default:
+			plan.Changes = append(plan.Changes, ImportChange{Key: key, Kind: ChangeUpdated})
+			conflicts = append(conflicts, key)
+		}
+	}
+	if opts.Prune {
+		for key := range existing {
+			if _, ok := values[key]; !ok {
+				plan.Changes = append(plan.Changes, ImportChange{Key: key, Kind: ChangeRemoved})
+			}
+		}
+	}
+
+	sort.Slice(plan.Changes, func(i, j int) bool { return plan.Changes[i].Key < plan.Changes[j].Key })
+	if opts.Strategy == StrategyFail && len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return plan, &ErrImportConflict{Keys: conflicts}
+	}
+	return plan, nil
+}
+
+// ApplyImport writes a plan's created, updated and removed keys in a single
+// transaction. If the environment's secrets changed since the plan was
+// made, nothing is written and store.ErrSecretsChanged is returned; plan
+// again to see the current changes.
+func (svc *Service) ApplyImport(plan *ImportPlan) error {
+	changes, err := svc.planChanges(plan)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if err := svc.store.ApplySecrets(plan.Environment.ID, plan.versions, changes); err != nil {
+		return fmt.Errorf("failed to import secrets: %w", err)
+	}
+	return nil
+}
+
+// planChanges encrypts a plan's created and updated values and lists its
+// removed keys
+func (svc *Service) planChanges(plan *ImportPlan) ([]models.SecretChange, error) {
+	encKey, err := svc.EnsureEnvironmentKey(plan.Environment.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []models.SecretChange
+	for _, c := range plan.Changes {
+		switch c.Kind {
+		case ChangeCreated, ChangeUpdated:
+			encryptedValue, nonce, err := crypto.Encrypt(encKey, []byte(plan.values[c.Key]), []byte(c.Key))
+			if err != nil {
+				return nil, fmt.Errorf("failed to encrypt %s: %w", c.Key, err)
+			}
+			changes = append(changes, models.SecretChange{Key: c.Key, EncryptedValue: encryptedValue, Nonce: nonce})
+		case ChangeRemoved:
+			changes = append(changes, models.SecretChange{Key: c.Key, Delete: true})
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,90 @@
+package secrets
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPlanImport(t *testing.T) {
+	te := setupTestEnv(t)
+	parent, _ := te.store.CreateEnvironment(te.project.ID, "base")
+	env, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "dev", parent.ID)
+	te.setSecret(t, parent.ID, "INHERITED", "p")
+	te.setSecret(t, env.ID, "SAME", "1")
+	te.setSecret(t, env.ID, "CHANGED", "old")
+	te.setSecret(t, env.ID, "EXTRA", "x")
+
+	svc := te.service()
+	values := map[string]string{"SAME": "1", "CHANGED": "new", "NEW": "n"}
+
+	plan, err := svc.PlanImport(te.project, "dev", values, ImportOptions{Strategy: StrategyOverwrite, Prune: true})
+	if err != nil {
+		t.Fatalf("PlanImport() error = %v", err)
+	}
+	want := []ImportChange{
+		{"CHANGED", ChangeUpdated},
+		{"EXTRA", ChangeRemoved},
+		{"NEW", ChangeCreated},
+		{"SAME", ChangeUnchanged},
+	}
+	if len(plan.Changes) != len(want) {
+		t.Fatalf("PlanImport() changes = %+v, want %+v", plan.Changes, want)
+	}
+	for i := range want {
+		if plan.Changes[i] != want[i] {
+			t.Errorf("change %d = %+v, want %+v", i, plan.Changes[i], want[i])
+		}
+	}
+
+	skip, err := svc.PlanImport(te.project, "dev", values, ImportOptions{Strategy: StrategySkip})
+	if err != nil {
+		t.Fatalf("PlanImport(skip) error = %v", err)
+	}
+	if skip.Count(ChangeSkipped) != 1 || skip.Count(ChangeRemoved) != 0 {
+		t.Errorf("PlanImport(skip) changes = %+v", skip.Changes)
+	}
+
+	_, err = svc.PlanImport(te.project, "dev", values, ImportOptions{Strategy: StrategyFail})
+	var conflict *ErrImportConflict
+	if !errors.As(err, &conflict) || len(conflict.Keys) != 1 || conflict.Keys[0] != "CHANGED" {
+		t.Errorf("PlanImport(fail) error = %v, want conflict on CHANGED", err)
+	}
+
+	if _, err := svc.PlanImport(te.project, "dev", map[string]string{"bad-key": "x"}, ImportOptions{}); !errors.Is(err, ErrInvalidKeyName) {
+		t.Errorf("PlanImport() with invalid key error = %v, want ErrInvalidKeyName", err)
+	}
+}
+
+func TestApplyImport(t *testing.T) {
+	te := setupTestEnv(t)
+	env, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	te.setSecret(t, env.ID, "CHANGED", "old")
+	te.setSecret(t, env.ID, "EXTRA", "x")
+
+	svc := te.service()
+	plan, err := svc.PlanImport(te.project, "dev", map[string]string{"CHANGED": "new", "NEW": "n"}, ImportOptions{Strategy: StrategyOverwrite, Prune: true})
+	if err != nil {
+		t.Fatalf("PlanImport() error = %v", err)
+	}
+	if err := svc.ApplyImport(plan); err != nil {
+		t.Fatalf("ApplyImport() error = %v", err)
+	}
+
+	values, err := svc.Load(te.project, "dev", Options{})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	got := ToMap(values)
+	if len(got) != 2 || got["CHANGED"] != "new" || got["NEW"] != "n" {
+		t.Errorf("Load() after import = %v", got)
+	}
+
+	// Re-planning the same import finds nothing to do
+	again, err := svc.PlanImport(te.project, "dev", map[string]string{"CHANGED": "new", "NEW": "n"}, ImportOptions{Strategy: StrategyFail, Prune: true})
+	if err != nil {
+		t.Fatalf("PlanImport() error = %v", err)
+	}
+	if again.Count(ChangeUnchanged) != 2 {
+		t.Errorf("PlanImport() after import = %+v, want all unchanged", again.Changes)
+	}
+}
@@ -0,0 +1,94 @@
+package secrets
+
+import (
+	"fmt"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+)
+
+// Grant seals an environment's data key to a member, along with the keys of
+// every environment it inherits from so inherited secrets stay readable.
+// It returns the IDs of the environments granted.
+func (svc *Service) Grant(member *models.Member, envID string) ([]string, error) {
+	keys, err := svc.EnvironmentKeys(envID)
+	if err != nil {
+		return nil, err
+	}
+
+	granted := make([]string, 0, len(keys))
+	for id, key := range keys {
+		sealed, err := crypto.SealTo(member.PublicKey, key, []byte(id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to seal environment key: %w", err)
+		}
+		grant := &models.MemberKey{MemberID: member.ID, EnvironmentID: id, SealedKey: sealed}
+		if err := svc.store.GrantMemberKey(grant); err != nil {
+			return nil, err
+		}
+		granted = append(granted, id)
+	}
+	return granted, nil
+}
+
+// Revocation reports the effects of revoking a member's access to an
+// environment
+type Revocation struct {
+	Rotation
+	// Retained lists the environments the revoked one inherits from whose
+	// keys the member still holds. They are granted along with the
+	// environment but left alone on revoke, since other grants may need them.
+	Retained []models.Environment
+}
+
+// Revoke removes a member's access to an environment. The environment is
+// rekeyed, so a copy of the old key the member kept can't read new values,
+// and the tokens holding it are given the new key.
+//
+// Only the environment itself is rekeyed: the member keeps the keys of the
+// environments it inherits from, which Revocation.Retained lists. A session
+// the member already unlocked, and any copy of the vault taken before the
+// rekey, can still be read with the old key.
+func (svc *Service) Revoke(member *models.Member, envID string) (*Revocation, error) {
+	_, rotation, err := svc.rotateEnvironmentKey(envID, member.ID)
+	if err != nil {
+		return nil, err
+	}
+	revocation := &Revocation{Rotation: *rotation}
+
+	ancestors, err := svc.store.GetEnvironmentAncestors(envID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ancestors: %w", err)
+	}
+	grants, err := svc.store.ListMemberKeys(member.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range ancestors {
+		for _, g := range grants {
+			if g.EnvironmentID == a.ID {
+				revocation.Retained = append(revocation.Retained, a)
+				break
+			}
+		}
+	}
+	return revocation, nil
+}
+
+// RevokeAll removes a member's access to every environment they were
+// granted, rekeying each one
+func (svc *Service) RevokeAll(member *models.Member) (*Rotation, error) {
+	grants, err := svc.store.ListMemberKeys(member.ID)
+	if err != nil {
+		return nil, err
+	}
+	all := &Rotation{}
+	for _, g := range grants {
+		_, rotation, err := svc.rotateEnvironmentKey(g.EnvironmentID, member.ID)
+		if err != nil {
+			return nil, err
+		}
+		all.merge(rotation)
+	}
+	return all, nil
+}
@@ -0,0 +1,85 @@
+package secrets
+
+import (
+	"fmt"
+
+	"github.com/russellromney/coffer/internal/models"
+)
+
+// PromoteOptions controls which secrets a promotion copies
+type PromoteOptions struct {
+	// Keys to promote. Empty promotes every key defined directly in the
+	// source environment.
+	Keys []string
+	// IncludeInherited also promotes the source's inherited keys when Keys
+	// is empty. Named keys are always promoted wherever they come from.
+	IncludeInherited bool
+	// RequireIndependent fails if the target inherits from the source, where
+	// a promotion would only shadow values the target already sees
+	RequireIndependent bool
+}
+
+// ErrTargetInherits is returned by PlanPromote with RequireIndependent when
+// the target environment inherits from the source
+type ErrTargetInherits struct {
+	From string
+	To   string
+}
+
+func (e *ErrTargetInherits) Error() string {
+	return fmt.Sprintf("'%s' inherits from '%s'", e.To, e.From)
+}
+
+// PlanPromote plans copying secrets from one environment to another in the
+// same project. Existing keys in the target are overwritten; nothing is
+// removed. Apply the plan with ApplyImport, which re-encrypts each value
+// with the target's key and records it in the target's history.
+func (svc *Service) PlanPromote(project *models.Project, fromEnv, toEnv string, opts PromoteOptions) (*ImportPlan, error) {
+	from, err := svc.Environment(project, fromEnv)
+	if err != nil {
+		return nil, err
+	}
+	to, err := svc.Environment(project, toEnv)
+	if err != nil {
+		return nil, err
+	}
+	if from.ID == to.ID {
+		return nil, fmt.Errorf("cannot promote '%s' to itself", fromEnv)
+	}
+
+	if opts.RequireIndependent {
+		ancestors, err := svc.store.GetEnvironmentAncestors(to.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get parent environments: %w", err)
+		}
+		for _, a := range ancestors {
+			if a.ID == from.ID {
+				return nil, &ErrTargetInherits{From: fromEnv, To: toEnv}
+			}
+		}
+	}
+
+	source, err := svc.Load(project, fromEnv, Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	if len(opts.Keys) > 0 {
+		for _, key := range opts.Keys {
+			v, ok := source[key]
+			if !ok {
+				return nil, &ErrSecretNotFound{Project: project.Name, Env: fromEnv, Key: key}
+			}
+			values[key] = v.Value
+		}
+	} else {
+		for key, v := range source {
+			if !v.IsInherited || opts.IncludeInherited {
+				values[key] = v.Value
+			}
+		}
+	}
+
+	return svc.PlanImport(project, toEnv, values, ImportOptions{Strategy: StrategyOverwrite})
+}
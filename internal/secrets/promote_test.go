@@ -0,0 +1,110 @@
+package secrets
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/russellromney/coffer/internal/store"
+)
+
+func TestPlanPromote(t *testing.T) {
+	te := setupTestEnv(t)
+	base, _ := te.store.CreateEnvironment(te.project.ID, "base")
+	staging, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "staging", base.ID)
+	prod, _ := te.store.CreateEnvironment(te.project.ID, "prod")
+	te.setSecret(t, base.ID, "SHARED", "b")
+	te.setSecret(t, staging.ID, "API_URL", "https://api.example.com")
+	te.setSecret(t, staging.ID, "FLAG", "on")
+	te.setSecret(t, prod.ID, "FLAG", "off")
+	te.setSecret(t, prod.ID, "PROD_ONLY", "p")
+
+	svc := te.service()
+	plan, err := svc.PlanPromote(te.project, "staging", "prod", PromoteOptions{})
+	if err != nil {
+		t.Fatalf("PlanPromote() error = %v", err)
+	}
+	want := []ImportChange{{"API_URL", ChangeCreated}, {"FLAG", ChangeUpdated}}
+	if len(plan.Changes) != len(want) {
+		t.Fatalf("PlanPromote() changes = %+v, want %+v", plan.Changes, want)
+	}
+	for i := range want {
+		if plan.Changes[i] != want[i] {
+			t.Errorf("change %d = %+v, want %+v", i, plan.Changes[i], want[i])
+		}
+	}
+	if err := svc.ApplyImport(plan); err != nil {
+		t.Fatalf("ApplyImport() error = %v", err)
+	}
+
+	// Values are re-encrypted with prod's key and recorded in its history
+	got, err := svc.Get(te.project, "prod", "FLAG", Options{})
+	if err != nil || got.Value != "on" {
+		t.Errorf("Get(FLAG) after promote = %+v, %v", got, err)
+	}
+	history, _ := svc.History(te.project, "prod", "FLAG", 10, true)
+	if len(history) != 2 || history[0].Value != "on" {
+		t.Errorf("History(FLAG) after promote = %+v", history)
+	}
+	if _, err := svc.Get(te.project, "prod", "PROD_ONLY", Options{}); err != nil {
+		t.Errorf("promote removed PROD_ONLY: %v", err)
+	}
+
+	inherited, err := svc.PlanPromote(te.project, "staging", "prod", PromoteOptions{IncludeInherited: true})
+	if err != nil {
+		t.Fatalf("PlanPromote(IncludeInherited) error = %v", err)
+	}
+	if inherited.Count(ChangeCreated) != 1 || inherited.Count(ChangeUnchanged) != 2 {
+		t.Errorf("PlanPromote(IncludeInherited) changes = %+v", inherited.Changes)
+	}
+
+	named, err := svc.PlanPromote(te.project, "staging", "prod", PromoteOptions{Keys: []string{"SHARED"}})
+	if err != nil || len(named.Changes) != 1 || named.Changes[0] != (ImportChange{"SHARED", ChangeCreated}) {
+		t.Errorf("PlanPromote(SHARED) = %+v, %v", named, err)
+	}
+
+	var notFound *ErrSecretNotFound
+	if _, err := svc.PlanPromote(te.project, "staging", "prod", PromoteOptions{Keys: []string{"MISSING"}}); !errors.As(err, &notFound) {
+		t.Errorf("PlanPromote(MISSING) error = %v, want ErrSecretNotFound", err)
+	}
+
+	var inherits *ErrTargetInherits
+	if _, err := svc.PlanPromote(te.project, "base", "staging", PromoteOptions{RequireIndependent: true}); !errors.As(err, &inherits) {
+		t.Errorf("PlanPromote(RequireIndependent) error = %v, want ErrTargetInherits", err)
+	}
+	if _, err := svc.PlanPromote(te.project, "base", "staging", PromoteOptions{}); err != nil {
+		t.Errorf("PlanPromote() into a child error = %v", err)
+	}
+	if _, err := svc.PlanPromote(te.project, "prod", "prod", PromoteOptions{}); err == nil {
+		t.Error("PlanPromote() to itself expected error")
+	}
+}
+
+func TestPromoteStalePlan(t *testing.T) {
+	te := setupTestEnv(t)
+	staging, _ := te.store.CreateEnvironment(te.project.ID, "staging")
+	prod, _ := te.store.CreateEnvironment(te.project.ID, "prod")
+	te.setSecret(t, staging.ID, "FLAG", "on")
+	te.setSecret(t, prod.ID, "FLAG", "off")
+
+	svc := te.service()
+	plan, err := svc.PlanPromote(te.project, "staging", "prod", PromoteOptions{})
+	if err != nil {
+		t.Fatalf("PlanPromote() error = %v", err)
+	}
+
+	// A write to the target between planning and applying isn't overwritten
+	te.setSecret(t, prod.ID, "FLAG", "hotfix")
+	if err := svc.ApplyImport(plan); !errors.Is(err, store.ErrSecretsChanged) {
+		t.Fatalf("ApplyImport() error = %v, want ErrSecretsChanged", err)
+	}
+	if got, _ := svc.Get(te.project, "prod", "FLAG", Options{}); got.Value != "hotfix" {
+		t.Errorf("FLAG = %q after a stale promote, want hotfix", got.Value)
+	}
+
+	// So is a key added in the meantime
+	plan, _ = svc.PlanPromote(te.project, "staging", "prod", PromoteOptions{})
+	te.setSecret(t, prod.ID, "NEW", "n")
+	if err := svc.ApplyImport(plan); !errors.Is(err, store.ErrSecretsChanged) {
+		t.Errorf("ApplyImport() after a key was added error = %v, want ErrSecretsChanged", err)
+	}
+}
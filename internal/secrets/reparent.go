@@ -0,0 +1,324 @@
+package secrets
+
+import (
+	"fmt"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+// Layers returns an environment's layers in order of increasing precedence
+func (svc *Service) Layers(project *models.Project, envName string) ([]models.Environment, error) {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := svc.store.GetEnvironmentLayers(env.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get layers: %w", err)
+	}
+	return layers, nil
+}
+
+// PlanReparent compares the secrets visible in an environment now with what
+// it would see if its parent were parentName ("" for no parent). Its layers
+// are kept. Nothing is written.
+func (svc *Service) PlanReparent(project *models.Project, envName, parentName string) ([]ValueDiff, error) {
+	env, parentID, layerIDs, err := svc.reparentPlan(project, envName, parentName)
+	if err != nil {
+		return nil, err
+	}
+	return svc.planInheritance(env, parentID, layerIDs)
+}
+
+// Reparent makes parentName the parent of an environment, or removes its
+// parent if parentName is "". Secrets defined in the environment and its
+// layers are kept; inherited values now come from the new parent, whose keys
+// are granted to everyone holding the environment's.
+func (svc *Service) Reparent(project *models.Project, envName, parentName string) (*Regrant, error) {
+	env, parentID, layerIDs, err := svc.reparentPlan(project, envName, parentName)
+	if err != nil {
+		return nil, err
+	}
+	return svc.setInheritance(env, parentID, layerIDs, nil)
+}
+
+// PlanLayers compares the secrets visible in an environment now with what it
+// would see if it were composed from layerNames, in order of increasing
+// precedence. Its parent is kept. Nothing is written.
+func (svc *Service) PlanLayers(project *models.Project, envName string, layerNames []string) ([]ValueDiff, error) {
+	env, layerIDs, err := svc.layersPlan(project, envName, layerNames)
+	if err != nil {
+		return nil, err
+	}
+	return svc.planInheritance(env, env.ParentID, layerIDs)
+}
+
+// SetLayers composes an environment from layerNames, in order of increasing
+// precedence: each layer's values (including what the layer inherits)
+// override its parent's and earlier layers', and the environment's own
+// values override them all. No names removes every layer. The keys of new
+// layers are granted to everyone holding the environment's.
+func (svc *Service) SetLayers(project *models.Project, envName string, layerNames []string) (*Regrant, error) {
+	env, layerIDs, err := svc.layersPlan(project, envName, layerNames)
+	if err != nil {
+		return nil, err
+	}
+	return svc.setInheritance(env, env.ParentID, layerIDs, nil)
+}
+
+// Detach stops an environment inheriting from anything: its parent and
+// layers are removed. With materialize, the values it inherits are first
+// copied into it in the same transaction, so what it sees doesn't change.
+// It returns the keys that were copied.
+func (svc *Service) Detach(project *models.Project, envName string, materialize bool) ([]string, error) {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := svc.store.GetEnvironmentLayers(env.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get layers: %w", err)
+	}
+	if env.ParentID == nil && len(layers) == 0 {
+		return nil, fmt.Errorf("environment '%s' doesn't inherit from anything", envName)
+	}
+
+	var keys []string
+	var changes []models.SecretChange
+	if materialize {
+		values, err := svc.loadCurrent(env)
+		if err != nil {
+			return nil, err
+		}
+		encKey, err := svc.EnsureEnvironmentKey(env.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range SortedKeys(values) {
+			v := values[key]
+			if !v.IsInherited {
+				continue
+			}
+			encryptedValue, nonce, err := crypto.Encrypt(encKey, []byte(v.Value), []byte(key))
+			if err != nil {
+				return nil, fmt.Errorf("failed to encrypt %s: %w", key, err)
+			}
+			changes = append(changes, models.SecretChange{Key: key, EncryptedValue: encryptedValue, Nonce: nonce})
+			keys = append(keys, key)
+		}
+	}
+
+	if _, err := svc.setInheritance(env, nil, nil, changes); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// reparentPlan looks up an environment, its new parent and its current layers
+func (svc *Service) reparentPlan(project *models.Project, envName, parentName string) (*models.Environment, *string, []string, error) {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var parentID *string
+	if parentName != "" {
+		parent, err := svc.inheritanceSource(project, env, parentName)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		parentID = &parent.ID
+	}
+	layers, err := svc.store.GetEnvironmentLayers(env.ID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get layers: %w", err)
+	}
+	for _, layer := range layers {
+		if parentID != nil && layer.ID == *parentID {
+			return nil, nil, nil, fmt.Errorf("'%s' is already a layer of '%s'", parentName, envName)
+		}
+	}
+	return env, parentID, envIDs(layers), nil
+}
+
+// layersPlan looks up an environment and its new layers
+func (svc *Service) layersPlan(project *models.Project, envName string, layerNames []string) (*models.Environment, []string, error) {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, nil, err
+	}
+	layerIDs := make([]string, 0, len(layerNames))
+	seen := make(map[string]bool, len(layerNames))
+	for _, name := range layerNames {
+		if seen[name] {
+			return nil, nil, fmt.Errorf("layer '%s' is listed more than once", name)
+		}
+		seen[name] = true
+		layer, err := svc.inheritanceSource(project, env, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if env.ParentID != nil && *env.ParentID == layer.ID {
+			return nil, nil, fmt.Errorf("'%s' is already the parent of '%s'", name, envName)
+		}
+		layerIDs = append(layerIDs, layer.ID)
+	}
+	return env, layerIDs, nil
+}
+
+// inheritanceSource looks up an environment for env to inherit from,
+// rejecting one that would make env inherit from itself
+func (svc *Service) inheritanceSource(project *models.Project, env *models.Environment, name string) (*models.Environment, error) {
+	source, err := svc.Environment(project, name)
+	if err != nil {
+		return nil, err
+	}
+	if source.ID == env.ID {
+		return nil, fmt.Errorf("'%s' can't inherit from itself: %w", env.Name, store.ErrInheritanceCycle)
+	}
+	ancestors, err := svc.store.GetEnvironmentAncestors(source.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parent environments: %w", err)
+	}
+	for _, a := range ancestors {
+		if a.ID == env.ID {
+			return nil, fmt.Errorf("'%s' can't inherit from '%s', which inherits from it: %w", env.Name, name, store.ErrInheritanceCycle)
+		}
+	}
+	return source, nil
+}
+
+// planInheritance compares what env sees now with what it would see
+// inheriting from parentID and layerIDs. Each source's view (including what
+// it inherits) overrides the ones before it, and env's own values override
+// them all.
+func (svc *Service) planInheritance(env *models.Environment, parentID *string, layerIDs []string) ([]ValueDiff, error) {
+	before, err := svc.loadCurrent(env)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := layerIDs
+	if parentID != nil {
+		sources = append([]string{*parentID}, layerIDs...)
+	}
+	after := make(map[string]Value)
+	for _, id := range sources {
+		source, err := svc.store.GetEnvironment(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get environment: %w", err)
+		}
+		view, err := svc.loadCurrent(source)
+		if err != nil {
+			return nil, err
+		}
+		for key, v := range view {
+			v.IsInherited = true
+			after[key] = v
+		}
+	}
+	for key, v := range before {
+		if !v.IsInherited {
+			after[key] = v
+		}
+	}
+	return Compare(before, after), nil
+}
+
+// Regrant reports who was given the keys of an environment's new sources,
+// or of a cloned environment
+type Regrant struct {
+	Members []string
+	Tokens  []string
+}
+
+// setInheritance points env at new sources. In the same transaction, the
+// keys of the sources (and of everything they inherit from) are sealed to
+// the members and environment-scoped tokens holding env's key, as Grant and
+// token creation would have if the sources had been there from the start.
+func (svc *Service) setInheritance(env *models.Environment, parentID *string, layerIDs []string, changes []models.SecretChange) (*Regrant, error) {
+	grants, regrant, err := svc.inheritanceGrants(env, parentID, layerIDs)
+	if err != nil {
+		return nil, err
+	}
+	err = svc.store.SetEnvironmentInheritance(env.ID, parentID, layerIDs, changes, grants)
+	if err == store.ErrInheritanceCycle {
+		return nil, fmt.Errorf("'%s' would inherit from itself: %w", env.Name, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update inheritance: %w", err)
+	}
+	return regrant, nil
+}
+
+// inheritanceGrants seals the keys env would need to inherit from parentID
+// and layerIDs, and doesn't already inherit, to the holders of env's key.
+// Project-wide and unscoped tokens already hold every key in their scope.
+func (svc *Service) inheritanceGrants(env *models.Environment, parentID *string, layerIDs []string) (models.KeyGrants, *Regrant, error) {
+	var grants models.KeyGrants
+	regrant := &Regrant{}
+
+	current, err := svc.store.GetEnvironmentAncestors(env.ID)
+	if err != nil {
+		return grants, nil, fmt.Errorf("failed to get parent environments: %w", err)
+	}
+	held := map[string]bool{env.ID: true}
+	for _, id := range envIDs(current) {
+		held[id] = true
+	}
+
+	sources := layerIDs
+	if parentID != nil {
+		sources = append([]string{*parentID}, layerIDs...)
+	}
+	needed := make(map[string][]byte)
+	for _, id := range sources {
+		keys, err := svc.EnvironmentKeys(id)
+		if err != nil {
+			return grants, nil, err
+		}
+		for envID, key := range keys {
+			if !held[envID] {
+				needed[envID] = key
+			}
+		}
+	}
+	if len(needed) == 0 {
+		return grants, regrant, nil
+	}
+
+	members, err := svc.store.ListEnvironmentMembers(env.ID)
+	if err != nil {
+		return grants, nil, fmt.Errorf("failed to list members: %w", err)
+	}
+	for _, m := range members {
+		for envID, key := range needed {
+			sealed, err := crypto.SealTo(m.PublicKey, key, []byte(envID))
+			if err != nil {
+				return grants, nil, fmt.Errorf("failed to seal environment key to '%s': %w", m.Name, err)
+			}
+			grants.Members = append(grants.Members, models.MemberKey{MemberID: m.ID, EnvironmentID: envID, SealedKey: sealed})
+		}
+		regrant.Members = append(regrant.Members, m.Name)
+	}
+
+	tokens, err := svc.store.ListEnvironmentTokens(env.ID)
+	if err != nil {
+		return grants, nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	for _, t := range tokens {
+		if t.EnvironmentID == "" {
+			continue
+		}
+		for envID, key := range needed {
+			sealed, err := crypto.SealTo(t.PublicKey, key, []byte(envID))
+			if err != nil {
+				return grants, nil, fmt.Errorf("failed to seal environment key to token '%s': %w", t.Name, err)
+			}
+			grants.Tokens = append(grants.Tokens, models.TokenKey{TokenID: t.ID, EnvironmentID: envID, SealedKey: sealed})
+		}
+		regrant.Tokens = append(regrant.Tokens, t.Name)
+	}
+	return grants, regrant, nil
+}
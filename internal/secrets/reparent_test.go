@@ -0,0 +1,299 @@
+package secrets
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+func TestReparent(t *testing.T) {
+	te := setupTestEnv(t)
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	prod, _ := te.store.CreateEnvironment(te.project.ID, "prod")
+	personal, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "dev_personal", dev.ID)
+	te.setSecret(t, dev.ID, "HOST", "localhost")
+	te.setSecret(t, dev.ID, "DEBUG", "1")
+	te.setSecret(t, prod.ID, "HOST", "db.internal")
+	te.setSecret(t, personal.ID, "NAME", "me")
+
+	svc := te.service()
+	diffs, err := svc.PlanReparent(te.project, "dev_personal", "prod")
+	if err != nil {
+		t.Fatalf("PlanReparent() error = %v", err)
+	}
+	kinds := make(map[string]string)
+	for _, d := range diffs {
+		kinds[d.Key] = d.Kind
+	}
+	if kinds["DEBUG"] != ChangeRemoved || kinds["HOST"] != ChangeUpdated || kinds["NAME"] != ChangeUnchanged {
+		t.Errorf("PlanReparent() = %v", kinds)
+	}
+
+	snap, err := svc.CreateSnapshot(te.project, "dev_personal", "")
+	if err != nil {
+		t.Fatalf("CreateSnapshot() error = %v", err)
+	}
+	if _, err := svc.Reparent(te.project, "dev_personal", "prod"); err != nil {
+		t.Fatalf("Reparent() error = %v", err)
+	}
+	values, _ := svc.Load(te.project, "dev_personal", Options{})
+	if v := values["HOST"]; v.Value != "db.internal" || v.SourceEnvName != "prod" {
+		t.Errorf("HOST after Reparent() = %+v", v)
+	}
+
+	// The past is read through the parent it had then
+	past, err := svc.Load(te.project, "dev_personal", Options{At: AtSnapshot(snap)})
+	if err != nil {
+		t.Fatalf("Load(At) error = %v", err)
+	}
+	if v := past["HOST"]; v.Value != "localhost" || v.SourceEnvName != "dev" || past["DEBUG"].Value != "1" {
+		t.Errorf("Load(At before Reparent()) = %+v", past)
+	}
+
+	// prod is now an ancestor of dev_personal, so it can't become prod's parent
+	for _, parent := range []string{"dev_personal", "prod"} {
+		if _, err := svc.Reparent(te.project, "prod", parent); !errors.Is(err, store.ErrInheritanceCycle) {
+			t.Errorf("Reparent(prod, %s) error = %v, want ErrInheritanceCycle", parent, err)
+		}
+		if _, err := svc.PlanReparent(te.project, "prod", parent); !errors.Is(err, store.ErrInheritanceCycle) {
+			t.Errorf("PlanReparent(prod, %s) error = %v, want ErrInheritanceCycle", parent, err)
+		}
+	}
+
+	if _, err := svc.Reparent(te.project, "dev_personal", ""); err != nil {
+		t.Fatalf("Reparent(none) error = %v", err)
+	}
+	values, _ = svc.Load(te.project, "dev_personal", Options{})
+	if len(values) != 1 {
+		t.Errorf("Load() after removing the parent = %+v, want only NAME", values)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	te := setupTestEnv(t)
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	personal, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "dev_personal", dev.ID)
+	te.setSecret(t, dev.ID, "HOST", "localhost")
+	te.setSecret(t, dev.ID, "NAME", "team")
+	te.setSecret(t, personal.ID, "NAME", "me")
+
+	svc := te.service()
+	before, _ := svc.Load(te.project, "dev_personal", Options{})
+
+	keys, err := svc.Detach(te.project, "dev_personal", true)
+	if err != nil {
+		t.Fatalf("Detach() error = %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "HOST" {
+		t.Errorf("Detach() materialized %v, want [HOST]", keys)
+	}
+
+	after, _ := svc.Load(te.project, "dev_personal", Options{})
+	if len(after) != len(before) {
+		t.Fatalf("Load() after Detach() = %+v, want %+v", after, before)
+	}
+	for key, v := range after {
+		if v.IsInherited || v.Value != before[key].Value {
+			t.Errorf("%s after Detach() = %+v, want local %q", key, v, before[key].Value)
+		}
+	}
+	if env, _ := te.store.GetEnvironment(personal.ID); env.ParentID != nil {
+		t.Errorf("parent after Detach() = %v, want none", *env.ParentID)
+	}
+
+	// Materialized values are recorded in history
+	history, _ := svc.History(te.project, "dev_personal", "HOST", 10, false)
+	if len(history) != 1 {
+		t.Errorf("History(HOST) = %+v, want one entry", history)
+	}
+
+	if _, err := svc.Detach(te.project, "dev_personal", true); err == nil {
+		t.Error("Detach() of a root environment expected error")
+	}
+}
+
+func TestLayers(t *testing.T) {
+	te := setupTestEnv(t)
+	base, _ := te.store.CreateEnvironment(te.project.ID, "base")
+	prod, _ := te.store.CreateEnvironment(te.project.ID, "prod")
+	eu, _ := te.store.CreateEnvironment(te.project.ID, "eu-overrides")
+	prodEU, _ := te.store.CreateEnvironment(te.project.ID, "prod-eu")
+	te.setSecret(t, base.ID, "LOG_LEVEL", "debug")
+	te.setSecret(t, base.ID, "HOST", "localhost")
+	te.setSecret(t, prod.ID, "LOG_LEVEL", "warn")
+	te.setSecret(t, prod.ID, "HOST", "db.internal")
+	te.setSecret(t, eu.ID, "HOST", "db.eu.internal")
+	te.setSecret(t, prodEU.ID, "NAME", "prod-eu")
+	beforeLayers := time.Now()
+
+	svc := te.service()
+	layers := []string{"base", "prod", "eu-overrides"}
+	diffs, err := svc.PlanLayers(te.project, "prod-eu", layers)
+	if err != nil {
+		t.Fatalf("PlanLayers() error = %v", err)
+	}
+	kinds := make(map[string]string)
+	for _, d := range diffs {
+		kinds[d.Key] = d.Kind
+	}
+	if kinds["HOST"] != ChangeCreated || kinds["LOG_LEVEL"] != ChangeCreated || kinds["NAME"] != ChangeUnchanged {
+		t.Errorf("PlanLayers() = %v", kinds)
+	}
+
+	if _, err := svc.SetLayers(te.project, "prod-eu", layers); err != nil {
+		t.Fatalf("SetLayers() error = %v", err)
+	}
+	got, _ := svc.Layers(te.project, "prod-eu")
+	if len(got) != 3 || got[0].Name != "base" || got[2].Name != "eu-overrides" {
+		t.Errorf("Layers() = %+v", got)
+	}
+
+	// Later layers win, and the winner reports what it shadows
+	values, _ := svc.Load(te.project, "prod-eu", Options{})
+	if v := values["HOST"]; v.Value != "db.eu.internal" || v.SourceEnvName != "eu-overrides" || len(v.Shadows) != 2 || v.Shadows[0] != "prod" || v.Shadows[1] != "base" {
+		t.Errorf("HOST = %+v", v)
+	}
+	if v := values["LOG_LEVEL"]; v.Value != "warn" || len(v.Shadows) != 1 || v.Shadows[0] != "base" {
+		t.Errorf("LOG_LEVEL = %+v", v)
+	}
+
+	// Reading at an earlier time merges the layers the same way
+	afterLayers := time.Now()
+	if _, err := svc.Set(te.project, "eu-overrides", "HOST", "db.eu2.internal"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	past, err := svc.Load(te.project, "prod-eu", Options{At: AtTime(afterLayers)})
+	if err != nil {
+		t.Fatalf("Load(At) error = %v", err)
+	}
+	if v := past["HOST"]; v.Value != "db.eu.internal" || len(v.Shadows) != 2 {
+		t.Errorf("HOST at %s = %+v", afterLayers, v)
+	}
+
+	// ...over the layers it had then, not the current ones
+	past, err = svc.Load(te.project, "prod-eu", Options{At: AtTime(beforeLayers)})
+	if err != nil {
+		t.Fatalf("Load(At) error = %v", err)
+	}
+	if _, ok := past["HOST"]; ok || past["NAME"].Value != "prod-eu" {
+		t.Errorf("Load(At before layers) = %+v, want only NAME", past)
+	}
+
+	// Reparenting keeps the layers, so a layer can't also be the parent
+	if _, err := svc.Reparent(te.project, "prod-eu", "base"); err == nil {
+		t.Error("Reparent() to one of its layers expected error")
+	}
+	te.store.CreateEnvironment(te.project.ID, "global")
+	if _, err := svc.Reparent(te.project, "prod-eu", "global"); err != nil {
+		t.Fatalf("Reparent() error = %v", err)
+	}
+	if got, _ := svc.Layers(te.project, "prod-eu"); len(got) != 3 {
+		t.Errorf("Layers() after Reparent() = %+v", got)
+	}
+
+	if _, err := svc.SetLayers(te.project, "prod", []string{"prod-eu"}); !errors.Is(err, store.ErrInheritanceCycle) {
+		t.Errorf("SetLayers(prod, prod-eu) error = %v, want ErrInheritanceCycle", err)
+	}
+	if _, err := svc.SetLayers(te.project, "prod-eu", []string{"prod", "prod"}); err == nil {
+		t.Error("SetLayers() with a repeated layer expected error")
+	}
+
+	// Detaching removes the parent and every layer
+	keys, err := svc.Detach(te.project, "prod-eu", true)
+	if err != nil {
+		t.Fatalf("Detach() error = %v", err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("Detach() materialized %v, want HOST and LOG_LEVEL", keys)
+	}
+	if got, _ := svc.Layers(te.project, "prod-eu"); len(got) != 0 {
+		t.Errorf("Layers() after Detach() = %+v", got)
+	}
+	values, _ = svc.Load(te.project, "prod-eu", Options{})
+	if v := values["HOST"]; v.Value != "db.eu2.internal" || v.IsInherited {
+		t.Errorf("HOST after Detach() = %+v", v)
+	}
+}
+
+func TestInheritanceGrants(t *testing.T) {
+	te := setupTestEnv(t)
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	prod, _ := te.store.CreateEnvironment(te.project.ID, "prod")
+	eu, _ := te.store.CreateEnvironment(te.project.ID, "eu-overrides")
+	personal, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "dev_personal", dev.ID)
+	te.setSecret(t, dev.ID, "DEBUG", "1")
+	te.setSecret(t, prod.ID, "HOST", "db.internal")
+	te.setSecret(t, eu.ID, "REGION", "eu-west-1")
+	te.setSecret(t, personal.ID, "NAME", "me")
+
+	svc := te.service()
+	privateKey, publicKey, _ := crypto.GenerateKeyPair()
+	member, _ := te.store.CreateMember("alice", publicKey)
+	if _, err := svc.Grant(member, personal.ID); err != nil {
+		t.Fatalf("Grant() error = %v", err)
+	}
+	tokenPrivate, tokenPublic, _ := crypto.GenerateKeyPair()
+	token := &models.APIToken{Name: "ci", TokenHash: []byte("hash"), PublicKey: tokenPublic, ProjectID: te.project.ID, EnvironmentID: personal.ID}
+	keys, _ := svc.TokenKeys(token)
+	var tokenGrants []models.TokenKey
+	for envID, key := range keys {
+		sealed, _ := crypto.SealTo(tokenPublic, key, []byte(envID))
+		tokenGrants = append(tokenGrants, models.TokenKey{EnvironmentID: envID, SealedKey: sealed})
+	}
+	te.store.CreateAPIToken(token, tokenGrants)
+
+	regrant, err := svc.Reparent(te.project, "dev_personal", "prod")
+	if err != nil {
+		t.Fatalf("Reparent() error = %v", err)
+	}
+	if len(regrant.Members) != 1 || regrant.Members[0] != "alice" || len(regrant.Tokens) != 1 || regrant.Tokens[0] != "ci" {
+		t.Errorf("Reparent() regrant = %+v, want alice and ci", regrant)
+	}
+
+	regrant, err = svc.SetLayers(te.project, "dev_personal", []string{"eu-overrides"})
+	if err != nil {
+		t.Fatalf("SetLayers() error = %v", err)
+	}
+	if len(regrant.Members) != 1 || len(regrant.Tokens) != 1 {
+		t.Errorf("SetLayers() regrant = %+v, want alice and ci", regrant)
+	}
+
+	// A member session opens only its own grants, without the vault key,
+	// and reads what the new parent and layer provide
+	noVaultKey := func() ([]byte, error) { return nil, errors.New("no vault key") }
+	grants, _ := te.store.ListMemberKeys(member.ID)
+	memberKeys := make(map[string][]byte)
+	for _, g := range grants {
+		key, err := crypto.OpenSealed(privateKey, g.SealedKey, []byte(g.EnvironmentID))
+		if err != nil {
+			t.Fatalf("OpenSealed() error = %v", err)
+		}
+		memberKeys[g.EnvironmentID] = key
+	}
+	memberSvc := New(te.store, noVaultKey).WithEnvironmentKeys(memberKeys)
+	values, err := memberSvc.Load(te.project, "dev_personal", Options{})
+	if err != nil {
+		t.Fatalf("member Load() error = %v", err)
+	}
+	if values["HOST"].Value != "db.internal" || values["REGION"].Value != "eu-west-1" || values["NAME"].Value != "me" {
+		t.Errorf("member Load() = %+v", values)
+	}
+
+	// The token gets the same keys
+	sealed, _ := te.store.ListTokenKeys(token.ID)
+	tokenKeys := make(map[string][]byte)
+	for _, g := range sealed {
+		key, err := crypto.OpenSealed(tokenPrivate, g.SealedKey, []byte(g.EnvironmentID))
+		if err != nil {
+			t.Fatalf("OpenSealed() error = %v", err)
+		}
+		tokenKeys[g.EnvironmentID] = key
+	}
+	if tokenKeys[prod.ID] == nil || tokenKeys[eu.ID] == nil {
+		t.Errorf("token keys = %d keys, want prod and eu-overrides included", len(tokenKeys))
+	}
+}
@@ -0,0 +1,622 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/resolver"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+// ErrEnvironmentNotFound is returned when an environment doesn't exist in a project
+type ErrEnvironmentNotFound struct {
+	Project string
+	Env     string
+}
+
+func (e *ErrEnvironmentNotFound) Error() string {
+	return fmt.Sprintf("environment '%s' not found in project '%s'", e.Env, e.Project)
+}
+
+// ErrSecretNotFound is returned when a secret doesn't exist in an environment (or its ancestors)
+type ErrSecretNotFound struct {
+	Project string
+	Env     string
+	Key     string
+}
+
+func (e *ErrSecretNotFound) Error() string {
+	return fmt.Sprintf("secret '%s' not found in %s/%s", e.Key, e.Project, e.Env)
+}
+
+// ErrInvalidKeyName is returned when a secret key isn't a valid environment variable name
+var ErrInvalidKeyName = errors.New("invalid key name: must contain only uppercase letters, numbers, and underscores")
+
+// KeyFunc returns the vault key, which wraps each environment's data key
+type KeyFunc func() ([]byte, error)
+
+// Options controls how secrets are loaded
+type Options struct {
+	// Resolve expands ${VAR} references after decryption
+	Resolve bool
+	// At reads secrets as they were at a point in history. The zero value
+	// reads the current secrets.
+	At Point
+}
+
+// Value is a decrypted secret along with where it came from
+type Value struct {
+	Key           string    `json:"key"`
+	Value         string    `json:"value"`
+	Version       int       `json:"version"`
+	SourceEnvID   string    `json:"source_env_id"`
+	SourceEnvName string    `json:"source_env_name"`
+	IsInherited   bool      `json:"is_inherited"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// Shadows lists the lower-precedence environments whose definitions
+	// of the key this value hides, highest precedence first
+	Shadows []string `json:"shadows,omitempty"`
+	// DecryptErr is set by List when the value was requested but could not
+	// be decrypted
+	DecryptErr error `json:"-"`
+}
+
+// Version is a decrypted entry from a secret's history
+type Version struct {
+	Version    int       `json:"version"`
+	ChangeType string    `json:"change_type"`
+	CreatedAt  time.Time `json:"created_at"`
+	Value      string    `json:"value,omitempty"`
+	// DecryptErr is set when the value was requested but could not be decrypted
+	DecryptErr error `json:"-"`
+}
+
+// Service loads and decrypts secrets from a store.
+//
+// Each environment's secrets are encrypted with its own data key, which is
+// stored sealed to the vault's public key (see wrapEnvironmentKey) and to
+// each member and service token granted the environment. Environments
+// created before per-environment keys have no data key yet; their secrets
+// are still encrypted with the vault key until the first write gives them one.
+//
+// A Service keeps the keys it unwraps, so it's meant for a single operation:
+// once another process rotates a key, a Service that already holds the old
+// one can no longer read that environment.
+type Service struct {
+	store    store.Store
+	keyFn    KeyFunc
+	encKey   []byte
+	vaultPub []byte
+	envKeys  map[string][]byte
+}
+
+// New creates a Service reading from s, fetching the vault key lazily via keyFn
+func New(s store.Store, keyFn KeyFunc) *Service {
+	return &Service{store: s, keyFn: keyFn, envKeys: make(map[string][]byte)}
+}
+
+// WithEnvironmentKeys preloads unwrapped data keys by environment ID, so
+// those environments can be read without the vault key
+func (svc *Service) WithEnvironmentKeys(keys map[string][]byte) *Service {
+	for envID, key := range keys {
+		svc.envKeys[envID] = key
+	}
+	return svc
+}
+
+// key returns the vault key, fetching it on first use
+func (svc *Service) key() ([]byte, error) {
+	if svc.encKey != nil {
+		return svc.encKey, nil
+	}
+	key, err := svc.keyFn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key: %w", err)
+	}
+	svc.encKey = key
+	return key, nil
+}
+
+// Environment looks up an environment by name within a project
+func (svc *Service) Environment(project *models.Project, envName string) (*models.Environment, error) {
+	env, err := svc.store.GetEnvironmentByName(project.ID, envName)
+	if err == store.ErrNotFound {
+		return nil, &ErrEnvironmentNotFound{Project: project.Name, Env: envName}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get environment: %w", err)
+	}
+	return env, nil
+}
+
+// Load decrypts all secrets visible in an environment, including inherited ones
+func (svc *Service) Load(project *models.Project, envName string, opts Options) (map[string]Value, error) {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]Value
+	if opts.At.IsZero() {
+		values, err = svc.loadCurrent(env)
+	} else {
+		values, err = svc.loadAt(env, opts.At)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Resolve {
+		resolved, err := resolver.Resolve(ToMap(values))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve secret references: %w", err)
+		}
+		for key, value := range resolved {
+			v := values[key]
+			v.Value = value
+			values[key] = v
+		}
+	}
+
+	return values, nil
+}
+
+func (svc *Service) loadCurrent(env *models.Environment) (map[string]Value, error) {
+	merged, err := svc.store.ListSecretsWithInheritance(env.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+
+	values := make(map[string]Value, len(merged))
+	for _, ms := range merged {
+		v, err := svc.decrypt(ms)
+		if err != nil {
+			return nil, err
+		}
+		values[ms.Key] = v
+	}
+	return values, nil
+}
+
+// List returns every secret visible in an environment, including inherited
+// ones, sorted by key. Values are only decrypted when withValues is set, so
+// key names can be listed without holding the keys of every environment they
+// come from; per-secret decryption failures are reported on the entry rather
+// than failing the whole call.
+func (svc *Service) List(project *models.Project, envName string, withValues bool) ([]Value, error) {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := svc.store.ListSecretsWithInheritance(env.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+
+	values := make([]Value, 0, len(merged))
+	for _, ms := range merged {
+		v := Value{
+			Key:           ms.Key,
+			Version:       ms.Version,
+			SourceEnvID:   ms.SourceEnvID,
+			SourceEnvName: ms.SourceEnvName,
+			IsInherited:   ms.IsInherited,
+			UpdatedAt:     ms.UpdatedAt,
+			Shadows:       shadowedEnvNames(ms.Shadowed),
+		}
+		if withValues {
+			decrypted, err := svc.decrypt(ms)
+			if err != nil {
+				v.DecryptErr = err
+			} else {
+				v.Value = decrypted.Value
+			}
+		}
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Key < values[j].Key })
+	return values, nil
+}
+
+// Get decrypts a single secret, walking up the inheritance chain if needed
+func (svc *Service) Get(project *models.Project, envName, key string, opts Options) (*Value, error) {
+	if opts.Resolve || !opts.At.IsZero() {
+		// References may point anywhere in the environment, and past states
+		// are reconstructed as a whole, so load everything
+		values, err := svc.Load(project, envName, opts)
+		if err != nil {
+			return nil, err
+		}
+		v, ok := values[key]
+		if !ok {
+			return nil, &ErrSecretNotFound{Project: project.Name, Env: envName, Key: key}
+		}
+		return &v, nil
+	}
+
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := svc.store.GetSecretWithInheritance(env.ID, key)
+	if err == store.ErrNotFound {
+		return nil, &ErrSecretNotFound{Project: project.Name, Env: envName, Key: key}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+
+	v, err := svc.decrypt(*ms)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Set encrypts and stores a secret in an environment, creating it if needed.
+// It reports whether the secret was newly created.
+func (svc *Service) Set(project *models.Project, envName, key, value string) (bool, error) {
+	if !IsValidKeyName(key) {
+		return false, ErrInvalidKeyName
+	}
+
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return false, err
+	}
+
+	encKey, err := svc.EnsureEnvironmentKey(env.ID)
+	if err != nil {
+		return false, err
+	}
+
+	// Encrypt value with key name as AAD
+	encryptedValue, nonce, err := crypto.Encrypt(encKey, []byte(value), []byte(key))
+	if err != nil {
+		return false, fmt.Errorf("failed to encrypt value: %w", err)
+	}
+
+	_, err = svc.store.GetSecret(env.ID, key)
+	if err == store.ErrNotFound {
+		if _, err := svc.store.CreateSecret(env.ID, key, encryptedValue, nonce); err != nil {
+			return false, fmt.Errorf("failed to create secret: %w", err)
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check secret: %w", err)
+	}
+
+	if _, err := svc.store.UpdateSecret(env.ID, key, encryptedValue, nonce); err != nil {
+		return false, fmt.Errorf("failed to update secret: %w", err)
+	}
+	return false, nil
+}
+
+// Delete removes a secret defined directly in an environment
+func (svc *Service) Delete(project *models.Project, envName, key string) error {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return err
+	}
+
+	err = svc.store.DeleteSecret(env.ID, key)
+	if err == store.ErrNotFound {
+		return &ErrSecretNotFound{Project: project.Name, Env: envName, Key: key}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete secret: %w", err)
+	}
+	return nil
+}
+
+// History returns the version history of a secret, newest first.
+// Values are only decrypted when withValues is set; per-version decryption
+// failures are reported on the entry rather than failing the whole call.
+func (svc *Service) History(project *models.Project, envName, key string, limit int, withValues bool) ([]Version, error) {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := svc.store.GetSecretHistory(env.ID, key, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history: %w", err)
+	}
+
+	var encKey []byte
+	if withValues && len(history) > 0 {
+		encKey, err = svc.environmentKey(env.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	versions := make([]Version, 0, len(history))
+	for _, h := range history {
+		ver := Version{
+			Version:    h.Version,
+			ChangeType: h.ChangeType,
+			CreatedAt:  h.CreatedAt,
+		}
+		if withValues && h.ChangeType != models.ChangeTypeDelete {
+			plaintext, err := crypto.Decrypt(encKey, h.EncryptedValue, h.Nonce, []byte(key))
+			if err != nil {
+				ver.DecryptErr = err
+			} else {
+				ver.Value = string(plaintext)
+			}
+		}
+		versions = append(versions, ver)
+	}
+
+	return versions, nil
+}
+
+// EnsureEnvironmentKey returns an environment's data key, creating one (and
+// re-encrypting the environment's existing secrets under it) if needed
+func (svc *Service) EnsureEnvironmentKey(envID string) ([]byte, error) {
+	if key, ok := svc.envKeys[envID]; ok {
+		return key, nil
+	}
+	_, err := svc.store.GetEnvironmentKey(envID)
+	if err == store.ErrNotFound {
+		key, _, err := svc.rotateEnvironmentKey(envID, "")
+		return key, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get environment key: %w", err)
+	}
+	return svc.environmentKey(envID)
+}
+
+// EnvironmentKeys returns the data keys needed to read an environment: its
+// own and those of every environment it inherits from
+func (svc *Service) EnvironmentKeys(envID string) (map[string][]byte, error) {
+	ancestors, err := svc.store.GetEnvironmentAncestors(envID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ancestors: %w", err)
+	}
+
+	keys := make(map[string][]byte, len(ancestors)+1)
+	for _, id := range append([]string{envID}, envIDs(ancestors)...) {
+		key, err := svc.EnsureEnvironmentKey(id)
+		if err != nil {
+			return nil, err
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// Rotation reports how rotating an environment's key affected service tokens
+type Rotation struct {
+	// Resealed names the tokens the new key was sealed to
+	Resealed []string
+}
+
+// merge adds another rotation's tokens, skipping names already listed
+func (r *Rotation) merge(other *Rotation) {
+	r.Resealed = appendNew(r.Resealed, other.Resealed)
+}
+
+func appendNew(list, names []string) []string {
+	for _, name := range names {
+		if !slices.Contains(list, name) {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// RotateEnvironmentKey gives an environment a fresh data key and re-encrypts
+// its secrets and their history under it in one transaction. Members and
+// tokens with access to the environment are granted the new key.
+//
+// Sessions that were already unlocked hold the old key, and can't read the
+// environment until they unlock again. The old key can still read copies of
+// the vault taken before the rotation.
+func (svc *Service) RotateEnvironmentKey(envID string) ([]byte, *Rotation, error) {
+	return svc.rotateEnvironmentKey(envID, "")
+}
+
+// rotateEnvironmentKey rotates an environment's key, dropping the grant of
+// revokeMemberID (if set) in the same transaction
+func (svc *Service) rotateEnvironmentKey(envID, revokeMemberID string) ([]byte, *Rotation, error) {
+	// The old key is only needed if the environment has values to move, so
+	// a session without the vault key can still give a new environment its
+	// first key
+	oldKey, oldKeyErr := svc.environmentKey(envID)
+
+	newKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate environment key: %w", err)
+	}
+	envKey, err := svc.wrapEnvironmentKey(envID, newKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	grants, rotation, err := svc.sealGrants(envID, newKey, revokeMemberID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The store reads the rows inside its transaction, so nothing written
+	// concurrently is left under the old key
+	reencryptRow := func(ciphertext, nonce []byte, key string) ([]byte, []byte, error) {
+		if oldKeyErr != nil {
+			return nil, nil, oldKeyErr
+		}
+		return reencrypt(oldKey, newKey, ciphertext, nonce, key)
+	}
+	if err := svc.store.RekeyEnvironment(envKey, grants, reencryptRow); err != nil {
+		return nil, nil, fmt.Errorf("failed to rekey environment: %w", err)
+	}
+
+	svc.envKeys[envID] = newKey
+	return newKey, rotation, nil
+}
+
+// sealGrants seals an environment's new data key to every member and
+// service token holding its current one, except revokeMemberID
+func (svc *Service) sealGrants(envID string, key []byte, revokeMemberID string) (models.KeyGrants, *Rotation, error) {
+	var grants models.KeyGrants
+	rotation := &Rotation{}
+
+	members, err := svc.store.ListEnvironmentMembers(envID)
+	if err != nil {
+		return grants, nil, fmt.Errorf("failed to list members: %w", err)
+	}
+	for _, m := range members {
+		if m.ID == revokeMemberID {
+			continue
+		}
+		sealed, err := crypto.SealTo(m.PublicKey, key, []byte(envID))
+		if err != nil {
+			return grants, nil, fmt.Errorf("failed to seal environment key to '%s': %w", m.Name, err)
+		}
+		grants.Members = append(grants.Members, models.MemberKey{MemberID: m.ID, EnvironmentID: envID, SealedKey: sealed})
+	}
+
+	tokens, err := svc.store.ListEnvironmentTokens(envID)
+	if err != nil {
+		return grants, nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	for _, t := range tokens {
+		sealed, err := crypto.SealTo(t.PublicKey, key, []byte(envID))
+		if err != nil {
+			return grants, nil, fmt.Errorf("failed to seal environment key to token '%s': %w", t.Name, err)
+		}
+		grants.Tokens = append(grants.Tokens, models.TokenKey{TokenID: t.ID, EnvironmentID: envID, SealedKey: sealed})
+		rotation.Resealed = append(rotation.Resealed, t.Name)
+	}
+	return grants, rotation, nil
+}
+
+// environmentKey returns the key an environment's secrets are currently
+// encrypted with: its data key, or the vault key if it doesn't have one yet
+func (svc *Service) environmentKey(envID string) ([]byte, error) {
+	if key, ok := svc.envKeys[envID]; ok {
+		return key, nil
+	}
+
+	envKey, err := svc.store.GetEnvironmentKey(envID)
+	if err == store.ErrNotFound {
+		return svc.key()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get environment key: %w", err)
+	}
+
+	key, err := svc.unwrapEnvironmentKey(envKey)
+	if err != nil {
+		return nil, err
+	}
+
+	svc.envKeys[envID] = key
+	return key, nil
+}
+
+// decrypt turns a stored secret into a Value, using the data key of the
+// environment the secret is defined in
+func (svc *Service) decrypt(ms models.MergedSecret) (Value, error) {
+	encKey, err := svc.environmentKey(ms.SourceEnvID)
+	if err != nil {
+		return Value{}, err
+	}
+
+	plaintext, err := crypto.Decrypt(encKey, ms.EncryptedValue, ms.Nonce, []byte(ms.Key))
+	if err != nil {
+		return Value{}, fmt.Errorf("failed to decrypt secret '%s': %w", ms.Key, err)
+	}
+
+	return Value{
+		Key:           ms.Key,
+		Value:         string(plaintext),
+		Version:       ms.Version,
+		SourceEnvID:   ms.SourceEnvID,
+		SourceEnvName: ms.SourceEnvName,
+		IsInherited:   ms.IsInherited,
+		UpdatedAt:     ms.UpdatedAt,
+		Shadows:       shadowedEnvNames(ms.Shadowed),
+	}, nil
+}
+
+func shadowedEnvNames(shadowed []models.ShadowedSecret) []string {
+	if len(shadowed) == 0 {
+		return nil
+	}
+	names := make([]string, len(shadowed))
+	for i, sh := range shadowed {
+		names[i] = sh.SourceEnvName
+	}
+	return names
+}
+
+// reencrypt moves a value from one key to another, keeping the key name as AAD
+func reencrypt(oldKey, newKey, ciphertext, nonce []byte, key string) ([]byte, []byte, error) {
+	plaintext, err := crypto.Decrypt(oldKey, ciphertext, nonce, []byte(key))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt '%s' for re-encryption: %w", key, err)
+	}
+	encrypted, newNonce, err := crypto.Encrypt(newKey, plaintext, []byte(key))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to re-encrypt '%s': %w", key, err)
+	}
+	return encrypted, newNonce, nil
+}
+
+// envIDs returns the IDs of envs
+func envIDs(envs []models.Environment) []string {
+	ids := make([]string, len(envs))
+	for i, e := range envs {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+// ToMap flattens loaded values into a plain key/value map
+func ToMap(values map[string]Value) map[string]string {
+	result := make(map[string]string, len(values))
+	for key, v := range values {
+		result[key] = v.Value
+	}
+	return result
+}
+
+// SortedKeys returns the keys of values in alphabetical order
+func SortedKeys(values map[string]Value) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// IsValidKeyName reports whether key is an uppercase environment variable name
+func IsValidKeyName(key string) bool {
+	if len(key) == 0 {
+		return false
+	}
+	for i, c := range key {
+		if c >= 'A' && c <= 'Z' {
+			continue
+		}
+		if c >= '0' && c <= '9' && i > 0 {
+			continue
+		}
+		if c == '_' {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,479 @@
+package secrets
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+type testEnv struct {
+	store   *store.SQLiteStore
+	key     []byte
+	project *models.Project
+}
+
+func setupTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	s, err := store.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create test store: %v", err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	if err := s.CreateVaultMeta([]byte("salt"), []byte("check"), []byte("nonce")); err != nil {
+		t.Fatalf("CreateVaultMeta() error = %v", err)
+	}
+
+	project, err := s.CreateProject("myapp", "")
+	if err != nil {
+		t.Fatalf("CreateProject() error = %v", err)
+	}
+
+	return &testEnv{store: s, key: key, project: project}
+}
+
+func (te *testEnv) service() *Service {
+	return New(te.store, func() ([]byte, error) { return te.key, nil })
+}
+
+func (te *testEnv) setSecret(t *testing.T, envID, key, value string) {
+	t.Helper()
+	ciphertext, nonce, err := crypto.Encrypt(te.key, []byte(value), []byte(key))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	if _, err := te.store.GetSecret(envID, key); err == store.ErrNotFound {
+		_, err = te.store.CreateSecret(envID, key, ciphertext, nonce)
+		if err != nil {
+			t.Fatalf("CreateSecret() error = %v", err)
+		}
+		return
+	}
+	if _, err := te.store.UpdateSecret(envID, key, ciphertext, nonce); err != nil {
+		t.Fatalf("UpdateSecret() error = %v", err)
+	}
+}
+
+func TestLoadWithInheritance(t *testing.T) {
+	te := setupTestEnv(t)
+
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	personal, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "dev_personal", dev.ID)
+
+	te.setSecret(t, dev.ID, "API_KEY", "shared")
+	te.setSecret(t, dev.ID, "DB_URL", "postgres://dev")
+	te.setSecret(t, personal.ID, "DB_URL", "postgres://personal")
+
+	values, err := te.service().Load(te.project, "dev_personal", Options{})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if len(values) != 2 {
+		t.Fatalf("Load() returned %d values, want 2", len(values))
+	}
+
+	apiKey := values["API_KEY"]
+	if apiKey.Value != "shared" || !apiKey.IsInherited || apiKey.SourceEnvName != "dev" {
+		t.Errorf("Load()[API_KEY] = %+v, want inherited 'shared' from dev", apiKey)
+	}
+
+	dbURL := values["DB_URL"]
+	if dbURL.Value != "postgres://personal" || dbURL.IsInherited || dbURL.SourceEnvID != personal.ID {
+		t.Errorf("Load()[DB_URL] = %+v, want local 'postgres://personal'", dbURL)
+	}
+}
+
+func TestLoadResolve(t *testing.T) {
+	te := setupTestEnv(t)
+
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	te.setSecret(t, dev.ID, "HOST", "localhost")
+	te.setSecret(t, dev.ID, "URL", "http://${HOST}:8080")
+
+	raw, err := te.service().Load(te.project, "dev", Options{})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if raw["URL"].Value != "http://${HOST}:8080" {
+		t.Errorf("Load()[URL] = %q, want unresolved reference", raw["URL"].Value)
+	}
+
+	resolved, err := te.service().Load(te.project, "dev", Options{Resolve: true})
+	if err != nil {
+		t.Fatalf("Load(Resolve) error = %v", err)
+	}
+	if resolved["URL"].Value != "http://localhost:8080" {
+		t.Errorf("Load(Resolve)[URL] = %q, want http://localhost:8080", resolved["URL"].Value)
+	}
+}
+
+func TestLoadEnvironmentNotFound(t *testing.T) {
+	te := setupTestEnv(t)
+
+	_, err := te.service().Load(te.project, "missing", Options{})
+	var notFound *ErrEnvironmentNotFound
+	if !errors.As(err, &notFound) {
+		t.Fatalf("Load() error = %v, want ErrEnvironmentNotFound", err)
+	}
+	if notFound.Env != "missing" || notFound.Project != "myapp" {
+		t.Errorf("ErrEnvironmentNotFound = %+v", notFound)
+	}
+}
+
+func TestLoadWrongKey(t *testing.T) {
+	te := setupTestEnv(t)
+
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	te.setSecret(t, dev.ID, "API_KEY", "value")
+
+	wrongKey, _ := crypto.GenerateKey()
+	svc := New(te.store, func() ([]byte, error) { return wrongKey, nil })
+	if _, err := svc.Load(te.project, "dev", Options{}); err == nil {
+		t.Error("Load() with wrong key should fail")
+	}
+}
+
+func TestGet(t *testing.T) {
+	te := setupTestEnv(t)
+
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	te.store.CreateEnvironmentWithParent(te.project.ID, "dev_personal", dev.ID)
+	te.setSecret(t, dev.ID, "HOST", "localhost")
+	te.setSecret(t, dev.ID, "URL", "http://${HOST}")
+	te.setSecret(t, dev.ID, "URL", "https://${HOST}")
+
+	v, err := te.service().Get(te.project, "dev_personal", "URL", Options{})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if v.Value != "https://${HOST}" || !v.IsInherited || v.Version != 2 {
+		t.Errorf("Get() = %+v, want inherited version 2", v)
+	}
+
+	v, err = te.service().Get(te.project, "dev_personal", "URL", Options{Resolve: true})
+	if err != nil {
+		t.Fatalf("Get(Resolve) error = %v", err)
+	}
+	if v.Value != "https://localhost" {
+		t.Errorf("Get(Resolve) = %q, want https://localhost", v.Value)
+	}
+
+	_, err = te.service().Get(te.project, "dev", "MISSING", Options{})
+	var notFound *ErrSecretNotFound
+	if !errors.As(err, &notFound) {
+		t.Errorf("Get() error = %v, want ErrSecretNotFound", err)
+	}
+}
+
+func TestSetAndDelete(t *testing.T) {
+	te := setupTestEnv(t)
+	te.store.CreateEnvironment(te.project.ID, "dev")
+	svc := te.service()
+
+	created, err := svc.Set(te.project, "dev", "API_KEY", "v1")
+	if err != nil || !created {
+		t.Fatalf("Set() = %v, %v, want created", created, err)
+	}
+	created, err = svc.Set(te.project, "dev", "API_KEY", "v2")
+	if err != nil || created {
+		t.Fatalf("Set() = %v, %v, want updated", created, err)
+	}
+
+	v, err := svc.Get(te.project, "dev", "API_KEY", Options{})
+	if err != nil || v.Value != "v2" || v.Version != 2 {
+		t.Errorf("Get() = %+v, %v, want v2 at version 2", v, err)
+	}
+
+	if _, err := svc.Set(te.project, "dev", "bad-key", "x"); err != ErrInvalidKeyName {
+		t.Errorf("Set() invalid key error = %v, want ErrInvalidKeyName", err)
+	}
+
+	if err := svc.Delete(te.project, "dev", "API_KEY"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	var notFound *ErrSecretNotFound
+	if err := svc.Delete(te.project, "dev", "API_KEY"); !errors.As(err, &notFound) {
+		t.Errorf("Delete() again error = %v, want ErrSecretNotFound", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	te := setupTestEnv(t)
+
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	te.setSecret(t, dev.ID, "API_KEY", "v1")
+	te.setSecret(t, dev.ID, "API_KEY", "v2")
+	if err := te.store.DeleteSecret(dev.ID, "API_KEY"); err != nil {
+		t.Fatalf("DeleteSecret() error = %v", err)
+	}
+
+	keyCalls := 0
+	svc := New(te.store, func() ([]byte, error) {
+		keyCalls++
+		return te.key, nil
+	})
+
+	history, err := svc.History(te.project, "dev", "API_KEY", 10, false)
+	if err != nil {
+		t.Fatalf("History() error = %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("History() returned %d entries, want 3", len(history))
+	}
+	if keyCalls != 0 {
+		t.Error("History() without values should not fetch the key")
+	}
+	if history[0].Value != "" {
+		t.Error("History() without values should not decrypt")
+	}
+
+	history, err = svc.History(te.project, "dev", "API_KEY", 10, true)
+	if err != nil {
+		t.Fatalf("History() error = %v", err)
+	}
+	if history[0].ChangeType != models.ChangeTypeDelete || history[0].Value != "" {
+		t.Errorf("History()[0] = %+v, want delete without value", history[0])
+	}
+	if history[1].Value != "v2" || history[2].Value != "v1" {
+		t.Errorf("History() values = %q, %q, want v2, v1", history[1].Value, history[2].Value)
+	}
+}
+
+func TestList(t *testing.T) {
+	te := setupTestEnv(t)
+
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	personal, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "dev_personal", dev.ID)
+	te.setSecret(t, dev.ID, "API_KEY", "shared")
+	te.setSecret(t, personal.ID, "NAME", "me")
+	te.store.CreateSecret(personal.ID, "CORRUPT", []byte("not a ciphertext"), []byte("nonce123456"))
+
+	// Key names don't need any key at all, e.g. for a session that only
+	// holds some of the environments it inherits from
+	noKey := New(te.store, func() ([]byte, error) { return nil, errors.New("no key") })
+	values, err := noKey.List(te.project, "dev_personal", false)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(values) != 3 || values[0].Key != "API_KEY" || !values[0].IsInherited || values[0].Value != "" {
+		t.Errorf("List() = %+v", values)
+	}
+
+	// One bad value doesn't fail the rest
+	values, err = te.service().List(te.project, "dev_personal", true)
+	if err != nil {
+		t.Fatalf("List(withValues) error = %v", err)
+	}
+	if values[0].Value != "shared" || values[1].Key != "CORRUPT" || values[1].DecryptErr == nil || values[2].Value != "me" {
+		t.Errorf("List(withValues) = %+v", values)
+	}
+}
+
+func TestEnvironmentKeyMigration(t *testing.T) {
+	te := setupTestEnv(t)
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+
+	// Secrets written before per-environment keys are sealed with the vault key
+	te.setSecret(t, dev.ID, "OLD", "v1")
+	te.setSecret(t, dev.ID, "OLD", "v2")
+
+	svc := te.service()
+	if _, err := svc.Set(te.project, "dev", "NEW", "fresh"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if _, err := te.store.GetEnvironmentKey(dev.ID); err != nil {
+		t.Fatalf("GetEnvironmentKey() after Set error = %v", err)
+	}
+
+	// Existing values and history must have been re-encrypted under the new key
+	old, _ := te.store.GetSecret(dev.ID, "OLD")
+	if _, err := crypto.Decrypt(te.key, old.EncryptedValue, old.Nonce, []byte("OLD")); err == nil {
+		t.Error("secret should no longer be encrypted with the vault key")
+	}
+
+	values, err := te.service().Load(te.project, "dev", Options{})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if values["OLD"].Value != "v2" || values["NEW"].Value != "fresh" {
+		t.Errorf("Load() = %+v", values)
+	}
+
+	history, err := te.service().History(te.project, "dev", "OLD", 10, true)
+	if err != nil {
+		t.Fatalf("History() error = %v", err)
+	}
+	if len(history) != 2 || history[1].Value != "v1" || history[1].DecryptErr != nil {
+		t.Errorf("History() = %+v", history)
+	}
+}
+
+func TestEnvironmentKeysAcrossInheritance(t *testing.T) {
+	te := setupTestEnv(t)
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	personal, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "dev_personal", dev.ID)
+	te.store.CreateEnvironment(te.project.ID, "prod")
+
+	svc := te.service()
+	svc.Set(te.project, "dev", "SHARED", "from-dev")
+	svc.Set(te.project, "dev_personal", "LOCAL", "mine")
+	svc.Set(te.project, "prod", "PROD_ONLY", "secret")
+
+	keys, err := svc.EnvironmentKeys(personal.ID)
+	if err != nil {
+		t.Fatalf("EnvironmentKeys() error = %v", err)
+	}
+	if len(keys) != 2 || string(keys[dev.ID]) == string(keys[personal.ID]) {
+		t.Fatalf("EnvironmentKeys() should return distinct keys for dev and dev_personal")
+	}
+
+	// Only the environment keys are available, not the vault key
+	scoped := New(te.store, func() ([]byte, error) { return nil, errors.New("no vault key") }).WithEnvironmentKeys(keys)
+	values, err := scoped.Load(te.project, "dev_personal", Options{})
+	if err != nil {
+		t.Fatalf("Load() with environment keys error = %v", err)
+	}
+	if values["SHARED"].Value != "from-dev" || values["LOCAL"].Value != "mine" {
+		t.Errorf("Load() = %+v", values)
+	}
+	if _, err := scoped.Load(te.project, "prod", Options{}); err == nil {
+		t.Error("Load() of another environment should fail without its key")
+	}
+}
+
+func TestRotateEnvironmentKey(t *testing.T) {
+	te := setupTestEnv(t)
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+
+	svc := te.service()
+	svc.Set(te.project, "dev", "API_KEY", "abc")
+	before, _ := svc.EnsureEnvironmentKey(dev.ID)
+
+	after, _, err := svc.RotateEnvironmentKey(dev.ID)
+	if err != nil {
+		t.Fatalf("RotateEnvironmentKey() error = %v", err)
+	}
+	if string(before) == string(after) {
+		t.Error("RotateEnvironmentKey() should generate a new key")
+	}
+
+	got, err := te.service().Get(te.project, "dev", "API_KEY", Options{})
+	if err != nil || got.Value != "abc" {
+		t.Errorf("Get() after rotation = %v, %v", got, err)
+	}
+}
+
+func TestGrantAndRevoke(t *testing.T) {
+	te := setupTestEnv(t)
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	prod, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "prod", dev.ID)
+
+	svc := te.service()
+	svc.Set(te.project, "dev", "SHARED", "base")
+	svc.Set(te.project, "prod", "API_KEY", "v1")
+
+	privateKey, publicKey, _ := crypto.GenerateKeyPair()
+	member, _ := te.store.CreateMember("alice", publicKey)
+
+	granted, err := svc.Grant(member, prod.ID)
+	if err != nil {
+		t.Fatalf("Grant() error = %v", err)
+	}
+	if len(granted) != 2 {
+		t.Errorf("Grant() granted %d environments, want prod and its parent", len(granted))
+	}
+
+	// The member can read prod, including inherited secrets, with only their private key
+	grants, _ := te.store.ListMemberKeys(member.ID)
+	keys := make(map[string][]byte)
+	for _, g := range grants {
+		key, err := crypto.OpenSealed(privateKey, g.SealedKey, []byte(g.EnvironmentID))
+		if err != nil {
+			t.Fatalf("OpenSealed() error = %v", err)
+		}
+		keys[g.EnvironmentID] = key
+	}
+	memberSvc := New(te.store, func() ([]byte, error) { return nil, errors.New("no vault key") }).WithEnvironmentKeys(keys)
+	values, err := memberSvc.Load(te.project, "prod", Options{})
+	if err != nil {
+		t.Fatalf("Load() as member error = %v", err)
+	}
+	if values["SHARED"].Value != "base" || values["API_KEY"].Value != "v1" {
+		t.Errorf("Load() as member = %+v", values)
+	}
+
+	revocation, err := svc.Revoke(member, prod.ID)
+	if err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	members, _ := te.store.ListEnvironmentMembers(prod.ID)
+	if len(members) != 0 {
+		t.Errorf("Revoke() should remove the grant, members = %+v", members)
+	}
+
+	// Only prod is rekeyed: the member keeps dev's key, and is told so
+	if len(revocation.Retained) != 1 || revocation.Retained[0].ID != dev.ID {
+		t.Errorf("Revoke() retained = %+v, want dev", revocation.Retained)
+	}
+
+	// A kept copy of the old key can't read values written after the rekey
+	svc.Set(te.project, "prod", "API_KEY", "v2")
+	stale := New(te.store, func() ([]byte, error) { return nil, errors.New("no vault key") }).WithEnvironmentKeys(keys)
+	if _, err := stale.Get(te.project, "prod", "API_KEY", Options{}); err == nil {
+		t.Error("Get() with a revoked key should fail")
+	}
+}
+
+func TestRotateKeepsGrants(t *testing.T) {
+	te := setupTestEnv(t)
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+
+	svc := te.service()
+	svc.Set(te.project, "dev", "API_KEY", "abc")
+
+	privateKey, publicKey, _ := crypto.GenerateKeyPair()
+	member, _ := te.store.CreateMember("alice", publicKey)
+	svc.Grant(member, dev.ID)
+
+	newKey, _, err := svc.RotateEnvironmentKey(dev.ID)
+	if err != nil {
+		t.Fatalf("RotateEnvironmentKey() error = %v", err)
+	}
+	grants, _ := te.store.ListMemberKeys(member.ID)
+	if len(grants) != 1 {
+		t.Fatalf("grants after rotation = %d, want 1", len(grants))
+	}
+	key, err := crypto.OpenSealed(privateKey, grants[0].SealedKey, []byte(dev.ID))
+	if err != nil || string(key) != string(newKey) {
+		t.Errorf("rotation should reseal the new key to existing members: %v", err)
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	values := map[string]Value{
+		"C": {Key: "C", Value: "3"},
+		"A": {Key: "A", Value: "1"},
+		"B": {Key: "B", Value: "2"},
+	}
+
+	keys := SortedKeys(values)
+	if len(keys) != 3 || keys[0] != "A" || keys[1] != "B" || keys[2] != "C" {
+		t.Errorf("SortedKeys() = %v, want [A B C]", keys)
+	}
+
+	m := ToMap(values)
+	if m["B"] != "2" {
+		t.Errorf("ToMap()[B] = %q, want 2", m["B"])
+	}
+}
@@ -0,0 +1,349 @@
+package secrets
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+// Point is a point in an environment's history: a time, or a snapshot. A
+// snapshot is matched on history sequence numbers rather than timestamps, so
+// it holds exactly the changes recorded before it whatever the clock did.
+type Point struct {
+	Time time.Time
+	// Seq is a snapshot's history boundary, used when bySeq is set
+	Seq   int64
+	bySeq bool
+}
+
+// AtTime returns the point in history at t
+func AtTime(t time.Time) Point {
+	return Point{Time: t}
+}
+
+// AtSnapshot returns the point in history a snapshot recorded
+func AtSnapshot(snap *models.Snapshot) Point {
+	return Point{Time: snap.CreatedAt, Seq: snap.HistorySeq, bySeq: true}
+}
+
+// IsZero reports whether p is the zero Point, meaning the current state
+func (p Point) IsZero() bool {
+	return p.Time.IsZero() && !p.bySeq
+}
+
+// includes reports whether an entry recorded at seq and createdAt had been
+// recorded by p
+func (p Point) includes(seq int64, createdAt time.Time) bool {
+	if p.bySeq {
+		return seq <= p.Seq
+	}
+	return !createdAt.After(p.Time)
+}
+
+// ParseSnapshotVersion parses a snapshot reference like "v3" or "3"
+func ParseSnapshotVersion(ref string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimPrefix(ref, "v"))
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// CreateSnapshot records the environment's current state under the next
+// snapshot version
+func (svc *Service) CreateSnapshot(project *models.Project, envName, message string) (*models.Snapshot, error) {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := svc.store.CreateSnapshot(env.ID, message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// Snapshots lists an environment's snapshots, oldest first
+func (svc *Service) Snapshots(project *models.Project, envName string) ([]models.Snapshot, error) {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := svc.store.ListSnapshots(env.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	return snapshots, nil
+}
+
+// Snapshot looks up a snapshot by version
+func (svc *Service) Snapshot(project *models.Project, envName string, version int) (*models.Snapshot, error) {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := svc.store.GetSnapshot(env.ID, version)
+	if err == store.ErrNotFound {
+		return nil, fmt.Errorf("snapshot v%d not found in %s/%s", version, project.Name, envName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// ValuesAt reconstructs the secrets defined directly in an environment (not
+// inherited ones) as they were at a point in history
+func (svc *Service) ValuesAt(project *models.Project, envName string, at Point) (map[string]string, error) {
+	env, err := svc.Environment(project, envName)
+	if err != nil {
+		return nil, err
+	}
+	return svc.valuesAt(env.ID, at)
+}
+
+func (svc *Service) valuesAt(envID string, at Point) (map[string]string, error) {
+	latest, err := svc.historyAt(envID, at)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(latest))
+	if len(latest) == 0 {
+		return values, nil
+	}
+	encKey, err := svc.environmentKey(envID)
+	if err != nil {
+		return nil, err
+	}
+	for key, h := range latest {
+		plaintext, err := crypto.Decrypt(encKey, h.EncryptedValue, h.Nonce, []byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s version %d: %w", key, h.Version, err)
+		}
+		values[key] = string(plaintext)
+	}
+	return values, nil
+}
+
+// loadAt reconstructs every secret visible in an environment at a point in
+// history, evaluating inheritance over the parents and layers it had then
+func (svc *Service) loadAt(env *models.Environment, at Point) (map[string]Value, error) {
+	if env.CreatedAt.After(at.Time) {
+		return nil, fmt.Errorf("environment '%s' did not exist at %s", env.Name, at.Time.Format(time.RFC3339))
+	}
+	ancestors, err := svc.lineageAt(env, at)
+	if err != nil {
+		return nil, err
+	}
+	chain := append([]models.Environment{*env}, ancestors...)
+
+	// Walk from the lowest precedence up so nearer environments override
+	// what they inherit
+	values := make(map[string]Value)
+	for i := len(chain) - 1; i >= 0; i-- {
+		e := chain[i]
+		latest, err := svc.historyAt(e.ID, at)
+		if err != nil {
+			return nil, err
+		}
+		if len(latest) == 0 {
+			continue
+		}
+		encKey, err := svc.environmentKey(e.ID)
+		if err != nil {
+			return nil, err
+		}
+		for key, h := range latest {
+			plaintext, err := crypto.Decrypt(encKey, h.EncryptedValue, h.Nonce, []byte(key))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt %s version %d: %w", key, h.Version, err)
+			}
+			v := Value{
+				Key:           key,
+				Value:         string(plaintext),
+				Version:       h.Version,
+				SourceEnvID:   e.ID,
+				SourceEnvName: e.Name,
+				IsInherited:   i > 0,
+				UpdatedAt:     h.CreatedAt,
+			}
+			if prev, ok := values[key]; ok {
+				v.Shadows = append([]string{prev.SourceEnvName}, prev.Shadows...)
+			}
+			values[key] = v
+		}
+	}
+	return values, nil
+}
+
+// lineageAt returns every environment env inherited from at a point in
+// history, highest precedence first, walking the parents and layers each
+// environment had then the way store.GetEnvironmentAncestors walks the
+// current ones
+func (svc *Service) lineageAt(env *models.Environment, at Point) ([]models.Environment, error) {
+	var result []models.Environment
+	seen := make(map[string]bool)
+	onPath := map[string]bool{env.ID: true}
+
+	var walk func(e *models.Environment) error
+	walk = func(e *models.Environment) error {
+		sources, err := svc.sourcesAt(e, at)
+		if err != nil {
+			return err
+		}
+		for _, id := range sources {
+			if onPath[id] {
+				return store.ErrInheritanceCycle
+			}
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			src, err := svc.store.GetEnvironment(id)
+			if err == store.ErrNotFound {
+				return fmt.Errorf("environment '%s' inherited from an environment that has since been deleted", e.Name)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to get environment: %w", err)
+			}
+			result = append(result, *src)
+
+			onPath[id] = true
+			if err := walk(src); err != nil {
+				return err
+			}
+			delete(onPath, id)
+		}
+		return nil
+	}
+
+	if err := walk(env); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// sourcesAt returns the IDs of what an environment inherited from directly
+// at a point in history, highest precedence first: its layers from last to
+// first, then its parent
+func (svc *Service) sourcesAt(env *models.Environment, at Point) ([]string, error) {
+	changes, err := svc.store.GetInheritanceHistory(env.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inheritance history: %w", err)
+	}
+
+	parentID := env.ParentID
+	var layerIDs []string
+	if len(changes) == 0 {
+		// Never changed: the current links have held since it was created
+		layers, err := svc.store.GetEnvironmentLayers(env.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get layers: %w", err)
+		}
+		for _, l := range layers {
+			layerIDs = append(layerIDs, l.ID)
+		}
+	} else {
+		// The first entry holds the links from before any change
+		parentID, layerIDs = changes[0].ParentID, changes[0].LayerIDs
+		for _, c := range changes[1:] {
+			if !at.includes(c.Seq, c.CreatedAt) {
+				break
+			}
+			parentID, layerIDs = c.ParentID, c.LayerIDs
+		}
+	}
+
+	sources := make([]string, 0, len(layerIDs)+1)
+	for i := len(layerIDs) - 1; i >= 0; i-- {
+		sources = append(sources, layerIDs[i])
+	}
+	if parentID != nil {
+		sources = append(sources, *parentID)
+	}
+	return sources, nil
+}
+
+// historyAt returns each key's latest history entry at a point in history,
+// leaving out keys that were deleted
+func (svc *Service) historyAt(envID string, at Point) (map[string]models.SecretHistory, error) {
+	history, err := svc.store.ListEnvironmentHistory(envID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list history: %w", err)
+	}
+
+	// Versions restart when a deleted key is re-created, so go by the order
+	// the entries were recorded in
+	sort.Slice(history, func(i, j int) bool { return history[i].Seq < history[j].Seq })
+	latest := make(map[string]models.SecretHistory)
+	for _, h := range history {
+		if !at.includes(h.Seq, h.CreatedAt) {
+			continue
+		}
+		if h.ChangeType == models.ChangeTypeDelete {
+			delete(latest, h.Key)
+			continue
+		}
+		latest[h.Key] = h
+	}
+	return latest, nil
+}
+
+// PlanRollback plans restoring every secret defined directly in an
+// environment to its state at a point in history: changed keys are reverted,
+// deleted keys re-created and keys added since then removed. Apply the plan
+// with ApplyRollback.
+func (svc *Service) PlanRollback(project *models.Project, envName string, at Point) (*ImportPlan, error) {
+	values, err := svc.ValuesAt(project, envName, at)
+	if err != nil {
+		return nil, err
+	}
+	return svc.PlanImport(project, envName, values, ImportOptions{Strategy: StrategyOverwrite, Prune: true})
+}
+
+// ApplyRollback snapshots the environment with message and writes a
+// rollback plan in the same transaction, so the snapshot holds exactly the
+// state the rollback replaces. If the environment's secrets changed since
+// the plan was made, nothing is written and store.ErrSecretsChanged is
+// returned; plan again to see the current changes.
+func (svc *Service) ApplyRollback(plan *ImportPlan, message string) (*models.Snapshot, error) {
+	changes, err := svc.planChanges(plan)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := svc.store.SnapshotAndApplySecrets(plan.Environment.ID, message, plan.versions, changes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to roll back: %w", err)
+	}
+	return snap, nil
+}
+
+// Diff compares two sets of values and returns the created, updated and
+// removed keys going from one to the other, sorted by key
+func Diff(from, to map[string]string) []ImportChange {
+	var changes []ImportChange
+	for key, value := range to {
+		old, ok := from[key]
+		switch {
+		case !ok:
+			changes = append(changes, ImportChange{Key: key, Kind: ChangeCreated})
+		case old != value:
+			changes = append(changes, ImportChange{Key: key, Kind: ChangeUpdated})
+		}
+	}
+	for key := range from {
+		if _, ok := to[key]; !ok {
+			changes = append(changes, ImportChange{Key: key, Kind: ChangeRemoved})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
@@ -0,0 +1,269 @@
+package secrets
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/russellromney/coffer/internal/store"
+)
+
+func TestRollbackToSnapshot(t *testing.T) {
+	te := setupTestEnv(t)
+	env, _ := te.store.CreateEnvironment(te.project.ID, "prod")
+	te.setSecret(t, env.ID, "CHANGED", "old")
+	te.setSecret(t, env.ID, "DELETED", "d")
+	te.setSecret(t, env.ID, "SAME", "s")
+
+	svc := te.service()
+	snap, err := svc.CreateSnapshot(te.project, "prod", "before migration")
+	if err != nil {
+		t.Fatalf("CreateSnapshot() error = %v", err)
+	}
+
+	te.setSecret(t, env.ID, "CHANGED", "new")
+	te.setSecret(t, env.ID, "ADDED", "a")
+	if err := te.store.DeleteSecret(env.ID, "DELETED"); err != nil {
+		t.Fatal(err)
+	}
+
+	at, err := svc.ValuesAt(te.project, "prod", AtSnapshot(snap))
+	if err != nil {
+		t.Fatalf("ValuesAt() error = %v", err)
+	}
+	want := map[string]string{"CHANGED": "old", "DELETED": "d", "SAME": "s"}
+	if len(at) != len(want) {
+		t.Fatalf("ValuesAt() = %v, want %v", at, want)
+	}
+	for k, v := range want {
+		if at[k] != v {
+			t.Errorf("ValuesAt()[%s] = %q, want %q", k, at[k], v)
+		}
+	}
+
+	plan, err := svc.PlanRollback(te.project, "prod", AtSnapshot(snap))
+	if err != nil {
+		t.Fatalf("PlanRollback() error = %v", err)
+	}
+	if plan.Count(ChangeCreated) != 1 || plan.Count(ChangeUpdated) != 1 || plan.Count(ChangeRemoved) != 1 {
+		t.Errorf("PlanRollback() changes = %+v", plan.Changes)
+	}
+
+	// A plan made before the environment changed again isn't applied
+	stale, _ := svc.PlanRollback(te.project, "prod", AtSnapshot(snap))
+	te.setSecret(t, env.ID, "ADDED", "a2")
+	if _, err := svc.ApplyRollback(stale, "stale"); !errors.Is(err, store.ErrSecretsChanged) {
+		t.Fatalf("ApplyRollback() with a stale plan error = %v, want ErrSecretsChanged", err)
+	}
+	if snaps, _ := svc.Snapshots(te.project, "prod"); len(snaps) != 1 {
+		t.Errorf("stale rollback left %d snapshots, want 1", len(snaps))
+	}
+
+	plan, _ = svc.PlanRollback(te.project, "prod", AtSnapshot(snap))
+	before, err := svc.ApplyRollback(plan, "before rollback")
+	if err != nil {
+		t.Fatalf("ApplyRollback() error = %v", err)
+	}
+
+	// The snapshot taken with the rollback holds the state it replaced
+	replaced, _ := svc.ValuesAt(te.project, "prod", AtSnapshot(before))
+	if len(replaced) != 3 || replaced["CHANGED"] != "new" || replaced["ADDED"] != "a2" {
+		t.Errorf("ValuesAt(before rollback) = %v", replaced)
+	}
+
+	values, err := svc.Load(te.project, "prod", Options{})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	got := ToMap(values)
+	if len(got) != len(want) {
+		t.Fatalf("Load() after rollback = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Load()[%s] after rollback = %q, want %q", k, got[k], v)
+		}
+	}
+
+	// The rollback itself is recorded in history
+	history, _ := svc.History(te.project, "prod", "CHANGED", 10, true)
+	if len(history) != 3 || history[0].Value != "old" {
+		t.Errorf("History() after rollback = %+v", history)
+	}
+}
+
+// TestSnapshotIgnoresClock checks that a snapshot holds exactly the changes
+// recorded before it, even when the clock says otherwise
+func TestSnapshotIgnoresClock(t *testing.T) {
+	te := setupTestEnv(t)
+	env, _ := te.store.CreateEnvironment(te.project.ID, "prod")
+	te.setSecret(t, env.ID, "KEY", "before")
+
+	svc := te.service()
+	snap, err := svc.CreateSnapshot(te.project, "prod", "")
+	if err != nil {
+		t.Fatalf("CreateSnapshot() error = %v", err)
+	}
+	te.setSecret(t, env.ID, "KEY", "after")
+	te.setSecret(t, env.ID, "LATER", "x")
+
+	// As if the snapshot's clock ran ahead of the later writes
+	snap.CreatedAt = time.Now().Add(time.Hour)
+	values, err := svc.ValuesAt(te.project, "prod", AtSnapshot(snap))
+	if err != nil {
+		t.Fatalf("ValuesAt() error = %v", err)
+	}
+	if len(values) != 1 || values["KEY"] != "before" {
+		t.Errorf("ValuesAt(snapshot) = %v, want KEY=before only", values)
+	}
+}
+
+func TestValuesAtRecreatedKey(t *testing.T) {
+	te := setupTestEnv(t)
+	env, _ := te.store.CreateEnvironment(te.project.ID, "prod")
+	te.setSecret(t, env.ID, "KEY", "first")
+	te.setSecret(t, env.ID, "KEY", "second")
+	te.store.DeleteSecret(env.ID, "KEY")
+	te.setSecret(t, env.ID, "KEY", "recreated")
+
+	svc := te.service()
+	values, err := svc.ValuesAt(te.project, "prod", AtTime(time.Now()))
+	if err != nil {
+		t.Fatalf("ValuesAt() error = %v", err)
+	}
+	if values["KEY"] != "recreated" {
+		t.Errorf("ValuesAt()[KEY] = %q, want recreated", values["KEY"])
+	}
+
+	before, err := svc.ValuesAt(te.project, "prod", AtTime(time.Time{}))
+	if err != nil {
+		t.Fatalf("ValuesAt() error = %v", err)
+	}
+	if len(before) != 0 {
+		t.Errorf("ValuesAt(zero) = %v, want empty", before)
+	}
+}
+
+func TestParseSnapshotVersion(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want int
+		ok   bool
+	}{
+		{"v3", 3, true},
+		{"12", 12, true},
+		{"v0", 0, false},
+		{"2h", 0, false},
+		{"2026-01-02T15:04:05Z", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseSnapshotVersion(tt.ref)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseSnapshotVersion(%q) = %d, %v; want %d, %v", tt.ref, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	changes := Diff(
+		map[string]string{"A": "1", "B": "2", "C": "3"},
+		map[string]string{"A": "1", "B": "changed", "D": "4"},
+	)
+	want := []ImportChange{{"B", ChangeUpdated}, {"C", ChangeRemoved}, {"D", ChangeCreated}}
+	if len(changes) != len(want) {
+		t.Fatalf("Diff() = %+v, want %+v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("Diff()[%d] = %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestLoadAt(t *testing.T) {
+	te := setupTestEnv(t)
+	parent, _ := te.store.CreateEnvironment(te.project.ID, "base")
+	env, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "prod", parent.ID)
+	te.setSecret(t, parent.ID, "SHARED", "parent-old")
+	te.setSecret(t, parent.ID, "HOST", "db")
+	te.setSecret(t, env.ID, "URL", "postgres://${HOST}")
+
+	svc := te.service()
+	at := time.Now()
+
+	te.setSecret(t, parent.ID, "SHARED", "parent-new")
+	te.setSecret(t, parent.ID, "HOST", "db2")
+	te.setSecret(t, env.ID, "SHARED", "override")
+	te.setSecret(t, env.ID, "LATER", "x")
+
+	values, err := svc.Load(te.project, "prod", Options{At: AtTime(at), Resolve: true})
+	if err != nil {
+		t.Fatalf("Load(At) error = %v", err)
+	}
+	if len(values) != 3 {
+		t.Fatalf("Load(At) = %+v, want 3 keys", values)
+	}
+	if v := values["SHARED"]; v.Value != "parent-old" || !v.IsInherited || v.SourceEnvName != "base" {
+		t.Errorf("SHARED = %+v, want inherited parent-old", v)
+	}
+	if v := values["URL"]; v.Value != "postgres://db" || v.IsInherited {
+		t.Errorf("URL = %+v, want resolved against the past HOST", v)
+	}
+
+	got, err := svc.Get(te.project, "prod", "SHARED", Options{At: AtTime(at)})
+	if err != nil {
+		t.Fatalf("Get(At) error = %v", err)
+	}
+	if got.Value != "parent-old" {
+		t.Errorf("Get(At) = %q, want parent-old", got.Value)
+	}
+	if _, err := svc.Get(te.project, "prod", "LATER", Options{At: AtTime(at)}); err == nil {
+		t.Error("Get(At) of a key created later expected error")
+	}
+
+	if _, err := svc.Load(te.project, "prod", Options{At: AtTime(env.CreatedAt.Add(-time.Hour))}); err == nil {
+		t.Error("Load(At) before the environment existed expected error")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	te := setupTestEnv(t)
+	base, _ := te.store.CreateEnvironment(te.project.ID, "base")
+	dev, _ := te.store.CreateEnvironmentWithParent(te.project.ID, "dev", base.ID)
+	prod, _ := te.store.CreateEnvironment(te.project.ID, "prod")
+	te.setSecret(t, base.ID, "SAME", "s")
+	te.setSecret(t, prod.ID, "SAME", "s")
+	te.setSecret(t, dev.ID, "URL", "localhost")
+	te.setSecret(t, prod.ID, "URL", "db.internal")
+	te.setSecret(t, dev.ID, "DEBUG", "1")
+	te.setSecret(t, prod.ID, "SENTRY", "dsn")
+
+	svc := te.service()
+	from, _ := svc.Load(te.project, "dev", Options{})
+	to, _ := svc.Load(te.project, "prod", Options{})
+
+	diffs := Compare(from, to)
+	want := []struct {
+		key  string
+		kind string
+	}{
+		{"DEBUG", ChangeRemoved},
+		{"SAME", ChangeUnchanged},
+		{"SENTRY", ChangeCreated},
+		{"URL", ChangeUpdated},
+	}
+	if len(diffs) != len(want) {
+		t.Fatalf("Compare() = %+v", diffs)
+	}
+	for i, w := range want {
+		if diffs[i].Key != w.key || diffs[i].Kind != w.kind {
+			t.Errorf("Compare()[%d] = %s %s, want %s %s", i, diffs[i].Key, diffs[i].Kind, w.key, w.kind)
+		}
+	}
+	if same := diffs[1]; !same.From.IsInherited || same.From.SourceEnvName != "base" || same.To.IsInherited {
+		t.Errorf("SAME provenance = %+v / %+v", same.From, same.To)
+	}
+	if diffs[0].To != nil || diffs[2].From != nil {
+		t.Errorf("one-sided keys have both values: %+v, %+v", diffs[0], diffs[2])
+	}
+}
@@ -0,0 +1,56 @@
+package secrets
+
+import (
+	"fmt"
+
+	"github.com/russellromney/coffer/internal/models"
+)
+
+// TokenKeys returns the data keys a service token needs for its scope: an
+// environment and everything it inherits from, every environment of a
+// project, or every environment in the vault for an unscoped token.
+// Environments without a data key are given one, so the token never needs
+// the vault key. Environments created later are sealed to the token when
+// they get their key (see sealGrants).
+func (svc *Service) TokenKeys(token *models.APIToken) (map[string][]byte, error) {
+	// Make sure the vault has a keypair, so a token session can create keys
+	// for new environments in its scope
+	if _, err := svc.vaultPublicKey(); err != nil {
+		return nil, err
+	}
+
+	if token.EnvironmentID != "" {
+		return svc.EnvironmentKeys(token.EnvironmentID)
+	}
+
+	var projects []models.Project
+	if token.ProjectID != "" {
+		project, err := svc.store.GetProject(token.ProjectID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get project: %w", err)
+		}
+		projects = []models.Project{*project}
+	} else {
+		var err error
+		projects, err = svc.store.ListProjects()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list projects: %w", err)
+		}
+	}
+
+	keys := make(map[string][]byte)
+	for _, p := range projects {
+		envs, err := svc.store.ListEnvironments(p.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list environments: %w", err)
+		}
+		for _, env := range envs {
+			key, err := svc.EnsureEnvironmentKey(env.ID)
+			if err != nil {
+				return nil, err
+			}
+			keys[env.ID] = key
+		}
+	}
+	return keys, nil
+}
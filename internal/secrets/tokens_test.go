@@ -0,0 +1,111 @@
+package secrets
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+func TestTokenKeys(t *testing.T) {
+	te := setupTestEnv(t)
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+	te.store.CreateEnvironment(te.project.ID, "prod")
+	other, _ := te.store.CreateProject("other", "")
+	te.store.CreateEnvironment(other.ID, "dev")
+
+	svc := te.service()
+	svc.Set(te.project, "dev", "API_KEY", "abc")
+
+	// A project token gets every environment of the project, and nothing else
+	privateKey, publicKey, _ := crypto.GenerateKeyPair()
+	token := &models.APIToken{Name: "deploy", TokenHash: []byte("hash"), PublicKey: publicKey, ProjectID: te.project.ID}
+	keys, err := svc.TokenKeys(token)
+	if err != nil {
+		t.Fatalf("TokenKeys() error = %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("TokenKeys() returned %d keys, want dev and prod", len(keys))
+	}
+	var grants []models.TokenKey
+	for envID, key := range keys {
+		sealed, _ := crypto.SealTo(publicKey, key, []byte(envID))
+		grants = append(grants, models.TokenKey{EnvironmentID: envID, SealedKey: sealed})
+	}
+	if err := te.store.CreateAPIToken(token, grants); err != nil {
+		t.Fatalf("CreateAPIToken() error = %v", err)
+	}
+
+	// Without the vault key, the token session can still give a new
+	// environment its first key, which is sealed to the token and the vault
+	staging, _ := te.store.CreateEnvironment(te.project.ID, "staging")
+	noVaultKey := func() ([]byte, error) { return nil, errors.New("no vault key") }
+	tokenSvc := New(store.NewScopedStore(te.store, token), noVaultKey).WithEnvironmentKeys(keys)
+	if _, err := tokenSvc.Set(te.project, "staging", "URL", "https://staging"); err != nil {
+		t.Fatalf("Set() in a new environment with a token error = %v", err)
+	}
+	got, err := te.service().Get(te.project, "staging", "URL", Options{})
+	if err != nil || got.Value != "https://staging" {
+		t.Errorf("owner Get() of a token-created key = %v, %v", got, err)
+	}
+
+	// Rotation reseals the new key to the token
+	newKey, rotation, err := svc.RotateEnvironmentKey(dev.ID)
+	if err != nil {
+		t.Fatalf("RotateEnvironmentKey() error = %v", err)
+	}
+	if len(rotation.Resealed) != 1 || rotation.Resealed[0] != "deploy" {
+		t.Errorf("RotateEnvironmentKey() rotation = %+v, want deploy resealed", rotation)
+	}
+	tokenKeys, _ := te.store.ListTokenKeys(token.ID)
+	opened := make(map[string][]byte)
+	for _, g := range tokenKeys {
+		key, err := crypto.OpenSealed(privateKey, g.SealedKey, []byte(g.EnvironmentID))
+		if err != nil {
+			t.Fatalf("OpenSealed() error = %v", err)
+		}
+		opened[g.EnvironmentID] = key
+	}
+	if len(opened) != 3 || string(opened[dev.ID]) != string(newKey) || opened[staging.ID] == nil {
+		t.Errorf("token keys after rotation = %d keys, want dev (rotated), prod and staging", len(opened))
+	}
+	rotated := New(te.store, noVaultKey).WithEnvironmentKeys(opened)
+	if got, err := rotated.Get(te.project, "dev", "API_KEY", Options{}); err != nil || got.Value != "abc" {
+		t.Errorf("Get() with rotated token keys = %v, %v", got, err)
+	}
+}
+
+func TestVaultKeyPairUpgrade(t *testing.T) {
+	te := setupTestEnv(t)
+	dev, _ := te.store.CreateEnvironment(te.project.ID, "dev")
+
+	// Keys wrapped with the vault key before the vault had a keypair
+	legacyKey, _ := crypto.GenerateKey()
+	wrapped, nonce, _ := crypto.Encrypt(te.key, legacyKey, []byte(dev.ID))
+	te.store.RekeyEnvironment(&models.EnvironmentKey{EnvironmentID: dev.ID, WrappedKey: wrapped, Nonce: nonce}, models.KeyGrants{}, nil)
+	ciphertext, valueNonce, _ := crypto.Encrypt(legacyKey, []byte("abc"), []byte("API_KEY"))
+	te.store.CreateSecret(dev.ID, "API_KEY", ciphertext, valueNonce)
+
+	svc := te.service()
+	if got, err := svc.Get(te.project, "dev", "API_KEY", Options{}); err != nil || got.Value != "abc" {
+		t.Fatalf("Get() with a legacy wrapped key = %v, %v", got, err)
+	}
+
+	// The next key is sealed to a keypair created on first use
+	if _, _, err := svc.RotateEnvironmentKey(dev.ID); err != nil {
+		t.Fatalf("RotateEnvironmentKey() error = %v", err)
+	}
+	meta, _ := te.store.GetVaultMeta()
+	if meta.PublicKey == nil || meta.PrivateKey == nil {
+		t.Error("rotation should create the vault keypair")
+	}
+	envKey, _ := te.store.GetEnvironmentKey(dev.ID)
+	if len(envKey.Nonce) != 0 {
+		t.Error("new environment keys should be sealed to the vault keypair")
+	}
+	if got, err := te.service().Get(te.project, "dev", "API_KEY", Options{}); err != nil || got.Value != "abc" {
+		t.Errorf("Get() with a sealed key = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,131 @@
+package secrets
+
+import (
+	"fmt"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+// vaultPrivateKeyAAD binds the encrypted vault private key to its purpose
+var vaultPrivateKeyAAD = []byte("coffer-vault-private-key")
+
+// wrapEnvironmentKey wraps a new data key for storage. It is sealed to the
+// vault's public key, so sessions without the vault key (service tokens,
+// members) can create environment keys that the owner can still open.
+// Stores without vault metadata wrap it with the vault key instead.
+func (svc *Service) wrapEnvironmentKey(envID string, key []byte) (*models.EnvironmentKey, error) {
+	publicKey, err := svc.vaultPublicKey()
+	if err == store.ErrNotFound {
+		vaultKey, err := svc.key()
+		if err != nil {
+			return nil, err
+		}
+		// Bind the wrapped key to its environment so it can't be swapped
+		wrapped, nonce, err := crypto.Encrypt(vaultKey, key, []byte(envID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap environment key: %w", err)
+		}
+		return &models.EnvironmentKey{EnvironmentID: envID, WrappedKey: wrapped, Nonce: nonce}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := crypto.SealTo(publicKey, key, []byte(envID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap environment key: %w", err)
+	}
+	return &models.EnvironmentKey{EnvironmentID: envID, WrappedKey: sealed, Nonce: []byte{}}, nil
+}
+
+// unwrapEnvironmentKey opens a stored data key with the vault's private key,
+// or with the vault key for keys wrapped before the vault had a keypair
+func (svc *Service) unwrapEnvironmentKey(envKey *models.EnvironmentKey) ([]byte, error) {
+	if len(envKey.Nonce) == 0 {
+		privateKey, err := svc.vaultPrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		key, err := crypto.OpenSealed(privateKey, envKey.WrappedKey, []byte(envKey.EnvironmentID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap environment key: %w", err)
+		}
+		return key, nil
+	}
+
+	vaultKey, err := svc.key()
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.Decrypt(vaultKey, envKey.WrappedKey, envKey.Nonce, []byte(envKey.EnvironmentID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap environment key: %w", err)
+	}
+	return key, nil
+}
+
+// vaultPublicKey returns the vault's public key, creating the keypair with
+// the vault key if the vault predates it. It returns store.ErrNotFound if
+// the store has no vault metadata.
+func (svc *Service) vaultPublicKey() ([]byte, error) {
+	if svc.vaultPub != nil {
+		return svc.vaultPub, nil
+	}
+	meta, err := svc.store.GetVaultMeta()
+	if err == store.ErrNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vault metadata: %w", err)
+	}
+
+	if meta.PublicKey == nil {
+		vaultKey, err := svc.key()
+		if err != nil {
+			return nil, err
+		}
+		privateKey, publicKey, err := crypto.GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		encrypted, nonce, err := crypto.Encrypt(vaultKey, privateKey, vaultPrivateKeyAAD)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt vault private key: %w", err)
+		}
+		err = svc.store.SetVaultKeyPair(publicKey, encrypted, nonce)
+		if err == store.ErrAlreadyExists {
+			// Another process created one first
+			return svc.vaultPublicKey()
+		}
+		if err != nil {
+			return nil, err
+		}
+		svc.vaultPub = publicKey
+		return publicKey, nil
+	}
+
+	svc.vaultPub = meta.PublicKey
+	return meta.PublicKey, nil
+}
+
+// vaultPrivateKey decrypts the vault's private key with the vault key
+func (svc *Service) vaultPrivateKey() ([]byte, error) {
+	vaultKey, err := svc.key()
+	if err != nil {
+		return nil, err
+	}
+	meta, err := svc.store.GetVaultMeta()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vault metadata: %w", err)
+	}
+	if meta.PrivateKey == nil {
+		return nil, fmt.Errorf("vault has no keypair")
+	}
+	privateKey, err := crypto.Decrypt(vaultKey, meta.PrivateKey, meta.PrivateKeyNonce, vaultPrivateKeyAAD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt vault private key: %w", err)
+	}
+	return privateKey, nil
+}
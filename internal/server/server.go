@@ -0,0 +1,399 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/secrets"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+var (
+	// ErrUnauthorized is returned when a request has a missing, unknown or expired token
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is returned when a token's scope doesn't cover the request
+	ErrForbidden = errors.New("token does not have access to this resource")
+)
+
+// Server exposes vault operations over HTTP/JSON
+type Server struct {
+	store store.Store
+	key   []byte
+	mux   *http.ServeMux
+}
+
+type tokenContextKey struct{}
+
+// New creates a Server backed by s, using key to encrypt and decrypt secrets
+func New(s store.Store, key []byte) *Server {
+	srv := &Server{store: s, key: key, mux: http.NewServeMux()}
+
+	srv.mux.HandleFunc("GET /v1/projects", srv.handleListProjects)
+	srv.mux.HandleFunc("GET /v1/projects/{project}/environments", srv.handleListEnvironments)
+	srv.mux.HandleFunc("GET /v1/projects/{project}/environments/{env}/secrets", srv.handleListSecrets)
+	srv.mux.HandleFunc("GET /v1/projects/{project}/environments/{env}/secrets/{key}", srv.handleGetSecret)
+	srv.mux.HandleFunc("PUT /v1/projects/{project}/environments/{env}/secrets/{key}", srv.handleSetSecret)
+	srv.mux.HandleFunc("DELETE /v1/projects/{project}/environments/{env}/secrets/{key}", srv.handleDeleteSecret)
+	srv.mux.HandleFunc("GET /v1/projects/{project}/environments/{env}/secrets/{key}/history", srv.handleHistory)
+	srv.mux.HandleFunc("GET /v1/audit", srv.handleAudit)
+
+	return srv
+}
+
+// Handler returns the HTTP handler with token authentication applied
+func (srv *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := srv.authenticate(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		ctx := context.WithValue(r.Context(), tokenContextKey{}, token)
+		srv.mux.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Listen opens a listener for addr, which is either unix:///path/to.sock or a
+// loopback TCP address (tcp://127.0.0.1:7410, localhost:7410)
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if path == "" {
+			return nil, fmt.Errorf("missing socket path in %s", addr)
+		}
+		// Remove a stale socket left behind by a previous run
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+		}
+		return l, nil
+	}
+
+	hostPort := strings.TrimPrefix(addr, "tcp://")
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %s: %w", addr, err)
+	}
+	if !isLoopback(host) {
+		return nil, fmt.Errorf("refusing to listen on non-loopback address %s", addr)
+	}
+	l, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", hostPort, err)
+	}
+	return l, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authenticate resolves the bearer token on a request
+func (srv *Server) authenticate(r *http.Request) (*models.APIToken, error) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || raw == "" {
+		return nil, ErrUnauthorized
+	}
+
+	token, err := srv.store.GetAPITokenByHash(crypto.HashToken(raw))
+	if err == store.ErrNotFound {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt) {
+		return nil, ErrUnauthorized
+	}
+
+	srv.store.TouchAPIToken(token.ID)
+	return token, nil
+}
+
+// secrets returns a secrets service for a single request
+func (srv *Server) secrets() *secrets.Service {
+	return secrets.New(srv.store, func() ([]byte, error) { return srv.key, nil })
+}
+
+func tokenFrom(r *http.Request) *models.APIToken {
+	return r.Context().Value(tokenContextKey{}).(*models.APIToken)
+}
+
+// project looks up the project in the request path and checks the token's scope
+func (srv *Server) project(r *http.Request) (*models.Project, error) {
+	name := r.PathValue("project")
+	project, err := srv.store.GetProjectByName(name)
+	if err == store.ErrNotFound {
+		return nil, fmt.Errorf("%w: project '%s'", store.ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token := tokenFrom(r)
+	if token.ProjectID != "" && token.ProjectID != project.ID {
+		return nil, ErrForbidden
+	}
+	return project, nil
+}
+
+// environment looks up the project and environment in the request path and
+// checks the token's scope, including read-only tokens for writes
+func (srv *Server) environment(r *http.Request, write bool) (*models.Project, *models.Environment, error) {
+	project, err := srv.project(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	env, err := srv.secrets().Environment(project, r.PathValue("env"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token := tokenFrom(r)
+	if token.EnvironmentID != "" && token.EnvironmentID != env.ID {
+		return nil, nil, ErrForbidden
+	}
+	if write && token.ReadOnly {
+		return nil, nil, ErrForbidden
+	}
+	return project, env, nil
+}
+
+func (srv *Server) handleListProjects(w http.ResponseWriter, r *http.Request) {
+	projects, err := srv.store.ListProjects()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	token := tokenFrom(r)
+	visible := []models.Project{}
+	for _, p := range projects {
+		if token.ProjectID == "" || token.ProjectID == p.ID {
+			visible = append(visible, p)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"projects": visible})
+}
+
+func (srv *Server) handleListEnvironments(w http.ResponseWriter, r *http.Request) {
+	project, err := srv.project(r)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	envs, err := srv.store.ListEnvironments(project.ID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	token := tokenFrom(r)
+	visible := []models.Environment{}
+	for _, e := range envs {
+		if token.EnvironmentID == "" || token.EnvironmentID == e.ID {
+			visible = append(visible, e)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"environments": visible})
+}
+
+func (srv *Server) handleListSecrets(w http.ResponseWriter, r *http.Request) {
+	project, env, err := srv.environment(r, false)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	values, err := srv.secrets().Load(project, env.Name, secrets.Options{Resolve: queryBool(r, "resolve")})
+	srv.audit(models.ActionExport, project, env, "", err)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	list := make([]secrets.Value, 0, len(values))
+	for _, key := range secrets.SortedKeys(values) {
+		list = append(list, values[key])
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"secrets": list})
+}
+
+func (srv *Server) handleGetSecret(w http.ResponseWriter, r *http.Request) {
+	project, env, err := srv.environment(r, false)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	key := r.PathValue("key")
+	value, err := srv.secrets().Get(project, env.Name, key, secrets.Options{Resolve: queryBool(r, "resolve")})
+	srv.audit(models.ActionRead, project, env, key, err)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, value)
+}
+
+func (srv *Server) handleSetSecret(w http.ResponseWriter, r *http.Request) {
+	project, env, err := srv.environment(r, true)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	var body struct {
+		Value *string `json:"value"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil || body.Value == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf(`request body must be {"value": "..."}`))
+		return
+	}
+
+	key := r.PathValue("key")
+	created, err := srv.secrets().Set(project, env.Name, key, *body.Value)
+	action := models.ActionUpdate
+	if created {
+		action = models.ActionCreate
+	}
+	srv.audit(action, project, env, key, err)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, map[string]any{"key": key, "created": created})
+}
+
+func (srv *Server) handleDeleteSecret(w http.ResponseWriter, r *http.Request) {
+	project, env, err := srv.environment(r, true)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	key := r.PathValue("key")
+	err = srv.secrets().Delete(project, env.Name, key)
+	srv.audit(models.ActionDelete, project, env, key, err)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	project, env, err := srv.environment(r, false)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	key := r.PathValue("key")
+	withValues := queryBool(r, "values")
+	history, err := srv.secrets().History(project, env.Name, key, queryInt(r, "limit", 10), withValues)
+	if withValues {
+		srv.audit(models.ActionRead, project, env, key, err)
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"history": history})
+}
+
+func (srv *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	// The audit log spans every project, so only unscoped tokens may read it
+	if tokenFrom(r).ProjectID != "" {
+		writeError(w, http.StatusForbidden, ErrForbidden)
+		return
+	}
+
+	logs, err := srv.store.GetAuditLogs(queryInt(r, "limit", 50))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"audit": logs})
+}
+
+// audit records an API access in the audit log
+func (srv *Server) audit(action string, project *models.Project, env *models.Environment, key string, err error) {
+	entry := &models.AuditLog{
+		Action:        action,
+		ProjectID:     project.ID,
+		EnvironmentID: env.ID,
+		SecretKey:     key,
+		Success:       err == nil,
+	}
+	if err != nil {
+		entry.ErrorMessage = err.Error()
+	}
+	srv.store.LogAudit(entry)
+}
+
+func queryBool(r *http.Request, name string) bool {
+	b, _ := strconv.ParseBool(r.URL.Query().Get(name))
+	return b
+}
+
+func queryInt(r *http.Request, name string, def int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeStoreError maps service and store errors onto HTTP status codes
+func writeStoreError(w http.ResponseWriter, err error) {
+	var envErr *secrets.ErrEnvironmentNotFound
+	var secretErr *secrets.ErrSecretNotFound
+	switch {
+	case errors.Is(err, ErrForbidden):
+		writeError(w, http.StatusForbidden, err)
+	case errors.Is(err, store.ErrNotFound), errors.As(err, &envErr), errors.As(err, &secretErr):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, secrets.ErrInvalidKeyName):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/secrets"
+	"github.com/russellromney/coffer/internal/store"
+)
+
+type testServer struct {
+	store   *store.SQLiteStore
+	handler http.Handler
+	project *models.Project
+	dev     *models.Environment
+	prod    *models.Environment
+}
+
+func setupTestServer(t *testing.T) *testServer {
+	t.Helper()
+	s, err := store.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create test store: %v", err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+
+	key, _ := crypto.GenerateKey()
+	project, _ := s.CreateProject("myapp", "")
+	dev, _ := s.CreateEnvironment(project.ID, "dev")
+	prod, _ := s.CreateEnvironment(project.ID, "prod")
+	s.CreateProject("other", "")
+
+	svc := secrets.New(s, func() ([]byte, error) { return key, nil })
+	svc.Set(project, "dev", "HOST", "localhost")
+	svc.Set(project, "dev", "URL", "http://${HOST}")
+	svc.Set(project, "prod", "HOST", "prod.example.com")
+
+	return &testServer{
+		store:   s,
+		handler: New(s, key).Handler(),
+		project: project,
+		dev:     dev,
+		prod:    prod,
+	}
+}
+
+func (ts *testServer) token(t *testing.T, tok *models.APIToken) string {
+	t.Helper()
+	raw, err := crypto.GenerateToken()
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	tok.TokenHash = crypto.HashToken(raw)
+	if err := ts.store.CreateAPIToken(tok, nil); err != nil {
+		t.Fatalf("CreateAPIToken() error = %v", err)
+	}
+	return raw
+}
+
+func (ts *testServer) do(t *testing.T, token, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	ts.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthentication(t *testing.T) {
+	ts := setupTestServer(t)
+
+	if rec := ts.do(t, "", "GET", "/v1/projects", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no token: status = %d, want 401", rec.Code)
+	}
+	if rec := ts.do(t, "coffer_bogus", "GET", "/v1/projects", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unknown token: status = %d, want 401", rec.Code)
+	}
+
+	expired := time.Now().Add(-time.Hour)
+	token := ts.token(t, &models.APIToken{Name: "old", ExpiresAt: &expired})
+	if rec := ts.do(t, token, "GET", "/v1/projects", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expired token: status = %d, want 401", rec.Code)
+	}
+
+	token = ts.token(t, &models.APIToken{Name: "admin"})
+	rec := ts.do(t, token, "GET", "/v1/projects", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid token: status = %d, want 200", rec.Code)
+	}
+	var resp struct {
+		Projects []models.Project `json:"projects"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if len(resp.Projects) != 2 {
+		t.Errorf("projects = %d, want 2", len(resp.Projects))
+	}
+}
+
+func TestSecretsCRUD(t *testing.T) {
+	ts := setupTestServer(t)
+	token := ts.token(t, &models.APIToken{Name: "admin"})
+
+	rec := ts.do(t, token, "GET", "/v1/projects/myapp/environments/dev/secrets/URL?resolve=true", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var value secrets.Value
+	json.Unmarshal(rec.Body.Bytes(), &value)
+	if value.Value != "http://localhost" {
+		t.Errorf("get: value = %q, want http://localhost", value.Value)
+	}
+
+	rec = ts.do(t, token, "PUT", "/v1/projects/myapp/environments/dev/secrets/NEW_KEY", `{"value": "abc"}`)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("create: status = %d, want 201", rec.Code)
+	}
+	rec = ts.do(t, token, "PUT", "/v1/projects/myapp/environments/dev/secrets/NEW_KEY", `{"value": "def"}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("update: status = %d, want 200", rec.Code)
+	}
+	rec = ts.do(t, token, "PUT", "/v1/projects/myapp/environments/dev/secrets/bad-key", `{"value": "x"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid key: status = %d, want 400", rec.Code)
+	}
+
+	rec = ts.do(t, token, "GET", "/v1/projects/myapp/environments/dev/secrets", "")
+	var list struct {
+		Secrets []secrets.Value `json:"secrets"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list.Secrets) != 3 || list.Secrets[1].Key != "NEW_KEY" || list.Secrets[1].Value != "def" {
+		t.Errorf("list: secrets = %+v", list.Secrets)
+	}
+
+	rec = ts.do(t, token, "GET", "/v1/projects/myapp/environments/dev/secrets/NEW_KEY/history?values=true", "")
+	var history struct {
+		History []secrets.Version `json:"history"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &history)
+	if len(history.History) != 2 || history.History[1].Value != "abc" {
+		t.Errorf("history = %+v", history.History)
+	}
+
+	if rec := ts.do(t, token, "DELETE", "/v1/projects/myapp/environments/dev/secrets/NEW_KEY", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("delete: status = %d, want 204", rec.Code)
+	}
+	if rec := ts.do(t, token, "GET", "/v1/projects/myapp/environments/dev/secrets/NEW_KEY", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("get deleted: status = %d, want 404", rec.Code)
+	}
+	if rec := ts.do(t, token, "GET", "/v1/projects/myapp/environments/staging/secrets", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("missing env: status = %d, want 404", rec.Code)
+	}
+
+	rec = ts.do(t, token, "GET", "/v1/audit", "")
+	var audit struct {
+		Audit []models.AuditLog `json:"audit"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &audit)
+	if len(audit.Audit) == 0 {
+		t.Error("audit log should record API access")
+	}
+}
+
+func TestTokenScope(t *testing.T) {
+	ts := setupTestServer(t)
+	token := ts.token(t, &models.APIToken{
+		Name:          "ci",
+		ProjectID:     ts.project.ID,
+		EnvironmentID: ts.dev.ID,
+		ReadOnly:      true,
+	})
+
+	if rec := ts.do(t, token, "GET", "/v1/projects/myapp/environments/dev/secrets/HOST", ""); rec.Code != http.StatusOK {
+		t.Errorf("in scope read: status = %d, want 200", rec.Code)
+	}
+	if rec := ts.do(t, token, "GET", "/v1/projects/myapp/environments/prod/secrets/HOST", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("other env: status = %d, want 403", rec.Code)
+	}
+	if rec := ts.do(t, token, "GET", "/v1/projects/other/environments", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("other project: status = %d, want 403", rec.Code)
+	}
+	if rec := ts.do(t, token, "PUT", "/v1/projects/myapp/environments/dev/secrets/HOST", `{"value": "x"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("read-only write: status = %d, want 403", rec.Code)
+	}
+	if rec := ts.do(t, token, "GET", "/v1/audit", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("scoped audit: status = %d, want 403", rec.Code)
+	}
+
+	rec := ts.do(t, token, "GET", "/v1/projects", "")
+	var projects struct {
+		Projects []models.Project `json:"projects"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &projects)
+	if len(projects.Projects) != 1 || projects.Projects[0].Name != "myapp" {
+		t.Errorf("scoped projects = %+v", projects.Projects)
+	}
+
+	rec = ts.do(t, token, "GET", "/v1/projects/myapp/environments", "")
+	var envs struct {
+		Environments []models.Environment `json:"environments"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &envs)
+	if len(envs.Environments) != 1 || envs.Environments[0].Name != "dev" {
+		t.Errorf("scoped environments = %+v", envs.Environments)
+	}
+}
+
+func TestListen(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "coffer.sock")
+	l, err := Listen("unix://" + sock)
+	if err != nil {
+		t.Fatalf("Listen(unix) error = %v", err)
+	}
+	l.Close()
+
+	l, err = Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(tcp) error = %v", err)
+	}
+	l.Close()
+
+	if _, err := Listen("0.0.0.0:0"); err == nil {
+		t.Error("Listen() should refuse non-loopback addresses")
+	}
+}
@@ -0,0 +1,255 @@
+package sops
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// metadataKey is the top-level key holding SOPS metadata in YAML and JSON
+const metadataKey = "sops"
+
+// dotenvMetadataPrefix prefixes SOPS metadata keys in dotenv files
+const dotenvMetadataPrefix = "sops_"
+
+// dotenvMACPattern detects a SOPS dotenv file by its MAC line
+var dotenvMACPattern = regexp.MustCompile(`(?m)^sops_mac=`)
+
+// dotenvAgePattern matches flattened age metadata keys, e.g. sops_age__list_0__map_enc
+var dotenvAgePattern = regexp.MustCompile(`^sops_age__list_(\d+)__map_(recipient|enc)$`)
+
+// parseTree parses a SOPS YAML or JSON file (JSON is valid YAML)
+func parseTree(data []byte) (*document, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, ErrNotSOPS
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, ErrNotSOPS
+	}
+
+	doc := &document{format: FormatYAML}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		doc.format = FormatJSON
+	}
+
+	mapping := root.Content[0]
+	found := false
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		if key.Value != metadataKey {
+			continue
+		}
+		if value.Kind != yaml.MappingNode {
+			return nil, ErrNotSOPS
+		}
+		if err := value.Decode(&doc.meta); err != nil {
+			return nil, fmt.Errorf("invalid SOPS metadata: %w", err)
+		}
+		found = true
+	}
+	if !found || doc.meta.MAC == "" {
+		return nil, ErrNotSOPS
+	}
+
+	if err := doc.walk(mapping, nil); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// walk collects the scalar leaves of a mapping in file order
+func (doc *document) walk(mapping *yaml.Node, path []string) error {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		if path == nil && key.Value == metadataKey {
+			continue
+		}
+		keyPath := append(append([]string(nil), path...), key.Value)
+
+		switch value.Kind {
+		case yaml.MappingNode:
+			if err := doc.walk(value, keyPath); err != nil {
+				return err
+			}
+		case yaml.ScalarNode:
+			l := leaf{path: keyPath, value: value.Value, kind: scalarKind(value)}
+			if l.kind == "null" {
+				l.value, l.kind = "", "str"
+			}
+			doc.leaves = append(doc.leaves, l)
+		case yaml.AliasNode:
+			return fmt.Errorf("'%s': YAML aliases aren't supported", strings.Join(keyPath, "."))
+		default:
+			return fmt.Errorf("'%s': lists aren't supported", strings.Join(keyPath, "."))
+		}
+	}
+	return nil
+}
+
+// scalarKind maps a YAML tag to the SOPS type of a plaintext value
+func scalarKind(n *yaml.Node) string {
+	switch n.ShortTag() {
+	case "!!int":
+		return "int"
+	case "!!float":
+		return "float"
+	case "!!bool":
+		return "bool"
+	case "!!null":
+		return "null"
+	default:
+		return "str"
+	}
+}
+
+// parseDotenv parses a SOPS dotenv file
+func parseDotenv(data []byte) (*document, error) {
+	doc := &document{format: FormatDotenv}
+	ages := map[int]*ageKey{}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", i+1)
+		}
+		value = strings.ReplaceAll(value, `\n`, "\n")
+
+		if !strings.HasPrefix(key, dotenvMetadataPrefix) {
+			doc.leaves = append(doc.leaves, leaf{path: []string{key}, value: value, kind: "str"})
+			continue
+		}
+
+		if m := dotenvAgePattern.FindStringSubmatch(key); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			if ages[n] == nil {
+				ages[n] = &ageKey{}
+			}
+			if m[2] == "recipient" {
+				ages[n].Recipient = value
+			} else {
+				ages[n].Enc = value
+			}
+			continue
+		}
+		switch strings.TrimPrefix(key, dotenvMetadataPrefix) {
+		case "lastmodified":
+			doc.meta.LastModified = value
+		case "mac":
+			doc.meta.MAC = value
+		case "unencrypted_suffix":
+			doc.meta.UnencryptedSuffix = value
+		case "mac_only_encrypted":
+			doc.meta.MACOnlyEncrypted = value == "true"
+		case "version":
+			doc.meta.Version = value
+		}
+	}
+
+	if doc.meta.MAC == "" {
+		return nil, ErrNotSOPS
+	}
+
+	indexes := make([]int, 0, len(ages))
+	for n := range ages {
+		indexes = append(indexes, n)
+	}
+	sort.Ints(indexes)
+	for _, n := range indexes {
+		doc.meta.Age = append(doc.meta.Age, *ages[n])
+	}
+	return doc, nil
+}
+
+// emitYAML renders the document as YAML with SOPS' 4-space indentation
+func (doc *document) emitYAML() ([]byte, error) {
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+	for _, l := range doc.leaves {
+		mapping.Content = append(mapping.Content, scalar(l.path[0]), scalar(l.value))
+	}
+
+	var meta yaml.Node
+	if err := meta.Encode(doc.meta); err != nil {
+		return nil, fmt.Errorf("failed to encode SOPS metadata: %w", err)
+	}
+	// Keep armored data keys readable as block literals
+	for _, n := range meta.Content {
+		if n.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, item := range n.Content {
+			for i := 0; i+1 < len(item.Content); i += 2 {
+				if item.Content[i].Value == "enc" {
+					item.Content[i+1].Style = yaml.LiteralStyle
+				}
+			}
+		}
+	}
+	mapping.Content = append(mapping.Content, scalar(metadataKey), &meta)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(4)
+	if err := enc.Encode(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{mapping}}); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func scalar(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// emitJSON renders the document as tab-indented JSON, preserving key order
+func (doc *document) emitJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	for _, l := range doc.leaves {
+		key, _ := json.Marshal(l.path[0])
+		value, _ := json.Marshal(l.value)
+		fmt.Fprintf(&buf, "\t%s: %s,\n", key, value)
+	}
+
+	meta, err := json.MarshalIndent(doc.meta, "\t", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode SOPS metadata: %w", err)
+	}
+	fmt.Fprintf(&buf, "\t%q: %s\n}\n", metadataKey, meta)
+	return buf.Bytes(), nil
+}
+
+// emitDotenv renders the document as a dotenv file with flattened metadata
+func (doc *document) emitDotenv() []byte {
+	var buf bytes.Buffer
+	line := func(key, value string) {
+		fmt.Fprintf(&buf, "%s=%s\n", key, strings.ReplaceAll(value, "\n", `\n`))
+	}
+
+	for _, l := range doc.leaves {
+		line(l.path[0], l.value)
+	}
+	for i, k := range doc.meta.Age {
+		line(fmt.Sprintf("sops_age__list_%d__map_enc", i), k.Enc)
+		line(fmt.Sprintf("sops_age__list_%d__map_recipient", i), k.Recipient)
+	}
+	line("sops_lastmodified", doc.meta.LastModified)
+	line("sops_mac", doc.meta.MAC)
+	if doc.meta.UnencryptedSuffix != "" {
+		line("sops_unencrypted_suffix", doc.meta.UnencryptedSuffix)
+	}
+	line("sops_version", doc.meta.Version)
+	return buf.Bytes()
+}
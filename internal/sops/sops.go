@@ -0,0 +1,392 @@
+// Package sops reads and writes SOPS-encrypted YAML, JSON and dotenv files
+// whose data key is encrypted to age recipients.
+//
+// Values are encrypted with AES-256-GCM under a random data key, using the
+// value's key path as additional data. A SHA-512 MAC over all values, itself
+// encrypted with the data key, protects the file against reordering and
+// tampering.
+package sops
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+const (
+	// Version is the SOPS file version written to metadata
+	Version = "3.8.1"
+	// DefaultUnencryptedSuffix marks keys whose values are stored in plaintext
+	DefaultUnencryptedSuffix = "_unencrypted"
+	// Separator joins nested key paths into flat keys (DB: {HOST: x} becomes DB__HOST)
+	Separator = "__"
+
+	// nonceSize is the GCM nonce size SOPS uses (larger than the GCM default)
+	nonceSize = 32
+	// dataKeySize is the size of the SOPS data key
+	dataKeySize = 32
+)
+
+// Format is the syntax of a SOPS file
+type Format string
+
+const (
+	FormatYAML   Format = "yaml"
+	FormatJSON   Format = "json"
+	FormatDotenv Format = "dotenv"
+)
+
+var (
+	// ErrNotSOPS is returned when a file has no SOPS metadata
+	ErrNotSOPS = errors.New("not a SOPS file: no sops metadata found")
+	// ErrNoMatchingIdentity is returned when no identity can decrypt the data key
+	ErrNoMatchingIdentity = errors.New("none of the age identities can decrypt this SOPS file")
+	// ErrMACMismatch is returned when the values don't match the file's MAC
+	ErrMACMismatch = errors.New("SOPS MAC mismatch: the file has been modified")
+)
+
+// Entry is a decrypted key/value pair, in file order
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Metadata describes a SOPS file without decrypting it
+type Metadata struct {
+	Format            Format
+	Recipients        []string
+	UnencryptedSuffix string
+	// Keys lists the file's (flattened) keys in file order
+	Keys []string
+}
+
+// ageKey is a data key encrypted to one age recipient
+type ageKey struct {
+	Recipient string `yaml:"recipient" json:"recipient"`
+	Enc       string `yaml:"enc" json:"enc"`
+}
+
+// metadata is the sops block of a file
+type metadata struct {
+	Age               []ageKey `yaml:"age,omitempty" json:"age,omitempty"`
+	LastModified      string   `yaml:"lastmodified" json:"lastmodified"`
+	MAC               string   `yaml:"mac" json:"mac"`
+	UnencryptedSuffix string   `yaml:"unencrypted_suffix,omitempty" json:"unencrypted_suffix,omitempty"`
+	MACOnlyEncrypted  bool     `yaml:"mac_only_encrypted,omitempty" json:"mac_only_encrypted,omitempty"`
+	Version           string   `yaml:"version" json:"version"`
+}
+
+// leaf is a scalar value in a SOPS document
+type leaf struct {
+	path  []string
+	value string
+	// kind is the plaintext type of unencrypted values: str, int, float or bool
+	kind string
+}
+
+// document is a parsed SOPS file
+type document struct {
+	format Format
+	leaves []leaf
+	meta   metadata
+}
+
+// DetectFormat reports the format of a SOPS file, or false if data isn't one
+func DetectFormat(data []byte) (Format, bool) {
+	if dotenvMACPattern.Match(data) {
+		return FormatDotenv, true
+	}
+	doc, err := parseTree(data)
+	if err != nil {
+		return "", false
+	}
+	return doc.format, true
+}
+
+// ReadMetadata returns a SOPS file's recipients, settings and key order
+// without decrypting it
+func ReadMetadata(data []byte) (*Metadata, error) {
+	doc, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &Metadata{
+		Format:            doc.format,
+		UnencryptedSuffix: doc.meta.UnencryptedSuffix,
+	}
+	for _, k := range doc.meta.Age {
+		meta.Recipients = append(meta.Recipients, k.Recipient)
+	}
+	for _, l := range doc.leaves {
+		meta.Keys = append(meta.Keys, strings.Join(l.path, Separator))
+	}
+	return meta, nil
+}
+
+// Decrypt decrypts a SOPS file with the given age identities, verifying its
+// MAC. Nested keys are flattened with Separator.
+func Decrypt(data []byte, identities []age.Identity) ([]Entry, *Metadata, error) {
+	doc, err := parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey, err := doc.dataKey(identities)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hash := sha512.New()
+	entries := make([]Entry, 0, len(doc.leaves))
+	for _, l := range doc.leaves {
+		value, kind := l.value, l.kind
+		encrypted := strings.HasPrefix(value, "ENC[")
+		if encrypted {
+			value, kind, err = decryptValue(dataKey, value, additionalData(l.path))
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to decrypt '%s': %w", strings.Join(l.path, "."), err)
+			}
+		}
+		if !doc.meta.MACOnlyEncrypted || encrypted {
+			hash.Write(macBytes(value, kind))
+		}
+		entries = append(entries, Entry{Key: strings.Join(l.path, Separator), Value: value})
+	}
+
+	mac, _, err := decryptValue(dataKey, doc.meta.MAC, doc.meta.LastModified)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt MAC: %w", err)
+	}
+	if !strings.EqualFold(mac, fmt.Sprintf("%X", hash.Sum(nil))) {
+		return nil, nil, ErrMACMismatch
+	}
+
+	meta, _ := ReadMetadata(data)
+	return entries, meta, nil
+}
+
+// Encrypt writes entries as a SOPS file in the given format, with the data
+// key encrypted to each age recipient. Keys ending in unencryptedSuffix are
+// left in plaintext.
+func Encrypt(entries []Entry, format Format, recipients []string, unencryptedSuffix string) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("SOPS files need at least one age recipient")
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	doc := &document{
+		format: format,
+		meta: metadata{
+			UnencryptedSuffix: unencryptedSuffix,
+			Version:           Version,
+		},
+	}
+
+	for _, r := range recipients {
+		enc, err := encryptDataKey(dataKey, r)
+		if err != nil {
+			return nil, err
+		}
+		doc.meta.Age = append(doc.meta.Age, ageKey{Recipient: r, Enc: enc})
+	}
+
+	hash := sha512.New()
+	for _, e := range entries {
+		hash.Write([]byte(e.Value))
+		value := e.Value
+		if unencryptedSuffix == "" || !strings.HasSuffix(e.Key, unencryptedSuffix) {
+			var err error
+			value, err = encryptValue(dataKey, e.Value, additionalData([]string{e.Key}))
+			if err != nil {
+				return nil, err
+			}
+		}
+		doc.leaves = append(doc.leaves, leaf{path: []string{e.Key}, value: value, kind: "str"})
+	}
+
+	doc.meta.LastModified = time.Now().UTC().Truncate(time.Second).Format(time.RFC3339)
+	mac, err := encryptValue(dataKey, fmt.Sprintf("%X", hash.Sum(nil)), doc.meta.LastModified)
+	if err != nil {
+		return nil, err
+	}
+	doc.meta.MAC = mac
+
+	switch format {
+	case FormatYAML:
+		return doc.emitYAML()
+	case FormatJSON:
+		return doc.emitJSON()
+	case FormatDotenv:
+		return doc.emitDotenv(), nil
+	default:
+		return nil, fmt.Errorf("unknown SOPS format: %s", format)
+	}
+}
+
+// parse reads a SOPS file in any supported format
+func parse(data []byte) (*document, error) {
+	if dotenvMACPattern.Match(data) {
+		return parseDotenv(data)
+	}
+	return parseTree(data)
+}
+
+// dataKey decrypts the file's data key with the first identity that matches
+func (doc *document) dataKey(identities []age.Identity) ([]byte, error) {
+	if len(doc.meta.Age) == 0 {
+		return nil, fmt.Errorf("SOPS file has no age recipients (only age keys are supported)")
+	}
+	if len(identities) == 0 {
+		return nil, ErrNoMatchingIdentity
+	}
+
+	for _, k := range doc.meta.Age {
+		r, err := age.Decrypt(armor.NewReader(strings.NewReader(strings.TrimSpace(k.Enc))), identities...)
+		if err != nil {
+			continue
+		}
+		key, err := io.ReadAll(r)
+		if err != nil || len(key) != dataKeySize {
+			continue
+		}
+		return key, nil
+	}
+	return nil, ErrNoMatchingIdentity
+}
+
+// encryptDataKey encrypts the data key to an age recipient as an armored age file
+func encryptDataKey(dataKey []byte, recipient string) (string, error) {
+	r, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		return "", fmt.Errorf("invalid age recipient %q: %w", recipient, err)
+	}
+
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, r)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	if _, err := w.Write(dataKey); err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	if err := aw.Close(); err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// additionalData is the AAD SOPS binds a value to: its key path
+func additionalData(path []string) string {
+	return strings.Join(path, ":") + ":"
+}
+
+// encValuePattern matches ENC[AES256_GCM,data:...,iv:...,tag:...,type:...]
+var encValuePattern = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// encryptValue encrypts a string value in SOPS' ENC[...] format
+func encryptValue(key []byte, value, aad string) (string, error) {
+	// SOPS leaves empty values empty
+	if value == "" {
+		return "", nil
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, nonceSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", fmt.Errorf("failed to generate iv: %w", err)
+	}
+
+	out := gcm.Seal(nil, iv, []byte(value), []byte(aad))
+	tagStart := len(out) - gcm.Overhead()
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:str]",
+		base64.StdEncoding.EncodeToString(out[:tagStart]),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(out[tagStart:])), nil
+}
+
+// decryptValue decrypts an ENC[...] value, returning the plaintext and its type
+func decryptValue(key []byte, value, aad string) (string, string, error) {
+	if value == "" {
+		return "", "str", nil
+	}
+
+	m := encValuePattern.FindStringSubmatch(value)
+	if m == nil {
+		return "", "", fmt.Errorf("malformed encrypted value")
+	}
+	data, err1 := base64.StdEncoding.DecodeString(m[1])
+	iv, err2 := base64.StdEncoding.DecodeString(m[2])
+	tag, err3 := base64.StdEncoding.DecodeString(m[3])
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return "", "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", "", err
+	}
+	if len(iv) != nonceSize {
+		return "", "", fmt.Errorf("malformed encrypted value: bad iv length")
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(aad))
+	if err != nil {
+		return "", "", fmt.Errorf("wrong key or corrupted data")
+	}
+	return string(plaintext), m[4], nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCMWithNonceSize(block, nonceSize)
+}
+
+// macBytes returns the bytes SOPS hashes for a value of the given type
+func macBytes(value, kind string) []byte {
+	switch kind {
+	case "bool":
+		// SOPS hashes booleans the way Python prints them
+		if b, err := strconv.ParseBool(value); err == nil {
+			if b {
+				return []byte("True")
+			}
+			return []byte("False")
+		}
+	case "int":
+		if n, err := strconv.Atoi(value); err == nil {
+			return []byte(strconv.Itoa(n))
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+		}
+	}
+	return []byte(value)
+}
@@ -0,0 +1,187 @@
+package sops
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func newIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity() error = %v", err)
+	}
+	return id
+}
+
+func TestRoundTrip(t *testing.T) {
+	id := newIdentity(t)
+	entries := []Entry{
+		{Key: "ZEBRA", Value: "last"},
+		{Key: "API_KEY", Value: "sk-123"},
+		{Key: "MULTILINE", Value: "line1\nline2"},
+		{Key: "EMPTY", Value: ""},
+		{Key: "DEBUG_unencrypted", Value: "true"},
+	}
+
+	for _, format := range []Format{FormatYAML, FormatJSON, FormatDotenv} {
+		t.Run(string(format), func(t *testing.T) {
+			data, err := Encrypt(entries, format, []string{id.Recipient().String()}, DefaultUnencryptedSuffix)
+			if err != nil {
+				t.Fatalf("Encrypt() error = %v", err)
+			}
+			if strings.Contains(string(data), "sk-123") {
+				t.Error("Encrypt() output contains plaintext value")
+			}
+			if !strings.Contains(string(data), "true") {
+				t.Error("Encrypt() should leave unencrypted-suffix values in plaintext")
+			}
+
+			got, ok := DetectFormat(data)
+			if !ok || got != format {
+				t.Errorf("DetectFormat() = %q, %v, want %q", got, ok, format)
+			}
+
+			decrypted, meta, err := Decrypt(data, []age.Identity{id})
+			if err != nil {
+				t.Fatalf("Decrypt() error = %v", err)
+			}
+			if len(decrypted) != len(entries) {
+				t.Fatalf("Decrypt() returned %d entries, want %d", len(decrypted), len(entries))
+			}
+			for i, e := range entries {
+				if decrypted[i] != e {
+					t.Errorf("entry %d = %+v, want %+v", i, decrypted[i], e)
+				}
+			}
+			if len(meta.Recipients) != 1 || meta.Recipients[0] != id.Recipient().String() {
+				t.Errorf("Recipients = %v", meta.Recipients)
+			}
+			if meta.UnencryptedSuffix != DefaultUnencryptedSuffix {
+				t.Errorf("UnencryptedSuffix = %q", meta.UnencryptedSuffix)
+			}
+		})
+	}
+}
+
+func TestDecryptWrongIdentity(t *testing.T) {
+	id := newIdentity(t)
+	data, err := Encrypt([]Entry{{Key: "A", Value: "1"}}, FormatYAML, []string{id.Recipient().String()}, "")
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	if _, _, err := Decrypt(data, []age.Identity{newIdentity(t)}); err != ErrNoMatchingIdentity {
+		t.Errorf("Decrypt() error = %v, want ErrNoMatchingIdentity", err)
+	}
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	id := newIdentity(t)
+	entries := []Entry{{Key: "A", Value: "1"}, {Key: "B", Value: "2"}}
+	data, err := Encrypt(entries, FormatDotenv, []string{id.Recipient().String()}, "")
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	// Swapping two encrypted values breaks their key binding
+	lines := strings.Split(string(data), "\n")
+	a := strings.TrimPrefix(lines[0], "A=")
+	b := strings.TrimPrefix(lines[1], "B=")
+	lines[0], lines[1] = "A="+b, "B="+a
+	if _, _, err := Decrypt([]byte(strings.Join(lines, "\n")), []age.Identity{id}); err == nil {
+		t.Error("Decrypt() should reject swapped values")
+	}
+
+	// Dropping a value breaks the MAC
+	dropped := strings.Join(append(lines[:1:1], lines[2:]...), "\n")
+	dropped = strings.Replace(dropped, "A="+b, "A="+a, 1)
+	if _, _, err := Decrypt([]byte(dropped), []age.Identity{id}); err != ErrMACMismatch {
+		t.Errorf("Decrypt() error = %v, want ErrMACMismatch", err)
+	}
+}
+
+func TestDecryptNestedYAML(t *testing.T) {
+	id := newIdentity(t)
+	dataKey := make([]byte, dataKeySize)
+	enc, err := encryptDataKey(dataKey, id.Recipient().String())
+	if err != nil {
+		t.Fatalf("encryptDataKey() error = %v", err)
+	}
+
+	host, _ := encryptValue(dataKey, "db.internal", additionalData([]string{"DB", "HOST"}))
+	hash := sha512.New()
+	hash.Write([]byte("db.internal"))
+	hash.Write([]byte("True"))
+	hash.Write([]byte("5432"))
+	lastModified := "2024-01-01T00:00:00Z"
+	mac, _ := encryptValue(dataKey, fmt.Sprintf("%X", hash.Sum(nil)), lastModified)
+
+	data := fmt.Sprintf(`DB:
+    HOST: %s
+    SSL_unencrypted: true
+    PORT_unencrypted: 5432
+sops:
+    age:
+        - recipient: %s
+          enc: |
+%s
+    lastmodified: "%s"
+    mac: %s
+    unencrypted_suffix: _unencrypted
+    version: 3.8.1
+`, host, id.Recipient(), indent(enc, "            "), lastModified, mac)
+
+	entries, _, err := Decrypt([]byte(data), []age.Identity{id})
+	if err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	want := []Entry{
+		{Key: "DB__HOST", Value: "db.internal"},
+		{Key: "DB__SSL_unencrypted", Value: "true"},
+		{Key: "DB__PORT_unencrypted", Value: "5432"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("Decrypt() = %+v, want %+v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestReadMetadata(t *testing.T) {
+	id := newIdentity(t)
+	data, err := Encrypt([]Entry{{Key: "B", Value: "2"}, {Key: "A", Value: "1"}}, FormatJSON, []string{id.Recipient().String()}, "")
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	meta, err := ReadMetadata(data)
+	if err != nil {
+		t.Fatalf("ReadMetadata() error = %v", err)
+	}
+	if meta.Format != FormatJSON {
+		t.Errorf("Format = %q, want json", meta.Format)
+	}
+	if strings.Join(meta.Keys, ",") != "B,A" {
+		t.Errorf("Keys = %v, want [B A]", meta.Keys)
+	}
+
+	if _, err := ReadMetadata([]byte("A=1\n")); err != ErrNotSOPS {
+		t.Errorf("ReadMetadata() on plain dotenv error = %v, want ErrNotSOPS", err)
+	}
+}
+
+func indent(s, prefix string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i := range lines {
+		lines[i] = prefix + lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,565 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/russellromney/coffer/internal/models"
+)
+
+var (
+	// ErrOutOfScope is returned when a scoped store is asked for data outside its token's scope
+	ErrOutOfScope = errors.New("access denied: outside the token's scope")
+	// ErrReadOnly is returned when a read-only scoped store is asked to modify data
+	ErrReadOnly = errors.New("access denied: token is read-only")
+)
+
+// ScopedStore restricts a Store to the project, environment and access level
+// of an API token. Operations outside the scope fail with ErrOutOfScope or
+// ErrReadOnly; token and vault management are always denied.
+type ScopedStore struct {
+	Store
+	token *models.APIToken
+}
+
+// NewScopedStore wraps s so it only exposes what token is allowed to access
+func NewScopedStore(s Store, token *models.APIToken) *ScopedStore {
+	return &ScopedStore{Store: s, token: token}
+}
+
+// checkProject verifies a project ID is within scope
+func (s *ScopedStore) checkProject(projectID string) error {
+	if s.token.ProjectID != "" && s.token.ProjectID != projectID {
+		return ErrOutOfScope
+	}
+	return nil
+}
+
+// checkEnv verifies an environment ID is within scope
+func (s *ScopedStore) checkEnv(envID string) error {
+	if s.token.EnvironmentID != "" {
+		if s.token.EnvironmentID != envID {
+			return ErrOutOfScope
+		}
+		return nil
+	}
+	if s.token.ProjectID == "" {
+		return nil
+	}
+	env, err := s.Store.GetEnvironment(envID)
+	if err != nil {
+		return err
+	}
+	return s.checkProject(env.ProjectID)
+}
+
+// checkWrite verifies the token may modify data
+func (s *ScopedStore) checkWrite() error {
+	if s.token.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Vault operations
+
+func (s *ScopedStore) SetKeychainEnabled(enabled bool) error {
+	return ErrOutOfScope
+}
+
+func (s *ScopedStore) SetVaultKeyPair(publicKey, privateKey, privateKeyNonce []byte) error {
+	return ErrOutOfScope
+}
+
+// Project operations
+
+func (s *ScopedStore) CreateProject(name, description string) (*models.Project, error) {
+	// Creating projects would widen the token's reach
+	if s.token.ProjectID != "" {
+		return nil, ErrOutOfScope
+	}
+	if err := s.checkWrite(); err != nil {
+		return nil, err
+	}
+	return s.Store.CreateProject(name, description)
+}
+
+func (s *ScopedStore) GetProject(id string) (*models.Project, error) {
+	if err := s.checkProject(id); err != nil {
+		return nil, err
+	}
+	return s.Store.GetProject(id)
+}
+
+func (s *ScopedStore) GetProjectByName(name string) (*models.Project, error) {
+	p, err := s.Store.GetProjectByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkProject(p.ID); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *ScopedStore) ListProjects() ([]models.Project, error) {
+	projects, err := s.Store.ListProjects()
+	if err != nil {
+		return nil, err
+	}
+	visible := []models.Project{}
+	for _, p := range projects {
+		if s.checkProject(p.ID) == nil {
+			visible = append(visible, p)
+		}
+	}
+	return visible, nil
+}
+
+func (s *ScopedStore) RenameProject(id, name string) error {
+	if s.token.EnvironmentID != "" {
+		return ErrOutOfScope
+	}
+	if err := s.checkProject(id); err != nil {
+		return err
+	}
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	return s.Store.RenameProject(id, name)
+}
+
+func (s *ScopedStore) CopyProject(project *models.Project, envs []models.EnvironmentCopy) error {
+	// Like creating a project, copying one would widen the token's reach
+	if s.token.ProjectID != "" {
+		return ErrOutOfScope
+	}
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	return s.Store.CopyProject(project, envs)
+}
+
+func (s *ScopedStore) DeleteProject(id string) error {
+	if s.token.ProjectID != "" || s.token.EnvironmentID != "" {
+		return ErrOutOfScope
+	}
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	return s.Store.DeleteProject(id)
+}
+
+// Environment operations
+
+func (s *ScopedStore) CreateEnvironment(projectID, name string) (*models.Environment, error) {
+	if s.token.EnvironmentID != "" {
+		return nil, ErrOutOfScope
+	}
+	if err := s.checkProject(projectID); err != nil {
+		return nil, err
+	}
+	if err := s.checkWrite(); err != nil {
+		return nil, err
+	}
+	return s.Store.CreateEnvironment(projectID, name)
+}
+
+func (s *ScopedStore) CreateEnvironmentWithParent(projectID, name, parentID string) (*models.Environment, error) {
+	if s.token.EnvironmentID != "" {
+		return nil, ErrOutOfScope
+	}
+	if err := s.checkProject(projectID); err != nil {
+		return nil, err
+	}
+	if err := s.checkWrite(); err != nil {
+		return nil, err
+	}
+	return s.Store.CreateEnvironmentWithParent(projectID, name, parentID)
+}
+
+func (s *ScopedStore) GetEnvironment(id string) (*models.Environment, error) {
+	if err := s.checkEnv(id); err != nil {
+		return nil, err
+	}
+	return s.Store.GetEnvironment(id)
+}
+
+func (s *ScopedStore) GetEnvironmentByName(projectID, name string) (*models.Environment, error) {
+	if err := s.checkProject(projectID); err != nil {
+		return nil, err
+	}
+	env, err := s.Store.GetEnvironmentByName(projectID, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkEnv(env.ID); err != nil {
+		return nil, fmt.Errorf("environment '%s': %w", name, err)
+	}
+	return env, nil
+}
+
+func (s *ScopedStore) ListEnvironments(projectID string) ([]models.Environment, error) {
+	if err := s.checkProject(projectID); err != nil {
+		return nil, err
+	}
+	envs, err := s.Store.ListEnvironments(projectID)
+	if err != nil {
+		return nil, err
+	}
+	visible := []models.Environment{}
+	for _, e := range envs {
+		if s.token.EnvironmentID == "" || s.token.EnvironmentID == e.ID {
+			visible = append(visible, e)
+		}
+	}
+	return visible, nil
+}
+
+func (s *ScopedStore) RenameEnvironment(id, name string) error {
+	if s.token.EnvironmentID != "" {
+		return ErrOutOfScope
+	}
+	if err := s.checkEnv(id); err != nil {
+		return err
+	}
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	return s.Store.RenameEnvironment(id, name)
+}
+
+func (s *ScopedStore) CopyEnvironments(envs []models.EnvironmentCopy) error {
+	if s.token.EnvironmentID != "" {
+		return ErrOutOfScope
+	}
+	for _, c := range envs {
+		if err := s.checkProject(c.Environment.ProjectID); err != nil {
+			return err
+		}
+	}
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	return s.Store.CopyEnvironments(envs)
+}
+
+func (s *ScopedStore) DeleteEnvironment(id string) error {
+	if s.token.EnvironmentID != "" {
+		return ErrOutOfScope
+	}
+	if err := s.checkEnv(id); err != nil {
+		return err
+	}
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	return s.Store.DeleteEnvironment(id)
+}
+
+func (s *ScopedStore) SetEnvironmentInheritance(envID string, parentID *string, layerIDs []string, changes []models.SecretChange, grants models.KeyGrants) error {
+	if err := s.checkEnv(envID); err != nil {
+		return err
+	}
+	sources := layerIDs
+	if parentID != nil {
+		sources = append([]string{*parentID}, layerIDs...)
+	}
+	for _, id := range sources {
+		if err := s.checkEnv(id); err != nil {
+			return err
+		}
+	}
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	return s.Store.SetEnvironmentInheritance(envID, parentID, layerIDs, changes, grants)
+}
+
+// GetEnvironmentAncestors returns what an in-scope environment inherits
+// from. An environment-scoped token sees its environment's ancestors even
+// though it can't address them directly: it already reads their values
+// through the environment, and holds their keys to do so.
+func (s *ScopedStore) GetEnvironmentAncestors(envID string) ([]models.Environment, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.GetEnvironmentAncestors(envID)
+}
+
+// GetEnvironmentLayers returns an in-scope environment's layers, which are
+// visible for the same reason as its ancestors
+func (s *ScopedStore) GetEnvironmentLayers(envID string) ([]models.Environment, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.GetEnvironmentLayers(envID)
+}
+
+// GetInheritanceHistory returns the recorded lineage of an in-scope
+// environment, visible for the same reason as its ancestors
+func (s *ScopedStore) GetInheritanceHistory(envID string) ([]models.InheritanceChange, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.GetInheritanceHistory(envID)
+}
+
+// GetEnvironmentChildren returns the in-scope environments that inherit
+// from an in-scope environment. Children outside the scope are hidden.
+func (s *ScopedStore) GetEnvironmentChildren(envID string) ([]models.Environment, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	children, err := s.Store.GetEnvironmentChildren(envID)
+	if err != nil {
+		return nil, err
+	}
+	visible := []models.Environment{}
+	for _, c := range children {
+		if s.checkEnv(c.ID) == nil {
+			visible = append(visible, c)
+		}
+	}
+	return visible, nil
+}
+
+// Environment key operations
+
+func (s *ScopedStore) GetEnvironmentKey(envID string) (*models.EnvironmentKey, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.GetEnvironmentKey(envID)
+}
+
+func (s *ScopedStore) RekeyEnvironment(key *models.EnvironmentKey, grants models.KeyGrants, reencrypt ReencryptFunc) error {
+	if err := s.checkEnv(key.EnvironmentID); err != nil {
+		return err
+	}
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	return s.Store.RekeyEnvironment(key, grants, reencrypt)
+}
+
+// Member operations are vault administration and always denied, apart from
+// listing an environment's members: rekeying an in-scope environment has to
+// seal the new key to them.
+
+func (s *ScopedStore) CreateMember(name string, publicKey []byte) (*models.Member, error) {
+	return nil, ErrOutOfScope
+}
+
+func (s *ScopedStore) GetMemberByName(name string) (*models.Member, error) {
+	return nil, ErrOutOfScope
+}
+
+func (s *ScopedStore) GetMemberByPublicKey(publicKey []byte) (*models.Member, error) {
+	return nil, ErrOutOfScope
+}
+
+func (s *ScopedStore) ListMembers() ([]models.Member, error) {
+	return nil, ErrOutOfScope
+}
+
+func (s *ScopedStore) ListMemberKeys(memberID string) ([]models.MemberKey, error) {
+	return nil, ErrOutOfScope
+}
+
+func (s *ScopedStore) ListEnvironmentMembers(envID string) ([]models.Member, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.ListEnvironmentMembers(envID)
+}
+
+func (s *ScopedStore) DeleteMember(id string) error {
+	return ErrOutOfScope
+}
+
+func (s *ScopedStore) GrantMemberKey(grant *models.MemberKey) error {
+	return ErrOutOfScope
+}
+
+// Secret operations
+
+func (s *ScopedStore) CreateSecret(envID, key string, encryptedValue, nonce []byte) (*models.Secret, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	if err := s.checkWrite(); err != nil {
+		return nil, err
+	}
+	return s.Store.CreateSecret(envID, key, encryptedValue, nonce)
+}
+
+func (s *ScopedStore) UpdateSecret(envID, key string, encryptedValue, nonce []byte) (*models.Secret, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	if err := s.checkWrite(); err != nil {
+		return nil, err
+	}
+	return s.Store.UpdateSecret(envID, key, encryptedValue, nonce)
+}
+
+func (s *ScopedStore) GetSecret(envID, key string) (*models.Secret, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.GetSecret(envID, key)
+}
+
+func (s *ScopedStore) ListSecrets(envID string) ([]models.Secret, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.ListSecrets(envID)
+}
+
+func (s *ScopedStore) DeleteSecret(envID, key string) error {
+	if err := s.checkEnv(envID); err != nil {
+		return err
+	}
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	return s.Store.DeleteSecret(envID, key)
+}
+
+func (s *ScopedStore) ApplySecrets(envID string, expected map[string]int, changes []models.SecretChange) error {
+	if err := s.checkEnv(envID); err != nil {
+		return err
+	}
+	if err := s.checkWrite(); err != nil {
+		return err
+	}
+	return s.Store.ApplySecrets(envID, expected, changes)
+}
+
+func (s *ScopedStore) GetSecretWithInheritance(envID, key string) (*models.MergedSecret, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.GetSecretWithInheritance(envID, key)
+}
+
+func (s *ScopedStore) ListSecretsWithInheritance(envID string) ([]models.MergedSecret, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.ListSecretsWithInheritance(envID)
+}
+
+func (s *ScopedStore) GetSecretHistory(envID, key string, limit int) ([]models.SecretHistory, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.GetSecretHistory(envID, key, limit)
+}
+
+func (s *ScopedStore) GetSecretVersion(envID, key string, version int) (*models.SecretHistory, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.GetSecretVersion(envID, key, version)
+}
+
+func (s *ScopedStore) ListEnvironmentHistory(envID string) ([]models.SecretHistory, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.ListEnvironmentHistory(envID)
+}
+
+// Snapshot operations
+
+func (s *ScopedStore) CreateSnapshot(envID, message string) (*models.Snapshot, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	if err := s.checkWrite(); err != nil {
+		return nil, err
+	}
+	return s.Store.CreateSnapshot(envID, message)
+}
+
+func (s *ScopedStore) SnapshotAndApplySecrets(envID, message string, expected map[string]int, changes []models.SecretChange) (*models.Snapshot, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	if err := s.checkWrite(); err != nil {
+		return nil, err
+	}
+	return s.Store.SnapshotAndApplySecrets(envID, message, expected, changes)
+}
+
+func (s *ScopedStore) GetSnapshot(envID string, version int) (*models.Snapshot, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.GetSnapshot(envID, version)
+}
+
+func (s *ScopedStore) ListSnapshots(envID string) ([]models.Snapshot, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.ListSnapshots(envID)
+}
+
+// Config operations
+
+// GetConfig reports the token's project as the active project, so commands
+// run with a project-scoped token don't depend on global state
+func (s *ScopedStore) GetConfig(key string) (string, error) {
+	if key == models.ConfigActiveProject && s.token.ProjectID != "" {
+		return s.token.ProjectID, nil
+	}
+	return s.Store.GetConfig(key)
+}
+
+func (s *ScopedStore) SetConfig(key, value string) error {
+	return ErrOutOfScope
+}
+
+func (s *ScopedStore) DeleteConfig(key string) error {
+	return ErrOutOfScope
+}
+
+// API token operations
+
+func (s *ScopedStore) CreateAPIToken(token *models.APIToken, grants []models.TokenKey) error {
+	return ErrOutOfScope
+}
+
+func (s *ScopedStore) ListAPITokens() ([]models.APIToken, error) {
+	return nil, ErrOutOfScope
+}
+
+// ListEnvironmentTokens is allowed for in-scope environments, like
+// ListEnvironmentMembers, so rekeying can seal the new key to other tokens
+func (s *ScopedStore) ListEnvironmentTokens(envID string) ([]models.APIToken, error) {
+	if err := s.checkEnv(envID); err != nil {
+		return nil, err
+	}
+	return s.Store.ListEnvironmentTokens(envID)
+}
+
+func (s *ScopedStore) ListTokenKeys(tokenID string) ([]models.TokenKey, error) {
+	return nil, ErrOutOfScope
+}
+
+func (s *ScopedStore) DeleteAPIToken(id string) error {
+	return ErrOutOfScope
+}
+
+// Audit operations
+
+func (s *ScopedStore) GetAuditLogs(limit int) ([]models.AuditLog, error) {
+	if s.token.ProjectID != "" {
+		return nil, ErrOutOfScope
+	}
+	return s.Store.GetAuditLogs(limit)
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"sort"
@@ -17,6 +18,12 @@ var (
 	ErrNotFound = errors.New("not found")
 	// ErrAlreadyExists is returned when trying to create a duplicate
 	ErrAlreadyExists = errors.New("already exists")
+	// ErrInheritanceCycle is returned when an environment would inherit from
+	// itself
+	ErrInheritanceCycle = errors.New("environment would inherit from itself")
+	// ErrSecretsChanged is returned when an environment's secrets no longer
+	// match the versions a change was planned against
+	ErrSecretsChanged = errors.New("secrets changed since the change was planned")
 )
 
 // SQLiteStore implements Store using SQLite
@@ -67,6 +74,9 @@ func (s *SQLiteStore) migrate() error {
 		key_check BLOB NOT NULL,
 		key_check_nonce BLOB NOT NULL,
 		keychain_enabled BOOLEAN DEFAULT 0,
+		public_key BLOB,
+		private_key BLOB,
+		private_key_nonce BLOB,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
 
@@ -88,6 +98,51 @@ func (s *SQLiteStore) migrate() error {
 	CREATE INDEX IF NOT EXISTS idx_environments_project ON environments(project_id);
 	CREATE INDEX IF NOT EXISTS idx_environments_parent ON environments(parent_id);
 
+	CREATE TABLE IF NOT EXISTS environment_layers (
+		environment_id TEXT NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		-- Checked at commit, so deleting a whole project can remove layers and
+		-- the environments that use them in any order
+		layer_id TEXT NOT NULL REFERENCES environments(id) DEFERRABLE INITIALLY DEFERRED,
+		PRIMARY KEY (environment_id, position),
+		UNIQUE(environment_id, layer_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_environment_layers_layer ON environment_layers(layer_id);
+
+	-- What an environment inherits from after each change to it. The first
+	-- entry holds the links it had before its first change.
+	CREATE TABLE IF NOT EXISTS inheritance_history (
+		environment_id TEXT NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+		parent_id TEXT,
+		layer_ids TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (environment_id, seq)
+	);
+
+	CREATE TABLE IF NOT EXISTS environment_keys (
+		environment_id TEXT PRIMARY KEY REFERENCES environments(id) ON DELETE CASCADE,
+		wrapped_key BLOB NOT NULL,
+		nonce BLOB NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS members (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		public_key BLOB NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS member_keys (
+		member_id TEXT NOT NULL REFERENCES members(id) ON DELETE CASCADE,
+		environment_id TEXT NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+		sealed_key BLOB NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (member_id, environment_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_member_keys_env ON member_keys(environment_id);
+
 	CREATE TABLE IF NOT EXISTS secrets (
 		id TEXT PRIMARY KEY,
 		environment_id TEXT NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
@@ -110,15 +165,57 @@ func (s *SQLiteStore) migrate() error {
 		nonce BLOB NOT NULL,
 		version INTEGER NOT NULL,
 		change_type TEXT NOT NULL,
+		seq INTEGER,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
 	CREATE INDEX IF NOT EXISTS idx_secret_history_env_key ON secret_history(environment_id, key);
 
+	-- Counters that only ever go up, unlike MAX() over rows that can be
+	-- deleted
+	CREATE TABLE IF NOT EXISTS sequences (
+		name TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS snapshots (
+		id TEXT PRIMARY KEY,
+		environment_id TEXT NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+		version INTEGER NOT NULL,
+		message TEXT,
+		history_seq INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(environment_id, version)
+	);
+
 	CREATE TABLE IF NOT EXISTS config (
 		key TEXT PRIMARY KEY,
 		value TEXT NOT NULL
 	);
 
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		token_hash BLOB NOT NULL UNIQUE,
+		wrapped_key BLOB,
+		wrapped_nonce BLOB,
+		public_key BLOB,
+		project_id TEXT REFERENCES projects(id) ON DELETE CASCADE,
+		environment_id TEXT REFERENCES environments(id) ON DELETE CASCADE,
+		read_only BOOLEAN DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		last_used_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS token_keys (
+		token_id TEXT NOT NULL REFERENCES api_tokens(id) ON DELETE CASCADE,
+		environment_id TEXT NOT NULL REFERENCES environments(id) ON DELETE CASCADE,
+		sealed_key BLOB NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (token_id, environment_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_token_keys_env ON token_keys(environment_id);
+
 	CREATE TABLE IF NOT EXISTS audit_log (
 		id TEXT PRIMARY KEY,
 		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
@@ -145,9 +242,75 @@ func (s *SQLiteStore) migrate() error {
 	// Ignore error - column may already exist
 	_ = err
 
+	// Migration: Number history recorded before seq existed
+	_, err = s.db.Exec(`ALTER TABLE secret_history ADD COLUMN seq INTEGER`)
+	// Ignore error - column may already exist
+	_ = err
+	if err := s.numberHistory(); err != nil {
+		return err
+	}
+
+	// Migration: Add the vault keypair to vaults created before it
+	for _, column := range []string{"public_key", "private_key", "private_key_nonce"} {
+		_, err = s.db.Exec(`ALTER TABLE vault_meta ADD COLUMN ` + column + ` BLOB`)
+		// Ignore error - column may already exist
+		_ = err
+	}
+
 	return nil
 }
 
+// numberHistory numbers history entries without a seq in the order they
+// were written, after any that have one, and starts the history sequence
+// after the last of them
+func (s *SQLiteStore) numberHistory() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var seq int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM secret_history`).Scan(&seq); err != nil {
+		return fmt.Errorf("failed to number history: %w", err)
+	}
+	rows, err := tx.Query(`SELECT id FROM secret_history WHERE seq IS NULL ORDER BY created_at, rowid`)
+	if err != nil {
+		return fmt.Errorf("failed to number history: %w", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to number history: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to number history: %w", err)
+	}
+	for _, id := range ids {
+		seq++
+		if _, err := tx.Exec(`UPDATE secret_history SET seq = ? WHERE id = ?`, seq, id); err != nil {
+			return fmt.Errorf("failed to number history: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_secret_history_seq ON secret_history(seq)`); err != nil {
+		return fmt.Errorf("failed to index history: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO sequences (name, value) VALUES ('history', ?)
+		ON CONFLICT(name) DO UPDATE SET value = MAX(value, excluded.value)
+	`, seq)
+	if err != nil {
+		return fmt.Errorf("failed to number history: %w", err)
+	}
+	return tx.Commit()
+}
+
 // Close closes the database connection
 func (s *SQLiteStore) Close() error {
 	return s.db.Close()
@@ -158,9 +321,9 @@ func (s *SQLiteStore) Close() error {
 func (s *SQLiteStore) GetVaultMeta() (*models.VaultMeta, error) {
 	var meta models.VaultMeta
 	err := s.db.QueryRow(`
-		SELECT id, salt, key_check, key_check_nonce, keychain_enabled, created_at
+		SELECT id, salt, key_check, key_check_nonce, keychain_enabled, public_key, private_key, private_key_nonce, created_at
 		FROM vault_meta WHERE id = 1
-	`).Scan(&meta.ID, &meta.Salt, &meta.KeyCheck, &meta.KeyCheckNonce, &meta.KeychainEnabled, &meta.CreatedAt)
+	`).Scan(&meta.ID, &meta.Salt, &meta.KeyCheck, &meta.KeyCheckNonce, &meta.KeychainEnabled, &meta.PublicKey, &meta.PrivateKey, &meta.PrivateKeyNonce, &meta.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, ErrNotFound
 	}
@@ -181,6 +344,23 @@ func (s *SQLiteStore) CreateVaultMeta(salt, keyCheck, keyCheckNonce []byte) erro
 	return nil
 }
 
+// SetVaultKeyPair stores the vault's keypair, unless it already has one.
+// It returns ErrAlreadyExists if another keypair was stored first.
+func (s *SQLiteStore) SetVaultKeyPair(publicKey, privateKey, privateKeyNonce []byte) error {
+	result, err := s.db.Exec(`
+		UPDATE vault_meta SET public_key = ?, private_key = ?, private_key_nonce = ?
+		WHERE id = 1 AND public_key IS NULL
+	`, publicKey, privateKey, privateKeyNonce)
+	if err != nil {
+		return fmt.Errorf("failed to set vault keypair: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
 func (s *SQLiteStore) SetKeychainEnabled(enabled bool) error {
 	_, err := s.db.Exec(`UPDATE vault_meta SET keychain_enabled = ? WHERE id = 1`, enabled)
 	if err != nil {
@@ -266,6 +446,48 @@ func (s *SQLiteStore) ListProjects() ([]models.Project, error) {
 	return projects, rows.Err()
 }
 
+func (s *SQLiteStore) RenameProject(id, name string) error {
+	result, err := s.db.Exec(`UPDATE projects SET name = ? WHERE id = ?`, name, id)
+	if err != nil {
+		return fmt.Errorf("failed to rename project: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CopyProject inserts a new project and copies of environments into it in a
+// single transaction. Environments are inserted in order, so parents must
+// come before their children.
+func (s *SQLiteStore) CopyProject(project *models.Project, envs []models.EnvironmentCopy) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if project.ID == "" {
+		project.ID = uuid.New().String()
+	}
+	if project.CreatedAt.IsZero() {
+		project.CreatedAt = time.Now()
+	}
+	_, err = tx.Exec(`
+		INSERT INTO projects (id, name, description, created_at)
+		VALUES (?, ?, ?, ?)
+	`, project.ID, project.Name, project.Description, project.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create project: %w", err)
+	}
+
+	if err := copyEnvironmentsTx(tx, envs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (s *SQLiteStore) DeleteProject(id string) error {
 	result, err := s.db.Exec(`DELETE FROM projects WHERE id = ?`, id)
 	if err != nil {
@@ -362,6 +584,97 @@ func (s *SQLiteStore) ListEnvironments(projectID string) ([]models.Environment,
 	return envs, rows.Err()
 }
 
+func (s *SQLiteStore) RenameEnvironment(id, name string) error {
+	result, err := s.db.Exec(`UPDATE environments SET name = ? WHERE id = ?`, name, id)
+	if err != nil {
+		return fmt.Errorf("failed to rename environment: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CopyEnvironments inserts copies of environments, with their keys, secrets
+// and history, in a single transaction. Environments are inserted in order,
+// so parents must come before their children.
+func (s *SQLiteStore) CopyEnvironments(envs []models.EnvironmentCopy) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := copyEnvironmentsTx(tx, envs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func copyEnvironmentsTx(tx *sql.Tx, envs []models.EnvironmentCopy) error {
+	now := time.Now()
+	for _, c := range envs {
+		e := c.Environment
+		if e.CreatedAt.IsZero() {
+			e.CreatedAt = now
+		}
+		_, err := tx.Exec(`
+			INSERT INTO environments (id, project_id, name, parent_id, created_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, e.ID, e.ProjectID, e.Name, e.ParentID, e.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to create environment '%s': %w", e.Name, err)
+		}
+		if err := insertLayersTx(tx, e.ID, c.Layers); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO environment_keys (environment_id, wrapped_key, nonce, created_at)
+			VALUES (?, ?, ?, ?)
+		`, e.ID, c.Key.WrappedKey, c.Key.Nonce, now)
+		if err != nil {
+			return fmt.Errorf("failed to store environment key: %w", err)
+		}
+
+		for _, sec := range c.Secrets {
+			if sec.CreatedAt.IsZero() {
+				sec.CreatedAt, sec.UpdatedAt = now, now
+			}
+			_, err = tx.Exec(`
+				INSERT INTO secrets (id, environment_id, key, encrypted_value, nonce, version, created_at, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			`, uuid.New().String(), e.ID, sec.Key, sec.EncryptedValue, sec.Nonce, sec.Version, sec.CreatedAt, sec.UpdatedAt)
+			if err != nil {
+				return fmt.Errorf("failed to copy secret: %w", err)
+			}
+		}
+
+		for _, h := range c.History {
+			if h.CreatedAt.IsZero() {
+				h.CreatedAt = now
+			}
+			seq, err := nextHistorySeqTx(tx)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`
+				INSERT INTO secret_history (id, environment_id, key, encrypted_value, nonce, version, change_type, seq, created_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`, uuid.New().String(), e.ID, h.Key, h.EncryptedValue, h.Nonce, h.Version, h.ChangeType, seq, h.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("failed to copy history: %w", err)
+			}
+		}
+
+		if err := applyGrantsTx(tx, c.Grants, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *SQLiteStore) DeleteEnvironment(id string) error {
 	result, err := s.db.Exec(`DELETE FROM environments WHERE id = ?`, id)
 	if err != nil {
@@ -396,139 +709,376 @@ func (s *SQLiteStore) CreateEnvironmentWithParent(projectID, name, parentID stri
 	}, nil
 }
 
-// GetEnvironmentAncestors returns the chain of parent environments (from immediate parent to root)
-func (s *SQLiteStore) GetEnvironmentAncestors(envID string) ([]models.Environment, error) {
-	ancestors := []models.Environment{}
-	currentID := envID
-	visited := make(map[string]bool)
+// SetEnvironmentInheritance replaces what an environment inherits from: its
+// parent (nil for none) and its layers, in order of increasing precedence.
+// Secret changes are applied to the environment in the same transaction, so
+// values can be copied in before a source is removed, and so are grants of
+// the new sources' keys. Every source must be in the same project, and it
+// fails with ErrInheritanceCycle if the environment would end up inheriting
+// from itself.
+func (s *SQLiteStore) SetEnvironmentInheritance(envID string, parentID *string, layerIDs []string, changes []models.SecretChange, grants models.KeyGrants) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
-	// Walk up the chain, max 10 levels to prevent infinite loops
-	for i := 0; i < 10; i++ {
-		var e models.Environment
-		var parentID sql.NullString
-		err := s.db.QueryRow(`
-			SELECT id, project_id, name, parent_id, created_at FROM environments WHERE id = ?
-		`, currentID).Scan(&e.ID, &e.ProjectID, &e.Name, &parentID, &e.CreatedAt)
+	var projectID string
+	err = tx.QueryRow(`SELECT project_id FROM environments WHERE id = ?`, envID).Scan(&projectID)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get environment: %w", err)
+	}
+
+	sources := layerIDs
+	if parentID != nil {
+		sources = append([]string{*parentID}, layerIDs...)
+	}
+	seen := make(map[string]bool, len(sources))
+	for _, id := range sources {
+		if id == envID {
+			return ErrInheritanceCycle
+		}
+		if seen[id] {
+			return fmt.Errorf("environment is listed more than once")
+		}
+		seen[id] = true
+
+		var sourceProjectID string
+		err := tx.QueryRow(`SELECT project_id FROM environments WHERE id = ?`, id).Scan(&sourceProjectID)
 		if err == sql.ErrNoRows {
-			break
+			return ErrNotFound
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to get ancestor: %w", err)
+			return fmt.Errorf("failed to get environment: %w", err)
 		}
-
-		if parentID.Valid {
-			e.ParentID = &parentID.String
+		if sourceProjectID != projectID {
+			return fmt.Errorf("environments can only inherit from the same project")
 		}
+	}
 
-		// Skip the first one (it's the environment itself, not an ancestor)
-		if currentID != envID {
-			// Check for circular reference
-			if visited[e.ID] {
-				return nil, fmt.Errorf("circular inheritance detected")
-			}
-			visited[e.ID] = true
-			ancestors = append(ancestors, e)
-		}
+	if err := recordFirstInheritanceTx(tx, envID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE environments SET parent_id = ? WHERE id = ?`, parentID, envID)
+	if err != nil {
+		return fmt.Errorf("failed to set parent: %w", err)
+	}
+	_, err = tx.Exec(`DELETE FROM environment_layers WHERE environment_id = ?`, envID)
+	if err != nil {
+		return fmt.Errorf("failed to clear layers: %w", err)
+	}
+	if err := insertLayersTx(tx, envID, layerIDs); err != nil {
+		return err
+	}
 
-		// Move to parent
-		if !parentID.Valid {
-			break
-		}
-		currentID = parentID.String
+	// Check the whole graph, however deep, now that the links are in place
+	if _, err := lineage(tx, envID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	seq, err := nextHistorySeqTx(tx)
+	if err != nil {
+		return err
+	}
+	if err := recordInheritanceTx(tx, envID, parentID, layerIDs, seq, now); err != nil {
+		return err
+	}
+	if err := applySecretsTx(tx, envID, changes, now); err != nil {
+		return err
+	}
+	if err := applyGrantsTx(tx, grants, now); err != nil {
+		return err
 	}
 
-	return ancestors, nil
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
 }
 
-// GetEnvironmentChildren returns all direct children of an environment
-func (s *SQLiteStore) GetEnvironmentChildren(envID string) ([]models.Environment, error) {
+// recordFirstInheritanceTx records the links an environment has had since it
+// was created, before they change for the first time
+func recordFirstInheritanceTx(tx *sql.Tx, envID string) error {
+	var recorded bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM inheritance_history WHERE environment_id = ?)`, envID).Scan(&recorded)
+	if err != nil {
+		return fmt.Errorf("failed to get inheritance history: %w", err)
+	}
+	if recorded {
+		return nil
+	}
+
+	var parentID sql.NullString
+	var createdAt time.Time
+	err = tx.QueryRow(`SELECT parent_id, created_at FROM environments WHERE id = ?`, envID).Scan(&parentID, &createdAt)
+	if err != nil {
+		return fmt.Errorf("failed to get environment: %w", err)
+	}
+	layers, err := queryEnvironments(tx, `
+		SELECT e.id, e.project_id, e.name, e.parent_id, e.created_at
+		FROM environment_layers l JOIN environments e ON e.id = l.layer_id
+		WHERE l.environment_id = ? ORDER BY l.position
+	`, envID)
+	if err != nil {
+		return fmt.Errorf("failed to get layers: %w", err)
+	}
+	layerIDs := make([]string, len(layers))
+	for i, l := range layers {
+		layerIDs[i] = l.ID
+	}
+
+	var parent *string
+	if parentID.Valid {
+		parent = &parentID.String
+	}
+	// Sequence 0 sorts before anything recorded since
+	return recordInheritanceTx(tx, envID, parent, layerIDs, 0, createdAt)
+}
+
+func recordInheritanceTx(tx *sql.Tx, envID string, parentID *string, layerIDs []string, seq int64, at time.Time) error {
+	if layerIDs == nil {
+		layerIDs = []string{}
+	}
+	layers, err := json.Marshal(layerIDs)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO inheritance_history (environment_id, parent_id, layer_ids, seq, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, envID, parentID, string(layers), seq, at)
+	if err != nil {
+		return fmt.Errorf("failed to record inheritance: %w", err)
+	}
+	return nil
+}
+
+// GetInheritanceHistory returns the recorded changes to what an environment
+// inherits from, oldest first. It's empty if the environment has kept the
+// parent and layers it was created with.
+func (s *SQLiteStore) GetInheritanceHistory(envID string) ([]models.InheritanceChange, error) {
 	rows, err := s.db.Query(`
-		SELECT id, project_id, name, parent_id, created_at FROM environments
-		WHERE parent_id = ? ORDER BY name
+		SELECT environment_id, parent_id, layer_ids, seq, created_at
+		FROM inheritance_history WHERE environment_id = ? ORDER BY seq
 	`, envID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get children: %w", err)
+		return nil, fmt.Errorf("failed to get inheritance history: %w", err)
 	}
 	defer rows.Close()
 
-	children := []models.Environment{}
+	changes := []models.InheritanceChange{}
 	for rows.Next() {
-		var e models.Environment
+		var c models.InheritanceChange
 		var parentID sql.NullString
-		if err := rows.Scan(&e.ID, &e.ProjectID, &e.Name, &parentID, &e.CreatedAt); err != nil {
-			return nil, fmt.Errorf("failed to scan child: %w", err)
+		var layers string
+		if err := rows.Scan(&c.EnvironmentID, &parentID, &layers, &c.Seq, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan inheritance history: %w", err)
 		}
 		if parentID.Valid {
-			e.ParentID = &parentID.String
+			c.ParentID = &parentID.String
 		}
-		children = append(children, e)
+		if err := json.Unmarshal([]byte(layers), &c.LayerIDs); err != nil {
+			return nil, fmt.Errorf("failed to read layers: %w", err)
+		}
+		changes = append(changes, c)
 	}
-	return children, rows.Err()
+	return changes, rows.Err()
 }
 
-// GetSecretWithInheritance gets a secret, walking up the inheritance chain if not found locally
-func (s *SQLiteStore) GetSecretWithInheritance(envID, key string) (*models.MergedSecret, error) {
-	// First try to get the secret directly from this environment
-	env, err := s.GetEnvironment(envID)
-	if err != nil {
-		return nil, err
+func insertLayersTx(tx *sql.Tx, envID string, layerIDs []string) error {
+	for i, id := range layerIDs {
+		_, err := tx.Exec(`
+			INSERT INTO environment_layers (environment_id, position, layer_id) VALUES (?, ?, ?)
+		`, envID, i, id)
+		if err != nil {
+			return fmt.Errorf("failed to add layer: %w", err)
+		}
 	}
+	return nil
+}
 
-	sec, err := s.GetSecret(envID, key)
-	if err == nil {
-		// Found locally
-		return &models.MergedSecret{
-			Secret:        *sec,
-			SourceEnvID:   envID,
-			SourceEnvName: env.Name,
-			IsInherited:   false,
-		}, nil
-	}
-	if err != ErrNotFound {
-		return nil, err
-	}
+// GetEnvironmentLayers returns an environment's layers in order of
+// increasing precedence
+func (s *SQLiteStore) GetEnvironmentLayers(envID string) ([]models.Environment, error) {
+	return queryEnvironments(s.db, `
+		SELECT e.id, e.project_id, e.name, e.parent_id, e.created_at
+		FROM environment_layers l JOIN environments e ON e.id = l.layer_id
+		WHERE l.environment_id = ? ORDER BY l.position
+	`, envID)
+}
 
-	// Not found locally, walk up the chain
-	ancestors, err := s.GetEnvironmentAncestors(envID)
-	if err != nil {
-		return nil, err
-	}
+// GetEnvironmentAncestors returns every environment an environment inherits
+// from, highest precedence first: its layers from last to first, then its
+// parent, each followed by what it inherits in turn
+func (s *SQLiteStore) GetEnvironmentAncestors(envID string) ([]models.Environment, error) {
+	return lineage(s.db, envID)
+}
 
-	for _, ancestor := range ancestors {
-		sec, err := s.GetSecret(ancestor.ID, key)
-		if err == nil {
-			return &models.MergedSecret{
-				Secret:        *sec,
-				SourceEnvID:   ancestor.ID,
-				SourceEnvName: ancestor.Name,
-				IsInherited:   true,
-			}, nil
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// lineage walks the inheritance graph depth-first from envID. An environment
+// reachable more than once keeps its highest-precedence position. Fails with
+// ErrInheritanceCycle if envID can reach itself.
+func lineage(q queryer, envID string) ([]models.Environment, error) {
+	result := []models.Environment{}
+	seen := make(map[string]bool)
+	onPath := map[string]bool{envID: true}
+
+	var walk func(id string) error
+	walk = func(id string) error {
+		sources, err := directSources(q, id)
+		if err != nil {
+			return err
 		}
-		if err != ErrNotFound {
-			return nil, err
+		for _, src := range sources {
+			if onPath[src.ID] {
+				return ErrInheritanceCycle
+			}
+			if seen[src.ID] {
+				continue
+			}
+			seen[src.ID] = true
+			result = append(result, src)
+
+			onPath[src.ID] = true
+			if err := walk(src.ID); err != nil {
+				return err
+			}
+			delete(onPath, src.ID)
 		}
+		return nil
 	}
 
-	return nil, ErrNotFound
+	if err := walk(envID); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-// ListSecretsWithInheritance lists all secrets including inherited ones
-func (s *SQLiteStore) ListSecretsWithInheritance(envID string) ([]models.MergedSecret, error) {
-	// Get the environment
-	env, err := s.GetEnvironment(envID)
+// directSources returns what an environment inherits from directly, highest
+// precedence first: its layers from last to first, then its parent
+func directSources(q queryer, envID string) ([]models.Environment, error) {
+	sources, err := queryEnvironments(q, `
+		SELECT e.id, e.project_id, e.name, e.parent_id, e.created_at
+		FROM environment_layers l JOIN environments e ON e.id = l.layer_id
+		WHERE l.environment_id = ? ORDER BY l.position DESC
+	`, envID)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to get layers: %w", err)
 	}
-
-	// Build the chain: [current, parent, grandparent, ...]
-	chain := []models.Environment{*env}
+	parent, err := queryEnvironments(q, `
+		SELECT p.id, p.project_id, p.name, p.parent_id, p.created_at
+		FROM environments e JOIN environments p ON p.id = e.parent_id
+		WHERE e.id = ?
+	`, envID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ancestor: %w", err)
+	}
+	return append(sources, parent...), nil
+}
+
+func queryEnvironments(q queryer, query string, args ...any) ([]models.Environment, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	envs := []models.Environment{}
+	for rows.Next() {
+		var e models.Environment
+		var parentID sql.NullString
+		if err := rows.Scan(&e.ID, &e.ProjectID, &e.Name, &parentID, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan environment: %w", err)
+		}
+		if parentID.Valid {
+			e.ParentID = &parentID.String
+		}
+		envs = append(envs, e)
+	}
+	return envs, rows.Err()
+}
+
+// GetEnvironmentChildren returns the environments that inherit directly from
+// an environment, as their parent or as one of their layers
+func (s *SQLiteStore) GetEnvironmentChildren(envID string) ([]models.Environment, error) {
+	children, err := queryEnvironments(s.db, `
+		SELECT id, project_id, name, parent_id, created_at FROM environments
+		WHERE parent_id = ? OR id IN (SELECT environment_id FROM environment_layers WHERE layer_id = ?)
+		ORDER BY name
+	`, envID, envID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get children: %w", err)
+	}
+	return children, nil
+}
+
+// GetSecretWithInheritance gets a secret, looking through everything the
+// environment inherits from if it isn't defined locally
+func (s *SQLiteStore) GetSecretWithInheritance(envID, key string) (*models.MergedSecret, error) {
+	env, err := s.GetEnvironment(envID)
+	if err != nil {
+		return nil, err
+	}
+	ancestors, err := s.GetEnvironmentAncestors(envID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first definition found wins; later ones are shadowed by it
+	var merged *models.MergedSecret
+	for _, e := range append([]models.Environment{*env}, ancestors...) {
+		sec, err := s.GetSecret(e.ID, key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if merged == nil {
+			merged = &models.MergedSecret{
+				Secret:        *sec,
+				SourceEnvID:   e.ID,
+				SourceEnvName: e.Name,
+				IsInherited:   e.ID != envID,
+			}
+			continue
+		}
+		merged.Shadowed = append(merged.Shadowed, models.ShadowedSecret{Secret: *sec, SourceEnvID: e.ID, SourceEnvName: e.Name})
+	}
+
+	if merged == nil {
+		return nil, ErrNotFound
+	}
+	return merged, nil
+}
+
+// ListSecretsWithInheritance lists all secrets including inherited ones.
+// Each reports the environment its value comes from and the environments
+// whose definitions it shadows.
+func (s *SQLiteStore) ListSecretsWithInheritance(envID string) ([]models.MergedSecret, error) {
+	env, err := s.GetEnvironment(envID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the chain: [current, then what it inherits from by precedence]
+	chain := []models.Environment{*env}
 	ancestors, err := s.GetEnvironmentAncestors(envID)
 	if err != nil {
 		return nil, err
 	}
 	chain = append(chain, ancestors...)
 
-	// Process from root to child (reverse order) so child overrides parent
+	// Process from lowest to highest precedence so nearer definitions
+	// override (and shadow) the ones they replace
 	secretMap := make(map[string]models.MergedSecret)
 	for i := len(chain) - 1; i >= 0; i-- {
 		ancestor := chain[i]
@@ -538,13 +1088,17 @@ func (s *SQLiteStore) ListSecretsWithInheritance(envID string) ([]models.MergedS
 		}
 
 		for _, sec := range secrets {
-			isInherited := ancestor.ID != envID
-			secretMap[sec.Key] = models.MergedSecret{
+			merged := models.MergedSecret{
 				Secret:        sec,
 				SourceEnvID:   ancestor.ID,
 				SourceEnvName: ancestor.Name,
-				IsInherited:   isInherited,
+				IsInherited:   ancestor.ID != envID,
 			}
+			if prev, ok := secretMap[sec.Key]; ok {
+				shadowed := models.ShadowedSecret{Secret: prev.Secret, SourceEnvID: prev.SourceEnvID, SourceEnvName: prev.SourceEnvName}
+				merged.Shadowed = append([]models.ShadowedSecret{shadowed}, prev.Shadowed...)
+			}
+			secretMap[sec.Key] = merged
 		}
 	}
 
@@ -560,12 +1114,292 @@ func (s *SQLiteStore) ListSecretsWithInheritance(envID string) ([]models.MergedS
 	return result, nil
 }
 
-// Secret operations
+// Environment key operations
 
-func (s *SQLiteStore) CreateSecret(envID, key string, encryptedValue, nonce []byte) (*models.Secret, error) {
+func (s *SQLiteStore) GetEnvironmentKey(envID string) (*models.EnvironmentKey, error) {
+	var k models.EnvironmentKey
+	err := s.db.QueryRow(`
+		SELECT environment_id, wrapped_key, nonce, created_at FROM environment_keys WHERE environment_id = ?
+	`, envID).Scan(&k.EnvironmentID, &k.WrappedKey, &k.Nonce, &k.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get environment key: %w", err)
+	}
+	return &k, nil
+}
+
+// RekeyEnvironment replaces an environment's data key and the copies of it
+// sealed to members and tokens, and re-encrypts its secrets and history under
+// the new key with reencrypt, all in one transaction. The rows are read after
+// the new key is written, so the transaction already holds the write lock and
+// no write can land between reading a row and replacing it.
+func (s *SQLiteStore) RekeyEnvironment(key *models.EnvironmentKey, grants models.KeyGrants, reencrypt ReencryptFunc) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+	_, err = tx.Exec(`
+		INSERT INTO environment_keys (environment_id, wrapped_key, nonce, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(environment_id) DO UPDATE SET
+			wrapped_key = excluded.wrapped_key,
+			nonce = excluded.nonce,
+			created_at = excluded.created_at
+	`, key.EnvironmentID, key.WrappedKey, key.Nonce, key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store environment key: %w", err)
+	}
+
+	// Grants sealed the old key, so they are replaced wholesale
+	for _, table := range []string{"member_keys", "token_keys"} {
+		_, err = tx.Exec(`DELETE FROM `+table+` WHERE environment_id = ?`, key.EnvironmentID)
+		if err != nil {
+			return fmt.Errorf("failed to clear %s: %w", table, err)
+		}
+	}
+	for i := range grants.Members {
+		grants.Members[i].EnvironmentID = key.EnvironmentID
+	}
+	for i := range grants.Tokens {
+		grants.Tokens[i].EnvironmentID = key.EnvironmentID
+	}
+	if err := applyGrantsTx(tx, grants, key.CreatedAt); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"secrets", "secret_history"} {
+		if err := reencryptTableTx(tx, table, key.EnvironmentID, reencrypt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ReencryptFunc re-encrypts a value stored for a secret key under an
+// environment's new data key
+type ReencryptFunc func(ciphertext, nonce []byte, key string) ([]byte, []byte, error)
+
+// reencryptTableTx rewrites every value an environment has in table (secrets
+// or secret_history) with reencrypt
+func reencryptTableTx(tx *sql.Tx, table, envID string, reencrypt ReencryptFunc) error {
+	type row struct {
+		id, key           string
+		ciphertext, nonce []byte
+	}
+	rows, err := tx.Query(`SELECT id, key, encrypted_value, nonce FROM `+table+` WHERE environment_id = ?`, envID)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", table, err)
+	}
+	var all []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.key, &r.ciphertext, &r.nonce); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan %s: %w", table, err)
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", table, err)
+	}
+
+	for _, r := range all {
+		ciphertext, nonce, err := reencrypt(r.ciphertext, r.nonce, r.key)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE `+table+` SET encrypted_value = ?, nonce = ? WHERE id = ?`, ciphertext, nonce, r.id)
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// Member operations
+
+func (s *SQLiteStore) CreateMember(name string, publicKey []byte) (*models.Member, error) {
 	id := uuid.New().String()
 	now := time.Now()
 
+	_, err := s.db.Exec(`
+		INSERT INTO members (id, name, public_key, created_at) VALUES (?, ?, ?, ?)
+	`, id, name, publicKey, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create member: %w", err)
+	}
+
+	return &models.Member{
+		ID:        id,
+		Name:      name,
+		PublicKey: publicKey,
+		CreatedAt: now,
+	}, nil
+}
+
+func (s *SQLiteStore) GetMemberByName(name string) (*models.Member, error) {
+	var m models.Member
+	err := s.db.QueryRow(`
+		SELECT id, name, public_key, created_at FROM members WHERE name = ?
+	`, name).Scan(&m.ID, &m.Name, &m.PublicKey, &m.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get member: %w", err)
+	}
+	return &m, nil
+}
+
+func (s *SQLiteStore) GetMemberByPublicKey(publicKey []byte) (*models.Member, error) {
+	var m models.Member
+	err := s.db.QueryRow(`
+		SELECT id, name, public_key, created_at FROM members WHERE public_key = ?
+	`, publicKey).Scan(&m.ID, &m.Name, &m.PublicKey, &m.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get member: %w", err)
+	}
+	return &m, nil
+}
+
+func (s *SQLiteStore) ListMembers() ([]models.Member, error) {
+	return s.queryMembers(`SELECT id, name, public_key, created_at FROM members ORDER BY name`)
+}
+
+// ListEnvironmentMembers returns the members holding a grant for an environment
+func (s *SQLiteStore) ListEnvironmentMembers(envID string) ([]models.Member, error) {
+	return s.queryMembers(`
+		SELECT m.id, m.name, m.public_key, m.created_at FROM members m
+		JOIN member_keys k ON k.member_id = m.id
+		WHERE k.environment_id = ? ORDER BY m.name
+	`, envID)
+}
+
+func (s *SQLiteStore) queryMembers(query string, args ...any) ([]models.Member, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members: %w", err)
+	}
+	defer rows.Close()
+
+	members := []models.Member{}
+	for rows.Next() {
+		var m models.Member
+		if err := rows.Scan(&m.ID, &m.Name, &m.PublicKey, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan member: %w", err)
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteMember(id string) error {
+	result, err := s.db.Exec(`DELETE FROM members WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete member: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GrantMemberKey stores an environment key sealed to a member, replacing any existing grant
+func (s *SQLiteStore) GrantMemberKey(grant *models.MemberKey) error {
+	if grant.CreatedAt.IsZero() {
+		grant.CreatedAt = time.Now()
+	}
+	return grantMemberKeyTx(s.db, grant)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func grantMemberKeyTx(db execer, grant *models.MemberKey) error {
+	_, err := db.Exec(`
+		INSERT INTO member_keys (member_id, environment_id, sealed_key, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(member_id, environment_id) DO UPDATE SET
+			sealed_key = excluded.sealed_key,
+			created_at = excluded.created_at
+	`, grant.MemberID, grant.EnvironmentID, grant.SealedKey, grant.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to grant member key: %w", err)
+	}
+	return nil
+}
+
+// applyGrantsTx stores grants, replacing existing grants for the same member
+// or token and environment
+func applyGrantsTx(tx *sql.Tx, grants models.KeyGrants, now time.Time) error {
+	for _, g := range grants.Members {
+		g.CreatedAt = now
+		if err := grantMemberKeyTx(tx, &g); err != nil {
+			return err
+		}
+	}
+	for _, g := range grants.Tokens {
+		g.CreatedAt = now
+		if err := grantTokenKeyTx(tx, &g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func grantTokenKeyTx(db execer, grant *models.TokenKey) error {
+	_, err := db.Exec(`
+		INSERT INTO token_keys (token_id, environment_id, sealed_key, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(token_id, environment_id) DO UPDATE SET
+			sealed_key = excluded.sealed_key,
+			created_at = excluded.created_at
+	`, grant.TokenID, grant.EnvironmentID, grant.SealedKey, grant.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to grant token key: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) ListMemberKeys(memberID string) ([]models.MemberKey, error) {
+	rows, err := s.db.Query(`
+		SELECT member_id, environment_id, sealed_key, created_at FROM member_keys
+		WHERE member_id = ? ORDER BY created_at, environment_id
+	`, memberID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list member keys: %w", err)
+	}
+	defer rows.Close()
+
+	grants := []models.MemberKey{}
+	for rows.Next() {
+		var g models.MemberKey
+		if err := rows.Scan(&g.MemberID, &g.EnvironmentID, &g.SealedKey, &g.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan member key: %w", err)
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// Secret operations
+
+func (s *SQLiteStore) CreateSecret(envID, key string, encryptedValue, nonce []byte) (*models.Secret, error) {
 	// Start transaction for secret + history
 	tx, err := s.db.Begin()
 	if err != nil {
@@ -573,7 +1407,120 @@ func (s *SQLiteStore) CreateSecret(envID, key string, encryptedValue, nonce []by
 	}
 	defer tx.Rollback()
 
-	_, err = tx.Exec(`
+	secret, err := createSecretTx(tx, envID, key, encryptedValue, nonce, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return secret, nil
+}
+
+func (s *SQLiteStore) UpdateSecret(envID, key string, encryptedValue, nonce []byte) (*models.Secret, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	secret, err := updateSecretTx(tx, envID, key, encryptedValue, nonce, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return secret, nil
+}
+
+// ApplySecrets writes a batch of changes to one environment in a single
+// transaction: keys are created or updated (with history), or deleted. If
+// any change fails, none are applied. expected maps each secret defined in
+// the environment to the version the changes were planned against; if the
+// environment no longer matches it, nothing is written and
+// ErrSecretsChanged is returned.
+func (s *SQLiteStore) ApplySecrets(envID string, expected map[string]int, changes []models.SecretChange) error {
+	now := time.Now()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkVersionsTx(tx, envID, expected); err != nil {
+		return err
+	}
+	if err := applySecretsTx(tx, envID, changes, now); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// checkVersionsTx returns ErrSecretsChanged unless the environment's secrets
+// are exactly the keys in expected, at the versions in expected
+func checkVersionsTx(tx *sql.Tx, envID string, expected map[string]int) error {
+	rows, err := tx.Query(`SELECT key, version FROM secrets WHERE environment_id = ?`, envID)
+	if err != nil {
+		return fmt.Errorf("failed to list secrets: %w", err)
+	}
+	defer rows.Close()
+
+	current := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var version int
+		if err := rows.Scan(&key, &version); err != nil {
+			return fmt.Errorf("failed to scan secret: %w", err)
+		}
+		current[key] = version
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list secrets: %w", err)
+	}
+
+	if len(current) != len(expected) {
+		return ErrSecretsChanged
+	}
+	for key, version := range expected {
+		if v, ok := current[key]; !ok || v != version {
+			return ErrSecretsChanged
+		}
+	}
+	return nil
+}
+
+func applySecretsTx(tx *sql.Tx, envID string, changes []models.SecretChange, now time.Time) error {
+	for _, c := range changes {
+		if c.Delete {
+			if err := deleteSecretTx(tx, envID, c.Key, now); err != nil {
+				return fmt.Errorf("%s: %w", c.Key, err)
+			}
+			continue
+		}
+
+		_, err := updateSecretTx(tx, envID, c.Key, c.EncryptedValue, c.Nonce, now)
+		if err == ErrNotFound {
+			_, err = createSecretTx(tx, envID, c.Key, c.EncryptedValue, c.Nonce, now)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.Key, err)
+		}
+	}
+	return nil
+}
+
+func createSecretTx(tx *sql.Tx, envID, key string, encryptedValue, nonce []byte, now time.Time) (*models.Secret, error) {
+	id := uuid.New().String()
+
+	_, err := tx.Exec(`
 		INSERT INTO secrets (id, environment_id, key, encrypted_value, nonce, version, created_at, updated_at)
 		VALUES (?, ?, ?, ?, ?, 1, ?, ?)
 	`, id, envID, key, encryptedValue, nonce, now, now)
@@ -582,19 +1529,13 @@ func (s *SQLiteStore) CreateSecret(envID, key string, encryptedValue, nonce []by
 	}
 
 	// Record in history
-	historyID := uuid.New().String()
-	_, err = tx.Exec(`
-		INSERT INTO secret_history (id, environment_id, key, encrypted_value, nonce, version, change_type, created_at)
-		VALUES (?, ?, ?, ?, ?, 1, ?, ?)
-	`, historyID, envID, key, encryptedValue, nonce, models.ChangeTypeCreate, now)
+	if err := recordHistoryTx(tx, envID, key, encryptedValue, nonce, 1, models.ChangeTypeCreate, now); err != nil {
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to record history: %w", err)
 	}
 
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("failed to commit: %w", err)
-	}
-
 	return &models.Secret{
 		ID:             id,
 		EnvironmentID:  envID,
@@ -607,19 +1548,11 @@ func (s *SQLiteStore) CreateSecret(envID, key string, encryptedValue, nonce []by
 	}, nil
 }
 
-func (s *SQLiteStore) UpdateSecret(envID, key string, encryptedValue, nonce []byte) (*models.Secret, error) {
-	now := time.Now()
-
-	tx, err := s.db.Begin()
-	if err != nil {
-		return nil, fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback()
-
+func updateSecretTx(tx *sql.Tx, envID, key string, encryptedValue, nonce []byte, now time.Time) (*models.Secret, error) {
 	// Get current version
 	var currentVersion int
 	var id string
-	err = tx.QueryRow(`
+	err := tx.QueryRow(`
 		SELECT id, version FROM secrets WHERE environment_id = ? AND key = ?
 	`, envID, key).Scan(&id, &currentVersion)
 	if err == sql.ErrNoRows {
@@ -641,19 +1574,13 @@ func (s *SQLiteStore) UpdateSecret(envID, key string, encryptedValue, nonce []by
 	}
 
 	// Record in history
-	historyID := uuid.New().String()
-	_, err = tx.Exec(`
-		INSERT INTO secret_history (id, environment_id, key, encrypted_value, nonce, version, change_type, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, historyID, envID, key, encryptedValue, nonce, newVersion, models.ChangeTypeUpdate, now)
+	if err := recordHistoryTx(tx, envID, key, encryptedValue, nonce, newVersion, models.ChangeTypeUpdate, now); err != nil {
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to record history: %w", err)
 	}
 
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("failed to commit: %w", err)
-	}
-
 	return &models.Secret{
 		ID:             id,
 		EnvironmentID:  envID,
@@ -702,18 +1629,23 @@ func (s *SQLiteStore) ListSecrets(envID string) ([]models.Secret, error) {
 }
 
 func (s *SQLiteStore) DeleteSecret(envID, key string) error {
-	now := time.Now()
-
 	tx, err := s.db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
+	if err := deleteSecretTx(tx, envID, key, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func deleteSecretTx(tx *sql.Tx, envID, key string, now time.Time) error {
 	// Get current secret for history
 	var encryptedValue, nonce []byte
 	var version int
-	err = tx.QueryRow(`
+	err := tx.QueryRow(`
 		SELECT encrypted_value, nonce, version FROM secrets WHERE environment_id = ? AND key = ?
 	`, envID, key).Scan(&encryptedValue, &nonce, &version)
 	if err == sql.ErrNoRows {
@@ -730,25 +1662,59 @@ func (s *SQLiteStore) DeleteSecret(envID, key string) error {
 	}
 
 	// Record in history with incremented version
-	historyID := uuid.New().String()
+	return recordHistoryTx(tx, envID, key, encryptedValue, nonce, version+1, models.ChangeTypeDelete, now)
+}
+
+// recordHistoryTx appends a history entry under the next history sequence
+// number
+func recordHistoryTx(tx *sql.Tx, envID, key string, encryptedValue, nonce []byte, version int, changeType string, now time.Time) error {
+	seq, err := nextHistorySeqTx(tx)
+	if err != nil {
+		return err
+	}
 	_, err = tx.Exec(`
-		INSERT INTO secret_history (id, environment_id, key, encrypted_value, nonce, version, change_type, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, historyID, envID, key, encryptedValue, nonce, version+1, models.ChangeTypeDelete, now)
+		INSERT INTO secret_history (id, environment_id, key, encrypted_value, nonce, version, change_type, seq, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, uuid.New().String(), envID, key, encryptedValue, nonce, version, changeType, seq, now)
 	if err != nil {
-		return fmt.Errorf("failed to record deletion history: %w", err)
+		return fmt.Errorf("failed to record history: %w", err)
 	}
+	return nil
+}
 
-	return tx.Commit()
+// nextHistorySeqTx advances the history sequence and returns its new value
+func nextHistorySeqTx(tx *sql.Tx) (int64, error) {
+	var seq int64
+	err := tx.QueryRow(`
+		INSERT INTO sequences (name, value) VALUES ('history', 1)
+		ON CONFLICT(name) DO UPDATE SET value = value + 1
+		RETURNING value
+	`).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to number history: %w", err)
+	}
+	return seq, nil
+}
+
+// historySeqTx returns the sequence number of the latest history entry
+func historySeqTx(tx *sql.Tx) (int64, error) {
+	var seq int64
+	err := tx.QueryRow(`
+		SELECT COALESCE((SELECT value FROM sequences WHERE name = 'history'), 0)
+	`).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get history sequence: %w", err)
+	}
+	return seq, nil
 }
 
 // Secret history operations
 
 func (s *SQLiteStore) GetSecretHistory(envID, key string, limit int) ([]models.SecretHistory, error) {
 	rows, err := s.db.Query(`
-		SELECT id, environment_id, key, encrypted_value, nonce, version, change_type, created_at
+		SELECT id, environment_id, key, encrypted_value, nonce, version, change_type, seq, created_at
 		FROM secret_history WHERE environment_id = ? AND key = ?
-		ORDER BY version DESC LIMIT ?
+		ORDER BY seq DESC LIMIT ?
 	`, envID, key, limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get secret history: %w", err)
@@ -758,7 +1724,30 @@ func (s *SQLiteStore) GetSecretHistory(envID, key string, limit int) ([]models.S
 	history := []models.SecretHistory{}
 	for rows.Next() {
 		var h models.SecretHistory
-		if err := rows.Scan(&h.ID, &h.EnvironmentID, &h.Key, &h.EncryptedValue, &h.Nonce, &h.Version, &h.ChangeType, &h.CreatedAt); err != nil {
+		if err := rows.Scan(&h.ID, &h.EnvironmentID, &h.Key, &h.EncryptedValue, &h.Nonce, &h.Version, &h.ChangeType, &h.Seq, &h.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan history: %w", err)
+		}
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+// ListEnvironmentHistory returns every history entry recorded in an environment
+func (s *SQLiteStore) ListEnvironmentHistory(envID string) ([]models.SecretHistory, error) {
+	rows, err := s.db.Query(`
+		SELECT id, environment_id, key, encrypted_value, nonce, version, change_type, seq, created_at
+		FROM secret_history WHERE environment_id = ?
+		ORDER BY seq
+	`, envID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environment history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []models.SecretHistory{}
+	for rows.Next() {
+		var h models.SecretHistory
+		if err := rows.Scan(&h.ID, &h.EnvironmentID, &h.Key, &h.EncryptedValue, &h.Nonce, &h.Version, &h.ChangeType, &h.Seq, &h.CreatedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan history: %w", err)
 		}
 		history = append(history, h)
@@ -769,9 +1758,9 @@ func (s *SQLiteStore) GetSecretHistory(envID, key string, limit int) ([]models.S
 func (s *SQLiteStore) GetSecretVersion(envID, key string, version int) (*models.SecretHistory, error) {
 	var h models.SecretHistory
 	err := s.db.QueryRow(`
-		SELECT id, environment_id, key, encrypted_value, nonce, version, change_type, created_at
+		SELECT id, environment_id, key, encrypted_value, nonce, version, change_type, seq, created_at
 		FROM secret_history WHERE environment_id = ? AND key = ? AND version = ?
-	`, envID, key, version).Scan(&h.ID, &h.EnvironmentID, &h.Key, &h.EncryptedValue, &h.Nonce, &h.Version, &h.ChangeType, &h.CreatedAt)
+	`, envID, key, version).Scan(&h.ID, &h.EnvironmentID, &h.Key, &h.EncryptedValue, &h.Nonce, &h.Version, &h.ChangeType, &h.Seq, &h.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, ErrNotFound
 	}
@@ -781,6 +1770,133 @@ func (s *SQLiteStore) GetSecretVersion(envID, key string, version int) (*models.
 	return &h, nil
 }
 
+// Snapshot operations
+
+// CreateSnapshot records the current point in an environment's history under
+// the next version number
+func (s *SQLiteStore) CreateSnapshot(envID, message string) (*models.Snapshot, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	snap, err := createSnapshotTx(tx, envID, message, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return snap, nil
+}
+
+// SnapshotAndApplySecrets snapshots an environment and then applies changes
+// to it in one transaction, so the snapshot holds exactly the state the
+// changes replace. expected maps each secret defined in the environment to
+// the version the changes were planned against; if the environment no
+// longer matches it, nothing is written and ErrSecretsChanged is returned.
+func (s *SQLiteStore) SnapshotAndApplySecrets(envID, message string, expected map[string]int, changes []models.SecretChange) (*models.Snapshot, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkVersionsTx(tx, envID, expected); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	snap, err := createSnapshotTx(tx, envID, message, now)
+	if err != nil {
+		return nil, err
+	}
+	// The changes are numbered after the snapshot's boundary, so it doesn't
+	// include them whatever the clock says
+	if err := applySecretsTx(tx, envID, changes, now); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return snap, nil
+}
+
+func createSnapshotTx(tx *sql.Tx, envID, message string, now time.Time) (*models.Snapshot, error) {
+	var version int
+	err := tx.QueryRow(`
+		SELECT COALESCE(MAX(version), 0) + 1 FROM snapshots WHERE environment_id = ?
+	`, envID).Scan(&version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot version: %w", err)
+	}
+
+	seq, err := historySeqTx(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &models.Snapshot{
+		ID:            uuid.New().String(),
+		EnvironmentID: envID,
+		Version:       version,
+		Message:       message,
+		HistorySeq:    seq,
+		CreatedAt:     now,
+	}
+	_, err = tx.Exec(`
+		INSERT INTO snapshots (id, environment_id, version, message, history_seq, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, snap.ID, snap.EnvironmentID, snap.Version, snap.Message, snap.HistorySeq, snap.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+func (s *SQLiteStore) GetSnapshot(envID string, version int) (*models.Snapshot, error) {
+	var snap models.Snapshot
+	var message sql.NullString
+	err := s.db.QueryRow(`
+		SELECT id, environment_id, version, message, history_seq, created_at
+		FROM snapshots WHERE environment_id = ? AND version = ?
+	`, envID, version).Scan(&snap.ID, &snap.EnvironmentID, &snap.Version, &message, &snap.HistorySeq, &snap.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot: %w", err)
+	}
+	snap.Message = message.String
+	return &snap, nil
+}
+
+func (s *SQLiteStore) ListSnapshots(envID string) ([]models.Snapshot, error) {
+	rows, err := s.db.Query(`
+		SELECT id, environment_id, version, message, history_seq, created_at
+		FROM snapshots WHERE environment_id = ? ORDER BY version
+	`, envID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	defer rows.Close()
+
+	snapshots := []models.Snapshot{}
+	for rows.Next() {
+		var snap models.Snapshot
+		var message sql.NullString
+		if err := rows.Scan(&snap.ID, &snap.EnvironmentID, &snap.Version, &message, &snap.HistorySeq, &snap.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan snapshot: %w", err)
+		}
+		snap.Message = message.String
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, rows.Err()
+}
+
 // Config operations
 
 func (s *SQLiteStore) GetConfig(key string) (string, error) {
@@ -811,6 +1927,165 @@ func (s *SQLiteStore) DeleteConfig(key string) error {
 	return err
 }
 
+// API token operations
+
+// CreateAPIToken stores a token and the environment keys sealed to it in
+// one transaction
+func (s *SQLiteStore) CreateAPIToken(token *models.APIToken, grants []models.TokenKey) error {
+	if token.ID == "" {
+		token.ID = uuid.New().String()
+	}
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO api_tokens (id, name, token_hash, wrapped_key, wrapped_nonce, public_key, project_id, environment_id, read_only, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, token.ID, token.Name, token.TokenHash, token.WrappedKey, token.WrappedNonce, token.PublicKey, nullString(token.ProjectID), nullString(token.EnvironmentID), token.ReadOnly, token.CreatedAt, nullTime(token.ExpiresAt))
+	if err != nil {
+		return fmt.Errorf("failed to create API token: %w", err)
+	}
+	for _, g := range grants {
+		g.TokenID = token.ID
+		g.CreatedAt = token.CreatedAt
+		if err := grantTokenKeyTx(tx, &g); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// apiTokenColumns are the columns scanAPIToken reads, prefixed with t.
+const apiTokenColumns = `t.id, t.name, t.token_hash, t.wrapped_key, t.wrapped_nonce, t.public_key, t.project_id, t.environment_id, t.read_only, t.created_at, t.expires_at, t.last_used_at`
+
+func (s *SQLiteStore) GetAPITokenByHash(hash []byte) (*models.APIToken, error) {
+	row := s.db.QueryRow(`SELECT `+apiTokenColumns+` FROM api_tokens t WHERE t.token_hash = ?`, hash)
+	token, err := scanAPIToken(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API token: %w", err)
+	}
+	return token, nil
+}
+
+func (s *SQLiteStore) ListAPITokens() ([]models.APIToken, error) {
+	return s.queryAPITokens(`SELECT ` + apiTokenColumns + ` FROM api_tokens t ORDER BY t.name`)
+}
+
+// ListEnvironmentTokens returns the tokens that hold, or are entitled to, an
+// environment's data key: those it was sealed to, tokens scoped to the
+// environment or to one that inherits from it, and project-wide and unscoped
+// tokens whose scope covers it
+func (s *SQLiteStore) ListEnvironmentTokens(envID string) ([]models.APIToken, error) {
+	return s.queryAPITokens(`
+		WITH RECURSIVE heirs(id) AS (
+			SELECT ?
+			UNION
+			SELECT e.id FROM environments e, heirs h
+			WHERE e.parent_id = h.id
+				OR e.id IN (SELECT environment_id FROM environment_layers WHERE layer_id = h.id)
+		)
+		SELECT `+apiTokenColumns+` FROM api_tokens t
+		WHERE EXISTS (SELECT 1 FROM token_keys k WHERE k.token_id = t.id AND k.environment_id = ?)
+			OR t.environment_id IN (SELECT id FROM heirs)
+			OR (t.environment_id IS NULL AND (t.project_id IS NULL OR t.project_id = (SELECT project_id FROM environments WHERE id = ?)))
+		ORDER BY t.name
+	`, envID, envID, envID)
+}
+
+func (s *SQLiteStore) queryAPITokens(query string, args ...any) ([]models.APIToken, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API token: %w", err)
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+// ListTokenKeys returns the environment keys sealed to a token
+func (s *SQLiteStore) ListTokenKeys(tokenID string) ([]models.TokenKey, error) {
+	rows, err := s.db.Query(`
+		SELECT token_id, environment_id, sealed_key, created_at FROM token_keys
+		WHERE token_id = ? ORDER BY environment_id
+	`, tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list token keys: %w", err)
+	}
+	defer rows.Close()
+
+	grants := []models.TokenKey{}
+	for rows.Next() {
+		var g models.TokenKey
+		if err := rows.Scan(&g.TokenID, &g.EnvironmentID, &g.SealedKey, &g.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan token key: %w", err)
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteAPIToken(id string) error {
+	result, err := s.db.Exec(`DELETE FROM api_tokens WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete API token: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) TouchAPIToken(id string) error {
+	_, err := s.db.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update API token: %w", err)
+	}
+	return nil
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIToken(row rowScanner) (*models.APIToken, error) {
+	var t models.APIToken
+	var projectID, envID sql.NullString
+	var expiresAt, lastUsedAt sql.NullTime
+	if err := row.Scan(&t.ID, &t.Name, &t.TokenHash, &t.WrappedKey, &t.WrappedNonce, &t.PublicKey, &projectID, &envID, &t.ReadOnly, &t.CreatedAt, &expiresAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	t.ProjectID = projectID.String
+	t.EnvironmentID = envID.String
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	return &t, nil
+}
+
 // Audit operations
 
 func (s *SQLiteStore) LogAudit(log *models.AuditLog) error {
@@ -857,6 +2132,14 @@ func (s *SQLiteStore) GetAuditLogs(limit int) ([]models.AuditLog, error) {
 	return logs, rows.Err()
 }
 
+// Helper function for nullable times
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
+
 // Helper function for nullable strings
 func nullString(s string) sql.NullString {
 	if s == "" {
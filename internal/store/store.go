@@ -13,13 +13,16 @@ type Store interface {
 	GetVaultMeta() (*models.VaultMeta, error)
 	CreateVaultMeta(salt, keyCheck, keyCheckNonce []byte) error
 	SetKeychainEnabled(enabled bool) error
+	SetVaultKeyPair(publicKey, privateKey, privateKeyNonce []byte) error
 
 	// Project operations
 	CreateProject(name, description string) (*models.Project, error)
 	GetProject(id string) (*models.Project, error)
 	GetProjectByName(name string) (*models.Project, error)
 	ListProjects() ([]models.Project, error)
+	RenameProject(id, name string) error
 	DeleteProject(id string) error
+	CopyProject(project *models.Project, envs []models.EnvironmentCopy) error
 
 	// Environment operations
 	CreateEnvironment(projectID, name string) (*models.Environment, error)
@@ -27,9 +30,28 @@ type Store interface {
 	GetEnvironment(id string) (*models.Environment, error)
 	GetEnvironmentByName(projectID, name string) (*models.Environment, error)
 	ListEnvironments(projectID string) ([]models.Environment, error)
+	RenameEnvironment(id, name string) error
 	DeleteEnvironment(id string) error
+	CopyEnvironments(envs []models.EnvironmentCopy) error
 	GetEnvironmentAncestors(envID string) ([]models.Environment, error)
 	GetEnvironmentChildren(envID string) ([]models.Environment, error)
+	GetEnvironmentLayers(envID string) ([]models.Environment, error)
+	SetEnvironmentInheritance(envID string, parentID *string, layerIDs []string, changes []models.SecretChange, grants models.KeyGrants) error
+	GetInheritanceHistory(envID string) ([]models.InheritanceChange, error)
+
+	// Environment key operations
+	GetEnvironmentKey(envID string) (*models.EnvironmentKey, error)
+	RekeyEnvironment(key *models.EnvironmentKey, grants models.KeyGrants, reencrypt ReencryptFunc) error
+
+	// Member operations
+	CreateMember(name string, publicKey []byte) (*models.Member, error)
+	GetMemberByName(name string) (*models.Member, error)
+	GetMemberByPublicKey(publicKey []byte) (*models.Member, error)
+	ListMembers() ([]models.Member, error)
+	DeleteMember(id string) error
+	GrantMemberKey(grant *models.MemberKey) error
+	ListMemberKeys(memberID string) ([]models.MemberKey, error)
+	ListEnvironmentMembers(envID string) ([]models.Member, error)
 
 	// Secret operations
 	CreateSecret(envID, key string, encryptedValue, nonce []byte) (*models.Secret, error)
@@ -37,6 +59,7 @@ type Store interface {
 	GetSecret(envID, key string) (*models.Secret, error)
 	ListSecrets(envID string) ([]models.Secret, error)
 	DeleteSecret(envID, key string) error
+	ApplySecrets(envID string, expected map[string]int, changes []models.SecretChange) error
 
 	// Inheritance-aware secret operations
 	GetSecretWithInheritance(envID, key string) (*models.MergedSecret, error)
@@ -45,12 +68,28 @@ type Store interface {
 	// Secret history operations
 	GetSecretHistory(envID, key string, limit int) ([]models.SecretHistory, error)
 	GetSecretVersion(envID, key string, version int) (*models.SecretHistory, error)
+	ListEnvironmentHistory(envID string) ([]models.SecretHistory, error)
+
+	// Snapshot operations
+	CreateSnapshot(envID, message string) (*models.Snapshot, error)
+	SnapshotAndApplySecrets(envID, message string, expected map[string]int, changes []models.SecretChange) (*models.Snapshot, error)
+	GetSnapshot(envID string, version int) (*models.Snapshot, error)
+	ListSnapshots(envID string) ([]models.Snapshot, error)
 
 	// Config operations
 	GetConfig(key string) (string, error)
 	SetConfig(key, value string) error
 	DeleteConfig(key string) error
 
+	// API token operations
+	CreateAPIToken(token *models.APIToken, grants []models.TokenKey) error
+	GetAPITokenByHash(hash []byte) (*models.APIToken, error)
+	ListAPITokens() ([]models.APIToken, error)
+	ListEnvironmentTokens(envID string) ([]models.APIToken, error)
+	ListTokenKeys(tokenID string) ([]models.TokenKey, error)
+	DeleteAPIToken(id string) error
+	TouchAPIToken(id string) error
+
 	// Audit operations
 	LogAudit(log *models.AuditLog) error
 	GetAuditLogs(limit int) ([]models.AuditLog, error)
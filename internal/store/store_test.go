@@ -1,9 +1,12 @@
 package store
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/russellromney/coffer/internal/models"
 )
@@ -741,3 +744,875 @@ func TestEmptyLists(t *testing.T) {
 		t.Errorf("GetAuditLogs() count = %d, want 0", len(logs))
 	}
 }
+
+func TestEnvironmentKeys(t *testing.T) {
+	store := setupTestStore(t)
+
+	project, _ := store.CreateProject("myapp", "")
+	env, _ := store.CreateEnvironment(project.ID, "dev")
+
+	if _, err := store.GetEnvironmentKey(env.ID); err != ErrNotFound {
+		t.Errorf("GetEnvironmentKey() error = %v, want ErrNotFound", err)
+	}
+
+	store.CreateSecret(env.ID, "API_KEY", []byte("v1"), []byte("n1"))
+	store.UpdateSecret(env.ID, "API_KEY", []byte("v2"), []byte("n2"))
+	history, err := store.ListEnvironmentHistory(env.ID)
+	if err != nil {
+		t.Fatalf("ListEnvironmentHistory() error = %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("ListEnvironmentHistory() returned %d entries, want 2", len(history))
+	}
+
+	calls := 0
+	rekeyed := func(ciphertext, nonce []byte, key string) ([]byte, []byte, error) {
+		calls++
+		if key != "API_KEY" {
+			t.Errorf("reencrypt() key = %q, want API_KEY", key)
+		}
+		return []byte("rekeyed"), []byte("n"), nil
+	}
+	key := &models.EnvironmentKey{EnvironmentID: env.ID, WrappedKey: []byte("wrapped"), Nonce: []byte("nonce")}
+	if err := store.RekeyEnvironment(key, models.KeyGrants{}, rekeyed); err != nil {
+		t.Fatalf("RekeyEnvironment() error = %v", err)
+	}
+
+	got, err := store.GetEnvironmentKey(env.ID)
+	if err != nil {
+		t.Fatalf("GetEnvironmentKey() error = %v", err)
+	}
+	if string(got.WrappedKey) != "wrapped" {
+		t.Errorf("WrappedKey = %q, want wrapped", got.WrappedKey)
+	}
+	secret, _ := store.GetSecret(env.ID, "API_KEY")
+	if string(secret.EncryptedValue) != "rekeyed" || secret.Version != 2 {
+		t.Errorf("secret after rekey = %q v%d", secret.EncryptedValue, secret.Version)
+	}
+	version, _ := store.GetSecretVersion(env.ID, "API_KEY", 1)
+	if string(version.EncryptedValue) != "rekeyed" {
+		t.Errorf("history after rekey = %q", version.EncryptedValue)
+	}
+	if calls != 3 {
+		t.Errorf("reencrypt() called %d times, want once per secret and history entry", calls)
+	}
+
+	// A value that can't be re-encrypted leaves everything as it was
+	key.WrappedKey = []byte("failed")
+	failing := func(ciphertext, nonce []byte, key string) ([]byte, []byte, error) {
+		return nil, nil, fmt.Errorf("bad value")
+	}
+	if err := store.RekeyEnvironment(key, models.KeyGrants{}, failing); err == nil {
+		t.Error("RekeyEnvironment() with a failing re-encryption expected error")
+	}
+	if got, _ := store.GetEnvironmentKey(env.ID); string(got.WrappedKey) != "wrapped" {
+		t.Errorf("WrappedKey after failed rekey = %q, want wrapped", got.WrappedKey)
+	}
+
+	// Replacing the key overwrites it
+	key.WrappedKey = []byte("rotated")
+	if err := store.RekeyEnvironment(key, models.KeyGrants{}, rekeyed); err != nil {
+		t.Fatalf("RekeyEnvironment() error = %v", err)
+	}
+	got, _ = store.GetEnvironmentKey(env.ID)
+	if string(got.WrappedKey) != "rotated" {
+		t.Errorf("WrappedKey = %q, want rotated", got.WrappedKey)
+	}
+
+	store.DeleteEnvironment(env.ID)
+	if _, err := store.GetEnvironmentKey(env.ID); err != ErrNotFound {
+		t.Errorf("GetEnvironmentKey() after delete error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMembers(t *testing.T) {
+	store := setupTestStore(t)
+
+	project, _ := store.CreateProject("myapp", "")
+	dev, _ := store.CreateEnvironment(project.ID, "dev")
+	prod, _ := store.CreateEnvironment(project.ID, "prod")
+
+	alice, err := store.CreateMember("alice", []byte("alice-public-key"))
+	if err != nil {
+		t.Fatalf("CreateMember() error = %v", err)
+	}
+	bob, _ := store.CreateMember("bob", []byte("bob-public-key"))
+	if _, err := store.CreateMember("alice", []byte("other-key")); err == nil {
+		t.Error("CreateMember() should reject duplicate names")
+	}
+
+	got, err := store.GetMemberByPublicKey([]byte("alice-public-key"))
+	if err != nil || got.ID != alice.ID {
+		t.Errorf("GetMemberByPublicKey() = %v, %v", got, err)
+	}
+	if _, err := store.GetMemberByName("carol"); err != ErrNotFound {
+		t.Errorf("GetMemberByName() error = %v, want ErrNotFound", err)
+	}
+
+	store.GrantMemberKey(&models.MemberKey{MemberID: alice.ID, EnvironmentID: dev.ID, SealedKey: []byte("a-dev")})
+	store.GrantMemberKey(&models.MemberKey{MemberID: alice.ID, EnvironmentID: prod.ID, SealedKey: []byte("a-prod")})
+	store.GrantMemberKey(&models.MemberKey{MemberID: bob.ID, EnvironmentID: dev.ID, SealedKey: []byte("b-dev")})
+
+	grants, err := store.ListMemberKeys(alice.ID)
+	if err != nil {
+		t.Fatalf("ListMemberKeys() error = %v", err)
+	}
+	if len(grants) != 2 {
+		t.Errorf("ListMemberKeys() returned %d grants, want 2", len(grants))
+	}
+
+	members, _ := store.ListEnvironmentMembers(dev.ID)
+	if len(members) != 2 || members[0].Name != "alice" || members[1].Name != "bob" {
+		t.Errorf("ListEnvironmentMembers() = %+v", members)
+	}
+
+	// Rekeying replaces the environment's grants
+	key := &models.EnvironmentKey{EnvironmentID: dev.ID, WrappedKey: []byte("w"), Nonce: []byte("n")}
+	err = store.RekeyEnvironment(key, models.KeyGrants{Members: []models.MemberKey{{MemberID: bob.ID, SealedKey: []byte("b-dev-2")}}}, nil)
+	if err != nil {
+		t.Fatalf("RekeyEnvironment() error = %v", err)
+	}
+	members, _ = store.ListEnvironmentMembers(dev.ID)
+	if len(members) != 1 || members[0].Name != "bob" {
+		t.Errorf("ListEnvironmentMembers() after rekey = %+v", members)
+	}
+
+	if err := store.DeleteMember(alice.ID); err != nil {
+		t.Fatalf("DeleteMember() error = %v", err)
+	}
+	grants, _ = store.ListMemberKeys(alice.ID)
+	if len(grants) != 0 {
+		t.Errorf("grants should be deleted with the member, got %d", len(grants))
+	}
+	list, _ := store.ListMembers()
+	if len(list) != 1 {
+		t.Errorf("ListMembers() returned %d members, want 1", len(list))
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	store := setupTestStore(t)
+
+	project, _ := store.CreateProject("myapp", "")
+	env, _ := store.CreateEnvironment(project.ID, "ci")
+
+	token := &models.APIToken{
+		Name:          "ci",
+		TokenHash:     []byte("hash-1"),
+		ProjectID:     project.ID,
+		EnvironmentID: env.ID,
+		ReadOnly:      true,
+	}
+	if err := store.CreateAPIToken(token, nil); err != nil {
+		t.Fatalf("CreateAPIToken() error = %v", err)
+	}
+	if token.ID == "" {
+		t.Error("CreateAPIToken() should assign an ID")
+	}
+
+	// Names are unique
+	if err := store.CreateAPIToken(&models.APIToken{Name: "ci", TokenHash: []byte("hash-2")}, nil); err == nil {
+		t.Error("CreateAPIToken() with duplicate name should fail")
+	}
+
+	got, err := store.GetAPITokenByHash([]byte("hash-1"))
+	if err != nil {
+		t.Fatalf("GetAPITokenByHash() error = %v", err)
+	}
+	if got.ProjectID != project.ID || got.EnvironmentID != env.ID || !got.ReadOnly {
+		t.Errorf("GetAPITokenByHash() = %+v", got)
+	}
+	if got.LastUsedAt != nil || got.ExpiresAt != nil {
+		t.Error("new token should have no last used or expiry time")
+	}
+
+	if err := store.TouchAPIToken(got.ID); err != nil {
+		t.Fatalf("TouchAPIToken() error = %v", err)
+	}
+	tokens, err := store.ListAPITokens()
+	if err != nil {
+		t.Fatalf("ListAPITokens() error = %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].LastUsedAt == nil {
+		t.Errorf("ListAPITokens() = %+v", tokens)
+	}
+
+	if _, err := store.GetAPITokenByHash([]byte("missing")); err != ErrNotFound {
+		t.Errorf("GetAPITokenByHash() error = %v, want ErrNotFound", err)
+	}
+
+	// Deleting the environment revokes tokens scoped to it
+	if err := store.DeleteEnvironment(env.ID); err != nil {
+		t.Fatalf("DeleteEnvironment() error = %v", err)
+	}
+	if _, err := store.GetAPITokenByHash([]byte("hash-1")); err != ErrNotFound {
+		t.Errorf("token should be removed with its environment, got %v", err)
+	}
+
+	if err := store.DeleteAPIToken("missing"); err != ErrNotFound {
+		t.Errorf("DeleteAPIToken() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestTokenKeys(t *testing.T) {
+	store := setupTestStore(t)
+
+	project, _ := store.CreateProject("myapp", "")
+	other, _ := store.CreateProject("other", "")
+	dev, _ := store.CreateEnvironment(project.ID, "dev")
+	ci, _ := store.CreateEnvironmentWithParent(project.ID, "ci", dev.ID)
+	otherEnv, _ := store.CreateEnvironment(other.ID, "dev")
+
+	ciToken := &models.APIToken{Name: "ci", TokenHash: []byte("hash-1"), PublicKey: []byte("pub-1"), ProjectID: project.ID, EnvironmentID: ci.ID}
+	err := store.CreateAPIToken(ciToken, []models.TokenKey{
+		{EnvironmentID: ci.ID, SealedKey: []byte("ci-key")},
+		{EnvironmentID: dev.ID, SealedKey: []byte("dev-key")},
+	})
+	if err != nil {
+		t.Fatalf("CreateAPIToken() error = %v", err)
+	}
+	projectToken := &models.APIToken{Name: "project", TokenHash: []byte("hash-2"), ProjectID: project.ID}
+	store.CreateAPIToken(projectToken, nil)
+	allToken := &models.APIToken{Name: "all", TokenHash: []byte("hash-3")}
+	store.CreateAPIToken(allToken, nil)
+
+	got, _ := store.GetAPITokenByHash([]byte("hash-1"))
+	if string(got.PublicKey) != "pub-1" {
+		t.Errorf("PublicKey = %q, want pub-1", got.PublicKey)
+	}
+	grants, err := store.ListTokenKeys(ciToken.ID)
+	if err != nil || len(grants) != 2 {
+		t.Fatalf("ListTokenKeys() = %+v, %v, want 2 grants", grants, err)
+	}
+
+	names := func(envID string) []string {
+		tokens, err := store.ListEnvironmentTokens(envID)
+		if err != nil {
+			t.Fatalf("ListEnvironmentTokens() error = %v", err)
+		}
+		var out []string
+		for _, tok := range tokens {
+			out = append(out, tok.Name)
+		}
+		return out
+	}
+	// dev is covered by the ci token (which holds its key as an ancestor)
+	// and by both wider tokens; the other project only by the unscoped one
+	if got := names(dev.ID); fmt.Sprint(got) != "[all ci project]" {
+		t.Errorf("ListEnvironmentTokens(dev) = %v", got)
+	}
+	if got := names(otherEnv.ID); fmt.Sprint(got) != "[all]" {
+		t.Errorf("ListEnvironmentTokens(other) = %v", got)
+	}
+
+	// Rekeying replaces the token grants along with the member grants
+	key := &models.EnvironmentKey{EnvironmentID: dev.ID, WrappedKey: []byte("w"), Nonce: []byte{}}
+	err = store.RekeyEnvironment(key, models.KeyGrants{
+		Tokens: []models.TokenKey{{TokenID: projectToken.ID, SealedKey: []byte("dev-key-2")}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("RekeyEnvironment() error = %v", err)
+	}
+	grants, _ = store.ListTokenKeys(ciToken.ID)
+	if len(grants) != 1 || grants[0].EnvironmentID != ci.ID {
+		t.Errorf("ci token grants after rekey = %+v, want only ci", grants)
+	}
+	grants, _ = store.ListTokenKeys(projectToken.ID)
+	if len(grants) != 1 || string(grants[0].SealedKey) != "dev-key-2" {
+		t.Errorf("project token grants after rekey = %+v", grants)
+	}
+	envKey, _ := store.GetEnvironmentKey(dev.ID)
+	if len(envKey.Nonce) != 0 {
+		t.Errorf("sealed key nonce = %v, want empty", envKey.Nonce)
+	}
+
+	// Grants go with the token
+	store.DeleteAPIToken(projectToken.ID)
+	if grants, _ := store.ListTokenKeys(projectToken.ID); len(grants) != 0 {
+		t.Errorf("grants should be deleted with the token, got %d", len(grants))
+	}
+}
+
+func TestVaultKeyPair(t *testing.T) {
+	store := setupTestStore(t)
+	store.CreateVaultMeta([]byte("salt"), []byte("check"), []byte("nonce"))
+
+	if err := store.SetVaultKeyPair([]byte("pub"), []byte("priv"), []byte("n")); err != nil {
+		t.Fatalf("SetVaultKeyPair() error = %v", err)
+	}
+	// The first keypair wins
+	if err := store.SetVaultKeyPair([]byte("pub-2"), []byte("priv-2"), []byte("n")); err != ErrAlreadyExists {
+		t.Errorf("second SetVaultKeyPair() error = %v, want ErrAlreadyExists", err)
+	}
+	meta, err := store.GetVaultMeta()
+	if err != nil {
+		t.Fatalf("GetVaultMeta() error = %v", err)
+	}
+	if string(meta.PublicKey) != "pub" || string(meta.PrivateKey) != "priv" {
+		t.Errorf("GetVaultMeta() keypair = %q, %q", meta.PublicKey, meta.PrivateKey)
+	}
+}
+
+func TestScopedStore(t *testing.T) {
+	store := setupTestStore(t)
+
+	project, _ := store.CreateProject("myapp", "")
+	other, _ := store.CreateProject("other", "")
+	dev, _ := store.CreateEnvironment(project.ID, "dev")
+	ci, _ := store.CreateEnvironmentWithParent(project.ID, "ci", dev.ID)
+	otherEnv, _ := store.CreateEnvironment(other.ID, "dev")
+	store.CreateSecret(dev.ID, "SHARED", []byte("v"), []byte("nonce123456"))
+	store.CreateSecret(ci.ID, "CI_ONLY", []byte("v"), []byte("nonce123456"))
+
+	scoped := NewScopedStore(store, &models.APIToken{
+		ProjectID:     project.ID,
+		EnvironmentID: ci.ID,
+		ReadOnly:      true,
+	})
+
+	// The token's project is the active project
+	active, err := scoped.GetConfig(models.ConfigActiveProject)
+	if err != nil || active != project.ID {
+		t.Errorf("GetConfig(active_project) = %v, %v, want %s", active, err, project.ID)
+	}
+
+	projects, _ := scoped.ListProjects()
+	if len(projects) != 1 || projects[0].ID != project.ID {
+		t.Errorf("ListProjects() = %+v, want only myapp", projects)
+	}
+	if _, err := scoped.GetProjectByName("other"); err != ErrOutOfScope {
+		t.Errorf("GetProjectByName(other) error = %v, want ErrOutOfScope", err)
+	}
+
+	envs, _ := scoped.ListEnvironments(project.ID)
+	if len(envs) != 1 || envs[0].ID != ci.ID {
+		t.Errorf("ListEnvironments() = %+v, want only ci", envs)
+	}
+	if _, err := scoped.GetEnvironmentByName(project.ID, "dev"); !errors.Is(err, ErrOutOfScope) {
+		t.Errorf("GetEnvironmentByName(dev) error = %v, want ErrOutOfScope", err)
+	}
+	if _, err := scoped.ListSecrets(otherEnv.ID); err != ErrOutOfScope {
+		t.Errorf("ListSecrets(other) error = %v, want ErrOutOfScope", err)
+	}
+
+	// Inherited secrets are still visible through the scoped environment
+	secrets, err := scoped.ListSecretsWithInheritance(ci.ID)
+	if err != nil || len(secrets) != 2 {
+		t.Errorf("ListSecretsWithInheritance(ci) = %d secrets, %v, want 2", len(secrets), err)
+	}
+
+	if _, err := scoped.CreateSecret(ci.ID, "NEW", []byte("v"), []byte("nonce123456")); err != ErrReadOnly {
+		t.Errorf("CreateSecret() error = %v, want ErrReadOnly", err)
+	}
+	if err := scoped.SetConfig(models.ConfigActiveProject, other.ID); err != ErrOutOfScope {
+		t.Errorf("SetConfig() error = %v, want ErrOutOfScope", err)
+	}
+	if err := scoped.CreateAPIToken(&models.APIToken{Name: "x"}, nil); err != ErrOutOfScope {
+		t.Errorf("CreateAPIToken() error = %v, want ErrOutOfScope", err)
+	}
+
+	// Members are vault administration
+	if _, err := scoped.ListMembers(); err != ErrOutOfScope {
+		t.Errorf("ListMembers() error = %v, want ErrOutOfScope", err)
+	}
+	if _, err := scoped.GetMemberByName("alice"); err != ErrOutOfScope {
+		t.Errorf("GetMemberByName() error = %v, want ErrOutOfScope", err)
+	}
+	if _, err := scoped.ListMemberKeys("id"); err != ErrOutOfScope {
+		t.Errorf("ListMemberKeys() error = %v, want ErrOutOfScope", err)
+	}
+
+	// The scoped environment's ancestry is visible, but not other environments'
+	ancestors, err := scoped.GetEnvironmentAncestors(ci.ID)
+	if err != nil || len(ancestors) != 1 || ancestors[0].ID != dev.ID {
+		t.Errorf("GetEnvironmentAncestors(ci) = %+v, %v, want dev", ancestors, err)
+	}
+	if _, err := scoped.GetEnvironmentAncestors(otherEnv.ID); err != ErrOutOfScope {
+		t.Errorf("GetEnvironmentAncestors(other) error = %v, want ErrOutOfScope", err)
+	}
+	if _, err := scoped.GetEnvironmentChildren(dev.ID); err != ErrOutOfScope {
+		t.Errorf("GetEnvironmentChildren(dev) error = %v, want ErrOutOfScope", err)
+	}
+	if _, err := scoped.GetEnvironmentLayers(dev.ID); err != ErrOutOfScope {
+		t.Errorf("GetEnvironmentLayers(dev) error = %v, want ErrOutOfScope", err)
+	}
+
+	// A project-wide read-write token can write to any environment in the project
+	writable := NewScopedStore(store, &models.APIToken{ProjectID: project.ID})
+	if _, err := writable.CreateSecret(dev.ID, "NEW", []byte("v"), []byte("nonce123456")); err != nil {
+		t.Errorf("CreateSecret() with project token error = %v", err)
+	}
+	if _, err := writable.CreateSecret(otherEnv.ID, "NEW", []byte("v"), []byte("nonce123456")); err != ErrOutOfScope {
+		t.Errorf("CreateSecret() in other project error = %v, want ErrOutOfScope", err)
+	}
+
+	// Children outside an environment token's scope are hidden
+	children, err := writable.GetEnvironmentChildren(dev.ID)
+	if err != nil || len(children) != 1 {
+		t.Errorf("GetEnvironmentChildren(dev) with project token = %+v, %v, want ci", children, err)
+	}
+}
+
+func TestApplySecrets(t *testing.T) {
+	store := setupTestStore(t)
+
+	project, _ := store.CreateProject("myapp", "")
+	env, _ := store.CreateEnvironment(project.ID, "dev")
+	store.CreateSecret(env.ID, "KEEP", []byte("k"), []byte("n"))
+	store.CreateSecret(env.ID, "UPDATE", []byte("u1"), []byte("n"))
+	store.CreateSecret(env.ID, "REMOVE", []byte("r"), []byte("n"))
+
+	err := store.ApplySecrets(env.ID, map[string]int{"KEEP": 1, "UPDATE": 1, "REMOVE": 1}, []models.SecretChange{
+		{Key: "NEW", EncryptedValue: []byte("new"), Nonce: []byte("n")},
+		{Key: "UPDATE", EncryptedValue: []byte("u2"), Nonce: []byte("n")},
+		{Key: "REMOVE", Delete: true},
+	})
+	if err != nil {
+		t.Fatalf("ApplySecrets() error = %v", err)
+	}
+
+	secrets, _ := store.ListSecrets(env.ID)
+	got := make(map[string]string)
+	for _, s := range secrets {
+		got[s.Key] = string(s.EncryptedValue)
+	}
+	want := map[string]string{"KEEP": "k", "NEW": "new", "UPDATE": "u2"}
+	if len(got) != len(want) {
+		t.Fatalf("ListSecrets() = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+
+	history, _ := store.GetSecretHistory(env.ID, "REMOVE", 10)
+	if len(history) != 2 || history[0].ChangeType != models.ChangeTypeDelete {
+		t.Errorf("REMOVE history = %+v, want a delete entry", history)
+	}
+
+	// A failing change rolls back the whole batch
+	err = store.ApplySecrets(env.ID, map[string]int{"KEEP": 1, "NEW": 1, "UPDATE": 2}, []models.SecretChange{
+		{Key: "ANOTHER", EncryptedValue: []byte("a"), Nonce: []byte("n")},
+		{Key: "MISSING", Delete: true},
+	})
+	if err == nil {
+		t.Fatal("ApplySecrets() should fail when deleting a missing key")
+	}
+	if _, err := store.GetSecret(env.ID, "ANOTHER"); err != ErrNotFound {
+		t.Errorf("GetSecret(ANOTHER) error = %v, want ErrNotFound after rollback", err)
+	}
+
+	// Versions that don't match the environment are rejected
+	changes := []models.SecretChange{{Key: "KEEP", EncryptedValue: []byte("k2"), Nonce: []byte("n")}}
+	for _, expected := range []map[string]int{{"KEEP": 1, "NEW": 1, "UPDATE": 1}, {"KEEP": 1, "NEW": 1}, nil} {
+		if err := store.ApplySecrets(env.ID, expected, changes); err != ErrSecretsChanged {
+			t.Errorf("ApplySecrets(%v) error = %v, want ErrSecretsChanged", expected, err)
+		}
+	}
+	if sec, _ := store.GetSecret(env.ID, "KEEP"); string(sec.EncryptedValue) != "k" {
+		t.Errorf("KEEP = %q after rejected changes, want k", sec.EncryptedValue)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	store := setupTestStore(t)
+	project, _ := store.CreateProject("myapp", "")
+	env, _ := store.CreateEnvironment(project.ID, "prod")
+
+	if _, err := store.GetSnapshot(env.ID, 1); err != ErrNotFound {
+		t.Errorf("GetSnapshot() error = %v, want ErrNotFound", err)
+	}
+
+	first, err := store.CreateSnapshot(env.ID, "before migration")
+	if err != nil {
+		t.Fatalf("CreateSnapshot() error = %v", err)
+	}
+	second, err := store.CreateSnapshot(env.ID, "")
+	if err != nil {
+		t.Fatalf("CreateSnapshot() error = %v", err)
+	}
+	if first.Version != 1 || second.Version != 2 {
+		t.Errorf("versions = %d, %d; want 1, 2", first.Version, second.Version)
+	}
+
+	got, err := store.GetSnapshot(env.ID, 1)
+	if err != nil {
+		t.Fatalf("GetSnapshot() error = %v", err)
+	}
+	if got.ID != first.ID || got.Message != "before migration" || !got.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("GetSnapshot() = %+v, want %+v", got, first)
+	}
+
+	list, err := store.ListSnapshots(env.ID)
+	if err != nil {
+		t.Fatalf("ListSnapshots() error = %v", err)
+	}
+	if len(list) != 2 || list[0].Version != 1 || list[1].Version != 2 {
+		t.Errorf("ListSnapshots() = %+v", list)
+	}
+
+	// Snapshots are removed with their environment
+	if err := store.DeleteEnvironment(env.ID); err != nil {
+		t.Fatalf("DeleteEnvironment() error = %v", err)
+	}
+	if list, _ := store.ListSnapshots(env.ID); len(list) != 0 {
+		t.Errorf("ListSnapshots() after delete = %+v", list)
+	}
+}
+
+func TestSnapshotAndApplySecrets(t *testing.T) {
+	store := setupTestStore(t)
+	project, _ := store.CreateProject("myapp", "")
+	env, _ := store.CreateEnvironment(project.ID, "prod")
+	store.CreateSecret(env.ID, "KEY", []byte("v1"), []byte("nonce"))
+	changes := []models.SecretChange{{Key: "KEY", EncryptedValue: []byte("v2"), Nonce: []byte("nonce")}}
+
+	// Versions that don't match the environment are rejected
+	for _, expected := range []map[string]int{{"KEY": 2}, {}, {"KEY": 1, "OTHER": 1}} {
+		if _, err := store.SnapshotAndApplySecrets(env.ID, "stale", expected, changes); err != ErrSecretsChanged {
+			t.Errorf("SnapshotAndApplySecrets(%v) error = %v, want ErrSecretsChanged", expected, err)
+		}
+	}
+	if list, _ := store.ListSnapshots(env.ID); len(list) != 0 {
+		t.Errorf("rejected changes left snapshots: %+v", list)
+	}
+
+	snap, err := store.SnapshotAndApplySecrets(env.ID, "before", map[string]int{"KEY": 1}, changes)
+	if err != nil {
+		t.Fatalf("SnapshotAndApplySecrets() error = %v", err)
+	}
+	if sec, _ := store.GetSecret(env.ID, "KEY"); sec.Version != 2 || string(sec.EncryptedValue) != "v2" {
+		t.Errorf("GetSecret() = %+v, want version 2", sec)
+	}
+	// The change is numbered after the snapshot, so the snapshot holds v1
+	history, _ := store.GetSecretHistory(env.ID, "KEY", 2)
+	if len(history) != 2 || history[1].Seq > snap.HistorySeq || history[0].Seq <= snap.HistorySeq {
+		t.Errorf("history = %+v, want only v1 up to seq %d", history, snap.HistorySeq)
+	}
+}
+
+func TestHistorySeq(t *testing.T) {
+	store := setupTestStore(t)
+	project, _ := store.CreateProject("myapp", "")
+	prod, _ := store.CreateEnvironment(project.ID, "prod")
+	dev, _ := store.CreateEnvironment(project.ID, "dev")
+
+	store.CreateSecret(prod.ID, "KEY", []byte("v1"), []byte("n"))
+	snap, _ := store.CreateSnapshot(prod.ID, "")
+	store.CreateSecret(dev.ID, "KEY", []byte("d"), []byte("n"))
+	store.UpdateSecret(dev.ID, "KEY", []byte("d2"), []byte("n"))
+
+	// Deleting the environment holding the latest entries doesn't hand their
+	// numbers out again, so later changes stay after the snapshot
+	if err := store.DeleteEnvironment(dev.ID); err != nil {
+		t.Fatalf("DeleteEnvironment() error = %v", err)
+	}
+	store.UpdateSecret(prod.ID, "KEY", []byte("v2"), []byte("n"))
+	history, _ := store.ListEnvironmentHistory(prod.ID)
+	if len(history) != 2 || history[0].Seq > snap.HistorySeq || history[1].Seq <= snap.HistorySeq+2 {
+		t.Errorf("history = %+v, want v2 numbered after seq %d", history, snap.HistorySeq+2)
+	}
+}
+
+func TestHistorySeqMigration(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() error = %v", err)
+	}
+	project, _ := store.CreateProject("myapp", "")
+	env, _ := store.CreateEnvironment(project.ID, "prod")
+	store.CreateSecret(env.ID, "B", []byte("b"), []byte("n"))
+	store.CreateSecret(env.ID, "A", []byte("a"), []byte("n"))
+	store.UpdateSecret(env.ID, "B", []byte("b2"), []byte("n"))
+
+	// Forget the numbering, as in a vault written before it existed
+	if _, err := store.db.Exec(`UPDATE secret_history SET seq = NULL; DELETE FROM sequences`); err != nil {
+		t.Fatalf("failed to clear seq: %v", err)
+	}
+	store.Close()
+
+	store, err = NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() error = %v", err)
+	}
+	defer store.Close()
+
+	history, _ := store.ListEnvironmentHistory(env.ID)
+	var got []string
+	for _, h := range history {
+		got = append(got, fmt.Sprintf("%s%d@%d", h.Key, h.Version, h.Seq))
+	}
+	if want := "[B1@1 A1@2 B2@3]"; fmt.Sprint(got) != want {
+		t.Errorf("history after migration = %v, want %s", got, want)
+	}
+
+	store.UpdateSecret(env.ID, "A", []byte("a2"), []byte("n"))
+	if history, _ := store.GetSecretHistory(env.ID, "A", 1); len(history) != 1 || history[0].Seq != 4 {
+		t.Errorf("new history = %+v, want seq 4", history)
+	}
+}
+
+func TestRename(t *testing.T) {
+	store := setupTestStore(t)
+	project, _ := store.CreateProject("myapp", "")
+	other, _ := store.CreateProject("other", "")
+	env, _ := store.CreateEnvironment(project.ID, "stage")
+	store.CreateEnvironment(project.ID, "prod")
+
+	if err := store.RenameEnvironment(env.ID, "staging"); err != nil {
+		t.Fatalf("RenameEnvironment() error = %v", err)
+	}
+	if got, err := store.GetEnvironmentByName(project.ID, "staging"); err != nil || got.ID != env.ID {
+		t.Errorf("GetEnvironmentByName(staging) = %+v, %v", got, err)
+	}
+	if err := store.RenameEnvironment(env.ID, "prod"); err == nil {
+		t.Error("RenameEnvironment() to an existing name expected error")
+	}
+	if err := store.RenameEnvironment("missing", "x"); err != ErrNotFound {
+		t.Errorf("RenameEnvironment(missing) error = %v, want ErrNotFound", err)
+	}
+
+	if err := store.RenameProject(project.ID, "myapp2"); err != nil {
+		t.Fatalf("RenameProject() error = %v", err)
+	}
+	if got, err := store.GetProjectByName("myapp2"); err != nil || got.ID != project.ID {
+		t.Errorf("GetProjectByName(myapp2) = %+v, %v", got, err)
+	}
+	if err := store.RenameProject(other.ID, "myapp2"); err == nil {
+		t.Error("RenameProject() to an existing name expected error")
+	}
+}
+
+func TestCopyProject(t *testing.T) {
+	store := setupTestStore(t)
+
+	baseID, devID := "env-base", "env-dev"
+	created := time.Now().Add(-time.Hour)
+	project := &models.Project{ID: "project-copy", Name: "copy"}
+	key := models.EnvironmentKey{WrappedKey: []byte("wrapped"), Nonce: []byte("nonce")}
+	base := models.EnvironmentCopy{
+		Environment: models.Environment{ID: baseID, ProjectID: project.ID, Name: "base", CreatedAt: created},
+		Key:         key,
+		Secrets:     []models.Secret{{Key: "A", EncryptedValue: []byte("a2"), Nonce: []byte("n"), Version: 2}},
+		History: []models.SecretHistory{
+			{Key: "A", EncryptedValue: []byte("a1"), Nonce: []byte("n"), Version: 1, ChangeType: models.ChangeTypeCreate, CreatedAt: created},
+			{Key: "A", EncryptedValue: []byte("a2"), Nonce: []byte("n"), Version: 2, ChangeType: models.ChangeTypeUpdate, CreatedAt: created.Add(time.Minute)},
+		},
+	}
+	dev := models.EnvironmentCopy{
+		Environment: models.Environment{ID: devID, ProjectID: project.ID, Name: "dev", ParentID: &baseID},
+		Key:         key,
+	}
+
+	// A failed copy leaves nothing behind
+	duplicate := dev
+	duplicate.Environment.Name = "base"
+	if err := store.CopyProject(project, []models.EnvironmentCopy{base, duplicate}); err == nil {
+		t.Fatal("CopyProject() with duplicate names expected error")
+	}
+	if _, err := store.GetProjectByName("copy"); err != ErrNotFound {
+		t.Errorf("GetProjectByName() after failed copy error = %v, want ErrNotFound", err)
+	}
+
+	if err := store.CopyProject(project, []models.EnvironmentCopy{base, dev}); err != nil {
+		t.Fatalf("CopyProject() error = %v", err)
+	}
+
+	envs, _ := store.ListEnvironments(project.ID)
+	if len(envs) != 2 {
+		t.Fatalf("ListEnvironments() = %+v, want 2", envs)
+	}
+	ancestors, _ := store.GetEnvironmentAncestors(devID)
+	if len(ancestors) != 1 || ancestors[0].ID != baseID || !ancestors[0].CreatedAt.Equal(created) {
+		t.Errorf("GetEnvironmentAncestors(dev) = %+v", ancestors)
+	}
+	secret, err := store.GetSecret(baseID, "A")
+	if err != nil || secret.Version != 2 || string(secret.EncryptedValue) != "a2" {
+		t.Errorf("GetSecret() = %+v, %v", secret, err)
+	}
+	history, _ := store.ListEnvironmentHistory(baseID)
+	if len(history) != 2 {
+		t.Errorf("ListEnvironmentHistory() = %+v, want 2 entries", history)
+	}
+	if _, err := store.GetEnvironmentKey(devID); err != nil {
+		t.Errorf("GetEnvironmentKey(dev) error = %v", err)
+	}
+
+	// Environments can be copied into an existing project too
+	clone := dev
+	clone.Environment.ID, clone.Environment.Name = "env-dev2", "dev2"
+	if err := store.CopyEnvironments([]models.EnvironmentCopy{clone}); err != nil {
+		t.Fatalf("CopyEnvironments() error = %v", err)
+	}
+	if got, err := store.GetEnvironmentByName(project.ID, "dev2"); err != nil || got.ParentID == nil || *got.ParentID != baseID {
+		t.Errorf("GetEnvironmentByName(dev2) = %+v, %v", got, err)
+	}
+}
+
+func TestSetEnvironmentInheritance(t *testing.T) {
+	store := setupTestStore(t)
+	project, _ := store.CreateProject("myapp", "")
+	other, _ := store.CreateProject("other", "")
+	a, _ := store.CreateEnvironment(project.ID, "a")
+	b, _ := store.CreateEnvironmentWithParent(project.ID, "b", a.ID)
+	c, _ := store.CreateEnvironmentWithParent(project.ID, "c", b.ID)
+	elsewhere, _ := store.CreateEnvironment(other.ID, "x")
+
+	for _, parent := range []string{a.ID, c.ID} {
+		if err := store.SetEnvironmentInheritance(a.ID, &parent, nil, nil, models.KeyGrants{}); err != ErrInheritanceCycle {
+			t.Errorf("SetEnvironmentInheritance(a, %s) error = %v, want ErrInheritanceCycle", parent, err)
+		}
+	}
+	if err := store.SetEnvironmentInheritance(a.ID, &elsewhere.ID, nil, nil, models.KeyGrants{}); err == nil {
+		t.Error("SetEnvironmentInheritance() to another project expected error")
+	}
+
+	// Cycles are caught however deep the chain is
+	parent := c.ID
+	for i := 0; i < 12; i++ {
+		env, _ := store.CreateEnvironmentWithParent(project.ID, fmt.Sprintf("deep%d", i), parent)
+		parent = env.ID
+	}
+	if err := store.SetEnvironmentInheritance(a.ID, &parent, nil, nil, models.KeyGrants{}); err != ErrInheritanceCycle {
+		t.Errorf("SetEnvironmentInheritance() under a deep descendant error = %v, want ErrInheritanceCycle", err)
+	}
+
+	changes := []models.SecretChange{{Key: "A", EncryptedValue: []byte("v"), Nonce: []byte("n")}}
+	if err := store.SetEnvironmentInheritance(c.ID, nil, nil, changes, models.KeyGrants{}); err != nil {
+		t.Fatalf("SetEnvironmentInheritance(c, nil) error = %v", err)
+	}
+	got, _ := store.GetEnvironment(c.ID)
+	if got.ParentID != nil {
+		t.Errorf("c parent = %v, want none", *got.ParentID)
+	}
+	if _, err := store.GetSecret(c.ID, "A"); err != nil {
+		t.Errorf("GetSecret() after reparent error = %v", err)
+	}
+
+	// The links before the first change are recorded along with it
+	history, err := store.GetInheritanceHistory(c.ID)
+	if err != nil {
+		t.Fatalf("GetInheritanceHistory() error = %v", err)
+	}
+	if len(history) != 2 || history[0].ParentID == nil || *history[0].ParentID != b.ID || history[1].ParentID != nil {
+		t.Errorf("GetInheritanceHistory() = %+v, want b then none", history)
+	}
+	if secretHistory, _ := store.GetSecretHistory(c.ID, "A", 1); len(secretHistory) != 1 || secretHistory[0].Seq <= history[1].Seq {
+		t.Errorf("secret history seq = %+v, want after inheritance seq %d", secretHistory, history[1].Seq)
+	}
+	if history, _ := store.GetInheritanceHistory(a.ID); len(history) != 0 {
+		t.Errorf("GetInheritanceHistory(a) after failed changes = %+v, want none", history)
+	}
+
+	// Grants of the new source's key are stored with the change, and only
+	// if it succeeds
+	alice, _ := store.CreateMember("alice", []byte("alice-pub"))
+	grants := models.KeyGrants{Members: []models.MemberKey{{MemberID: alice.ID, EnvironmentID: a.ID, SealedKey: []byte("a-key")}}}
+	if err := store.SetEnvironmentInheritance(c.ID, &elsewhere.ID, nil, nil, grants); err == nil {
+		t.Error("SetEnvironmentInheritance() to another project expected error")
+	}
+	if keys, _ := store.ListMemberKeys(alice.ID); len(keys) != 0 {
+		t.Errorf("failed SetEnvironmentInheritance() stored grants %+v", keys)
+	}
+	if err := store.SetEnvironmentInheritance(c.ID, &a.ID, nil, nil, grants); err != nil {
+		t.Fatalf("SetEnvironmentInheritance(c, a) error = %v", err)
+	}
+	ancestors, _ := store.GetEnvironmentAncestors(c.ID)
+	if len(ancestors) != 1 || ancestors[0].ID != a.ID {
+		t.Errorf("GetEnvironmentAncestors(c) = %+v", ancestors)
+	}
+	if keys, _ := store.ListMemberKeys(alice.ID); len(keys) != 1 || keys[0].EnvironmentID != a.ID {
+		t.Errorf("grants after SetEnvironmentInheritance() = %+v, want a", keys)
+	}
+}
+
+func TestEnvironmentLayers(t *testing.T) {
+	store := setupTestStore(t)
+	project, _ := store.CreateProject("myapp", "")
+
+	// prod-eu = [base, prod, eu], with base as its parent too for good measure
+	base, _ := store.CreateEnvironment(project.ID, "base")
+	store.CreateSecret(base.ID, "HOST", []byte("base-host"), []byte("nonce123456"))
+	store.CreateSecret(base.ID, "REGION", []byte("base-region"), []byte("nonce123456"))
+	store.CreateSecret(base.ID, "LOG", []byte("base-log"), []byte("nonce123456"))
+	prod, _ := store.CreateEnvironment(project.ID, "prod")
+	store.CreateSecret(prod.ID, "HOST", []byte("prod-host"), []byte("nonce123456"))
+	eu, _ := store.CreateEnvironment(project.ID, "eu")
+	store.CreateSecret(eu.ID, "HOST", []byte("eu-host"), []byte("nonce123456"))
+	store.CreateSecret(eu.ID, "REGION", []byte("eu-region"), []byte("nonce123456"))
+	prodEU, _ := store.CreateEnvironment(project.ID, "prod-eu")
+	store.CreateSecret(prodEU.ID, "REGION", []byte("own-region"), []byte("nonce123456"))
+
+	if err := store.SetEnvironmentInheritance(prodEU.ID, nil, []string{base.ID, prod.ID, eu.ID}, nil, models.KeyGrants{}); err != nil {
+		t.Fatalf("SetEnvironmentInheritance() error = %v", err)
+	}
+	layers, err := store.GetEnvironmentLayers(prodEU.ID)
+	if err != nil || len(layers) != 3 || layers[0].ID != base.ID || layers[2].ID != eu.ID {
+		t.Fatalf("GetEnvironmentLayers() = %+v, %v", layers, err)
+	}
+
+	merged, err := store.ListSecretsWithInheritance(prodEU.ID)
+	if err != nil {
+		t.Fatalf("ListSecretsWithInheritance() error = %v", err)
+	}
+	got := make(map[string]models.MergedSecret)
+	for _, m := range merged {
+		got[m.Key] = m
+	}
+	if len(got) != 3 {
+		t.Errorf("ListSecretsWithInheritance() = %+v, want 3 keys", merged)
+	}
+	// Later layers win, and each shadowed value is listed highest precedence first
+	host := got["HOST"]
+	if host.SourceEnvName != "eu" || len(host.Shadowed) != 2 || host.Shadowed[0].SourceEnvName != "prod" || host.Shadowed[1].SourceEnvName != "base" {
+		t.Errorf("HOST = %+v", host)
+	}
+	// The environment's own values beat every layer
+	region := got["REGION"]
+	if region.IsInherited || len(region.Shadowed) != 2 || region.Shadowed[0].SourceEnvName != "eu" {
+		t.Errorf("REGION = %+v", region)
+	}
+	if log := got["LOG"]; log.SourceEnvName != "base" || len(log.Shadowed) != 0 {
+		t.Errorf("LOG = %+v", log)
+	}
+	single, err := store.GetSecretWithInheritance(prodEU.ID, "HOST")
+	if err != nil || single.SourceEnvName != "eu" || len(single.Shadowed) != 2 {
+		t.Errorf("GetSecretWithInheritance(HOST) = %+v, %v", single, err)
+	}
+
+	// Layers count as children, and can't be deleted while in use
+	children, _ := store.GetEnvironmentChildren(eu.ID)
+	if len(children) != 1 || children[0].ID != prodEU.ID {
+		t.Errorf("GetEnvironmentChildren(eu) = %+v", children)
+	}
+	if err := store.DeleteEnvironment(eu.ID); err == nil {
+		t.Error("DeleteEnvironment() of a layer in use expected error")
+	}
+
+	// Layers can't introduce a cycle, be repeated, or be the environment itself
+	if err := store.SetEnvironmentInheritance(base.ID, nil, []string{prodEU.ID}, nil, models.KeyGrants{}); err != ErrInheritanceCycle {
+		t.Errorf("SetEnvironmentInheritance() via a layer error = %v, want ErrInheritanceCycle", err)
+	}
+	if err := store.SetEnvironmentInheritance(prodEU.ID, nil, []string{eu.ID, eu.ID}, nil, models.KeyGrants{}); err == nil {
+		t.Error("SetEnvironmentInheritance() with a repeated layer expected error")
+	}
+	if err := store.SetEnvironmentInheritance(prodEU.ID, nil, []string{prodEU.ID}, nil, models.KeyGrants{}); err != ErrInheritanceCycle {
+		t.Errorf("SetEnvironmentInheritance() with itself as a layer error = %v, want ErrInheritanceCycle", err)
+	}
+	if layers, _ := store.GetEnvironmentLayers(prodEU.ID); len(layers) != 3 {
+		t.Errorf("failed SetEnvironmentInheritance() changed layers to %+v", layers)
+	}
+
+	// A shared layer is only visited once
+	ancestors, _ := store.GetEnvironmentAncestors(prodEU.ID)
+	if len(ancestors) != 3 {
+		t.Errorf("GetEnvironmentAncestors() = %+v, want 3", ancestors)
+	}
+
+	// Deleting the whole project still works
+	if err := store.DeleteProject(project.ID); err != nil {
+		t.Errorf("DeleteProject() error = %v", err)
+	}
+}
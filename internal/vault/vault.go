@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/russellromney/coffer/internal/config"
 	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
 	"github.com/russellromney/coffer/internal/store"
 )
 
@@ -33,18 +35,41 @@ var (
 	ErrKeychainNotAvailable = errors.New("keychain not available on this system")
 	// ErrKeychainNotEnabled is returned when keychain is not enabled
 	ErrKeychainNotEnabled = errors.New("keychain not enabled: use 'coffer keychain enable' first")
+	// ErrInvalidToken is returned when a service token is unknown, revoked or can't unwrap the key
+	ErrInvalidToken = errors.New("invalid or revoked token")
+	// ErrTokenExpired is returned when a service token is past its expiry time
+	ErrTokenExpired = errors.New("token has expired")
+	// ErrTokenSession is returned when an operation requires the master password rather than a token
+	ErrTokenSession = errors.New("not allowed when authenticated with a token")
+	// ErrNoVaultKey is returned when a token or member session only carries environment keys
+	ErrNoVaultKey = errors.New("vault key not available: access is limited to granted environments")
+	// ErrUnknownMember is returned when an identity doesn't belong to a vault member
+	ErrUnknownMember = errors.New("identity does not belong to a member of this vault")
 )
 
-// Session represents an unlocked vault session
+// Session represents an unlocked vault session. Owner sessions hold the vault
+// key; member sessions hold only the environment keys granted to the member.
 type Session struct {
-	Key       []byte    `json:"key"`
-	ExpiresAt time.Time `json:"expires_at"`
+	Key             []byte            `json:"key,omitempty"`
+	MemberID        string            `json:"member_id,omitempty"`
+	MemberName      string            `json:"member_name,omitempty"`
+	EnvironmentKeys map[string][]byte `json:"environment_keys,omitempty"`
+	ExpiresAt       time.Time         `json:"expires_at"`
+}
+
+// tokenKeys is what a service token's wrapped key decrypts to: the token's
+// private key, which opens the environment keys sealed to it in the store
+type tokenKeys struct {
+	PrivateKey []byte `json:"private_key"`
 }
 
 // Vault manages the vault state and provides access to the encryption key
 type Vault struct {
 	cfg   *config.Config
 	store store.Store
+	// envKeys and token are set when unlocked in-memory with a service token
+	envKeys map[string][]byte
+	token   *models.APIToken
 }
 
 // New creates a new Vault instance
@@ -171,8 +196,11 @@ func (v *Vault) Lock() error {
 	return v.cfg.DeleteSession()
 }
 
-// IsUnlocked checks if the vault is currently unlocked with a valid session
+// IsUnlocked checks if the vault is currently unlocked with a valid session or token
 func (v *Vault) IsUnlocked() bool {
+	if v.token != nil {
+		return true
+	}
 	session, err := v.loadSession()
 	if err != nil {
 		return false
@@ -182,6 +210,10 @@ func (v *Vault) IsUnlocked() bool {
 
 // GetKey returns the encryption key if the vault is unlocked
 func (v *Vault) GetKey() ([]byte, error) {
+	if v.token != nil {
+		return nil, ErrNoVaultKey
+	}
+
 	session, err := v.loadSession()
 	if err != nil {
 		if errors.Is(err, ErrLocked) {
@@ -194,6 +226,9 @@ func (v *Vault) GetKey() ([]byte, error) {
 		v.Lock() // Clean up expired session
 		return nil, ErrSessionExpired
 	}
+	if session.Key == nil {
+		return nil, ErrNoVaultKey
+	}
 
 	return session.Key, nil
 }
@@ -205,10 +240,12 @@ func (v *Vault) GetStore() (store.Store, error) {
 
 // createSession creates a new session with the given key
 func (v *Vault) createSession(key []byte) error {
-	session := Session{
-		Key:       key,
-		ExpiresAt: time.Now().Add(SessionDuration),
-	}
+	return v.saveSession(Session{Key: key})
+}
+
+// saveSession writes a session that expires after SessionDuration
+func (v *Vault) saveSession(session Session) error {
+	session.ExpiresAt = time.Now().Add(SessionDuration)
 
 	data, err := json.Marshal(session)
 	if err != nil {
@@ -298,14 +335,14 @@ func (v *Vault) EnableKeychain(password string) error {
 	key := crypto.DeriveKey(password, meta.Salt)
 
 	// Store in keychain
-	if err := crypto.StoreKeyInKeychain(key); err != nil {
+	if err := crypto.StoreKeyInKeychain(v.cfg.KeychainAccount, key); err != nil {
 		return fmt.Errorf("failed to store key in keychain: %w", err)
 	}
 
 	// Update vault metadata
 	if err := s.SetKeychainEnabled(true); err != nil {
 		// Try to clean up keychain on failure
-		crypto.DeleteKeyFromKeychain()
+		crypto.DeleteKeyFromKeychain(v.cfg.KeychainAccount)
 		return fmt.Errorf("failed to enable keychain: %w", err)
 	}
 
@@ -324,7 +361,7 @@ func (v *Vault) DisableKeychain() error {
 	}
 
 	// Delete from keychain
-	if err := crypto.DeleteKeyFromKeychain(); err != nil {
+	if err := crypto.DeleteKeyFromKeychain(v.cfg.KeychainAccount); err != nil {
 		return fmt.Errorf("failed to delete key from keychain: %w", err)
 	}
 
@@ -338,46 +375,56 @@ func (v *Vault) DisableKeychain() error {
 
 // UnlockWithKeychain unlocks the vault using the OS keychain
 func (v *Vault) UnlockWithKeychain() error {
+	key, err := v.KeychainKey()
+	if err != nil {
+		return err
+	}
+
+	// Create session
+	if err := v.createSession(key); err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	return nil
+}
+
+// KeychainKey returns the verified key from the OS keychain without creating a session
+func (v *Vault) KeychainKey() ([]byte, error) {
 	if !v.IsInitialized() {
-		return ErrNotInitialized
+		return nil, ErrNotInitialized
 	}
 
 	s, err := v.openStore()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Check if keychain is enabled
 	meta, err := s.GetVaultMeta()
 	if err != nil {
-		return fmt.Errorf("failed to get vault metadata: %w", err)
+		return nil, fmt.Errorf("failed to get vault metadata: %w", err)
 	}
 
 	if !meta.KeychainEnabled {
-		return ErrKeychainNotEnabled
+		return nil, ErrKeychainNotEnabled
 	}
 
 	// Get key from keychain
-	key, err := crypto.GetKeyFromKeychain()
+	key, err := crypto.GetKeyFromKeychain(v.cfg.KeychainAccount)
 	if err != nil {
-		return fmt.Errorf("failed to get key from keychain: %w", err)
+		return nil, fmt.Errorf("failed to get key from keychain: %w", err)
 	}
 
 	// Verify key is correct
 	plaintext, err := crypto.Decrypt(key, meta.KeyCheck, meta.KeyCheckNonce, nil)
 	if err != nil {
-		return fmt.Errorf("keychain key is invalid: %w", err)
+		return nil, fmt.Errorf("keychain key is invalid: %w", err)
 	}
 	if string(plaintext) != KeyCheckValue {
-		return fmt.Errorf("keychain key is invalid")
+		return nil, fmt.Errorf("keychain key is invalid")
 	}
 
-	// Create session
-	if err := v.createSession(key); err != nil {
-		return fmt.Errorf("failed to create session: %w", err)
-	}
-
-	return nil
+	return key, nil
 }
 
 // IsKeychainEnabled checks if keychain is enabled for this vault
@@ -403,3 +450,196 @@ func (v *Vault) IsKeychainEnabled() (bool, error) {
 func (v *Vault) IsKeychainAvailable() bool {
 	return crypto.KeychainAvailable()
 }
+
+// UnlockWithToken unlocks the vault in-memory for this process using a
+// service token. No session file is written.
+func (v *Vault) UnlockWithToken(raw string) error {
+	if !v.IsInitialized() {
+		return ErrNotInitialized
+	}
+
+	s, err := v.openStore()
+	if err != nil {
+		return err
+	}
+
+	token, err := s.GetAPITokenByHash(crypto.HashToken(raw))
+	if err == store.ErrNotFound {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get token: %w", err)
+	}
+	if token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt) {
+		return ErrTokenExpired
+	}
+	// Unwrap the keys, bound to the token ID
+	plaintext, err := crypto.Decrypt(crypto.DeriveTokenKey(raw), token.WrappedKey, token.WrappedNonce, []byte(token.ID))
+	if err != nil {
+		return ErrInvalidToken
+	}
+	var keys tokenKeys
+	if err := json.Unmarshal(plaintext, &keys); err != nil || keys.PrivateKey == nil {
+		return ErrInvalidToken
+	}
+	envKeys, err := openTokenKeys(s, token.ID, keys.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	s.TouchAPIToken(token.ID)
+	v.envKeys = envKeys
+	v.token = token
+	return nil
+}
+
+// openTokenKeys opens the environment keys sealed to a token
+func openTokenKeys(s store.Store, tokenID string, privateKey []byte) (map[string][]byte, error) {
+	grants, err := s.ListTokenKeys(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	envKeys := make(map[string][]byte, len(grants))
+	for _, g := range grants {
+		key, err := crypto.OpenSealed(privateKey, g.SealedKey, []byte(g.EnvironmentID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open environment key: %w", err)
+		}
+		envKeys[g.EnvironmentID] = key
+	}
+	return envKeys, nil
+}
+
+// EnvironmentKeys returns the environment data keys carried by the service
+// token or member session the vault was unlocked with, keyed by environment ID
+func (v *Vault) EnvironmentKeys() map[string][]byte {
+	if v.token != nil {
+		return v.envKeys
+	}
+	session, err := v.loadSession()
+	if err != nil || time.Now().After(session.ExpiresAt) {
+		return nil
+	}
+	return session.EnvironmentKeys
+}
+
+// UnlockWithIdentity unlocks the vault for a member using their private key.
+// The session only holds the environment keys granted to the member.
+func (v *Vault) UnlockWithIdentity(privateKey []byte) (*models.Member, error) {
+	if !v.IsInitialized() {
+		return nil, ErrNotInitialized
+	}
+
+	publicKey, err := crypto.PublicKeyFor(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := v.openStore()
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.GetMemberByPublicKey(publicKey)
+	if err == store.ErrNotFound {
+		return nil, ErrUnknownMember
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get member: %w", err)
+	}
+
+	grants, err := s.ListMemberKeys(member.ID)
+	if err != nil {
+		return nil, err
+	}
+	envKeys := make(map[string][]byte, len(grants))
+	for _, g := range grants {
+		key, err := crypto.OpenSealed(privateKey, g.SealedKey, []byte(g.EnvironmentID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open environment key: %w", err)
+		}
+		envKeys[g.EnvironmentID] = key
+	}
+
+	err = v.saveSession(Session{
+		MemberID:        member.ID,
+		MemberName:      member.Name,
+		EnvironmentKeys: envKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// MemberName returns the member the current session belongs to, or "" for
+// the vault owner
+func (v *Vault) MemberName() string {
+	if v.token != nil {
+		return ""
+	}
+	session, err := v.loadSession()
+	if err != nil {
+		return ""
+	}
+	return session.MemberName
+}
+
+// Token returns the service token the vault was unlocked with, or nil for
+// password, keychain and session unlocks
+func (v *Vault) Token() *models.APIToken {
+	return v.token
+}
+
+// CreateToken stores a new service token and returns the raw token, which is
+// not stored anywhere. The token gets its own keypair: envKeys (the data keys
+// its scope needs, by environment ID) are sealed to its public key, and only
+// the token can unwrap the private key. It never carries the vault key.
+func (v *Vault) CreateToken(token *models.APIToken, envKeys map[string][]byte) (string, error) {
+	if v.token != nil {
+		return "", ErrTokenSession
+	}
+
+	privateKey, publicKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(tokenKeys{PrivateKey: privateKey})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode keys: %w", err)
+	}
+
+	s, err := v.openStore()
+	if err != nil {
+		return "", err
+	}
+
+	raw, err := crypto.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+
+	if token.ID == "" {
+		token.ID = uuid.New().String()
+	}
+	token.TokenHash = crypto.HashToken(raw)
+	token.PublicKey = publicKey
+	token.WrappedKey, token.WrappedNonce, err = crypto.Encrypt(crypto.DeriveTokenKey(raw), plaintext, []byte(token.ID))
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap key: %w", err)
+	}
+
+	grants := make([]models.TokenKey, 0, len(envKeys))
+	for envID, key := range envKeys {
+		sealed, err := crypto.SealTo(publicKey, key, []byte(envID))
+		if err != nil {
+			return "", fmt.Errorf("failed to seal environment key: %w", err)
+		}
+		grants = append(grants, models.TokenKey{EnvironmentID: envID, SealedKey: sealed})
+	}
+
+	if err := s.CreateAPIToken(token, grants); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
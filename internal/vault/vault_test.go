@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/russellromney/coffer/internal/config"
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/models"
 	"github.com/russellromney/coffer/internal/store"
 )
 
@@ -444,3 +446,148 @@ func TestNewWithStore(t *testing.T) {
 		t.Error("GetStore() should return the injected store")
 	}
 }
+
+func TestTokenUnlock(t *testing.T) {
+	v, cfg := setupTestVault(t)
+	if err := v.Initialize("test-password"); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+
+	token := &models.APIToken{Name: "ci", ReadOnly: true}
+	raw, err := v.CreateToken(token, nil)
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+	if len(token.WrappedKey) == 0 || len(token.PublicKey) == 0 {
+		t.Error("CreateToken() should store a wrapped private key and a public key")
+	}
+
+	// Lock and unlock with the token in a fresh vault instance
+	v.Lock()
+	v2 := New(cfg)
+	defer v2.Close()
+
+	if err := v2.UnlockWithToken("coffer_wrong"); err != ErrInvalidToken {
+		t.Errorf("UnlockWithToken(wrong) error = %v, want ErrInvalidToken", err)
+	}
+	if err := v2.UnlockWithToken(raw); err != nil {
+		t.Fatalf("UnlockWithToken() error = %v", err)
+	}
+	if !v2.IsUnlocked() {
+		t.Error("IsUnlocked() = false after token unlock")
+	}
+	if cfg.SessionExists() {
+		t.Error("token unlock should not write a session file")
+	}
+	// Tokens never carry the vault key
+	if _, err := v2.GetKey(); err != ErrNoVaultKey {
+		t.Errorf("GetKey() after token unlock error = %v, want ErrNoVaultKey", err)
+	}
+	if v2.Token() == nil || v2.Token().Name != "ci" {
+		t.Errorf("Token() = %+v, want ci", v2.Token())
+	}
+
+	// Tokens can't mint more tokens
+	if _, err := v2.CreateToken(&models.APIToken{Name: "more"}, nil); err != ErrTokenSession {
+		t.Errorf("CreateToken() with token session error = %v, want ErrTokenSession", err)
+	}
+}
+
+func TestEnvironmentToken(t *testing.T) {
+	v, cfg := setupTestVault(t)
+	if err := v.Initialize("test-password"); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+
+	s, _ := v.GetStore()
+	project, _ := s.CreateProject("myapp", "")
+	env, _ := s.CreateEnvironment(project.ID, "ci")
+
+	envKey, _ := crypto.GenerateKey()
+	token := &models.APIToken{Name: "ci", ProjectID: project.ID, EnvironmentID: env.ID}
+	raw, err := v.CreateToken(token, map[string][]byte{env.ID: envKey})
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+	// The key is sealed to the token in the store, not wrapped with the token
+	grants, _ := s.ListTokenKeys(token.ID)
+	if len(grants) != 1 || grants[0].EnvironmentID != env.ID {
+		t.Errorf("ListTokenKeys() = %+v, want one grant for ci", grants)
+	}
+
+	v2 := New(cfg)
+	defer v2.Close()
+	if err := v2.UnlockWithToken(raw); err != nil {
+		t.Fatalf("UnlockWithToken() error = %v", err)
+	}
+	if !v2.IsUnlocked() {
+		t.Error("IsUnlocked() = false after token unlock")
+	}
+	if _, err := v2.GetKey(); err != ErrNoVaultKey {
+		t.Errorf("GetKey() error = %v, want ErrNoVaultKey", err)
+	}
+	if got := v2.EnvironmentKeys()[env.ID]; string(got) != string(envKey) {
+		t.Error("EnvironmentKeys() should return the sealed environment key")
+	}
+}
+
+func TestUnlockWithIdentity(t *testing.T) {
+	v, cfg := setupTestVault(t)
+	if err := v.Initialize("test-password"); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+	s, _ := v.GetStore()
+
+	privateKey, publicKey, _ := crypto.GenerateKeyPair()
+	member, _ := s.CreateMember("alice", publicKey)
+	project, _ := s.CreateProject("myapp", "")
+	env, _ := s.CreateEnvironment(project.ID, "prod")
+	envKey, _ := crypto.GenerateKey()
+	sealed, _ := crypto.SealTo(publicKey, envKey, []byte(env.ID))
+	s.GrantMemberKey(&models.MemberKey{MemberID: member.ID, EnvironmentID: env.ID, SealedKey: sealed})
+	v.Lock()
+
+	v2 := New(cfg)
+	defer v2.Close()
+
+	stranger, _, _ := crypto.GenerateKeyPair()
+	if _, err := v2.UnlockWithIdentity(stranger); err != ErrUnknownMember {
+		t.Errorf("UnlockWithIdentity(stranger) error = %v, want ErrUnknownMember", err)
+	}
+
+	got, err := v2.UnlockWithIdentity(privateKey)
+	if err != nil {
+		t.Fatalf("UnlockWithIdentity() error = %v", err)
+	}
+	if got.Name != "alice" || v2.MemberName() != "alice" {
+		t.Errorf("member = %s, MemberName() = %s, want alice", got.Name, v2.MemberName())
+	}
+	if !v2.IsUnlocked() {
+		t.Error("IsUnlocked() = false after identity unlock")
+	}
+	if _, err := v2.GetKey(); err != ErrNoVaultKey {
+		t.Errorf("GetKey() error = %v, want ErrNoVaultKey", err)
+	}
+	if string(v2.EnvironmentKeys()[env.ID]) != string(envKey) {
+		t.Error("EnvironmentKeys() should return the granted key")
+	}
+}
+
+func TestTokenExpired(t *testing.T) {
+	v, cfg := setupTestVault(t)
+	if err := v.Initialize("test-password"); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+
+	expiresAt := time.Now().Add(-time.Minute)
+	raw, err := v.CreateToken(&models.APIToken{Name: "old", ExpiresAt: &expiresAt}, nil)
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+
+	v2 := New(cfg)
+	defer v2.Close()
+	if err := v2.UnlockWithToken(raw); err != ErrTokenExpired {
+		t.Errorf("UnlockWithToken() error = %v, want ErrTokenExpired", err)
+	}
+}
@@ -0,0 +1,294 @@
+// Package coffer is a client for reading secrets from a local coffer vault
+// in-process, as an alternative to shelling out to `coffer run`.
+//
+// The client uses the same vault as the CLI. It authenticates with the
+// current session (created by `coffer unlock`) and falls back to the OS
+// keychain when keychain integration is enabled.
+//
+//	c, err := coffer.Open(coffer.Options{})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer c.Close()
+//
+//	dbURL, err := c.Get(ctx, "myapp", "prod", "DATABASE_URL")
+package coffer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/russellromney/coffer/internal/config"
+	"github.com/russellromney/coffer/internal/models"
+	"github.com/russellromney/coffer/internal/secrets"
+	"github.com/russellromney/coffer/internal/store"
+	"github.com/russellromney/coffer/internal/vault"
+)
+
+// DefaultWatchInterval is how often Watch polls the vault for changes
+const DefaultWatchInterval = 5 * time.Second
+
+var (
+	// ErrNotFound is returned when a project, environment or secret doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrLocked is returned when there is no valid session and the keychain can't be used
+	ErrLocked = errors.New("vault is locked: run 'coffer unlock' or enable the keychain")
+	// ErrNotInitialized is returned when the vault has not been initialized
+	ErrNotInitialized = vault.ErrNotInitialized
+)
+
+// Options configures a Client
+type Options struct {
+	// DataDir is the vault directory (defaults to ~/.coffer)
+	DataDir string
+	// Vault opens a named vault instead of the current one (see 'coffer
+	// vault'). Ignored when DataDir is set.
+	Vault string
+	// WatchInterval is how often Watch polls for changes (defaults to DefaultWatchInterval)
+	WatchInterval time.Duration
+}
+
+// Change is sent by Watch whenever an environment's secrets change
+type Change struct {
+	// Values holds the full, resolved set of secrets after the change
+	Values map[string]string
+	// Changed lists the keys that were added, updated or removed, sorted
+	Changed []string
+	// Err is set when reloading failed; Values then holds the last good values
+	Err error
+}
+
+// Client reads secrets from a coffer vault
+type Client struct {
+	mu            sync.Mutex
+	vault         *vault.Vault
+	store         store.Store
+	watchInterval time.Duration
+}
+
+// Open opens the vault and returns a Client.
+// The vault must be initialized and either unlocked or keychain-enabled.
+func Open(opts Options) (*Client, error) {
+	var cfg *config.Config
+	if opts.DataDir != "" {
+		cfg = config.NewWithDataDir(opts.DataDir)
+	} else if opts.Vault != "" {
+		var err error
+		cfg, err = config.NewForVault(opts.Vault)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		cfg, err = config.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	v := vault.New(cfg)
+	if !v.IsInitialized() {
+		return nil, ErrNotInitialized
+	}
+
+	s, err := v.GetStore()
+	if err != nil {
+		v.Close()
+		return nil, err
+	}
+
+	c := &Client{
+		vault:         v,
+		store:         s,
+		watchInterval: opts.WatchInterval,
+	}
+	if c.watchInterval <= 0 {
+		c.watchInterval = DefaultWatchInterval
+	}
+	// Fail fast if there's no way to get the key
+	// Member sessions only carry the keys of their granted environments
+	if _, err := c.key(); err != nil && !(errors.Is(err, vault.ErrNoVaultKey) && v.EnvironmentKeys() != nil) {
+		v.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Close releases the underlying database connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.vault.Close()
+}
+
+// key returns the encryption key from the session, falling back to the keychain
+func (c *Client) key() ([]byte, error) {
+	key, err := c.vault.GetKey()
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, vault.ErrLocked) && !errors.Is(err, vault.ErrSessionExpired) {
+		return nil, err
+	}
+
+	key, kcErr := c.vault.KeychainKey()
+	if kcErr != nil {
+		return nil, ErrLocked
+	}
+	return key, nil
+}
+
+// secrets returns a secrets service for a single call. Keys are read from
+// the session afresh each time, so a rotation or 'coffer lock' in another
+// process takes effect on the next call.
+func (c *Client) secrets() *secrets.Service {
+	return secrets.New(c.store, c.key).WithEnvironmentKeys(c.vault.EnvironmentKeys())
+}
+
+// Get returns the resolved value of a single secret, following inheritance
+func (c *Client) Get(ctx context.Context, project, env, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, err := c.project(project)
+	if err != nil {
+		return "", err
+	}
+
+	v, err := c.secrets().Get(p, env, key, secrets.Options{Resolve: true})
+	if err != nil {
+		return "", wrapNotFound(err)
+	}
+	return v.Value, nil
+}
+
+// Load returns all secrets in an environment with inheritance applied and
+// ${VAR} references resolved
+func (c *Client) Load(ctx context.Context, project, env string) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, err := c.project(project)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := c.secrets().Load(p, env, secrets.Options{Resolve: true})
+	if err != nil {
+		return nil, wrapNotFound(err)
+	}
+	return secrets.ToMap(values), nil
+}
+
+// Watch polls an environment and sends a Change whenever its resolved secrets
+// differ from the previous poll. The current values are sent first. The
+// channel is closed when ctx is done.
+func (c *Client) Watch(ctx context.Context, project, env string) (<-chan Change, error) {
+	current, err := c.Load(ctx, project, env)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Change, 1)
+	ch <- Change{Values: current, Changed: sortedKeys(current)}
+
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(c.watchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			next, err := c.Load(ctx, project, env)
+			var change Change
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				change = Change{Values: current, Err: err}
+			} else {
+				changed := diffKeys(current, next)
+				if len(changed) == 0 {
+					continue
+				}
+				current = next
+				change = Change{Values: next, Changed: changed}
+			}
+
+			select {
+			case ch <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// project looks up a project by name
+func (c *Client) project(name string) (*models.Project, error) {
+	p, err := c.store.GetProjectByName(name)
+	if err == store.ErrNotFound {
+		return nil, fmt.Errorf("%w: project '%s'", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get project: %w", err)
+	}
+	return p, nil
+}
+
+// wrapNotFound maps internal not-found errors onto ErrNotFound
+func wrapNotFound(err error) error {
+	var envErr *secrets.ErrEnvironmentNotFound
+	var secretErr *secrets.ErrSecretNotFound
+	if errors.As(err, &envErr) || errors.As(err, &secretErr) {
+		return fmt.Errorf("%w: %s", ErrNotFound, err.Error())
+	}
+	return err
+}
+
+// diffKeys returns the sorted keys that differ between two sets of values
+func diffKeys(old, new map[string]string) []string {
+	changed := []string{}
+	for key, value := range new {
+		if prev, ok := old[key]; !ok || prev != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
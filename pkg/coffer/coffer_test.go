@@ -0,0 +1,240 @@
+package coffer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/russellromney/coffer/internal/config"
+	"github.com/russellromney/coffer/internal/crypto"
+	"github.com/russellromney/coffer/internal/secrets"
+	"github.com/russellromney/coffer/internal/store"
+	"github.com/russellromney/coffer/internal/vault"
+)
+
+type testVault struct {
+	dir   string
+	vault *vault.Vault
+	store store.Store
+	key   []byte
+	envID string
+}
+
+func setupTestVault(t *testing.T) *testVault {
+	t.Helper()
+	dir := t.TempDir()
+	v := vault.New(config.NewWithDataDir(dir))
+	t.Cleanup(func() {
+		v.Close()
+	})
+
+	if err := v.Initialize("test-password"); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+	s, err := v.GetStore()
+	if err != nil {
+		t.Fatalf("GetStore() error = %v", err)
+	}
+	key, err := v.GetKey()
+	if err != nil {
+		t.Fatalf("GetKey() error = %v", err)
+	}
+
+	project, err := s.CreateProject("myapp", "")
+	if err != nil {
+		t.Fatalf("CreateProject() error = %v", err)
+	}
+	env, err := s.CreateEnvironment(project.ID, "dev")
+	if err != nil {
+		t.Fatalf("CreateEnvironment() error = %v", err)
+	}
+
+	return &testVault{dir: dir, vault: v, store: s, key: key, envID: env.ID}
+}
+
+func (tv *testVault) set(t *testing.T, key, value string) {
+	t.Helper()
+	ciphertext, nonce, err := crypto.Encrypt(tv.key, []byte(value), []byte(key))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	if _, err := tv.store.GetSecret(tv.envID, key); err == store.ErrNotFound {
+		if _, err := tv.store.CreateSecret(tv.envID, key, ciphertext, nonce); err != nil {
+			t.Fatalf("CreateSecret() error = %v", err)
+		}
+		return
+	}
+	if _, err := tv.store.UpdateSecret(tv.envID, key, ciphertext, nonce); err != nil {
+		t.Fatalf("UpdateSecret() error = %v", err)
+	}
+}
+
+func TestGetAndLoad(t *testing.T) {
+	tv := setupTestVault(t)
+	tv.set(t, "HOST", "localhost")
+	tv.set(t, "URL", "http://${HOST}")
+
+	c, err := Open(Options{DataDir: tv.dir})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+
+	url, err := c.Get(ctx, "myapp", "dev", "URL")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if url != "http://localhost" {
+		t.Errorf("Get() = %q, want http://localhost", url)
+	}
+
+	values, err := c.Load(ctx, "myapp", "dev")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(values) != 2 || values["URL"] != "http://localhost" {
+		t.Errorf("Load() = %v", values)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	tv := setupTestVault(t)
+
+	c, err := Open(Options{DataDir: tv.dir})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if _, err := c.Get(ctx, "other", "dev", "KEY"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() missing project error = %v, want ErrNotFound", err)
+	}
+	if _, err := c.Get(ctx, "myapp", "prod", "KEY"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() missing env error = %v, want ErrNotFound", err)
+	}
+	if _, err := c.Get(ctx, "myapp", "dev", "KEY"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() missing key error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestOpenLocked(t *testing.T) {
+	tv := setupTestVault(t)
+	if err := tv.vault.Lock(); err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+
+	if _, err := Open(Options{DataDir: tv.dir}); !errors.Is(err, ErrLocked) {
+		t.Errorf("Open() error = %v, want ErrLocked", err)
+	}
+}
+
+func TestKeysChangedElsewhere(t *testing.T) {
+	tv := setupTestVault(t)
+	tv.set(t, "HOST", "localhost")
+	other := secrets.New(tv.store, tv.vault.GetKey)
+	if _, err := other.EnsureEnvironmentKey(tv.envID); err != nil {
+		t.Fatalf("EnsureEnvironmentKey() error = %v", err)
+	}
+
+	c, err := Open(Options{DataDir: tv.dir})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if _, err := c.Load(ctx, "myapp", "dev"); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	// Another process rotates the key: the client reads the new one
+	if _, _, err := other.RotateEnvironmentKey(tv.envID); err != nil {
+		t.Fatalf("RotateEnvironmentKey() error = %v", err)
+	}
+	values, err := c.Load(ctx, "myapp", "dev")
+	if err != nil {
+		t.Fatalf("Load() after rotation error = %v", err)
+	}
+	if values["HOST"] != "localhost" {
+		t.Errorf("Load() after rotation = %v", values)
+	}
+
+	// ...or locks the vault
+	if err := tv.vault.Lock(); err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	if _, err := c.Load(ctx, "myapp", "dev"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Load() after Lock() error = %v, want ErrLocked", err)
+	}
+}
+
+func TestOpenNotInitialized(t *testing.T) {
+	if _, err := Open(Options{DataDir: t.TempDir()}); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("Open() error = %v, want ErrNotInitialized", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	tv := setupTestVault(t)
+	tv.set(t, "API_KEY", "v1")
+
+	c, err := Open(Options{DataDir: tv.dir, WatchInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := c.Watch(ctx, "myapp", "dev")
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	initial := <-ch
+	if initial.Values["API_KEY"] != "v1" {
+		t.Errorf("initial Change.Values = %v", initial.Values)
+	}
+
+	tv.set(t, "API_KEY", "v2")
+	tv.set(t, "NEW_KEY", "x")
+
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case change := <-ch:
+			if change.Err != nil {
+				t.Fatalf("Change.Err = %v", change.Err)
+			}
+			if change.Values["API_KEY"] == "v2" && change.Values["NEW_KEY"] == "x" {
+				cancel()
+				for range ch {
+				}
+				return
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for change")
+		}
+	}
+}
+
+func TestDiffKeys(t *testing.T) {
+	old := map[string]string{"A": "1", "B": "2", "C": "3"}
+	new := map[string]string{"A": "1", "B": "changed", "D": "4"}
+
+	changed := diffKeys(old, new)
+	want := []string{"B", "C", "D"}
+	if len(changed) != len(want) {
+		t.Fatalf("diffKeys() = %v, want %v", changed, want)
+	}
+	for i := range want {
+		if changed[i] != want[i] {
+			t.Errorf("diffKeys()[%d] = %s, want %s", i, changed[i], want[i])
+		}
+	}
+}